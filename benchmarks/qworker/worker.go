@@ -57,21 +57,22 @@ func (w *Worker) processCall(cmd *queue.QCommand) (*queue.QResponse, error) {
 }
 
 func (w *Worker) Push(work string) error {
-	cmd := &queue.QCommand{"PUSH", work}
+	cmd := &queue.QCommand{Command: "PUSH", Value: work}
 	_, err := w.processCall(cmd)
 	return err
 }
 
 func (w *Worker) Pop() (*queue.QResponse, error) {
-	cmd := &queue.QCommand{"POP", ""}
+	cmd := &queue.QCommand{Command: "POP", Value: ""}
 	res, err := w.processCall(cmd)
 
 	// TODO: Make it do something with the response?
 	return res, err
 }
 
-func (w *Worker) Done() error {
-	cmd := &queue.QCommand{"DONE", ""}
+// Done says the popped message with the given id has been dealt with
+func (w *Worker) Done(id string) error {
+	cmd := &queue.QCommand{Command: "DONE", Value: id}
 	_, err := w.processCall(cmd)
 	return err
 }
@@ -1,11 +1,14 @@
 package client
 
 import (
-	"errors"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/mgentili/goPhat/level_log"
+	"net"
 	"net/rpc"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -16,14 +19,112 @@ const (
 	CALL           = 2
 )
 
+// Options configures how a Client talks to the servers. Zero fields get the defaults
+type Options struct {
+	Timeout     time.Duration // how long to wait for a single call (DefaultTimeout)
+	DialTimeout time.Duration // how long to wait for a connection to a server (Timeout)
+	GiveUp      time.Duration // how long to keep retrying a call (10 * Timeout)
+	RetryDelay  time.Duration // how long to wait before retrying a failed call, if Retry isn't set (Timeout / 10)
+	Retry       RetryPolicy   // whether and when to retry failed calls (always, after RetryDelay)
+	// the least time to wait after a server says it's busy, doubling for each busy reply
+	// in a row (Timeout)
+	BusyDelay time.Duration
+	// send reads marked as stale to the other replicas in turn, rather than the master
+	// (see ProcessStaleCallCtx)
+	ReadFromFollowers bool
+	// if set, connect to the servers over TLS
+	TLS *tls.Config
+	// how calls are encoded on the wire (GobCodec, net/rpc's own, if not set). The
+	// servers have to speak the same one
+	Codec Codec
+	// called as the client works (see also Client.Metrics)
+	Hooks Hooks
+	// if set, used to look the servers up again whenever the client has to hunt for the
+	// master (see RefreshServers and ResolveHosts)
+	Resolver Resolver
+	Log      *level_log.Logger // defaults to logging everything to stdout
+}
+
+// withDefaults fills in the zero fields of o
+func (o Options) withDefaults() Options {
+	if o.Timeout == 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = o.Timeout
+	}
+	if o.GiveUp == 0 {
+		o.GiveUp = o.Timeout * 10
+	}
+	if o.RetryDelay == 0 {
+		o.RetryDelay = o.Timeout / 10
+	}
+	if o.BusyDelay == 0 {
+		o.BusyDelay = o.Timeout
+	}
+	if o.Codec == nil {
+		o.Codec = GobCodec
+	}
+	if o.Retry == nil {
+		o.Retry = Backoff{Initial: o.RetryDelay}
+	}
+	return o
+}
+
+// CallOptions overrides the client's Options for a single call (see WithCallOptions).
+// Zero fields are left as they are
+type CallOptions struct {
+	Timeout time.Duration // how long to wait for each attempt
+	GiveUp  time.Duration // how long to keep retrying, all told
+}
+
+type callOptionsKey struct{}
+
+// WithCallOptions returns a context for calls that use o rather than the client's
+// Options. A deadline on ctx itself also bounds the whole call
+func WithCallOptions(ctx context.Context, o CallOptions) context.Context {
+	return context.WithValue(ctx, callOptionsKey{}, o)
+}
+
+// forCall returns the options for a call made with ctx
+func (o Options) forCall(ctx context.Context) Options {
+	o = o.withDefaults()
+	if co, ok := ctx.Value(callOptionsKey{}).(CallOptions); ok {
+		if co.Timeout != 0 {
+			o.Timeout = co.Timeout
+		}
+		if co.GiveUp != 0 {
+			o.GiveUp = co.GiveUp
+		}
+	}
+	return o
+}
+
+// Client can be used from any number of goroutines at once: their calls are pipelined over
+// one connection, and when it fails, only one of them reconnects
 type Client struct {
-	ServerLocations []string          //addresses of all servers
-	NumServers      uint              //length of ServerLocations
+	ServerLocations []string //addresses of all servers (see SetServers)
+	NumServers      uint     //length of ServerLocations
+	serversLock     sync.RWMutex
 	MasterId        uint              //id of master server
 	Id              uint              //id of currently connected server
 	Uid             string            //unique identifier of this client
 	RpcClient       *rpc.Client       //client connection to server (usually the master)
 	Log             *level_log.Logger //individual client's log
+	Options         Options
+	followers       followers
+	metrics         Metrics
+	metricsLock     sync.Mutex
+	events          chan Event
+	attach          func(conn *rpc.Client) error
+	serverHello     Hello // what the server RpcClient's connected to said about itself
+	// guards RpcClient, Id, MasterId, attach and serverHello, so calls can be made from any number of
+	// goroutines at once (net/rpc pipelines them over the one connection)
+	connLock sync.RWMutex
+	// held while reconnecting, so calls that fail together only reconnect once
+	reconnectLock sync.Mutex
+	disconnected  bool // whether Disconnected was the last connection event
+	stateLock     sync.Mutex
 }
 
 func (c *Client) SetupClientLog() {
@@ -35,15 +136,12 @@ func (c *Client) SetupClientLog() {
 // NewClient creates a new client connected to the server with given id
 // and attempts to connect to the master server
 func NewClient(servers []string, id uint, uid string) (*Client, error) {
+	return NewClientWithOptions(servers, id, uid, Options{})
+}
 
-	c := new(Client)
-
-	c.ServerLocations = servers
-	c.NumServers = uint(len(servers))
-	c.Id = id
-	c.MasterId = 0
-	c.Uid = uid
-	c.SetupClientLog()
+// NewClientWithOptions is NewClient with settings other than the defaults
+func NewClientWithOptions(servers []string, id uint, uid string, opts Options) (*Client, error) {
+	c := newClient(servers, id, uid, opts)
 	err := c.ConnectToServer(id)
 	if err != nil {
 		c.Log.Printf(DEBUG, "NewClient failed to connect client to server with id %d, error %s", id, err.Error())
@@ -59,83 +157,416 @@ func NewClient(servers []string, id uint, uid string) (*Client, error) {
 	return c, nil
 }
 
+// NewClientWait is NewClient, except that rather than failing if the cluster isn't ready
+// (e.g. it's still starting up and hasn't elected a master), it keeps trying until deadline
+func NewClientWait(servers []string, id uint, uid string, deadline time.Time) (*Client, error) {
+	return NewClientWaitWithOptions(servers, id, uid, deadline, Options{})
+}
+
+// NewClientWaitWithOptions is NewClientWait with settings other than the defaults
+func NewClientWaitWithOptions(servers []string, id uint, uid string, deadline time.Time, opts Options) (*Client, error) {
+	c := newClient(servers, id, uid, opts)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := c.WaitForCluster(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newClient(servers []string, id uint, uid string, opts Options) *Client {
+	c := new(Client)
+
+	c.ServerLocations = servers
+	c.NumServers = uint(len(servers))
+	c.Id = id
+	c.MasterId = 0
+	c.Uid = uid
+	c.Options = opts.withDefaults()
+	if c.Options.Log != nil {
+		c.Log = c.Options.Log
+	} else {
+		c.SetupClientLog()
+	}
+	return c
+}
+
+// WaitForCluster keeps trying to connect to the master until one's been elected and
+// answers, or ctx is done
+func (c *Client) WaitForCluster(ctx context.Context) error {
+	opts := c.Options.withDefaults()
+	_, next := c.Conn()
+	var err error
+	for {
+		if err = c.ConnectToServer(next % c.numServers()); err == nil {
+			c.reconnectLock.Lock()
+			err = c.connectToMaster()
+			c.reconnectLock.Unlock()
+			if err == nil {
+				err = c.confirmMaster(ctx)
+			}
+			if err == nil {
+				return nil
+			}
+		}
+		c.Log.Printf(STATUS, "Cluster isn't ready yet: %v", err)
+		next++
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("cluster not ready: %v", err)
+		case <-time.After(opts.RetryDelay):
+		}
+	}
+}
+
+// confirmMaster checks that the server the client's connected to says it's the master
+func (c *Client) confirmMaster(ctx context.Context) error {
+	if c.ServerHello().Has(FeaturePing) {
+		ping, err := c.Ping(ctx)
+		if err != nil {
+			return err
+		}
+		if ping.Role != RoleMaster {
+			return fmt.Errorf("server %d isn't the master (it's %s)", ping.Replica, ping.Role)
+		}
+		return nil
+	}
+	conn, id := c.Conn()
+	var master MasterInfo
+	timer := time.NewTimer(c.Options.withDefaults().Timeout)
+	defer timer.Stop()
+	call := conn.Go("Server.GetMaster", new(struct{}), &master, nil)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return ErrCallTimedOut
+	case <-call.Done:
+	}
+	if call.Error != nil {
+		return call.Error
+	}
+	if master.Id != id {
+		return fmt.Errorf("server %d isn't the master", id)
+	}
+	return nil
+}
+
 // connectToAnyServer connects client to server with given index
 func (c *Client) ConnectToServer(index uint) error {
 	c.Log.Printf(STATUS, "Trying to connect to server %d", index)
-	client, err := rpc.Dial("tcp", c.ServerLocations[index])
+	address, err := c.server(index)
+	if err != nil {
+		return err
+	}
+	client, err := c.dial(address)
+	var hello Hello
+	if err == nil {
+		if hello, err = c.hello(client); err != nil {
+			client.Close()
+		}
+	}
+	c.connected(index, err)
 	if err != nil {
+		c.emit(Event{State: Disconnected, Server: index, Err: err})
 		return err
 	}
+	c.emit(Event{State: Connected, Server: index})
 
+	c.connLock.Lock()
 	c.Id = index
 	c.RpcClient = client
+	c.serverHello = hello
+	c.connLock.Unlock()
 	return nil
 }
 
+// Conn returns the connection calls currently go over, and the id of its server
+func (c *Client) Conn() (*rpc.Client, uint) {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.RpcClient, c.Id
+}
+
+// Master returns the id of the server the client last heard was the master
+func (c *Client) Master() uint {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.MasterId
+}
+
+// dial connects to the server at address, over TLS if the options say so
+func (c *Client) dial(address string) (*rpc.Client, error) {
+	opts := c.Options.withDefaults()
+	dialer := &net.Dialer{Timeout: opts.DialTimeout}
+	var conn net.Conn
+	var err error
+	if opts.TLS == nil {
+		conn, err = dialer.Dial("tcp", address)
+	} else {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, opts.TLS)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClientWithCodec(opts.Codec(conn)), nil
+}
+
 // connectToMaster connects client to the current master node
 func (c *Client) ConnectToMaster() error {
-	c.Log.Printf(STATUS, "Trying to connect to master %d", c.MasterId)
+	c.reconnectLock.Lock()
+	defer c.reconnectLock.Unlock()
+	return c.connectToMaster()
+}
+
+// connectToMaster is ConnectToMaster, for callers holding reconnectLock
+func (c *Client) connectToMaster() error {
+	c.Log.Printf(STATUS, "Trying to connect to master %d", c.Master())
 	//connect to any server, and get the master id
+	opts := c.Options.withDefaults()
+	n := c.numServers()
 loop:
-	for i := uint(0); i < c.NumServers; i = i + 1 {
-		timer := time.NewTimer(time.Second)
-		call := c.RpcClient.Go("Server.GetMaster", new(struct{}), &c.MasterId, nil)
+	for i := uint(0); i < n; i = i + 1 {
+		timer := time.NewTimer(opts.Timeout)
+		var master MasterInfo
+		conn, id := c.Conn()
+		call := conn.Go("Server.GetMaster", new(struct{}), &master, nil)
 		select {
 		case <-timer.C:
 			c.Log.Printf(DEBUG, "GetMaster timed out!")
 		case <-call.Done:
+			timer.Stop()
 			if call.Error == nil {
-				c.Log.Printf(STATUS, "The master is %d", c.MasterId)
+				c.learnMaster(master)
+				c.setMaster(master.Id)
+				c.Log.Printf(STATUS, "The master is %d (view %d)", master.Id, master.View)
 				break loop
 			} else {
-				c.Log.Printf(DEBUG, "Errored when asking server %d for master info: %v", c.Id, call.Error)
+				c.Log.Printf(DEBUG, "Errored when asking server %d for master info: %v", id, call.Error)
 			}
 		}
 
 		//if problem with RPC or server is in recovery, need to connect to different server
-		time.Sleep(time.Second)
-		c.ConnectToServer((c.Id + uint(i+1)) % c.NumServers)
+		time.Sleep(opts.RetryDelay)
+		c.ConnectToServer((id + uint(i+1)) % n)
 	}
 
 	// If the currently connected server isn't the master, connect to master
-	if c.MasterId != c.Id {
+	if _, id := c.Conn(); c.Master() != id {
 		c.Log.Printf(STATUS, "Called Server.GetMaster, current master id is %d, my id is %d",
-			c.MasterId, c.Id)
-		err := c.ConnectToServer(c.MasterId)
+			c.Master(), id)
+		err := c.ConnectToServer(c.Master())
 		if err != nil {
 			return err
 		}
-		c.Log.Printf(STATUS, "Now current master id is %d, my id is %d\n", c.MasterId, c.Id)
+		c.Log.Printf(STATUS, "Now current master id is %d\n", c.Master())
 	}
+	c.attachSession()
 
 	return nil
 }
 
+// SetAttach sets f to be called with the connection whenever the client connects to a
+// master (including now, if it's connected to one), so the layer on top can carry its
+// session over to it
+func (c *Client) SetAttach(f func(conn *rpc.Client) error) error {
+	c.connLock.Lock()
+	c.attach = f
+	c.connLock.Unlock()
+	conn, id := c.Conn()
+	if conn == nil || id != c.Master() {
+		return nil
+	}
+	return f(conn)
+}
+
+func (c *Client) attachSession() {
+	c.connLock.RLock()
+	attach, conn, id, master := c.attach, c.RpcClient, c.Id, c.MasterId
+	c.connLock.RUnlock()
+	if attach == nil || id != master {
+		return
+	}
+	if err := attach(conn); err != nil {
+		c.Log.Printf(DEBUG, "Couldn't attach to master %d: %v", id, err)
+	}
+}
+
+// MasterInfo is what a server says about the master, in reply to GetMaster and when it
+// redirects a client (see NotMasterAt)
+type MasterInfo struct {
+	Id      uint
+	Address string // where clients reach the master ("" if the server doesn't know)
+	View    uint   // the VR view the master leads
+}
+
+// the errors servers reply with when they aren't the master, saying which one is
+const (
+	notMasterFormat   = "Not master node (master is %d)"
+	notMasterAtFormat = "Not master node (master is %d at %q in view %d)"
+)
+
+// NotMaster returns the error for a server to reply with when it isn't the master, so
+// the client can go straight to the master (see Reconnect)
+func NotMaster(masterId uint) error {
+	return fmt.Errorf(notMasterFormat, masterId)
+}
+
+// NotMasterAt is NotMaster, also saying where the master is, for clients whose list of
+// servers doesn't match the cluster's
+func NotMasterAt(master MasterInfo) error {
+	return fmt.Errorf(notMasterAtFormat, master.Id, master.Address, master.View)
+}
+
+// ParseNotMaster returns the master id from an error made by NotMaster or NotMasterAt
+func ParseNotMaster(err error) (uint, bool) {
+	master, ok := ParseRedirect(err)
+	return master.Id, ok
+}
+
+// ParseRedirect returns what an error made by NotMaster or NotMasterAt says about the
+// master (just its id, for NotMaster)
+func ParseRedirect(err error) (MasterInfo, bool) {
+	var m MasterInfo
+	if err == nil {
+		return m, false
+	}
+	if _, scanErr := fmt.Sscanf(err.Error(), notMasterAtFormat, &m.Id, &m.Address, &m.View); scanErr == nil {
+		return m, true
+	}
+	m = MasterInfo{}
+	if _, scanErr := fmt.Sscanf(err.Error(), notMasterFormat, &m.Id); scanErr != nil {
+		return m, false
+	}
+	return m, true
+}
+
+// Reconnect reconnects after a call failed with err: straight to the master if err says
+// which server that is, or by asking around otherwise
+func (c *Client) Reconnect(err error) {
+	c.reconnectLock.Lock()
+	defer c.reconnectLock.Unlock()
+	c.reconnect(err)
+}
+
+// ReconnectFrom is Reconnect for a call that failed over conn. If the client has
+// already moved on from conn (e.g. another call that failed reconnected), it does nothing
+func (c *Client) ReconnectFrom(conn *rpc.Client, err error) {
+	c.reconnectLock.Lock()
+	defer c.reconnectLock.Unlock()
+	if current, _ := c.Conn(); current != conn {
+		return
+	}
+	c.reconnect(err)
+}
+
+// reconnect is Reconnect, for callers holding reconnectLock
+func (c *Client) reconnect(err error) {
+	if master, ok := ParseRedirect(err); ok && master.Id != c.connectedTo() {
+		c.learnMaster(master)
+	}
+	if id, ok := ParseNotMaster(err); ok && id < c.numServers() && id != c.connectedTo() {
+		c.Log.Printf(STATUS, "Redirected to master %d", id)
+		if c.ConnectToServer(id) == nil {
+			c.setMaster(id)
+			c.attachSession()
+			return
+		}
+	}
+	c.RefreshServers()
+	c.connectToMaster()
+}
+
+func (c *Client) connectedTo() uint {
+	_, id := c.Conn()
+	return id
+}
+
 // processCallWithRetry tries to make a client call until a timeout triggers
 // retries happen when the RPC call fails
 func (c *Client) ProcessCallWithRetry(RPCCall string, args interface{}, reply interface{}) error {
-	timer := time.NewTimer(DefaultTimeout)
-	giveupTimer := time.NewTimer(DefaultTimeout * 10)
+	return c.ProcessCallWithRetryCtx(context.Background(), RPCCall, args, reply)
+}
+
+// ProcessCallWithRetryCtx is ProcessCallWithRetry, giving up once ctx is done
+func (c *Client) ProcessCallWithRetryCtx(ctx context.Context, RPCCall string, args interface{}, reply interface{}) (err error) {
+	c.callStarted(RPCCall)
+	start := time.Now()
+	defer func() { c.callEnded(RPCCall, time.Since(start), err) }()
+	opts := c.Options.forCall(ctx)
+	trace := tracePrefix(ctx)
+	giveupTimer := time.NewTimer(opts.GiveUp)
+	defer giveupTimer.Stop()
 	//c.Log.Printf(DEBUG, "Type is %v, %v", reflect.TypeOf(args), reflect.TypeOf(reply))
-	for {
-		dbCall := c.RpcClient.Go(RPCCall, args, reply, nil)
+	busy := 0 // busy replies in a row
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		timer := time.NewTimer(opts.Timeout)
+		conn, id := c.Conn()
+		dbCall := conn.Go(RPCCall, args, reply, nil)
+		var err error
 		select {
+		case <-ctx.Done():
+			c.Log.Printf(DEBUG, "%sCall canceled: %v", trace, ctx.Err())
+			timer.Stop()
+			return ctx.Err()
 		case <-giveupTimer.C:
-			c.Log.Printf(DEBUG, "Client completely giving up on this call")
-			return errors.New("Completely timed out")
+			c.Log.Printf(DEBUG, "%sClient completely giving up on this call", trace)
+			timer.Stop()
+			return ErrGaveUp
 		case <-timer.C:
-			c.Log.Printf(DEBUG, "Single call timed out")
-			c.ConnectToMaster()
-			timer.Reset(DefaultTimeout)
+			c.Log.Printf(DEBUG, "%sSingle call timed out", trace)
+			err = ErrCallTimedOut
 		case <-dbCall.Done:
+			timer.Stop()
 			if dbCall.Error == nil {
-				c.Log.Printf(STATUS, "Call done with no error")
+				c.Log.Printf(STATUS, "%sCall done with no error", trace)
 				return nil
 			}
-			c.Log.Printf(DEBUG, "Call failed with error %v", dbCall.Error)
-			time.Sleep(DefaultTimeout / 10)
-			//error possibilities 1) network failure 2) server can't process request
-			c.ConnectToMaster()
+			c.Log.Printf(DEBUG, "%sCall failed with error %v", trace, dbCall.Error)
+			err = dbCall.Error
+			if isConnectionError(err) {
+				c.emit(Event{State: Disconnected, Server: id, Err: err})
+			}
+		}
+		delay, retry := opts.Retry.Backoff(attempt, err)
+		if !retry {
+			return err
+		}
+		c.retrying(RPCCall, attempt, err)
+		if _, redirected := ParseNotMaster(err); redirected {
+			// no point waiting, we know where to go
+			delay = 0
+		}
+		if IsServerBusy(err) {
+			if busy < 10 {
+				busy++
+			}
+			c.serverBusy(RPCCall, attempt)
+			if d := opts.BusyDelay << uint(busy-1); d > delay {
+				delay = d
+			}
+			// the server knows better than we do how long it'll be
+			if d, ok := RetryAfter(err); ok && d > delay {
+				delay = d
+			}
+		} else {
+			busy = 0
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-giveupTimer.C:
+			c.Log.Printf(DEBUG, "%sClient completely giving up on this call", trace)
+			return ErrGaveUp
+		case <-time.After(delay):
+		}
+		//error possibilities 1) network failure 2) server can't process request
+		// 3) server too busy, in which case it's still the right one to ask
+		if !IsServerBusy(err) {
+			c.ReconnectFrom(conn, err)
 		}
 	}
 }
@@ -0,0 +1,251 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"github.com/mgentili/goPhat/level_log"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"testing"
+	"time"
+)
+
+func TestNotMaster(t *testing.T) {
+	// it has to survive being turned into a string by net/rpc
+	err := errors.New(NotMaster(2).Error())
+	if id, ok := ParseNotMaster(err); !ok || id != 2 {
+		t.Errorf("Expected master 2, got %d %v", id, ok)
+	}
+	if _, ok := ParseNotMaster(errors.New("Master Failover")); ok {
+		t.Errorf("Expected other errors not to parse")
+	}
+	at := MasterInfo{Id: 1, Address: "10.0.0.2:9000", View: 4}
+	err = errors.New(NotMasterAt(at).Error())
+	if master, ok := ParseRedirect(err); !ok || master != at {
+		t.Errorf("Expected %+v, got %+v %v", at, master, ok)
+	}
+	if id, ok := ParseNotMaster(err); !ok || id != 1 {
+		t.Errorf("Expected master 1, got %d %v", id, ok)
+	}
+	// a redirect to a server the client doesn't know about adds it
+	c := &Client{ServerLocations: []string{"a:1"}, NumServers: 1, Log: level_log.NewLL(ioutil.Discard, "c")}
+	c.learnMaster(at)
+	if servers := c.Servers(); len(servers) != 2 || servers[1] != at.Address {
+		t.Errorf("Expected the master's address to be learnt, got %v", servers)
+	}
+}
+
+func TestMetricsAndHooks(t *testing.T) {
+	var ended []time.Duration
+	var changes [][2]uint
+	c := &Client{Options: Options{Hooks: Hooks{
+		CallEnd:      func(call string, took time.Duration, err error) { ended = append(ended, took) },
+		MasterChange: func(old, new uint) { changes = append(changes, [2]uint{old, new}) },
+	}}}
+	c.callEnded("Server.RPCDB", 5*time.Millisecond, nil)
+	c.callEnded("Server.RPCDB", time.Minute, errors.New("Completely timed out"))
+	c.setMaster(0)
+	c.setMaster(2)
+	m := c.Metrics()
+	if m.Calls != 2 || m.Errors != 1 || m.Latency[1] != 1 || m.Latency[len(LatencyBuckets)] != 1 {
+		t.Errorf("Unexpected metrics %+v", m)
+	}
+	if m.MasterChanges != 1 || len(changes) != 1 || changes[0] != [2]uint{0, 2} {
+		t.Errorf("Expected one master change from 0 to 2, got %d %v", m.MasterChanges, changes)
+	}
+	if len(ended) != 2 {
+		t.Errorf("Expected the CallEnd hook to be called twice, got %v", ended)
+	}
+}
+
+func TestRefreshServers(t *testing.T) {
+	servers := []string{"10.0.0.1:9000", "10.0.0.2:9000"}
+	c := &Client{ServerLocations: []string{"10.0.0.1:9000"}, NumServers: 1, Log: level_log.NewLL(ioutil.Discard, "")}
+	c.Options.Resolver = func() ([]string, error) { return servers, nil }
+	if err := c.RefreshServers(); err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+	if address, err := c.server(1); err != nil || address != "10.0.0.2:9000" {
+		t.Errorf("Expected server 1 to be 10.0.0.2:9000, got %q %v", address, err)
+	}
+	servers[1] = "10.0.0.3:9000"
+	if got := c.Servers(); got[1] != "10.0.0.2:9000" {
+		t.Errorf("Expected the client to keep its own copy of the servers, got %v", got)
+	}
+	if _, err := c.server(2); err == nil {
+		t.Errorf("Expected an error for a server that doesn't exist")
+	}
+	if addrs, err := ResolveHosts([]string{"localhost:9000"})(); err != nil || len(addrs) != 1 {
+		t.Errorf("Expected localhost to resolve, got %v %v", addrs, err)
+	}
+}
+
+func TestCallOptions(t *testing.T) {
+	opts := Options{Timeout: time.Second}
+	o := opts.forCall(context.Background())
+	if o.Timeout != time.Second || o.DialTimeout != time.Second || o.GiveUp != 10*time.Second {
+		t.Errorf("Unexpected defaults %+v", o)
+	}
+	ctx := WithCallOptions(context.Background(), CallOptions{Timeout: time.Millisecond})
+	o = opts.forCall(ctx)
+	if o.Timeout != time.Millisecond || o.GiveUp != 10*time.Second {
+		t.Errorf("Expected only the call's timeout to change, got %+v", o)
+	}
+}
+
+// busyServer says it's busy the first few times it's called
+type busyServer struct {
+	busyFor    int
+	retryAfter time.Duration // if set, replies ServerBusyFor(retryAfter)
+}
+
+func (s *busyServer) Call(args int, reply *int) error {
+	if s.busyFor > 0 {
+		s.busyFor--
+		if s.retryAfter > 0 {
+			return ServerBusyFor(s.retryAfter)
+		}
+		return ErrServerBusy
+	}
+	*reply = args
+	return nil
+}
+
+func TestServerBusy(t *testing.T) {
+	server := rpc.NewServer()
+	server.RegisterName("Server", &busyServer{busyFor: 2})
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	c := &Client{RpcClient: rpc.NewClient(clientConn), Log: level_log.NewLL(ioutil.Discard, "")}
+	c.Options = Options{Timeout: time.Second, BusyDelay: 10 * time.Millisecond, RetryDelay: time.Millisecond}
+	start := time.Now()
+	var reply int
+	if err := c.ProcessCallWithRetry("Server.Call", 7, &reply); err != nil || reply != 7 {
+		t.Fatalf("Expected the call to go through in the end, got %d %v", reply, err)
+	}
+	// 10ms after the first busy reply, then 20ms
+	if took := time.Since(start); took < 30*time.Millisecond {
+		t.Errorf("Expected to back off for at least 30ms, took %v", took)
+	}
+	if m := c.Metrics(); m.Busy != 2 || m.Retries != 2 {
+		t.Errorf("Expected 2 busy replies and 2 retries, got %+v", m)
+	}
+}
+
+func TestServerBusyFor(t *testing.T) {
+	if d, ok := RetryAfter(errors.New(ServerBusyFor(50 * time.Millisecond).Error())); !ok || d != 50*time.Millisecond {
+		t.Errorf("Expected to wait 50ms, got %v %v", d, ok)
+	}
+	if !IsServerBusy(ServerBusyFor(time.Second)) {
+		t.Errorf("Expected ServerBusyFor to count as busy")
+	}
+	server := rpc.NewServer()
+	server.RegisterName("Server", &busyServer{busyFor: 1, retryAfter: 50 * time.Millisecond})
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	c := &Client{RpcClient: rpc.NewClient(clientConn), Log: level_log.NewLL(ioutil.Discard, "")}
+	c.Options = Options{Timeout: time.Second, BusyDelay: time.Millisecond, RetryDelay: time.Millisecond}
+	start := time.Now()
+	var reply int
+	if err := c.ProcessCallWithRetry("Server.Call", 7, &reply); err != nil || reply != 7 {
+		t.Fatalf("Expected the call to go through in the end, got %d %v", reply, err)
+	}
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Errorf("Expected to wait as long as the server said, took %v", took)
+	}
+}
+
+// futureServer only speaks protocol versions from the future
+type futureServer struct{}
+
+func (futureServer) Hello(args *Hello, reply *Hello) error {
+	*reply = Hello{Version: ProtocolVersion + 2, MinVersion: ProtocolVersion + 1}
+	return nil
+}
+
+func TestHello(t *testing.T) {
+	if v, err := Negotiate(LocalHello(), Hello{Version: ProtocolVersion + 1, MinVersion: 1}); err != nil || v != ProtocolVersion {
+		t.Errorf("Expected to speak version %d to a newer server, got %d %v", ProtocolVersion, v, err)
+	}
+	if _, err := Negotiate(LocalHello(), Hello{Version: 0, MinVersion: 0}); err == nil {
+		t.Errorf("Expected not to be able to speak to a server that's too old")
+	}
+
+	c := &Client{Log: level_log.NewLL(ioutil.Discard, ""), Options: Options{Timeout: time.Second}}
+	for _, server := range []interface{}{futureServer{}, &busyServer{}} {
+		rpcServer := rpc.NewServer()
+		rpcServer.RegisterName("Server", server)
+		serverConn, clientConn := net.Pipe()
+		go rpcServer.ServeConn(serverConn)
+		hello, err := c.hello(rpc.NewClient(clientConn))
+		switch server.(type) {
+		case futureServer:
+			if err == nil {
+				t.Errorf("Expected a server from the future to be turned away")
+			}
+		default:
+			// servers from before Hello are version 1
+			if err != nil || hello.Version != 1 {
+				t.Errorf("Expected an old server to be spoken to at version 1, got %v %v", hello, err)
+			}
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	var hooked []State
+	c := &Client{Options: Options{Hooks: Hooks{StateChange: func(e Event) { hooked = append(hooked, e.State) }}}}
+	events := c.Events()
+	c.emit(Event{State: Connected, Server: 1})
+	c.emit(Event{State: Disconnected, Server: 1, Err: rpc.ErrShutdown})
+	// only the first of a run of disconnections is reported
+	c.emit(Event{State: Disconnected, Server: 2, Err: rpc.ErrShutdown})
+	c.setMaster(2)
+	c.emit(Event{State: Connected, Server: 2})
+	c.ReportSessionExpired()
+	expected := []State{Connected, Disconnected, MasterChanged, Connected, SessionExpired}
+	for _, state := range expected {
+		if e := <-events; e.State != state {
+			t.Errorf("Expected %v, got %v", state, e.State)
+		}
+	}
+	if len(hooked) != len(expected) {
+		t.Errorf("Expected the hook to see %v, got %v", expected, hooked)
+	}
+	if !isConnectionError(rpc.ErrShutdown) || isConnectionError(ErrServerBusy) {
+		t.Errorf("Expected only ErrShutdown to count as losing the connection")
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	for name, codec := range map[string]Codec{"gob": GobCodec, "json": JSONCodec} {
+		server := rpc.NewServer()
+		server.RegisterName("Server", &busyServer{})
+		serverConn, clientConn := net.Pipe()
+		if name == "json" {
+			go server.ServeCodec(jsonrpc.NewServerCodec(serverConn))
+		} else {
+			go server.ServeConn(serverConn)
+		}
+		c := &Client{RpcClient: rpc.NewClientWithCodec(codec(clientConn)), Log: level_log.NewLL(ioutil.Discard, "")}
+		var reply int
+		if err := c.ProcessCallWithRetry("Server.Call", 7, &reply); err != nil || reply != 7 {
+			t.Errorf("%s: expected 7, got %d %v", name, reply, err)
+		}
+	}
+}
+
+func TestNewClientWait(t *testing.T) {
+	// nothing listens here
+	servers := []string{"127.0.0.1:1", "127.0.0.1:2"}
+	opts := Options{Timeout: 10 * time.Millisecond, Log: level_log.NewLL(ioutil.Discard, "")}
+	start := time.Now()
+	if _, err := NewClientWaitWithOptions(servers, 0, "u", start.Add(100*time.Millisecond), opts); err == nil {
+		t.Errorf("Expected waiting for a cluster that isn't there to fail")
+	}
+	if took := time.Since(start); took < 100*time.Millisecond || took > time.Second {
+		t.Errorf("Expected to give up at the deadline, took %v", took)
+	}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+)
+
+// Codec makes the net/rpc codec that calls to a server are encoded with, given the
+// connection to it (see Options.Codec)
+type Codec func(conn io.ReadWriteCloser) rpc.ClientCodec
+
+// GobCodec encodes calls with gob, as net/rpc does by default
+func GobCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobClientCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf}
+}
+
+// JSONCodec encodes calls as JSON-RPC 1.0, for servers that serve it (see phatRPC's
+// Config.JSONAddress)
+func JSONCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return jsonrpc.NewClientCodec(conn)
+}
+
+// gobClientCodec is net/rpc's own (unexported) gob codec
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
+	if err = c.enc.Encode(r); err != nil {
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	return c.dec.Decode(r)
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) error {
+	return c.dec.Decode(body)
+}
+
+func (c *gobClientCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"time"
+)
+
+// upper bounds of the call latency histogram buckets (the last bucket catches everything else)
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// Hooks are called as the client works, e.g. to feed its health into other monitoring.
+// Any of them can be nil. They're called on the goroutine doing the work, so they
+// shouldn't block
+type Hooks struct {
+	CallStart    func(call string)
+	CallEnd      func(call string, took time.Duration, err error)
+	Retry        func(call string, attempt int, err error) // before each retry of a failed call
+	Busy         func(call string, attempt int)            // when a server replies ErrServerBusy
+	Connect      func(server uint, err error)              // every time the client (re)connects to a server
+	MasterChange func(oldMaster uint, newMaster uint)
+	StateChange  func(e Event) // see Client.Events
+}
+
+// Metrics counts what a client has done (see Client.Metrics). It marshals to JSON, so it
+// can be published with expvar.Func
+type Metrics struct {
+	Calls         int64
+	Errors        int64 // calls that failed in the end
+	Retries       int64
+	Busy          int64 // ErrServerBusy replies
+	Connects      int64
+	MasterChanges int64
+	// number of calls that took up to each of LatencyBuckets (and, last, longer)
+	Latency    []int64
+	LatencySum time.Duration
+}
+
+// Metrics returns a copy of the client's metrics so far
+func (c *Client) Metrics() Metrics {
+	c.metricsLock.Lock()
+	defer c.metricsLock.Unlock()
+	m := c.metrics
+	m.Latency = append([]int64(nil), c.metrics.Latency...)
+	if m.Latency == nil {
+		m.Latency = make([]int64, len(LatencyBuckets)+1)
+	}
+	return m
+}
+
+func (c *Client) callStarted(call string) {
+	if h := c.Options.Hooks.CallStart; h != nil {
+		h(call)
+	}
+}
+
+func (c *Client) callEnded(call string, took time.Duration, err error) {
+	c.metricsLock.Lock()
+	c.metrics.Calls++
+	if err != nil {
+		c.metrics.Errors++
+	}
+	if c.metrics.Latency == nil {
+		c.metrics.Latency = make([]int64, len(LatencyBuckets)+1)
+	}
+	i := 0
+	for i < len(LatencyBuckets) && took > LatencyBuckets[i] {
+		i++
+	}
+	c.metrics.Latency[i]++
+	c.metrics.LatencySum += took
+	c.metricsLock.Unlock()
+	if h := c.Options.Hooks.CallEnd; h != nil {
+		h(call, took, err)
+	}
+}
+
+func (c *Client) retrying(call string, attempt int, err error) {
+	c.metricsLock.Lock()
+	c.metrics.Retries++
+	c.metricsLock.Unlock()
+	if h := c.Options.Hooks.Retry; h != nil {
+		h(call, attempt, err)
+	}
+}
+
+func (c *Client) serverBusy(call string, attempt int) {
+	c.metricsLock.Lock()
+	c.metrics.Busy++
+	c.metricsLock.Unlock()
+	if h := c.Options.Hooks.Busy; h != nil {
+		h(call, attempt)
+	}
+}
+
+func (c *Client) connected(server uint, err error) {
+	c.metricsLock.Lock()
+	c.metrics.Connects++
+	c.metricsLock.Unlock()
+	if h := c.Options.Hooks.Connect; h != nil {
+		h(server, err)
+	}
+}
+
+// setMaster records who the master is
+func (c *Client) setMaster(id uint) {
+	c.connLock.Lock()
+	old := c.MasterId
+	c.MasterId = id
+	c.connLock.Unlock()
+	if old == id {
+		return
+	}
+	c.metricsLock.Lock()
+	c.metrics.MasterChanges++
+	c.metricsLock.Unlock()
+	if h := c.Options.Hooks.MasterChange; h != nil {
+		h(old, id)
+	}
+	c.emit(Event{State: MasterChanged, Server: id})
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// the roles a server can say it has in reply to Ping, besides what it's doing instead
+// while it can't have one ("recovery" or "view change")
+const (
+	RoleMaster   = "master"
+	RoleFollower = "follower"
+)
+
+// PingReply is what a server says about itself in reply to Ping
+type PingReply struct {
+	Replica      uint
+	Role         string
+	View         uint
+	Master       uint
+	CommitNumber uint
+	Time         time.Time // the server's clock as it replied
+	// filled in by the client: how long the call took, and how far the server's clock
+	// seems to be ahead of ours (assuming the reply took half the round trip to arrive)
+	RoundTrip time.Duration
+	Skew      time.Duration
+}
+
+// Ping asks the server the client's connected to how it is, without retrying. It's
+// cheap enough to use as a liveness probe
+func (c *Client) Ping(ctx context.Context) (PingReply, error) {
+	var reply PingReply
+	conn, _ := c.Conn()
+	timer := time.NewTimer(c.Options.withDefaults().Timeout)
+	defer timer.Stop()
+	sent := time.Now()
+	call := conn.Go("Server.Ping", new(struct{}), &reply, nil)
+	select {
+	case <-ctx.Done():
+		return reply, ctx.Err()
+	case <-timer.C:
+		return reply, ErrCallTimedOut
+	case <-call.Done:
+	}
+	if call.Error != nil {
+		return reply, call.Error
+	}
+	reply.RoundTrip = time.Since(sent)
+	reply.Skew = reply.Time.Sub(sent.Add(reply.RoundTrip / 2))
+	return reply, nil
+}
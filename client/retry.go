@@ -0,0 +1,84 @@
+package client
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// returned (to the retry policy) when a single call doesn't finish within Options.Timeout
+var ErrCallTimedOut = errors.New("call timed out")
+
+// returned when a call still hasn't gone through after Options.GiveUp
+var ErrGaveUp = errors.New("Completely timed out")
+
+// the error servers reply with when they're too loaded to take a call. The client backs
+// off for longer after it than after other errors (see Options.BusyDelay)
+var ErrServerBusy = errors.New("server busy, try again later")
+
+const serverBusyForPrefix = "server busy, try again in "
+
+// ServerBusyFor is ErrServerBusy for a server that says how long to wait before trying
+// again
+func ServerBusyFor(d time.Duration) error {
+	return errors.New(serverBusyForPrefix + d.String())
+}
+
+// RetryAfter returns how long an error made by ServerBusyFor says to wait
+func RetryAfter(err error) (time.Duration, bool) {
+	if err == nil || !strings.HasPrefix(err.Error(), serverBusyForPrefix) {
+		return 0, false
+	}
+	d, parseErr := time.ParseDuration(strings.TrimPrefix(err.Error(), serverBusyForPrefix))
+	return d, parseErr == nil
+}
+
+// IsServerBusy returns whether err is ErrServerBusy (or made by ServerBusyFor), even
+// after it's been through net/rpc
+func IsServerBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, after := RetryAfter(err)
+	return after || err.Error() == ErrServerBusy.Error()
+}
+
+// RetryPolicy decides whether, and after how long, a failed call is retried
+type RetryPolicy interface {
+	// Backoff is called after attempt number attempt (starting at 1) failed with err. It
+	// returns how long to wait before trying again, or false to give up and return err
+	Backoff(attempt int, err error) (time.Duration, bool)
+}
+
+// Backoff is a RetryPolicy that waits Initial after the first failure and Multiplier times
+// longer after each one after that, up to Max
+type Backoff struct {
+	MaxAttempts int           // give up after this many attempts (0 means no limit, other than Options.GiveUp)
+	Initial     time.Duration // wait after the first failure
+	Max         time.Duration // longest wait (0 means no limit)
+	Multiplier  float64       // how much longer each wait is than the last (values under 1 mean 1)
+	// the fraction of each wait that's randomized, so clients that failed together don't
+	// all retry together: 0.2 waits between 80% and 120% of the wait
+	Jitter float64
+	// decides which errors are worth retrying (nil retries everything)
+	Retryable func(error) bool
+}
+
+func (b Backoff) Backoff(attempt int, err error) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+		return 0, false
+	}
+	if b.Retryable != nil && !b.Retryable(err) {
+		return 0, false
+	}
+	delay := float64(b.Initial) * math.Pow(math.Max(b.Multiplier, 1), float64(attempt-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay), true
+}
@@ -0,0 +1,34 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{MaxAttempts: 5, Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond, Multiplier: 2}
+	expected := []time.Duration{10, 20, 40, 50}
+	for i, e := range expected {
+		delay, retry := b.Backoff(i+1, ErrCallTimedOut)
+		if !retry || delay != e*time.Millisecond {
+			t.Errorf("Attempt %d: expected to wait %dms, got %v %v", i+1, e, delay, retry)
+		}
+	}
+	if _, retry := b.Backoff(5, ErrCallTimedOut); retry {
+		t.Errorf("Expected to give up after MaxAttempts")
+	}
+	// Jitter stays within its fraction
+	b.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if delay, _ := b.Backoff(1, ErrCallTimedOut); delay < 5*time.Millisecond || delay > 15*time.Millisecond {
+			t.Fatalf("Expected a jittered wait between 5ms and 15ms, got %v", delay)
+		}
+	}
+	// Only retryable errors are retried
+	fatal := errors.New("fatal")
+	b.Retryable = func(err error) bool { return err != fatal }
+	if _, retry := b.Backoff(1, fatal); retry {
+		t.Errorf("Expected a non-retryable error not to be retried")
+	}
+}
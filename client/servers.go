@@ -0,0 +1,109 @@
+package client
+
+import (
+	"fmt"
+	"net"
+)
+
+// Resolver returns the current addresses of the servers, in id order
+type Resolver func() ([]string, error)
+
+// ResolveHosts returns a Resolver which looks each of hostports ("host:port", in id
+// order) up again every time, for servers whose addresses change under the same names
+func ResolveHosts(hostports []string) Resolver {
+	return func() ([]string, error) {
+		servers := make([]string, len(hostports))
+		for i, hostport := range hostports {
+			host, port, err := net.SplitHostPort(hostport)
+			if err != nil {
+				return nil, err
+			}
+			addrs, err := net.LookupHost(host)
+			if err != nil {
+				return nil, err
+			}
+			if len(addrs) == 0 {
+				return nil, fmt.Errorf("no addresses for %s", host)
+			}
+			servers[i] = net.JoinHostPort(addrs[0], port)
+		}
+		return servers, nil
+	}
+}
+
+// Servers returns the addresses of the servers the client knows about
+func (c *Client) Servers() []string {
+	c.serversLock.RLock()
+	defer c.serversLock.RUnlock()
+	return append([]string(nil), c.ServerLocations...)
+}
+
+// SetServers changes the addresses of the servers, for when the cluster moves. The
+// current connection is left alone until it fails; the next reconnect uses the new list
+func (c *Client) SetServers(servers []string) {
+	c.serversLock.Lock()
+	c.ServerLocations = append([]string(nil), servers...)
+	c.NumServers = uint(len(servers))
+	c.serversLock.Unlock()
+	c.Log.Printf(STATUS, "Servers are now %v", servers)
+	c.dropFollowers()
+}
+
+// RefreshServers asks Options.Resolver for the servers' addresses again, if it's set
+func (c *Client) RefreshServers() error {
+	if c.Options.Resolver == nil {
+		return nil
+	}
+	servers, err := c.Options.Resolver()
+	if err != nil {
+		c.Log.Printf(DEBUG, "Couldn't refresh the servers: %v", err)
+		return err
+	}
+	if len(servers) == 0 {
+		return fmt.Errorf("resolver returned no servers")
+	}
+	old := c.Servers()
+	changed := len(old) != len(servers)
+	for i := 0; !changed && i < len(old); i++ {
+		changed = old[i] != servers[i]
+	}
+	if changed {
+		c.SetServers(servers)
+	}
+	return nil
+}
+
+// learnMaster takes the master's address from what a server said about it, if the
+// client's list of servers has it wrong (or doesn't have it at all)
+func (c *Client) learnMaster(master MasterInfo) {
+	if master.Address == "" {
+		return
+	}
+	servers := c.Servers()
+	if master.Id < uint(len(servers)) && servers[master.Id] == master.Address {
+		return
+	}
+	for uint(len(servers)) <= master.Id {
+		servers = append(servers, "")
+	}
+	servers[master.Id] = master.Address
+	c.Log.Printf(STATUS, "Master %d (view %d) is at %s", master.Id, master.View, master.Address)
+	c.SetServers(servers)
+}
+
+// server returns the address of the server with the given id
+func (c *Client) server(id uint) (string, error) {
+	c.serversLock.RLock()
+	defer c.serversLock.RUnlock()
+	if id >= c.NumServers {
+		return "", fmt.Errorf("no server %d (there are %d)", id, c.NumServers)
+	}
+	return c.ServerLocations[id], nil
+}
+
+// numServers is NumServers, safe against SetServers
+func (c *Client) numServers() uint {
+	c.serversLock.RLock()
+	defer c.serversLock.RUnlock()
+	return c.NumServers
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// followers are the connections used for stale reads
+type followers struct {
+	lock  sync.Mutex
+	conns map[uint]*rpc.Client
+	next  uint
+}
+
+// follower returns a connection to the next replica (other than the master) in turn,
+// along with its id
+func (c *Client) follower() (*rpc.Client, uint, error) {
+	f := &c.followers
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.conns == nil {
+		f.conns = make(map[uint]*rpc.Client)
+	}
+	n := c.numServers()
+	id := f.next % n
+	if id == c.Master() && n > 1 {
+		id = (id + 1) % n
+	}
+	f.next = id + 1
+	if conn, ok := f.conns[id]; ok {
+		return conn, id, nil
+	}
+	address, err := c.server(id)
+	if err != nil {
+		return nil, id, err
+	}
+	conn, err := c.dial(address)
+	if err != nil {
+		return nil, id, err
+	}
+	f.conns[id] = conn
+	return conn, id, nil
+}
+
+// dropFollower forgets a connection that failed
+func (c *Client) dropFollower(id uint) {
+	f := &c.followers
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if conn, ok := f.conns[id]; ok {
+		conn.Close()
+		delete(f.conns, id)
+	}
+}
+
+// dropFollowers forgets all the follower connections, once the servers have moved
+func (c *Client) dropFollowers() {
+	f := &c.followers
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for id, conn := range f.conns {
+		conn.Close()
+		delete(f.conns, id)
+	}
+}
+
+// ProcessStaleCallCtx makes a call whose reply may be out of date. With
+// Options.ReadFromFollowers, it goes to the replicas other than the master in turn,
+// spreading the load around; otherwise, or if none of them answer, it's just
+// ProcessCallWithRetryCtx
+func (c *Client) ProcessStaleCallCtx(ctx context.Context, RPCCall string, args interface{}, reply interface{}) error {
+	if !c.Options.ReadFromFollowers {
+		return c.ProcessCallWithRetryCtx(ctx, RPCCall, args, reply)
+	}
+	opts := c.Options.forCall(ctx)
+	trace := tracePrefix(ctx)
+	for i := uint(0); i < c.numServers(); i++ {
+		conn, id, err := c.follower()
+		if err != nil {
+			c.Log.Printf(DEBUG, "%sCouldn't connect to server %d for a stale read: %v", trace, id, err)
+			continue
+		}
+		timer := time.NewTimer(opts.Timeout)
+		call := conn.Go(RPCCall, args, reply, nil)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+			c.Log.Printf(DEBUG, "%sStale read from server %d timed out", trace, id)
+			c.dropFollower(id)
+			continue
+		case <-call.Done:
+			timer.Stop()
+		}
+		if call.Error == nil {
+			return nil
+		}
+		c.Log.Printf(DEBUG, "%sStale read from server %d failed: %v", trace, id, call.Error)
+		if call.Error == rpc.ErrShutdown {
+			c.dropFollower(id)
+		}
+	}
+	return c.ProcessCallWithRetryCtx(ctx, RPCCall, args, reply)
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"io"
+	"net"
+	"net/rpc"
+)
+
+// State is a change in the client's connection to the cluster, reported through
+// Client.Events and Hooks.StateChange
+type State int
+
+const (
+	Connected      State = iota // connected to a server
+	Disconnected                // lost the connection to a server; the client keeps trying to get it back
+	MasterChanged               // a different server is the master
+	SessionExpired              // the servers ended the client's session, so its ephemeral nodes and locks are gone
+)
+
+func (s State) String() string {
+	switch s {
+	case Connected:
+		return "Connected"
+	case Disconnected:
+		return "Disconnected"
+	case MasterChanged:
+		return "MasterChanged"
+	case SessionExpired:
+		return "SessionExpired"
+	}
+	return "Unknown"
+}
+
+// Event reports a State change
+type Event struct {
+	State  State
+	Server uint  // the server connected to or lost, or the new master
+	Err    error // why the connection was lost, for Disconnected
+}
+
+// how many events Events holds for a slow reader before dropping new ones
+const EventBuffer = 64
+
+// Events returns a channel of the client's state changes, so applications can e.g. stop
+// acting as a leader as soon as the client loses touch rather than on the next failed
+// call. Events are dropped if the channel's full, so it should be read promptly
+func (c *Client) Events() <-chan Event {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if c.events == nil {
+		c.events = make(chan Event, EventBuffer)
+	}
+	return c.events
+}
+
+// Connected returns whether the client is connected, as far as it knows: it finds out it
+// isn't when a call fails for want of a connection
+func (c *Client) Connected() bool {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return !c.disconnected
+}
+
+// ReportSessionExpired is for the session layer on top of the client to say the
+// servers have ended its session
+func (c *Client) ReportSessionExpired() {
+	c.emit(Event{State: SessionExpired})
+}
+
+func (c *Client) emit(e Event) {
+	c.stateLock.Lock()
+	switch e.State {
+	case Connected:
+		c.disconnected = false
+	case Disconnected:
+		if c.disconnected {
+			// already said so
+			c.stateLock.Unlock()
+			return
+		}
+		c.disconnected = true
+	}
+	if c.events != nil {
+		select {
+		case c.events <- e:
+		default:
+		}
+	}
+	c.stateLock.Unlock()
+	if h := c.Options.Hooks.StateChange; h != nil {
+		h(e)
+	}
+}
+
+// isConnectionError returns whether err means the connection to the server is gone
+func isConnectionError(err error) bool {
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
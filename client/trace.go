@@ -0,0 +1,37 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type traceIDKey struct{}
+
+// NewTraceID returns a random id to follow a request through the logs by
+func NewTraceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// WithTraceID returns a context for calls that are traced as id, rather than each
+// getting an id of its own. Several calls can share an id, so a whole operation can be
+// followed through the servers' logs
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// TraceID returns the trace id set on ctx by WithTraceID ("" if there isn't one)
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// tracePrefix is what the client's log lines about a call made with ctx start with
+func tracePrefix(ctx context.Context) string {
+	if id := TraceID(ctx); id != "" {
+		return "[" + id + "] "
+	}
+	return ""
+}
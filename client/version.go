@@ -0,0 +1,95 @@
+package client
+
+import (
+	"fmt"
+	"net/rpc"
+	"strings"
+	"time"
+)
+
+// ProtocolVersion is the version of the protocol between clients and servers this
+// release speaks. It goes up whenever either side changes in a way the other has to know
+// about
+const ProtocolVersion = 2
+
+// MinProtocolVersion is the oldest version this release can still talk to. Servers from
+// before versions were exchanged count as version 1
+const MinProtocolVersion = 1
+
+// features a server can have on top of the basic calls (see Hello)
+const (
+	FeatureWatches    = "watches"    // WatchExists and Invalidations
+	FeatureSessions   = "sessions"   // AttachSession, and OPEN_SESSION and KEEPALIVE
+	FeatureForwarding = "forwarding" // servers that aren't the master pass writes on to it
+	FeaturePing       = "ping"       // Ping
+)
+
+// Hello is what each side says about itself when a connection is made, so clients and
+// servers from different releases can work out what to speak, or fail clearly
+type Hello struct {
+	Version    int
+	MinVersion int
+	Features   []string
+}
+
+// Has returns whether h lists feature
+func (h Hello) Has(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalHello is what this release says about itself, with the given features
+func LocalHello(features ...string) Hello {
+	return Hello{Version: ProtocolVersion, MinVersion: MinProtocolVersion, Features: features}
+}
+
+// Negotiate returns the newest version both sides speak, or an error saying why there
+// isn't one
+func Negotiate(mine, theirs Hello) (int, error) {
+	version := mine.Version
+	if theirs.Version < version {
+		version = theirs.Version
+	}
+	if version < mine.MinVersion || version < theirs.MinVersion {
+		return 0, fmt.Errorf("incompatible protocol versions: we speak %d to %d, they speak %d to %d",
+			mine.MinVersion, mine.Version, theirs.MinVersion, theirs.Version)
+	}
+	return version, nil
+}
+
+// the Hello of servers from before there was one
+var oldServerHello = Hello{Version: 1, MinVersion: 1}
+
+// hello says hello to the server at the other end of conn, returning what it said back
+func (c *Client) hello(conn *rpc.Client) (Hello, error) {
+	mine := LocalHello()
+	var theirs Hello
+	call := conn.Go("Server.Hello", &mine, &theirs, nil)
+	timer := time.NewTimer(c.Options.withDefaults().Timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return theirs, ErrCallTimedOut
+	case <-call.Done:
+	}
+	if call.Error != nil && strings.Contains(call.Error.Error(), "can't find method") {
+		theirs = oldServerHello
+	} else if call.Error != nil {
+		return theirs, call.Error
+	}
+	if _, err := Negotiate(mine, theirs); err != nil {
+		return theirs, err
+	}
+	return theirs, nil
+}
+
+// ServerHello returns what the server the client's connected to said about itself
+func (c *Client) ServerHello() Hello {
+	c.connLock.RLock()
+	defer c.connLock.RUnlock()
+	return c.serverHello
+}
@@ -251,7 +251,7 @@ func (t *TestMaster) Verify() {
 			if err != nil {
 				t.log.Printf(DEBUG, "Get Data of %s failed with %s", loc, err)
 			}
-			str := res.Value
+			str := string(res.Value)
 			t.log.Printf(DEBUG, "Getting data for %s. Expected %s, got %s", loc, data, str)
 			if data != str {
 				t.log.Printf(DEBUG, "FAILED!")
@@ -271,7 +271,7 @@ func (t *TestMaster) EnsureEqualHash() {
 	for i, loc := range t.RPC_Locations {
 		if t.ReplicaStatus[i] == ALIVE {
 			client, _ := rpc.Dial("tcp", loc)
-			args := &phatdb.DBCommand{"SHA256", "", ""}
+			args := &phatdb.DBCommand{Command: "SHA256"}
 			reply := &phatdb.DBResponse{}
 			dbCall := client.Go("Server.RPCDB", args, reply, nil)
 			t.log.Printf(DEBUG, "SHA256: Requesting SHA256 from %v", loc)
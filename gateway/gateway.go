@@ -0,0 +1,222 @@
+// Package gateway serves the phatdb namespace over HTTP and JSON, for services that
+// can't speak net/rpc and gob. Each path in the tree is a URL:
+//
+//	GET    /a/b                          the node's value and stats
+//	GET    /a/b?children                 the names of its children
+//	GET    /a/b?watch=create&timeout=30s wait (up to timeout) for the node to exist, then GET it
+//	PUT    /a/b                          set the node's value to the body, creating it if need be
+//	PUT    /a/b?version=3                only set it if it's still at version 3
+//	DELETE /a/b                          delete it (?version=3 and ?recursive work as for PUT)
+//
+// GETs of a node reply with an ETag, and send nothing back (304) if it's in
+// If-None-Match. Everything is done through one PhatClient, so with its identities (see
+// PhatClient.Authenticate)
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/mgentili/goPhat/phatclient"
+	"github.com/mgentili/goPhat/phatdb"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// how long a watch waits if the request doesn't say
+const DefaultWatchTimeout = 30 * time.Second
+
+// the longest a request can ask a watch to wait
+const MaxWatchTimeout = 5 * time.Minute
+
+// Node is how nodes are written in replies
+type Node struct {
+	Path     string           `json:"path"`
+	Value    string           `json:"value"`
+	Stat     *phatdb.StatNode `json:"stat,omitempty"`
+	Children []string         `json:"children,omitempty"`
+}
+
+// Error is the reply to a request that failed
+type Error struct {
+	Error string `json:"error"`
+}
+
+type handler struct {
+	c *phatclient.PhatClient
+}
+
+// NewHandler returns a handler serving the tree c sees
+func NewHandler(c *phatclient.PhatClient) http.Handler {
+	return &handler{c: c}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	query := r.URL.Query()
+	switch r.Method {
+	case "GET":
+		if _, ok := query["children"]; ok {
+			kids, err := h.c.GetChildren(path)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, Node{Path: path, Children: kids})
+			return
+		}
+		if query.Get("watch") == "create" {
+			if !h.waitForCreate(w, r, path) {
+				return
+			}
+		} else if query.Get("watch") != "" {
+			writeJSON(w, http.StatusBadRequest, Error{"watch must be create"})
+			return
+		}
+		n, modified, err := h.c.GetDataIfModified(path, parseETag(r.Header.Get("If-None-Match")))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("ETag", etag(n.Stats))
+		if !modified {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		writeJSON(w, http.StatusOK, Node{Path: path, Value: string(n.Value), Stat: n.Stats})
+	case "PUT":
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(phatdb.MaxValueSize)))
+		if err != nil {
+			writeJSON(w, http.StatusRequestEntityTooLarge, Error{err.Error()})
+			return
+		}
+		if v := query.Get("version"); v != "" {
+			version, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, Error{"bad version"})
+				return
+			}
+			n, err := h.c.SetDataVersion(path, string(body), version)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, Node{Path: path, Value: string(body), Stat: n.Stats})
+			return
+		}
+		err = h.c.SetData(path, string(body))
+		if err != nil && err.Error() == os.ErrNotExist.Error() {
+			n, err := h.c.Create(path, string(body))
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, Node{Path: path, Value: string(body), Stat: n.Stats})
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "DELETE":
+		var err error
+		if _, ok := query["recursive"]; ok {
+			err = h.c.DeleteRecursive(path)
+		} else if v := query.Get("version"); v != "" {
+			version, parseErr := strconv.ParseUint(v, 10, 64)
+			if parseErr != nil {
+				writeJSON(w, http.StatusBadRequest, Error{"bad version"})
+				return
+			}
+			err = h.c.DeleteVersion(path, version)
+		} else {
+			err = h.c.Delete(path)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, Error{"method not allowed"})
+	}
+}
+
+// etag identifies a version of a node, for If-None-Match
+func etag(s *phatdb.StatNode) string {
+	return fmt.Sprintf("\"%d.%d\"", s.CreateOp, s.Version)
+}
+
+// parseETag returns a node with the stats etag was made from, or nil if it's not one of ours
+func parseETag(etag string) *phatdb.DataNode {
+	s := &phatdb.StatNode{}
+	if _, err := fmt.Sscanf(etag, "\"%d.%d\"", &s.CreateOp, &s.Version); err != nil {
+		return nil
+	}
+	return &phatdb.DataNode{Stats: s}
+}
+
+// waitForCreate waits until there's a node at path, or writes the reply and returns
+// false if there still isn't one when the request's timeout is up
+func (h *handler) waitForCreate(w http.ResponseWriter, r *http.Request, path string) bool {
+	timeout := DefaultWatchTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		var err error
+		if timeout, err = time.ParseDuration(t); err != nil || timeout < 0 {
+			writeJSON(w, http.StatusBadRequest, Error{"bad timeout"})
+			return false
+		}
+	}
+	if timeout > MaxWatchTimeout {
+		timeout = MaxWatchTimeout
+	}
+	exists, created, err := h.c.ExistsWCtx(r.Context(), path)
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+	if exists {
+		return true
+	}
+	select {
+	case <-created:
+		return true
+	case <-r.Context().Done():
+		return false
+	case <-time.After(timeout):
+		writeError(w, os.ErrNotExist)
+		return false
+	}
+}
+
+// writeError replies with err, and a status to match. Errors come back from the servers
+// as strings, so that's what they're matched on
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err.Error() {
+	case os.ErrNotExist.Error():
+		status = http.StatusNotFound
+	case os.ErrExist.Error(), phatdb.ErrNotEmpty.Error(), phatdb.ErrLocked.Error():
+		status = http.StatusConflict
+	case phatdb.ErrBadVersion.Error():
+		status = http.StatusPreconditionFailed
+	case phatdb.ErrNotAuthorized.Error():
+		status = http.StatusForbidden
+	case phatdb.ErrTooLarge.Error(), phatdb.ErrQuotaExceeded.Error():
+		status = http.StatusRequestEntityTooLarge
+	case phatdb.ErrPathTooDeep.Error(), phatdb.ErrNameTooLong.Error(), phatdb.ErrDeleteRoot.Error(),
+		phatdb.ErrRootNode.Error():
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, Error{err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
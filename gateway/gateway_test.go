@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"encoding/json"
+	"github.com/mgentili/goPhat/phatRPC"
+	"github.com/mgentili/goPhat/phatclient"
+	"github.com/mgentili/goPhat/vr"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var replica_config = []string{"127.0.0.1:9100", "127.0.0.1:9101", "127.0.0.1:9102"}
+var client_config = []string{"127.0.0.1:6100", "127.0.0.1:6101", "127.0.0.1:6102"}
+
+func do(t *testing.T, method string, url string, body string) (*http.Response, Node) {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %s", method, url, err)
+	}
+	defer resp.Body.Close()
+	var n Node
+	json.NewDecoder(resp.Body).Decode(&n)
+	return resp, n
+}
+
+func TestGateway(t *testing.T) {
+	for i := 0; i < 3; i = i + 1 {
+		newReplica := vr.RunAsReplica(uint(i), replica_config)
+		phatRPC.StartServer(client_config[i], newReplica)
+	}
+	cli, err := phatclient.NewClient(client_config, 0, "gateway")
+	if err != nil {
+		t.Fatalf("Couldn't connect: %s", err)
+	}
+	server := httptest.NewServer(NewHandler(cli))
+	defer server.Close()
+
+	if resp, _ := do(t, "GET", server.URL+"/app/config", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected GET of a missing node to 404, got %d", resp.StatusCode)
+	}
+	// A watch waiting for the node
+	watched := make(chan Node)
+	go func() {
+		_, n := do(t, "GET", server.URL+"/app/config?watch=create&timeout=5s", "")
+		watched <- n
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if resp, _ := do(t, "PUT", server.URL+"/app/config", "v1"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("Expected PUT of a new node to 201, got %d", resp.StatusCode)
+	}
+	select {
+	case n := <-watched:
+		if n.Value != "v1" {
+			t.Errorf("Expected the watch to return v1, got %+v", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("Watch never returned")
+	}
+	if resp, _ := do(t, "PUT", server.URL+"/app/config?version=7", "v2"); resp.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("Expected PUT at the wrong version to 412, got %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, "PUT", server.URL+"/app/config?version=1", "v2"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected PUT at the right version to 200, got %d", resp.StatusCode)
+	}
+	if _, n := do(t, "GET", server.URL+"/app/config", ""); n.Value != "v2" || n.Stat.Version != 2 {
+		t.Errorf("Expected v2 at version 2, got %+v", n)
+	}
+	resp, _ := do(t, "GET", server.URL+"/app/config", "")
+	req, _ := http.NewRequest("GET", server.URL+"/app/config", nil)
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected GET with a current ETag to 304, got %v %v", resp, err)
+	}
+	if _, n := do(t, "GET", server.URL+"/app?children", ""); len(n.Children) != 1 || n.Children[0] != "config" {
+		t.Errorf("Expected /app's children to be [config], got %+v", n)
+	}
+	if resp, _ := do(t, "DELETE", server.URL+"/app?recursive", ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected DELETE to 204, got %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, "GET", server.URL+"/app/config", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected GET of a deleted node to 404, got %d", resp.StatusCode)
+	}
+}
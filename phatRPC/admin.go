@@ -0,0 +1,120 @@
+package phatRPC
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/mgentili/goPhat/vr"
+)
+
+// The admin endpoints, served over HTTP on Config.AdminAddress:
+//
+//	GET  /health    200 if the replica is up and in a normal view, 503 otherwise
+//	GET  /status    the replica's Status, as JSON
+//	POST /snapshot  take a VR snapshot now
+//	POST /compact   checkpoint the database now, so its journal can be thrown away
+
+var errNoSnapshotFile = errors.New("replica has nowhere to keep snapshots")
+
+// Status is what /status replies with
+type Status struct {
+	Replica       uint   `json:"replica"`
+	Status        string `json:"status"`
+	View          uint   `json:"view"`
+	Master        uint   `json:"master"`
+	MasterAddress string `json:"masterAddress"`
+	IsMaster      bool   `json:"isMaster"`
+	HasLease      bool   `json:"hasLease"`
+	OpNumber      uint   `json:"opNumber"`
+	CommitNumber  uint   `json:"commitNumber"`
+	// ops we've heard of that we haven't committed yet
+	CommitLag     uint `json:"commitLag"`
+	SnapshotIndex uint `json:"snapshotIndex"`
+	Sessions      int  `json:"sessions"`
+}
+
+var statusNames = map[int]string{
+	vr.Normal:     "normal",
+	vr.Recovery:   "recovery",
+	vr.ViewChange: "view change",
+}
+
+// status returns what /status replies with
+func (s *Server) status() Status {
+	r := s.ReplicaServer
+	master := s.masterInfo()
+	st := Status{
+		Replica:       r.Rstate.ReplicaNumber,
+		Status:        statusNames[r.Rstate.Status],
+		View:          r.Rstate.View,
+		Master:        master.Id,
+		MasterAddress: master.Address,
+		IsMaster:      r.IsMaster(),
+		HasLease:      r.HasLease(),
+		OpNumber:      r.Rstate.OpNumber,
+		CommitNumber:  r.Rstate.CommitNumber,
+		SnapshotIndex: r.SnapshotIndex,
+		Sessions:      s.db.SessionCount(),
+	}
+	if st.OpNumber > st.CommitNumber {
+		st.CommitLag = st.OpNumber - st.CommitNumber
+	}
+	return st
+}
+
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
+		st := s.status()
+		select {
+		case <-s.done:
+			writeAdminJSON(w, http.StatusServiceUnavailable, st)
+			return
+		default:
+		}
+		if st.Status != "normal" {
+			writeAdminJSON(w, http.StatusServiceUnavailable, st)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, st)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		writeAdminJSON(w, http.StatusOK, s.status())
+	})
+	mux.HandleFunc("/snapshot", s.adminPost(func() error {
+		if s.ReplicaServer.SnapshotFile == "" {
+			return errNoSnapshotFile
+		}
+		s.ReplicaServer.TakeSnapshot()
+		return nil
+	}))
+	mux.HandleFunc("/compact", s.adminPost(s.db.Compact))
+	return mux
+}
+
+// adminPost returns a handler for an admin action, which replies with the status once
+// it's done
+func (s *Server) adminPost(action func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			writeAdminJSON(w, http.StatusMethodNotAllowed, adminError{"use POST"})
+			return
+		}
+		if err := action(); err != nil {
+			writeAdminJSON(w, http.StatusInternalServerError, adminError{err.Error()})
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, s.status())
+	}
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
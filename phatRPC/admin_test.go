@@ -0,0 +1,60 @@
+package phatRPC
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mgentili/goPhat/vr"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	if vr.NREPLICAS == 0 {
+		vr.NREPLICAS = 3
+	}
+	admin := "127.0.0.1:9397"
+	s, err := NewServer("127.0.0.1:9398", &vr.Replica{}, Config{AdminAddress: admin})
+	if err != nil {
+		t.Fatalf("Couldn't start the server: %s", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	}()
+
+	resp, err := http.Get("http://" + admin + "/health")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the server to be healthy, got %v %v", resp, err)
+	}
+	resp.Body.Close()
+
+	resp, err = http.Get("http://" + admin + "/status")
+	if err != nil {
+		t.Fatalf("Couldn't get the status: %s", err)
+	}
+	var st Status
+	err = json.NewDecoder(resp.Body).Decode(&st)
+	resp.Body.Close()
+	if err != nil || st.Status != "normal" || st.MasterAddress != "127.0.0.1:9398" || st.Sessions != 0 {
+		t.Errorf("Unexpected status %+v %v", st, err)
+	}
+
+	resp, err = http.Post("http://"+admin+"/compact", "", nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected compacting to work, got %v %v", resp, err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get("http://" + admin + "/compact")
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected compacting to need a POST, got %v %v", resp, err)
+	}
+	resp.Body.Close()
+	// this replica has nowhere to keep them
+	resp, err = http.Post("http://"+admin+"/snapshot", "", nil)
+	if err != nil || resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected snapshotting to fail, got %v %v", resp, err)
+	}
+	resp.Body.Close()
+}
@@ -0,0 +1,77 @@
+package phatRPC
+
+import (
+	"time"
+
+	"github.com/mgentili/goPhat/client"
+)
+
+// how long busy clients are told to wait, if Config.BusyRetryAfter isn't set
+const DEFAULT_BUSY_RETRY_AFTER = 100 * time.Millisecond
+
+// admission limits how much work the server takes on at once, so that under load calls
+// are turned away with client.ServerBusyFor rather than piling up
+type admission struct {
+	calls      chan struct{} // a slot for each RPCDB call in progress (nil for no limit)
+	ops        chan struct{} // a slot for each command waiting on VR (nil for no limit)
+	retryAfter time.Duration
+}
+
+func newAdmission(config Config) *admission {
+	a := &admission{retryAfter: config.BusyRetryAfter}
+	if a.retryAfter == 0 {
+		a.retryAfter = DEFAULT_BUSY_RETRY_AFTER
+	}
+	if config.MaxCalls > 0 {
+		a.calls = make(chan struct{}, config.MaxCalls)
+	}
+	if config.MaxPendingOps > 0 {
+		a.ops = make(chan struct{}, config.MaxPendingOps)
+	}
+	return a
+}
+
+// take takes a slot in slots, or returns false straight away if there aren't any left
+func take(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func release(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// startCall is called at the start of each RPCDB call. If it doesn't return an error,
+// finishCall must be called once the call's done
+func (a *admission) startCall() error {
+	if !take(a.calls) {
+		return client.ServerBusyFor(a.retryAfter)
+	}
+	return nil
+}
+
+func (a *admission) finishCall() {
+	release(a.calls)
+}
+
+// startOp is called before a command is handed to VR. If it doesn't return an error,
+// finishOp must be called once the command's committed
+func (a *admission) startOp() error {
+	if !take(a.ops) {
+		return client.ServerBusyFor(a.retryAfter)
+	}
+	return nil
+}
+
+func (a *admission) finishOp() {
+	release(a.ops)
+}
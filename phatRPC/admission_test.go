@@ -0,0 +1,39 @@
+package phatRPC
+
+import (
+	"github.com/mgentili/goPhat/client"
+	"testing"
+	"time"
+)
+
+func TestAdmission(t *testing.T) {
+	a := newAdmission(Config{MaxCalls: 2, MaxPendingOps: 1, BusyRetryAfter: 50 * time.Millisecond})
+	if a.startCall() != nil || a.startCall() != nil {
+		t.Fatalf("Expected the first two calls to be let in")
+	}
+	err := a.startCall()
+	if d, ok := client.RetryAfter(err); !ok || d != 50*time.Millisecond {
+		t.Errorf("Expected the third call to be told to wait 50ms, got %v", err)
+	}
+	a.finishCall()
+	if err := a.startCall(); err != nil {
+		t.Errorf("Expected a call to be let in once another finished, got %s", err)
+	}
+	if a.startOp() != nil {
+		t.Fatalf("Expected the first op to be let in")
+	}
+	if !client.IsServerBusy(a.startOp()) {
+		t.Errorf("Expected the second op to be turned away")
+	}
+	a.finishOp()
+	if err := a.startOp(); err != nil {
+		t.Errorf("Expected an op to be let in once another finished, got %s", err)
+	}
+
+	unlimited := newAdmission(Config{})
+	for i := 0; i < 100; i++ {
+		if unlimited.startCall() != nil || unlimited.startOp() != nil {
+			t.Fatalf("Expected no limits by default")
+		}
+	}
+}
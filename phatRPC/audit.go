@@ -0,0 +1,79 @@
+package phatRPC
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/mgentili/goPhat/phatdb"
+)
+
+// AuditRecord is one line of the audit log (see Config.AuditLog): a write, who sent it
+// and how it went. Values are never recorded, since they may be secret
+type AuditRecord struct {
+	Time     time.Time `json:"time"`     // when the master received the write
+	Replica  uint      `json:"replica"`  // the server that recorded it
+	Identity string    `json:"identity"` // "scheme:id" the client authenticated as, or its session if it hasn't
+	Session  string    `json:"session,omitempty"`
+	TraceID  string    `json:"traceId,omitempty"`
+	Command  string    `json:"command"`
+	Path     string    `json:"path,omitempty"`
+	Target   string    `json:"target,omitempty"` // for COPY and MOVE
+	// VR op number the write was committed as (0 if it was turned away before then)
+	OpNumber uint64 `json:"opNumber"`
+	Code     string `json:"code"` // see phatdb.ErrorCode
+	Error    string `json:"error,omitempty"`
+}
+
+// auditLog writes AuditRecords to a Config.AuditLog, one JSON object per line
+type auditLog struct {
+	lock sync.Mutex
+	enc  *json.Encoder
+}
+
+func newAuditLog(out io.Writer) *auditLog {
+	if out == nil {
+		return nil
+	}
+	return &auditLog{enc: json.NewEncoder(out)}
+}
+
+// audit records a write and its result, if the server keeps an audit log. Only writes
+// are recorded, and only once each: as they're committed, or when they're turned away
+// before being replicated
+func (s *Server) audit(cmd *phatdb.DBCommand, result *phatdb.DBResponse) {
+	if s.auditLog == nil || !phatdb.IsWrite(cmd.Command) {
+		return
+	}
+	// the paths the write really touched, whatever the client's chroot
+	nodePath, target := cmd.Path, cmd.Target
+	if cmd.Root != "" {
+		nodePath = treePath(cmd.Root + "/" + nodePath)
+		if target != "" {
+			target = treePath(cmd.Root + "/" + target)
+		}
+	}
+	record := AuditRecord{
+		Time:     cmd.Time,
+		Replica:  s.ReplicaServer.Rstate.ReplicaNumber,
+		Identity: clientIdentity(cmd),
+		Session:  cmd.Session,
+		TraceID:  cmd.TraceID,
+		Command:  cmd.Command,
+		Path:     nodePath,
+		Target:   target,
+		OpNumber: cmd.OpNumber,
+		Code:     result.Code.String(),
+		Error:    result.Error,
+	}
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	s.auditLog.lock.Lock()
+	defer s.auditLog.lock.Unlock()
+	// the write's gone through either way, so all we can do is complain
+	if err := s.auditLog.enc.Encode(record); err != nil {
+		s.debug(DEBUG, "Couldn't write to the audit log: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package phatRPC
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/mgentili/goPhat/phatdb"
+	"github.com/mgentili/goPhat/vr"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	var out bytes.Buffer
+	s := &Server{ReplicaServer: &vr.Replica{}, auditLog: newAuditLog(&out)}
+	now := time.Now()
+	s.audit(&phatdb.DBCommand{Command: "GET", Path: "/a"}, &phatdb.DBResponse{})
+	s.audit(&phatdb.DBCommand{Command: "SET", Root: "/tenant", Path: "/a", Value: "secret", Session: "s1",
+		Auth: []phatdb.Identity{{"digest", "alice"}}, OpNumber: 7, Time: now}, &phatdb.DBResponse{})
+	denied := &phatdb.DBResponse{}
+	denied.Fail(phatdb.ErrNotAuthorized)
+	s.audit(&phatdb.DBCommand{Command: "DELETE", Path: "/b", Session: "s2"}, denied)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected the two writes to be recorded, got %q", out.String())
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("Expected values to be left out of the audit log, got %s", out.String())
+	}
+	var set, del AuditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &set); err != nil {
+		t.Fatalf("Couldn't parse %s: %s", lines[0], err)
+	}
+	if set.Command != "SET" || set.Path != "/tenant/a" || set.Identity != "digest:alice" || set.Session != "s1" ||
+		set.OpNumber != 7 || set.Code != phatdb.CodeOK.String() || !set.Time.Equal(now) {
+		t.Errorf("Expected the SET to be recorded, got %+v", set)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &del); err != nil {
+		t.Fatalf("Couldn't parse %s: %s", lines[1], err)
+	}
+	if del.Command != "DELETE" || del.Identity != "s2" || del.OpNumber != 0 || del.Code != phatdb.CodeNotAuthorized.String() || del.Error == "" {
+		t.Errorf("Expected the denied DELETE to be recorded, got %+v", del)
+	}
+
+	// no log, no records
+	s = &Server{ReplicaServer: &vr.Replica{}, auditLog: newAuditLog(nil)}
+	s.audit(&phatdb.DBCommand{Command: "SET", Path: "/a"}, &phatdb.DBResponse{})
+}
@@ -0,0 +1,100 @@
+package phatRPC
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mgentili/goPhat/phatdb"
+)
+
+// the most reads sent to the database in one batch, if Config.ReadBatchSize isn't set
+const DEFAULT_READ_BATCH_SIZE = 64
+
+// readBatcher collects reads that arrive close together and has the database answer
+// them as one READ_BATCH, so the command loop handles one request rather than many
+type readBatcher struct {
+	input   chan<- phatdb.DBCommandWithChannel
+	window  time.Duration // how long the first read of a batch waits for others
+	size    int
+	lock    sync.Mutex
+	pending []phatdb.DBCommandWithChannel
+	timer   *time.Timer
+}
+
+// newReadBatcher returns a batcher feeding input, or nil if the config doesn't ask for
+// batching
+func newReadBatcher(input chan<- phatdb.DBCommandWithChannel, config Config) *readBatcher {
+	if config.ReadBatchWindow <= 0 {
+		return nil
+	}
+	b := &readBatcher{input: input, window: config.ReadBatchWindow, size: config.ReadBatchSize}
+	if b.size <= 0 {
+		b.size = DEFAULT_READ_BATCH_SIZE
+	}
+	return b
+}
+
+// submit adds req to the batch being collected. Its reply comes on req.Done, as if it
+// had been sent to the database by itself
+func (b *readBatcher) submit(req phatdb.DBCommandWithChannel) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pending = append(b.pending, req)
+	if len(b.pending) >= b.size {
+		b.flushLocked()
+	} else if len(b.pending) == 1 {
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+}
+
+func (b *readBatcher) flush() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.flushLocked()
+}
+
+// flushLocked sends off the batch being collected, if there is one. b.lock must be held
+func (b *readBatcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return
+	}
+	batch := b.pending
+	b.pending = nil
+	go b.send(batch)
+}
+
+func (b *readBatcher) send(batch []phatdb.DBCommandWithChannel) {
+	if len(batch) == 1 {
+		b.input <- batch[0]
+		return
+	}
+	ops := make([]*phatdb.DBCommand, len(batch))
+	for i, req := range batch {
+		ops[i] = req.Cmd
+	}
+	done := make(chan *phatdb.DBResponse, 1)
+	b.input <- phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "READ_BATCH", Ops: ops}, done}
+	resp := <-done
+	results, _ := resp.Reply.([]phatdb.DBResponse)
+	for i, req := range batch {
+		result := &phatdb.DBResponse{Error: resp.Error, Code: resp.Code}
+		if i < len(results) {
+			result = &results[i]
+		}
+		req.Done <- result
+	}
+}
+
+// read sends a read to the database, batching it with others if the server batches
+// reads. Its reply comes on req.Done
+func (s *Server) read(req phatdb.DBCommandWithChannel) {
+	if s.batcher != nil && phatdb.Kind(req.Cmd.Command) == phatdb.ReadCommand {
+		s.batcher.submit(req)
+		return
+	}
+	s.InputChan <- req
+}
@@ -0,0 +1,56 @@
+package phatRPC
+
+import (
+	"github.com/mgentili/goPhat/phatdb"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReadBatcher(t *testing.T) {
+	input := make(chan phatdb.DBCommandWithChannel)
+	go phatdb.DatabaseServer(input)
+	defer close(input)
+	for i := 0; i < 3; i++ {
+		create := phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "CREATE", Path: "/n" + strconv.Itoa(i), Value: strconv.Itoa(i)}, make(chan *phatdb.DBResponse)}
+		input <- create
+		<-create.Done
+	}
+	// see what the batcher sends on its way to the database
+	sent := make(chan string, 10)
+	spy := make(chan phatdb.DBCommandWithChannel)
+	go func() {
+		for req := range spy {
+			sent <- req.Cmd.Command
+			input <- req
+		}
+	}()
+	defer close(spy)
+
+	b := newReadBatcher(spy, Config{ReadBatchWindow: 50 * time.Millisecond, ReadBatchSize: 3})
+	var dones []chan *phatdb.DBResponse
+	for i := 0; i < 5; i++ {
+		req := phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "GET", Path: "/n" + strconv.Itoa(i%3)}, make(chan *phatdb.DBResponse, 1)}
+		b.submit(req)
+		dones = append(dones, req.Done)
+	}
+	for i, done := range dones {
+		select {
+		case resp := <-done:
+			if resp.Error != "" || string(resp.Reply.(*phatdb.DataNode).Value) != strconv.Itoa(i%3) {
+				t.Errorf("GET %d got %#v", i, resp)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("GET %d wasn't answered", i)
+		}
+	}
+	// a full batch goes straight away, the rest once the window's up
+	if first, second := <-sent, <-sent; first != "READ_BATCH" || second != "READ_BATCH" {
+		t.Errorf("Expected two batches, got %s and %s", first, second)
+	}
+
+	// nothing's batched without a window
+	if newReadBatcher(spy, Config{}) != nil {
+		t.Errorf("Expected no batcher without a window")
+	}
+}
@@ -0,0 +1,149 @@
+package phatRPC
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/mgentili/goPhat/phatdb"
+)
+
+// responseCache keeps copies of nodes that have been read, so GETs and STATs of them can
+// be answered without going through the database's command loop. Entries are dropped as
+// writes to them (or their children, which show up in their stats) are applied, so it
+// never has anything the database doesn't. Only nodes anyone can read are kept, so the
+// cache doesn't need to check ACLs
+type responseCache struct {
+	lock  sync.Mutex
+	size  int
+	nodes map[string]phatdb.DataNode // by absolute path
+	// bumped whenever anything's dropped, so a read that was under way when a write
+	// went through doesn't put what it saw from before the write in the cache
+	gen uint64
+}
+
+// newResponseCache returns a cache of up to size nodes, or nil if size isn't positive
+func newResponseCache(size int) *responseCache {
+	if size <= 0 {
+		return nil
+	}
+	return &responseCache{size: size, nodes: make(map[string]phatdb.DataNode)}
+}
+
+// treePath returns p as the tree sees it: one leading slash, no trailing one. Unlike
+// path.Clean, it leaves ".." alone, since that's just a name to the tree
+func treePath(p string) string {
+	return "/" + strings.Join(phatdb.GetNodePath(p), "/")
+}
+
+// cachePath returns the absolute path of the node a cacheable command reads
+func cachePath(args *phatdb.DBCommand) (string, bool) {
+	if args.Command != "GET" && args.Command != "STAT" {
+		return "", false
+	}
+	return treePath(args.Root + "/" + args.Path), true
+}
+
+// lookup returns the reply to args from the cache if it can. Otherwise it returns the
+// generation to pass to store along with the database's reply
+func (c *responseCache) lookup(args *phatdb.DBCommand) (*phatdb.DBResponse, uint64, bool) {
+	p, ok := cachePath(args)
+	if !ok {
+		return nil, 0, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n, ok := c.nodes[p]
+	if !ok {
+		cacheMisses.Add(1)
+		return nil, c.gen, false
+	}
+	cacheHits.Add(1)
+	n = copyNode(n)
+	if args.Command == "STAT" {
+		return &phatdb.DBResponse{Reply: *n.Stats}, 0, true
+	}
+	return &phatdb.DBResponse{Reply: &n}, 0, true
+}
+
+// store keeps the node in the database's reply to a GET, unless something's been dropped
+// since lookup returned gen
+func (c *responseCache) store(args *phatdb.DBCommand, gen uint64, resp *phatdb.DBResponse) {
+	p, ok := cachePath(args)
+	if !ok || args.Command != "GET" || resp.Error != "" {
+		return
+	}
+	n, ok := resp.Reply.(*phatdb.DataNode)
+	if !ok || n == nil || n.Stats == nil || len(n.ACL) > 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.gen != gen {
+		return
+	}
+	if _, ok := c.nodes[p]; !ok && len(c.nodes) >= c.size {
+		// make room: which one goes doesn't matter much
+		for victim := range c.nodes {
+			delete(c.nodes, victim)
+			break
+		}
+	}
+	c.nodes[p] = copyNode(*n)
+}
+
+// changed drops what a write changed: the node, everything under it, and its parent
+func (c *responseCache) changed(change phatdb.Change) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gen++
+	delete(c.nodes, change.Path)
+	parts := phatdb.GetNodePath(change.Path)
+	if len(parts) > 0 {
+		delete(c.nodes, treePath(strings.Join(parts[:len(parts)-1], "/")))
+	}
+	prefix := strings.TrimSuffix(change.Path, "/") + "/"
+	for p := range c.nodes {
+		if strings.HasPrefix(p, prefix) {
+			delete(c.nodes, p)
+		}
+	}
+}
+
+// clear drops everything, e.g. once the database has been replaced by a snapshot
+func (c *responseCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gen++
+	c.nodes = make(map[string]phatdb.DataNode)
+}
+
+// copyNode copies n deeply enough that neither the tree nor a reply being encoded can
+// change the copy
+func copyNode(n phatdb.DataNode) phatdb.DataNode {
+	n.Value = append([]byte(nil), n.Value...)
+	if n.Stats != nil {
+		stats := *n.Stats
+		n.Stats = &stats
+	}
+	n.ACL = append([]phatdb.ACL(nil), n.ACL...)
+	return n
+}
+
+// cachedRead sends a read to the database (see read), unless the cache can answer it,
+// and returns the reply
+func (s *Server) cachedRead(req phatdb.DBCommandWithChannel) *phatdb.DBResponse {
+	var gen uint64
+	if s.cache != nil {
+		resp, g, ok := s.cache.lookup(req.Cmd)
+		if ok {
+			return resp
+		}
+		gen = g
+	}
+	s.read(req)
+	resp := <-req.Done
+	if s.cache != nil {
+		s.cache.store(req.Cmd, gen, resp)
+	}
+	return resp
+}
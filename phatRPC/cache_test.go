@@ -0,0 +1,90 @@
+package phatRPC
+
+import (
+	"github.com/mgentili/goPhat/phatdb"
+	"testing"
+)
+
+func TestResponseCache(t *testing.T) {
+	if newResponseCache(0) != nil {
+		t.Errorf("Expected no cache without a size")
+	}
+	c := newResponseCache(2)
+	get := &phatdb.DBCommand{Command: "GET", Path: "/a/b"}
+	stat := &phatdb.DBCommand{Command: "STAT", Root: "/a", Path: "b"}
+	node := &phatdb.DataNode{Value: []byte("1"), Stats: &phatdb.StatNode{Version: 1}}
+
+	_, gen, ok := c.lookup(get)
+	if ok {
+		t.Fatalf("Expected an empty cache to miss")
+	}
+	c.store(get, gen, &phatdb.DBResponse{Reply: node})
+	// the tree changing under the cache doesn't change what's cached
+	node.Value[0] = '2'
+	if resp, _, ok := c.lookup(get); !ok || string(resp.Reply.(*phatdb.DataNode).Value) != "1" {
+		t.Errorf("Expected a GET to hit, got %#v", resp)
+	}
+	if resp, _, ok := c.lookup(stat); !ok || resp.Reply.(phatdb.StatNode).Version != 1 {
+		t.Errorf("Expected a STAT of the same node to hit, got %#v", resp)
+	}
+
+	// writes to the node, its parent's list of children, or anything above it drop it
+	for _, changed := range []string{"/a/b", "/a/b/c", "/a"} {
+		_, gen, _ := c.lookup(&phatdb.DBCommand{Command: "GET", Path: "/x"})
+		c.store(get, gen, &phatdb.DBResponse{Reply: node})
+		c.changed(phatdb.Change{Command: "SET", Path: changed})
+		if _, _, ok := c.lookup(get); ok {
+			t.Errorf("Expected a write to %s to drop /a/b", changed)
+		}
+	}
+	_, gen, _ = c.lookup(get)
+	c.store(get, gen, &phatdb.DBResponse{Reply: node})
+	c.changed(phatdb.Change{Command: "SET", Path: "/a/bc"})
+	if _, _, ok := c.lookup(get); !ok {
+		t.Errorf("Expected a write to /a/bc to leave /a/b alone")
+	}
+
+	// a read that was under way during a write doesn't get cached
+	_, gen, _ = c.lookup(&phatdb.DBCommand{Command: "GET", Path: "/other"})
+	c.changed(phatdb.Change{Command: "SET", Path: "/other"})
+	c.store(&phatdb.DBCommand{Command: "GET", Path: "/other"}, gen, &phatdb.DBResponse{Reply: node})
+	if _, _, ok := c.lookup(&phatdb.DBCommand{Command: "GET", Path: "/other"}); ok {
+		t.Errorf("Expected a read from before a write not to be cached")
+	}
+
+	// nodes with ACLs aren't cached
+	c.clear()
+	secret := &phatdb.DBCommand{Command: "GET", Path: "/secret"}
+	_, gen, _ = c.lookup(secret)
+	c.store(secret, gen, &phatdb.DBResponse{Reply: &phatdb.DataNode{Stats: &phatdb.StatNode{}, ACL: []phatdb.ACL{{"digest", "alice", phatdb.PERM_ALL}}}})
+	if _, _, ok := c.lookup(secret); ok {
+		t.Errorf("Expected a node with an ACL not to be cached")
+	}
+
+	// it doesn't grow past its size
+	for _, p := range []string{"/1", "/2", "/3"} {
+		cmd := &phatdb.DBCommand{Command: "GET", Path: p}
+		_, gen, _ := c.lookup(cmd)
+		c.store(cmd, gen, &phatdb.DBResponse{Reply: node})
+	}
+	if len(c.nodes) != 2 {
+		t.Errorf("Expected 2 nodes cached, got %d", len(c.nodes))
+	}
+}
+
+func TestResponseCacheContainers(t *testing.T) {
+	// deleting a container's last child takes the container too, which changes its parent
+	db := phatdb.NewDatabase()
+	c := newResponseCache(10)
+	db.OnChange("/", c.changed)
+	db.Apply(&phatdb.DBCommand{Command: "CREATE", Path: "/a"})
+	db.Apply(&phatdb.DBCommand{Command: "CREATE", Path: "/a/c", Flags: phatdb.CONTAINER})
+	db.Apply(&phatdb.DBCommand{Command: "CREATE", Path: "/a/c/x"})
+	get := &phatdb.DBCommand{Command: "GET", Path: "/a"}
+	_, gen, _ := c.lookup(get)
+	c.store(get, gen, db.Apply(get))
+	db.Apply(&phatdb.DBCommand{Command: "DELETE", Path: "/a/c/x"})
+	if resp, _, ok := c.lookup(&phatdb.DBCommand{Command: "STAT", Path: "/a"}); ok {
+		t.Errorf("Expected emptying /a/c to drop /a, got %#v", resp.Reply)
+	}
+}
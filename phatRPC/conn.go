@@ -0,0 +1,77 @@
+package phatRPC
+
+import (
+	"errors"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"sync"
+
+	"github.com/mgentili/goPhat/phatdb"
+	"github.com/mgentili/goPhat/vr"
+)
+
+// what a call gets if its client has gone by the time it'd have replied (not that
+// anyone will see it)
+var errClientGone = errors.New("client disconnected")
+
+// serverCodec makes the codec calls on a client connection are encoded with
+type serverCodec func(conn io.ReadWriteCloser) rpc.ServerCodec
+
+// gob on the main listener, JSON-RPC 1.0 on Config.JSONAddress's (see phatdb/json.go
+// for how commands and responses are encoded)
+func gobCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return vr.NewGobServerCodec(conn)
+}
+
+func jsonCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return jsonrpc.NewServerCodec(conn)
+}
+
+// connCodec is the codec for one client connection. Besides encoding calls, it notices
+// when the client's gone, so calls waiting on VR can stop waiting for it
+type connCodec struct {
+	rpc.ServerCodec
+	s        *Server
+	gone     chan struct{}
+	goneOnce sync.Once
+	method   string // of the request being read
+}
+
+func (s *Server) newConnCodec(conn io.ReadWriteCloser, codec serverCodec) *connCodec {
+	return &connCodec{ServerCodec: codec(conn), s: s, gone: make(chan struct{})}
+}
+
+func (c *connCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.ServerCodec.ReadRequestHeader(r)
+	c.method = r.ServiceMethod
+	if err != nil {
+		// net/rpc stops reading once this fails, which it only does once the
+		// connection's closed (or garbled, which is as good as closed)
+		c.goneOnce.Do(func() { close(c.gone) })
+	}
+	return err
+}
+
+func (c *connCodec) ReadRequestBody(body interface{}) error {
+	err := c.ServerCodec.ReadRequestBody(body)
+	if cmd, ok := body.(*phatdb.DBCommand); ok && err == nil && c.method == "Server.RPCDB" {
+		c.s.callConns.Store(cmd, c.gone)
+	}
+	return err
+}
+
+// clientGone returns a channel that's closed once the client that sent args has gone,
+// or nil if it didn't come over a client connection. RPCDB calls forgetCall once it's
+// done with it
+func (s *Server) clientGone(args *phatdb.DBCommand) <-chan struct{} {
+	gone, ok := s.callConns.Load(args)
+	if !ok {
+		return nil
+	}
+	return gone.(chan struct{})
+}
+
+func (s *Server) forgetCall(args *phatdb.DBCommand) {
+	s.callConns.Delete(args)
+}
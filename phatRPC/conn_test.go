@@ -0,0 +1,46 @@
+package phatRPC
+
+import (
+	"github.com/mgentili/goPhat/phatdb"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+// goneWaiter's RPCDB waits for its client to go
+type goneWaiter struct {
+	s      *Server
+	waited chan bool
+}
+
+func (w *goneWaiter) RPCDB(args *phatdb.DBCommand, reply *phatdb.DBResponse) error {
+	defer w.s.forgetCall(args)
+	select {
+	case <-w.s.clientGone(args):
+		w.waited <- true
+	case <-time.After(5 * time.Second):
+		w.waited <- false
+	}
+	return nil
+}
+
+func TestClientGone(t *testing.T) {
+	s := &Server{}
+	waiter := &goneWaiter{s, make(chan bool, 1)}
+	server := rpc.NewServer()
+	server.RegisterName("Server", waiter)
+	serverConn, clientConn := net.Pipe()
+	go server.ServeCodec(s.newConnCodec(serverConn, gobCodec))
+	conn := rpc.NewClient(clientConn)
+	conn.Go("Server.RPCDB", &phatdb.DBCommand{Command: "SET"}, &phatdb.DBResponse{}, nil)
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	if !<-waiter.waited {
+		t.Errorf("Expected the call to hear that its client had gone")
+	}
+	s.callConns.Range(func(key, value interface{}) bool {
+		t.Errorf("Expected the call to have been forgotten")
+		return false
+	})
+}
@@ -0,0 +1,112 @@
+package phatRPC
+
+import (
+	"errors"
+	"github.com/mgentili/goPhat/phatdb"
+	"sync"
+)
+
+// how many of each session's latest numbered writes the servers remember the replies to,
+// to answer retries of them with
+var DedupWindow = 128
+
+// a numbered write was sent again after the servers stopped remembering it
+var ErrOldRequest = errors.New("request is too old to tell if it's a retry")
+
+type requestKey struct {
+	session string
+	seq     uint64
+}
+
+// dedupTable holds the replies to sessions' numbered writes (see
+// phatdb.DBCommand.SeqNumber), so a retry of one that's been committed gets the same
+// reply rather than being run again. Replies are recorded as commands commit, on every
+// replica, so a new master has them too (though a replica brought up to date from a
+// snapshot only has the ones committed since)
+type dedupTable struct {
+	lock    sync.Mutex
+	replies map[string]map[uint64]*phatdb.DBResponse
+	// writes the master is running, so a retry can wait for the original to finish
+	running map[requestKey]chan struct{}
+}
+
+func newDedupTable() *dedupTable {
+	return &dedupTable{
+		replies: make(map[string]map[uint64]*phatdb.DBResponse),
+		running: make(map[requestKey]chan struct{}),
+	}
+}
+
+// oldest returns the lowest numbered write of the session's that's remembered
+func oldest(replies map[uint64]*phatdb.DBResponse) uint64 {
+	var min uint64
+	for seq := range replies {
+		if min == 0 || seq < min {
+			min = seq
+		}
+	}
+	return min
+}
+
+// record remembers the reply to a numbered write as it commits
+func (d *dedupTable) record(cmd *phatdb.DBCommand, resp *phatdb.DBResponse) {
+	if cmd.SeqNumber == 0 || cmd.Session == "" {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	replies := d.replies[cmd.Session]
+	if replies == nil {
+		replies = make(map[uint64]*phatdb.DBResponse)
+		d.replies[cmd.Session] = replies
+	}
+	replies[cmd.SeqNumber] = resp
+	if len(replies) > DedupWindow {
+		delete(replies, oldest(replies))
+	}
+}
+
+// forget drops the replies to a session that's over
+func (d *dedupTable) forget(session string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.replies, session)
+}
+
+// start is called by the master before running a numbered write. If the write has been
+// committed already, it returns the reply; if it's being run, it waits for that to
+// finish first. Otherwise it returns nil, and finish must be called once the write has
+// been run
+func (d *dedupTable) start(session string, seq uint64) (*phatdb.DBResponse, error) {
+	key := requestKey{session, seq}
+	for {
+		d.lock.Lock()
+		replies := d.replies[session]
+		if resp, ok := replies[seq]; ok {
+			d.lock.Unlock()
+			return resp, nil
+		}
+		if len(replies) >= DedupWindow && seq < oldest(replies) {
+			d.lock.Unlock()
+			return nil, ErrOldRequest
+		}
+		running, ok := d.running[key]
+		if !ok {
+			d.running[key] = make(chan struct{})
+			d.lock.Unlock()
+			return nil, nil
+		}
+		d.lock.Unlock()
+		// the original may not commit (say we stop being master), so look again
+		<-running
+	}
+}
+
+// finish is called once a write start let through has been run
+func (d *dedupTable) finish(session string, seq uint64) {
+	key := requestKey{session, seq}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	close(d.running[key])
+	delete(d.running, key)
+}
@@ -0,0 +1,98 @@
+package phatRPC
+
+import (
+	"errors"
+	"github.com/mgentili/goPhat/phatdb"
+	"github.com/mgentili/goPhat/vr"
+	"sync"
+	"time"
+)
+
+// how many changed paths a watcher holds before giving up and telling the client to
+// drop everything
+const MAX_INVALIDATIONS = 1000
+
+// Invalidations is the reply to Server.Invalidations
+type Invalidations struct {
+	Paths []string // paths changed since the last call
+	Reset bool     // anything may have changed (e.g. we just became master), so start over
+}
+
+// watcher collects the paths changed for one client session between its Invalidations calls
+type watcher struct {
+	lock     sync.Mutex
+	paths    []string
+	reset    bool
+	notify   chan struct{}
+	cancel   func()
+	lastPoll time.Time
+}
+
+func (w *watcher) changed(c phatdb.Change) {
+	w.lock.Lock()
+	if len(w.paths) >= MAX_INVALIDATIONS {
+		w.paths = nil
+		w.reset = true
+	} else if !w.reset {
+		w.paths = append(w.paths, c.Path)
+	}
+	w.lock.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Invalidations waits for writes under args.Root (made by anyone) and replies with the
+// paths they changed, so clients can keep caches. A session's changes are collected
+// between calls, so nothing is missed as long as it keeps calling; the first call, and
+// any after the session's been idle for 2 * WATCH_TIMEOUT, reply with Reset instead
+func (s *Server) Invalidations(args *phatdb.DBCommand, reply *Invalidations) error {
+	if s.ReplicaServer.Rstate.Status != vr.Normal {
+		return errors.New("Master Failover")
+	}
+	if !s.ReplicaServer.IsMaster() {
+		return s.notMaster()
+	}
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.calls.Done()
+	s.confine(args)
+	s.watchersLock.Lock()
+	now := time.Now()
+	for session, w := range s.watchers {
+		if now.Sub(w.lastPoll) > 2*WATCH_TIMEOUT {
+			w.cancel()
+			delete(s.watchers, session)
+		}
+	}
+	w, ok := s.watchers[args.Session]
+	if !ok {
+		w = &watcher{notify: make(chan struct{}, 1)}
+		w.cancel = s.db.OnChange(args.Root, w.changed)
+		s.watchers[args.Session] = w
+	}
+	w.lastPoll = now
+	s.watchersLock.Unlock()
+	if !ok {
+		reply.Reset = true
+		return nil
+	}
+
+	timeout := time.NewTimer(WATCH_TIMEOUT)
+	defer timeout.Stop()
+	select {
+	case <-w.notify:
+	case <-timeout.C:
+	case <-s.done:
+	}
+	w.lock.Lock()
+	reply.Paths, reply.Reset = w.paths, w.reset
+	w.paths, w.reset = nil, false
+	w.lock.Unlock()
+	s.watchersLock.Lock()
+	w.lastPoll = time.Now()
+	s.watchersLock.Unlock()
+	return nil
+}
@@ -0,0 +1,80 @@
+package phatRPC
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/mgentili/goPhat/client"
+	"github.com/mgentili/goPhat/phatdb"
+	"github.com/mgentili/goPhat/vr"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestJSONAddress(t *testing.T) {
+	if vr.NREPLICAS == 0 {
+		vr.NREPLICAS = 3
+	}
+	address, jsonAddress := "127.0.0.1:9394", "127.0.0.1:9395"
+	s, err := NewServer(address, &vr.Replica{}, Config{JSONAddress: jsonAddress})
+	if err != nil {
+		t.Fatalf("Couldn't start the server: %s", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	}()
+
+	// a Go client speaking JSON gets typed replies, as it would with gob
+	conn, err := net.Dial("tcp", jsonAddress)
+	if err != nil {
+		t.Fatalf("Couldn't connect: %s", err)
+	}
+	rpcConn := rpc.NewClientWithCodec(client.JSONCodec(conn))
+	defer rpcConn.Close()
+	reply := &phatdb.DBResponse{}
+	if err := rpcConn.Call("Server.RPCDB", &phatdb.DBCommand{Command: "EXISTS", Path: "/", Stale: true}, reply); err != nil {
+		t.Fatalf("EXISTS over JSON failed: %s", err)
+	}
+	if exists, ok := reply.Reply.(bool); !ok || !exists {
+		t.Errorf("Expected / to exist, got %#v", reply)
+	}
+
+	// and so does anyone writing JSON by hand
+	raw, err := net.Dial("tcp", jsonAddress)
+	if err != nil {
+		t.Fatalf("Couldn't connect: %s", err)
+	}
+	defer raw.Close()
+	raw.Write([]byte(`{"method": "Server.RPCDB", "params": [{"Command": "EXISTS", "Path": "/nothing", "Stale": true}], "id": 1}` + "\n"))
+	var resp struct {
+		Id     int
+		Result struct {
+			Reply bool
+			Type  string
+			Error string
+			Code  phatdb.ErrorCode
+		}
+		Error interface{}
+	}
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := json.NewDecoder(bufio.NewReader(raw)).Decode(&resp); err != nil {
+		t.Fatalf("Couldn't read the reply: %s", err)
+	}
+	if resp.Id != 1 || resp.Error != nil || resp.Result.Reply || resp.Result.Type != "bool" || resp.Result.Code != phatdb.CodeOK {
+		t.Errorf("Expected /nothing not to exist, got %+v", resp)
+	}
+
+	// the gob listener's still there
+	gobConn, err := rpc.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Couldn't connect: %s", err)
+	}
+	defer gobConn.Close()
+	if err := gobConn.Call("Server.RPCDB", &phatdb.DBCommand{Command: "EXISTS", Path: "/", Stale: true}, reply); err != nil || reply.Reply != true {
+		t.Errorf("Expected / to exist, got %v %v", reply, err)
+	}
+}
@@ -0,0 +1,35 @@
+package phatRPC
+
+import (
+	"github.com/mgentili/goPhat/client"
+	"github.com/mgentili/goPhat/vr"
+	"testing"
+)
+
+func TestMasterInfo(t *testing.T) {
+	if vr.NREPLICAS == 0 {
+		vr.NREPLICAS = 3
+	}
+	r := &vr.Replica{}
+	r.Rstate.ReplicaNumber = 2
+	r.SetClientAddresses([]string{"a:1", "b:1"}, "c:1")
+	s := &Server{ReplicaServer: r}
+	for view := uint(0); view < 2*vr.NREPLICAS; view++ {
+		r.Rstate.View = view
+		master := s.masterInfo()
+		if master.Id != view%vr.NREPLICAS || master.View != view || master.Address != r.ClientAddresses[master.Id] {
+			t.Errorf("Unexpected master %+v in view %d", master, view)
+		}
+		// clients find their way from the redirect
+		if redirect, ok := client.ParseRedirect(s.notMaster()); !ok || redirect != master {
+			t.Errorf("Expected to be redirected to %+v, got %+v", master, redirect)
+		}
+	}
+
+	// unknown addresses are left for the client to work out
+	r.SetClientAddresses(nil, "c:1")
+	r.Rstate.View = 0
+	if address := r.MasterAddress(); address != "" {
+		t.Errorf("Expected replica 0's address to be unknown, got %q", address)
+	}
+}
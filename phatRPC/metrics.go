@@ -0,0 +1,164 @@
+package phatRPC
+
+import (
+	"expvar"
+	"fmt"
+	"github.com/mgentili/goPhat/client"
+	"github.com/mgentili/goPhat/phatdb"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metrics are published through expvar, alongside the database's, so servers can serve
+// them at /debug/vars, or for Prometheus, at /metrics
+var (
+	requestCount   = expvar.NewMap("phatrpc_requests")
+	requestErrors  = expvar.NewMap("phatrpc_request_errors")
+	requestLatency = expvar.NewMap("phatrpc_request_latency")
+	redirectCount  = expvar.NewInt("phatrpc_redirects")
+	forwardCount   = expvar.NewInt("phatrpc_forwards")
+	callsInFlight  = expvar.NewInt("phatrpc_calls_in_flight")
+	opsPending     = expvar.NewInt("phatrpc_ops_pending")
+	cacheHits      = expvar.NewInt("phatrpc_cache_hits")
+	cacheMisses    = expvar.NewInt("phatrpc_cache_misses")
+	commitWait     = &phatdb.Histogram{Bounds: client.LatencyBuckets}
+	latencyLock    sync.Mutex
+)
+
+func init() {
+	expvar.Publish("phatrpc_commit_wait", commitWait)
+}
+
+// what Prometheus is told each metric is (histograms it can tell for itself; anything
+// else is untyped)
+var metricTypes = map[string]string{
+	"phatdb_commands":         "counter",
+	"phatdb_command_errors":   "counter",
+	"phatdb_nodes":            "gauge",
+	"phatdb_bytes":            "gauge",
+	"phatrpc_requests":        "counter",
+	"phatrpc_request_errors":  "counter",
+	"phatrpc_redirects":       "counter",
+	"phatrpc_forwards":        "counter",
+	"phatrpc_calls_in_flight": "gauge",
+	"phatrpc_ops_pending":     "gauge",
+	"phatrpc_cache_hits":      "counter",
+	"phatrpc_cache_misses":    "counter",
+}
+
+// the label a map's keys go under for Prometheus ("key" if it isn't here)
+var metricLabels = map[string]string{
+	"phatdb_commands":         "command",
+	"phatdb_command_errors":   "command",
+	"phatdb_command_latency":  "command",
+	"phatrpc_requests":        "command",
+	"phatrpc_request_errors":  "command",
+	"phatrpc_request_latency": "command",
+}
+
+var metricName = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+// recordRequest counts an RPCDB call and how long it took
+func recordRequest(command string, reply *phatdb.DBResponse, err error, took time.Duration) {
+	requestCount.Add(command, 1)
+	if err != nil || reply.Error != "" {
+		requestErrors.Add(command, 1)
+	}
+	latencyLock.Lock()
+	h, ok := requestLatency.Get(command).(*phatdb.Histogram)
+	if !ok {
+		h = &phatdb.Histogram{Bounds: client.LatencyBuckets}
+		requestLatency.Set(command, h)
+	}
+	latencyLock.Unlock()
+	h.Observe(took)
+}
+
+// metricsHandler serves the metrics as JSON at /debug/vars and in Prometheus's text
+// format at /metrics
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheus(w)
+	})
+	return mux
+}
+
+// writePrometheus writes every published integer, float, map of them and histogram
+func writePrometheus(w io.Writer) {
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !metricName.MatchString(kv.Key) {
+			return
+		}
+		switch v := kv.Value.(type) {
+		case *phatdb.Histogram:
+			fmt.Fprintf(w, "# TYPE %s histogram\n", kv.Key)
+			writeHistogram(w, kv.Key, "", v)
+		case *expvar.Int, *expvar.Float:
+			writeType(w, kv.Key)
+			fmt.Fprintf(w, "%s %s\n", kv.Key, v)
+		case *expvar.Map:
+			label, ok := metricLabels[kv.Key]
+			if !ok {
+				label = "key"
+			}
+			typed := false
+			v.Do(func(entry expvar.KeyValue) {
+				labels := label + "=" + strconv.Quote(entry.Key)
+				switch value := entry.Value.(type) {
+				case *phatdb.Histogram:
+					if !typed {
+						fmt.Fprintf(w, "# TYPE %s histogram\n", kv.Key)
+						typed = true
+					}
+					writeHistogram(w, kv.Key, labels, value)
+				case *expvar.Int, *expvar.Float:
+					if !typed {
+						writeType(w, kv.Key)
+						typed = true
+					}
+					fmt.Fprintf(w, "%s{%s} %s\n", kv.Key, labels, value)
+				}
+			})
+		}
+	})
+}
+
+func writeType(w io.Writer, name string) {
+	t, ok := metricTypes[name]
+	if !ok {
+		t = "untyped"
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, t)
+}
+
+// writeHistogram writes h's buckets (counting up, as Prometheus wants), sum and count,
+// in seconds
+func writeHistogram(w io.Writer, name string, labels string, h *phatdb.Histogram) {
+	bounds, counts, sum := h.Buckets()
+	prefix := ""
+	if labels != "" {
+		prefix = labels + ","
+	}
+	var total int64
+	for i, n := range counts {
+		total += n
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(bounds[i].Seconds(), 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=%q} %d\n", name, prefix, le, total)
+	}
+	braced := ""
+	if labels != "" {
+		braced = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, braced, sum.Seconds())
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braced, total)
+}
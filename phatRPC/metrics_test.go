@@ -0,0 +1,40 @@
+package phatRPC
+
+import (
+	"bytes"
+	"errors"
+	"github.com/mgentili/goPhat/phatdb"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	recordRequest("PROM_TEST", &phatdb.DBResponse{}, nil, 2*time.Millisecond)
+	recordRequest("PROM_TEST", &phatdb.DBResponse{Error: "no"}, nil, 2*time.Millisecond)
+	recordRequest("PROM_TEST", &phatdb.DBResponse{}, errors.New("gone"), time.Minute)
+
+	var buf bytes.Buffer
+	writePrometheus(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE phatrpc_requests counter",
+		`phatrpc_requests{command="PROM_TEST"} 3`,
+		`phatrpc_request_errors{command="PROM_TEST"} 2`,
+		"# TYPE phatrpc_request_latency histogram",
+		`phatrpc_request_latency_bucket{command="PROM_TEST",le="0.001"} 0`,
+		`phatrpc_request_latency_bucket{command="PROM_TEST",le="0.01"} 2`,
+		`phatrpc_request_latency_bucket{command="PROM_TEST",le="+Inf"} 3`,
+		`phatrpc_request_latency_count{command="PROM_TEST"} 3`,
+		"# TYPE phatrpc_calls_in_flight gauge",
+		"# TYPE phatrpc_commit_wait histogram",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected %q in the metrics, got:\n%s", line, out)
+		}
+	}
+	// expvar's own non-numeric vars aren't metrics
+	if strings.Contains(out, "cmdline") || strings.Contains(out, "memstats") {
+		t.Errorf("Expected only numbers in the metrics, got:\n%s", out)
+	}
+}
@@ -1,19 +1,40 @@
 package phatRPC
 
 import (
+	"crypto/tls"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"github.com/mgentili/goPhat/client"
 	"github.com/mgentili/goPhat/level_log"
 	"github.com/mgentili/goPhat/phatdb"
 	"github.com/mgentili/goPhat/vr"
+	"io"
 	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"sync"
+	"time"
 )
 
 const DEBUG = 0
 
+// how often the master checks for expired TTL nodes
+const EXPIRE_INTERVAL = time.Second
+
+// how long a non-master waits for the master to answer a write it's forwarded
+const FORWARD_TIMEOUT = 10 * time.Second
+
+// how often the master checks for sessions that haven't been renewed in time
+const SESSION_CHECK_INTERVAL = time.Second
+
+// how often the master checks for tombstones older than phatdb.TombstoneRetention
+const TOMBSTONE_GC_INTERVAL = time.Minute
+
+// how long WatchExists holds a call open before replying false (clients just call again)
+const WATCH_TIMEOUT = 30 * time.Second
+
 var RPC_log *level_log.Logger
 
 /* special object just for RPC calls, so that other methods
@@ -27,6 +48,99 @@ type Server struct {
 	ReplicaServer   *vr.Replica
 	InputChan       chan phatdb.DBCommandWithChannel
 	ClientListeners map[int](chan int)
+	db              *phatdb.Database
+	// by session, for Invalidations
+	watchers     map[string]*watcher
+	watchersLock sync.Mutex
+	// the last write number each session has told us of (see AttachSession)
+	sessions     map[string]uint64
+	sessionsLock sync.Mutex
+	// replies to committed writes, for answering retries
+	dedup         *dedupTable
+	forwardWrites bool
+	admission     *admission
+	batcher       *readBatcher
+	cache         *responseCache
+	auditLog      *auditLog
+	tenants       map[string]Tenant
+	tenantIds     map[string]string // which tenant each identity belongs to
+	admins        map[string]bool
+	// the connection each RPCDB call came over (see connCodec)
+	callConns   sync.Map
+	rateLimiter *rateLimiter
+	rpcServer   *rpc.Server
+	// what Shutdown has to stop
+	listener        net.Listener
+	jsonListener    net.Listener
+	metricsListener net.Listener
+	adminListener   net.Listener
+	conns           map[net.Conn]bool
+	connsLock       sync.Mutex
+	calls           sync.WaitGroup // client calls using the database
+	background      sync.WaitGroup // expireNodes and purgeTombstones
+	shuttingDown    bool           // guarded by connsLock
+	done            chan struct{}  // closed as Shutdown starts
+	// set once Shutdown has cut us off from the replica; guards InputChan for VR
+	detached   bool
+	detachLock sync.RWMutex
+}
+
+// Config holds the optional settings for StartServerWithConfig
+type Config struct {
+	// where the database persists its tree (defaults to only keeping it in memory)
+	Storage phatdb.Storage
+	// if set, serve the server's and database's metrics over HTTP on this address, as
+	// JSON at /debug/vars (as expvar does) and for Prometheus at /metrics
+	MetricsAddress string
+	// if set, serve the admin endpoints (see admin.go) over HTTP on this address
+	AdminAddress string
+	// where clients reach each replica, by replica number, so servers can tell clients
+	// where the master is when redirecting them. Without it, only the master's own
+	// address (as given to StartServerWithConfig) is known
+	ClientAddresses []string
+	// if set, a server that isn't the master passes writes on to the master (over the
+	// replica network) and relays the reply, rather than redirecting the client, for
+	// clients that can't pick which server they talk to (e.g. behind a load balancer)
+	ForwardWrites bool
+	// the most RPCDB calls the server handles at once, and the most commands it has
+	// waiting on VR at once (0 means no limit). Calls over either limit are turned away
+	// with client.ServerBusyFor(BusyRetryAfter), which defaults to
+	// DEFAULT_BUSY_RETRY_AFTER
+	MaxCalls       int
+	MaxPendingOps  int
+	BusyRetryAfter time.Duration
+	// limits on how often each client can call RPCDB, and for particular clients, by
+	// identity ("scheme:id" of the first identity they authenticate as, or their session
+	// if they haven't). Calls over the limit are turned away with client.ServerBusyFor
+	RateLimits       RateLimits
+	ClientRateLimits map[string]RateLimits
+	// the teams sharing the deployment, by name (see Tenant). Clients that aren't in any
+	// tenant see the whole tree, as usual
+	Tenants map[string]Tenant
+	// the identities ("scheme:id", proven with AUTH) of the clients allowed to administer
+	// the root (see phatdb.Admin), e.g. to turn on read-only mode
+	Admins []string
+	// if set, clients connect over TLS with this configuration (which needs at least a
+	// certificate), so what they read and write isn't sent in the clear. The replica
+	// network and the metrics and admin endpoints aren't affected
+	TLS *tls.Config
+	// if set, reads that arrive within this long of each other are sent to the database
+	// together, at most ReadBatchSize (by default DEFAULT_READ_BATCH_SIZE) at a time.
+	// This makes each read wait up to ReadBatchWindow longer, but takes load off the
+	// database's command loop when there are many of them
+	ReadBatchWindow time.Duration
+	ReadBatchSize   int
+	// if set, keep up to this many nodes that are read often in memory, so GETs and
+	// STATs of them don't have to wait their turn in the database (see cache.go)
+	ResponseCacheSize int
+	// if set, every write is recorded here as it's committed (or turned away before
+	// then), as a line of JSON (see AuditRecord), so who changed what can be worked
+	// out later. Each replica records the writes it commits, wherever they came from
+	AuditLog io.Writer
+	// if set, also serve clients on this address with JSON-RPC 1.0 (net/rpc/jsonrpc)
+	// rather than gob, for scripts and clients not written in Go (see phatdb/json.go for
+	// how commands and responses look). It uses TLS too if TLS is set
+	JSONAddress string
 }
 
 type Null struct{}
@@ -36,14 +150,36 @@ type CommandFunctor struct {
 	Command phatdb.DBCommandWithChannel
 }
 
+// TraceID makes the command's trace id show up in VR's log lines about it
+func (c CommandFunctor) TraceID() string {
+	return c.Command.Cmd.TraceID
+}
+
 func (c CommandFunctor) CommitFunc(context interface{}) {
 	server := context.(*Server)
 	argsWithChannel := c.Command
+	server.detachLock.RLock()
+	defer server.detachLock.RUnlock()
+	if server.detached {
+		if argsWithChannel.Done != nil {
+			argsWithChannel.Done <- &phatdb.DBResponse{Error: ErrShutdown.Error(), Code: phatdb.CodeOther}
+		}
+		return
+	}
+	// the command itself lives in the log, so stamp the op number on a copy
+	// (we're called with the commit lock held, so this commit is the next one)
+	cmd := *argsWithChannel.Cmd
+	cmd.OpNumber = uint64(server.ReplicaServer.Rstate.CommitNumber + 1)
 	// we make our own DBCommandWithChannel so we (VR) can make sure the DB has committed before continuing on
-	newArgsWithChannel := phatdb.DBCommandWithChannel{argsWithChannel.Cmd, make(chan *phatdb.DBResponse)}
+	newArgsWithChannel := phatdb.DBCommandWithChannel{&cmd, make(chan *phatdb.DBResponse)}
 	server.InputChan <- newArgsWithChannel
 	// wait til the DB has actually committed the transaction
 	result := <-newArgsWithChannel.Done
+	server.dedup.record(&cmd, result)
+	server.audit(&cmd, result)
+	if (cmd.Command == "CLOSE_SESSION" || cmd.Command == "EXPIRE_SESSION") && result.Error == "" {
+		server.forgetSession(cmd.Session)
+	}
 	// and pass the result along to the server-side RPC
 	// (if we're not master .Done will be nil since channels aren't passed over RPC)
 	if argsWithChannel.Done != nil {
@@ -51,16 +187,159 @@ func (c CommandFunctor) CommitFunc(context interface{}) {
 	}
 }
 
+// SnapshotFunc serializes the database for VR's snapshots
+func SnapshotFunc(context interface{}, snapshotIndex func() uint) ([]byte, uint, error) {
+	s := context.(*Server)
+	// hold off commits so the index we report matches the serialized tree exactly
+	s.ReplicaServer.CommitLock.Lock()
+	s.detachLock.RLock()
+	defer s.detachLock.RUnlock()
+	if s.detached {
+		s.ReplicaServer.CommitLock.Unlock()
+		return nil, 0, ErrShutdown
+	}
+	index := snapshotIndex()
+	argsWithChannel := phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "SNAPSHOT"}, make(chan *phatdb.DBResponse)}
+	s.InputChan <- argsWithChannel
+	result := <-argsWithChannel.Done
+	s.ReplicaServer.CommitLock.Unlock()
+
+	if result.Error != "" {
+		return nil, 0, errors.New(result.Error)
+	}
+	return result.Reply.([]byte), index, nil
+}
+
+// ForwardFunc handles a write forwarded to us by a replica that isn't the master (see
+// Config.ForwardWrites)
+func ForwardFunc(context interface{}, request interface{}) (interface{}, error) {
+	s := context.(*Server)
+	args, ok := request.(phatdb.DBCommand)
+	if !ok {
+		return nil, errors.New("bad forwarded request")
+	}
+	reply := &phatdb.DBResponse{}
+	err := s.RPCDB(&args, reply)
+	return *reply, err
+}
+
+// LoadSnapshotFunc replaces the database with one serialized by SnapshotFunc
+func LoadSnapshotFunc(context interface{}, data []byte) error {
+	s := context.(*Server)
+	s.detachLock.RLock()
+	defer s.detachLock.RUnlock()
+	if s.detached {
+		return ErrShutdown
+	}
+	argsWithChannel := phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "LOAD_SNAPSHOT", Value: string(data)}, make(chan *phatdb.DBResponse)}
+	s.InputChan <- argsWithChannel
+
+	result := <-argsWithChannel.Done
+	if s.cache != nil {
+		s.cache.clear()
+	}
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+	return nil
+}
+
 func (s *Server) debug(level int, format string, args ...interface{}) {
 	str := fmt.Sprintf("%d: %s", s.ReplicaServer.Rstate.ReplicaNumber, format)
 	RPC_log.Printf(level, str, args...)
 }
 
-// startDB starts the database for the server
-func (s *Server) startDB() {
+// traceDebug is debug for a line about a client's command, tagged with its trace id
+func (s *Server) traceDebug(cmd *phatdb.DBCommand, level int, format string, args ...interface{}) {
+	if cmd.TraceID != "" {
+		format = "[" + cmd.TraceID + "] " + format
+	}
+	s.debug(level, format, args...)
+}
+
+// startDB starts the database for the server, rebuilding it from storage
+func (s *Server) startDB(store phatdb.Storage) error {
+	if store == nil {
+		store = phatdb.MemoryStorage{}
+	}
+	db, err := phatdb.OpenDatabase(store)
+	if err != nil {
+		return err
+	}
 	input := make(chan phatdb.DBCommandWithChannel)
 	s.InputChan = input
-	go phatdb.DatabaseServer(input)
+	s.db = db
+	go db.Serve(input)
+	s.background.Add(3)
+	go s.expireNodes()
+	go s.expireSessions()
+	go s.purgeTombstones()
+	return nil
+}
+
+// expireNodes periodically deletes expired TTL nodes while we're master. The deletion
+// goes through VR (with the master's time) so every replica deletes them at the same op
+func (s *Server) expireNodes() {
+	defer s.background.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(EXPIRE_INTERVAL):
+		}
+		if !s.ReplicaServer.IsMaster() {
+			continue
+		}
+		now := time.Now()
+		// only bother replicating if there's actually something to expire
+		check := phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "EXPIRED", Time: now}, make(chan *phatdb.DBResponse, 1)}
+		s.InputChan <- check
+		if expired, _ := (<-check.Done).Reply.([]string); len(expired) == 0 {
+			continue
+		}
+		expire := phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "EXPIRE", Time: now}, make(chan *phatdb.DBResponse, 1)}
+		if err := s.ReplicaServer.RunVR(CommandFunctor{expire}); err != nil {
+			s.debug(DEBUG, "Couldn't replicate the expiry: %v", err)
+			continue
+		}
+		result := <-expire.Done
+		s.debug(DEBUG, "Expired nodes %v", result.Reply)
+	}
+}
+
+// purgeTombstones periodically replicates a PURGE_TOMBSTONES while we're master, so every
+// replica forgets the same tombstones
+func (s *Server) purgeTombstones() {
+	defer s.background.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(TOMBSTONE_GC_INTERVAL):
+		}
+		if !s.ReplicaServer.IsMaster() {
+			continue
+		}
+		cutoff := time.Now().Add(-phatdb.TombstoneRetention)
+		// only bother replicating if there's actually something to purge
+		check := phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "TOMBSTONES", Path: "/"}, make(chan *phatdb.DBResponse, 1)}
+		s.InputChan <- check
+		stones, _ := (<-check.Done).Reply.([]phatdb.Tombstone)
+		old := false
+		for _, stone := range stones {
+			old = old || stone.Deleted.Before(cutoff)
+		}
+		if !old {
+			continue
+		}
+		purge := phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "PURGE_TOMBSTONES", Time: cutoff, Auth: []phatdb.Identity{phatdb.Admin}}, make(chan *phatdb.DBResponse, 1)}
+		if err := s.ReplicaServer.RunVR(CommandFunctor{purge}); err != nil {
+			s.debug(DEBUG, "Couldn't replicate the purge: %v", err)
+			continue
+		}
+		result := <-purge.Done
+		s.debug(DEBUG, "Purged tombstones %v", result.Reply)
+	}
 }
 
 func SetupRPCLog() {
@@ -74,22 +353,71 @@ func SetupRPCLog() {
 // startServer starts a TCP server that accepts client requests at the given port
 // and has information about the replica server
 func StartServer(address string, replica *vr.Replica) (*rpc.Server, error) {
+	return StartServerWithConfig(address, replica, Config{})
+}
+
+// StartServerWithConfig is StartServer with extra settings
+func StartServerWithConfig(address string, replica *vr.Replica, config Config) (*rpc.Server, error) {
+	s, err := NewServer(address, replica, config)
+	if err != nil {
+		return nil, err
+	}
+	return s.rpcServer, nil
+}
+
+// NewServer is StartServerWithConfig, returning the Server so it can be shut down
+func NewServer(address string, replica *vr.Replica, config Config) (*Server, error) {
 	SetupRPCLog()
+	if config.TLS != nil && len(config.TLS.Certificates) == 0 && config.TLS.GetCertificate == nil {
+		return nil, errors.New("TLS config has no certificate")
+	}
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return nil, err
 	}
+	if config.TLS != nil {
+		listener = tls.NewListener(listener, config.TLS)
+	}
 
 	serve := new(Server)
 	serve.ReplicaServer = replica
-	serve.startDB()
+	serve.watchers = make(map[string]*watcher)
+	serve.sessions = make(map[string]uint64)
+	serve.dedup = newDedupTable()
+	serve.listener = listener
+	serve.conns = make(map[net.Conn]bool)
+	serve.done = make(chan struct{})
+	replica.SetClientAddresses(config.ClientAddresses, address)
+	if err = serve.startDB(config.Storage); err != nil {
+		return nil, err
+	}
 	replica.Context = serve
+	replica.SnapshotFunc = SnapshotFunc
+	replica.LoadSnapshotFunc = LoadSnapshotFunc
+	// the master takes forwarded writes whether or not we forward them ourselves
+	replica.ForwardFunc = ForwardFunc
+	serve.forwardWrites = config.ForwardWrites
+	serve.admission = newAdmission(config)
+	serve.rateLimiter = newRateLimiter(config)
+	serve.batcher = newReadBatcher(serve.InputChan, config)
+	serve.cache = newResponseCache(config.ResponseCacheSize)
+	if serve.cache != nil {
+		serve.db.OnChange("/", serve.cache.changed)
+	}
+	serve.auditLog = newAuditLog(config.AuditLog)
+	serve.tenants = config.Tenants
+	serve.tenantIds = tenantsByIdentity(config.Tenants)
+	serve.admins = make(map[string]bool, len(config.Admins))
+	for _, id := range config.Admins {
+		serve.admins[id] = true
+	}
 
 	newServer := rpc.NewServer()
 	err = newServer.Register(serve)
 	if err != nil {
 		return nil, err
 	}
+	serve.rpcServer = newServer
 
 	// have to gob.Register this struct so we can pass it through RPC
 	// as a generic interface{} (I don't understand the details that well,
@@ -99,63 +427,367 @@ func StartServer(address string, replica *vr.Replica) (*rpc.Server, error) {
 	// Need to register all types that are returned within the DBResponse
 	gob.Register(phatdb.DataNode{})
 	gob.Register(phatdb.StatNode{})
+	gob.Register([]phatdb.ACL{})
+	gob.Register([]phatdb.DBResponse{})
+	gob.Register(phatdb.Quota{})
+	gob.Register([]phatdb.ListEntry{})
+	gob.Register([]phatdb.Tombstone{})
+	gob.Register([]phatdb.AuditEntry{})
+	gob.Register(phatdb.SessionInfo{})
+	// forwarded writes and their replies
+	gob.Register(phatdb.DBCommand{})
+	gob.Register(phatdb.DBResponse{})
+
+	if config.JSONAddress != "" {
+		jsonListener, err := net.Listen("tcp", config.JSONAddress)
+		if err != nil {
+			return nil, err
+		}
+		if config.TLS != nil {
+			jsonListener = tls.NewListener(jsonListener, config.TLS)
+		}
+		serve.jsonListener = jsonListener
+	}
+	if config.MetricsAddress != "" {
+		metricsListener, err := net.Listen("tcp", config.MetricsAddress)
+		if err != nil {
+			return nil, err
+		}
+		serve.metricsListener = metricsListener
+		go http.Serve(metricsListener, metricsHandler())
+	}
+	if config.AdminAddress != "" {
+		adminListener, err := net.Listen("tcp", config.AdminAddress)
+		if err != nil {
+			return nil, err
+		}
+		serve.adminListener = adminListener
+		go http.Serve(adminListener, serve.adminHandler())
+	}
 
 	serve.debug(DEBUG, "Server at %s trying to accept new client connections\n", address)
-	go newServer.Accept(listener)
+	go serve.accept(serve.listener, gobCodec)
+	if serve.jsonListener != nil {
+		go serve.accept(serve.jsonListener, jsonCodec)
+	}
 	//log.Println("Accepted new connection?")
-	return newServer, nil
+	return serve, nil
+}
+
+// Hello tells a client what protocol versions and features the server has, and fails
+// if it doesn't speak any version the client does
+func (s *Server) Hello(args *client.Hello, reply *client.Hello) error {
+	*reply = s.hello()
+	_, err := client.Negotiate(*reply, *args)
+	return err
+}
+
+// hello is what the server says about itself in reply to Hello
+func (s *Server) hello() client.Hello {
+	features := []string{client.FeatureWatches, client.FeatureSessions, client.FeaturePing}
+	if s.forwardWrites {
+		features = append(features, client.FeatureForwarding)
+	}
+	return client.LocalHello(features...)
 }
 
-// GetMaster returns the address of the current master replica
-func (s *Server) GetMaster(args *Null, reply *uint) error {
+// Ping says how the server is, cheaply: its role, view and commit number, and the time
+func (s *Server) Ping(args *Null, reply *client.PingReply) error {
+	r := s.ReplicaServer
+	*reply = client.PingReply{
+		Replica:      r.Rstate.ReplicaNumber,
+		Role:         statusNames[r.Rstate.Status],
+		View:         r.Rstate.View,
+		Master:       r.GetMasterId(),
+		CommitNumber: r.Rstate.CommitNumber,
+		Time:         time.Now(),
+	}
+	if r.Rstate.Status == vr.Normal {
+		reply.Role = client.RoleFollower
+		if r.IsMaster() {
+			reply.Role = client.RoleMaster
+		}
+	}
+	return nil
+}
+
+// GetMaster returns the id and address of the current master replica
+func (s *Server) GetMaster(args *Null, reply *client.MasterInfo) error {
 	//if in recovery state, error
 	if s.ReplicaServer.Rstate.Status != vr.Normal {
 		return errors.New("Master Failover")
 	}
 
-	*reply = s.ReplicaServer.GetMasterId()
+	*reply = s.masterInfo()
 	return nil
 }
 
+// masterInfo says which replica is master, and where clients reach it
+func (s *Server) masterInfo() client.MasterInfo {
+	r := s.ReplicaServer
+	return client.MasterInfo{Id: r.GetMasterId(), View: r.Rstate.View, Address: r.MasterAddress()}
+}
+
+// notMaster is the error to redirect clients to the master with
+func (s *Server) notMaster() error {
+	return client.NotMasterAt(s.masterInfo())
+}
+
+// reads that any replica will answer, for clients that say they can live with stale data
+var staleReads = map[string]bool{
+	"GET":             true,
+	"GET_IF_MODIFIED": true,
+	"CHILDREN":        true,
+	"STAT":            true,
+	"EXISTS":          true,
+	"LIST":            true,
+}
+
+// commands only the servers send themselves (see expireNodes and expireSessions)
+var serverOnly = map[string]bool{
+	"PURGE_TOMBSTONES": true,
+	"EXPIRE":           true,
+	"EXPIRED":          true,
+	"RENEW_SESSIONS":   true,
+	"EXPIRED_SESSIONS": true,
+	"EXPIRE_SESSION":   true,
+}
+
 // RPCDB processes an RPC call sent by client
 func (s *Server) RPCDB(args *phatdb.DBCommand, reply *phatdb.DBResponse) error {
+	start := time.Now()
+	callsInFlight.Add(1)
+	err := s.rpcdb(args, reply)
+	callsInFlight.Add(-1)
+	recordRequest(args.Command, reply, err, time.Since(start))
+	return err
+}
+
+func (s *Server) rpcdb(args *phatdb.DBCommand, reply *phatdb.DBResponse) error {
+	defer s.forgetCall(args)
 	if s.ReplicaServer.Rstate.Status != vr.Normal {
 		return errors.New("Master Failover")
 	}
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.calls.Done()
+	if err := s.admission.startCall(); err != nil {
+		s.traceDebug(args, DEBUG, "Too many calls, turning %s away", args.Command)
+		return err
+	}
+	defer s.admission.finishCall()
+	// the rate limits and forwarded writes go by who the client's proven it is too
+	s.identify(args)
+
+	kind := phatdb.Kind(args.Command)
+	if kind == phatdb.UnknownCommand || kind == phatdb.InternalCommand {
+		reply.Fail(phatdb.ErrUnknownCommand)
+		return nil
+	}
+	if serverOnly[args.Command] {
+		reply.Fail(phatdb.ErrNotAuthorized)
+		s.audit(args, reply)
+		return nil
+	}
+	// before it's replicated, since every replica would have to inflate it
+	if err := phatdb.CheckCompressed(args); err != nil {
+		reply.Fail(err)
+		return nil
+	}
+	if wait, ok := s.rateLimiter.allow(s.limitKey(args), phatdb.Replicated(args.Command), time.Now()); !ok {
+		s.traceDebug(args, DEBUG, "%s is over its rate limit", s.limitKey(args))
+		return client.ServerBusyFor(wait)
+	}
 
 	//if the server isn't the master, the respond with an error, and send over master's address
 	MasterId := s.ReplicaServer.GetMasterId()
 	Id := s.ReplicaServer.Rstate.ReplicaNumber
-	s.debug(DEBUG, "Master id: %d, My id: %d", MasterId, Id)
-	// Temporary workaround to allow responses to SHA256 on non-master nodes
-	if Id != MasterId && args.Command != "SHA256" {
-		s.debug(DEBUG, "I'm not the master!")
-		reply.Error = "Not master node"
+	s.traceDebug(args, DEBUG, "%s %s: Master id: %d, My id: %d", args.Command, args.Path, MasterId, Id)
+	stale := args.Stale && staleReads[args.Command]
+	if Id != MasterId && !stale && s.forwardWrites && phatdb.IsWrite(args.Command) {
+		return s.forward(args, reply)
+	}
+	// local commands (SHA256 and DIGEST) are answered by any replica
+	if Id != MasterId && !stale && kind != phatdb.LocalCommand {
+		s.traceDebug(args, DEBUG, "I'm not the master!")
+		redirectCount.Add(1)
+		err := s.notMaster()
+		reply.Fail(err)
 		reply.Reply = MasterId
-		return errors.New("Not master node")
-	} else {
-		argsWithChannel := phatdb.DBCommandWithChannel{args, make(chan *phatdb.DBResponse, 1)}
-		switch args.Command {
+		return err
+	}
+	// (forwarded writes are confined by the master)
+	s.confine(args)
+	args.Time = time.Now()
+	argsWithChannel := phatdb.DBCommandWithChannel{args, make(chan *phatdb.DBResponse, 1)}
+	if stale || kind == phatdb.LocalCommand {
+		// whatever we have will do, so skip VR even on the master
+		*reply = *s.cachedRead(argsWithChannel)
+		return nil
+	}
+	if args.SeqNumber > 0 && args.Session != "" {
+		s.noteSeqNumber(args.Session, args.SeqNumber)
+	}
+	if args.Command == "AUTH" {
+		// only who the credentials say the client is goes in the log, never the
+		// credentials themselves. Value carries the token to issue instead, if this is
+		// the session's first AUTH
+		id, err := phatdb.Authenticate(args.Scheme, args.Value)
+		if err != nil {
+			reply.Fail(err)
+			s.audit(args, reply)
+			return nil
+		}
+		args.Value = phatdb.NewAuthToken()
+		args.Auth = []phatdb.Identity{id}
+	}
+	if phatdb.Replicated(args.Command) {
 		//if the command is a write, then we need to go through paxos
-		case "CREATE", "DELETE", "SET", "GET":
-			s.ReplicaServer.RunVR(CommandFunctor{argsWithChannel})
-			s.debug(DEBUG, "Command committed, waiting for DB response")
-			result := <-argsWithChannel.Done
-			*reply = *result
-			s.debug(DEBUG, "Finished write-only")
-			//paxos(args)
-		default:
-			//for reads we can go directly to the DB
-			//TODO: make sure we have the master lease?
-			// (probably just requires making sure Rstate.Status==Normal because otherwise we wouldn't
-			// be considered master anymore)
-			s.debug(DEBUG, "Read-only command skips Paxos")
-			s.InputChan <- argsWithChannel
-			result := <-argsWithChannel.Done
+		deduped := args.SeqNumber > 0 && args.Session != ""
+		if deduped {
+			done, err := s.dedup.start(args.Session, args.SeqNumber)
+			if err != nil {
+				reply.Fail(err)
+				return nil
+			}
+			if done != nil {
+				s.traceDebug(args, DEBUG, "Already committed, sending the same reply")
+				*reply = *done
+				return nil
+			}
+		}
+		finish := func() {
+			if deduped {
+				s.dedup.finish(args.Session, args.SeqNumber)
+			}
+		}
+		// no point replicating what's only going to be turned away
+		if err := s.db.CheckAccess(args); err != nil {
+			s.traceDebug(args, DEBUG, "%s %s isn't allowed", args.Command, args.Path)
+			reply.Fail(err)
+			s.audit(args, reply)
+			finish()
+			return nil
+		}
+		// our validators only run here, so every replica applies the same commands
+		if err := s.db.Validate(args); err != nil {
+			s.traceDebug(args, DEBUG, "%s %s isn't valid: %v", args.Command, args.Path, err)
+			reply.Fail(err)
+			finish()
+			return nil
+		}
+		if err := s.admission.startOp(); err != nil {
+			s.traceDebug(args, DEBUG, "Too many commands waiting on VR, turning %s away", args.Command)
+			finish()
+			return err
+		}
+		// the client may go before the command's committed. It still commits, but then
+		// only this goroutine waits for it, not the call
+		committed := make(chan *phatdb.DBResponse, 1)
+		opsPending.Add(1)
+		go func() {
+			defer finish()
+			defer s.admission.finishOp()
+			defer opsPending.Add(-1)
+			started := time.Now()
+			if err := s.ReplicaServer.RunVR(CommandFunctor{argsWithChannel}); err != nil {
+				s.traceDebug(args, DEBUG, "Couldn't replicate %s: %v", args.Command, err)
+				failed := &phatdb.DBResponse{}
+				failed.Fail(err)
+				committed <- failed
+				return
+			}
+			commitWait.Observe(time.Since(started))
+			s.traceDebug(args, DEBUG, "Command committed, waiting for DB response")
+			committed <- <-argsWithChannel.Done
+		}()
+		select {
+		case result := <-committed:
 			*reply = *result
-
-			s.debug(DEBUG, "Finished read-only")
+			s.traceDebug(args, DEBUG, "Finished write-only")
+			return nil
+		case <-s.clientGone(args):
+			s.traceDebug(args, DEBUG, "Client went before %s committed, not waiting for it", args.Command)
+			return errClientGone
 		}
 	}
+	//for reads we can go directly to the DB, as long as we hold the master lease:
+	// otherwise another master may have been elected without us knowing, and
+	// what we have may be out of date
+	if !s.ReplicaServer.HasLease() {
+		s.traceDebug(args, DEBUG, "No master lease, can't serve the read")
+		redirectCount.Add(1)
+		err := s.notMaster()
+		reply.Fail(err)
+		reply.Reply = MasterId
+		return err
+	}
+	s.traceDebug(args, DEBUG, "Read-only command skips Paxos")
+	*reply = *s.cachedRead(argsWithChannel)
+	s.traceDebug(args, DEBUG, "Finished read-only")
 	return nil
 }
+
+// forward passes a write on to the master and relays its reply
+func (s *Server) forward(args *phatdb.DBCommand, reply *phatdb.DBResponse) error {
+	s.traceDebug(args, DEBUG, "Forwarding %s to master %d", args.Command, s.ReplicaServer.GetMasterId())
+	forwardCount.Add(1)
+	result, err := s.ReplicaServer.Forward(*args, FORWARD_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	resp, ok := result.(phatdb.DBResponse)
+	if !ok {
+		return errors.New("bad reply from the master")
+	}
+	*reply = resp
+	return nil
+}
+
+// WatchExists waits for the node at args.Path to exist, replying true once it does, or
+// false if it still doesn't after WATCH_TIMEOUT
+func (s *Server) WatchExists(args *phatdb.DBCommand, reply *phatdb.DBResponse) error {
+	if s.ReplicaServer.Rstate.Status != vr.Normal {
+		return errors.New("Master Failover")
+	}
+	if !s.ReplicaServer.IsMaster() {
+		err := s.notMaster()
+		reply.Fail(err)
+		reply.Reply = s.ReplicaServer.GetMasterId()
+		return err
+	}
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.calls.Done()
+	s.confine(args)
+	changed := make(chan struct{}, 1)
+	// watch before checking, so a create in between can't be missed
+	cancel := s.db.OnChange(args.Root+"/"+args.Path, func(phatdb.Change) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+	defer cancel()
+	timeout := time.NewTimer(WATCH_TIMEOUT)
+	defer timeout.Stop()
+	for {
+		check := *args
+		check.Command = "EXISTS"
+		argsWithChannel := phatdb.DBCommandWithChannel{&check, make(chan *phatdb.DBResponse, 1)}
+		s.InputChan <- argsWithChannel
+		*reply = *<-argsWithChannel.Done
+		if reply.Error != "" || reply.Reply == true {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timeout.C:
+			return nil
+		case <-s.done:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package phatRPC
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/mgentili/goPhat/phatdb"
+)
+
+// RateLimit is a token bucket: a client can make Burst calls straight off, and Rate a
+// second on average after that. A zero Rate means no limit
+type RateLimit struct {
+	Rate  float64
+	Burst int // defaults to Rate (rounded up), and is at least 1
+}
+
+// RateLimits are the limits for one client, on reads (which only the master's DB loop
+// has to answer) and on commands that go through VR
+type RateLimits struct {
+	Reads  RateLimit
+	Writes RateLimit
+}
+
+// once there are this many buckets, ones that have filled back up are thrown away
+const maxIdleBuckets = 1024
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type bucketKey struct {
+	client string
+	write  bool
+}
+
+// rateLimiter keeps a bucket for each client and command class
+type rateLimiter struct {
+	lock      sync.Mutex
+	limits    RateLimits
+	overrides map[string]RateLimits
+	buckets   map[bucketKey]*bucket
+}
+
+func newRateLimiter(config Config) *rateLimiter {
+	overrides := make(map[string]RateLimits)
+	for client, limits := range config.ClientRateLimits {
+		overrides[client] = limits
+	}
+	for name, tenant := range config.Tenants {
+		overrides[tenantLimitKey(name)] = tenant.Rate
+	}
+	return &rateLimiter{limits: config.RateLimits, overrides: overrides, buckets: make(map[bucketKey]*bucket)}
+}
+
+// clientIdentity is who a command's limits are counted against: the first identity
+// it's authenticated as ("scheme:id", as for Config.ClientRateLimits), or its session
+func clientIdentity(args *phatdb.DBCommand) string {
+	if len(args.Auth) > 0 {
+		return args.Auth[0].Scheme + ":" + args.Auth[0].Id
+	}
+	return args.Session
+}
+
+// limit returns client's limit on reads or writes
+func (l *rateLimiter) limit(client string, write bool) RateLimit {
+	limits, ok := l.overrides[client]
+	if !ok {
+		limits = l.limits
+	}
+	if write {
+		return limits.Writes
+	}
+	return limits.Reads
+}
+
+func (limit RateLimit) burst() float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return math.Max(1, math.Ceil(limit.Rate))
+}
+
+// allow takes a token for a command from client, returning false and how long until
+// there'll be one if there isn't one now
+func (l *rateLimiter) allow(client string, write bool, now time.Time) (time.Duration, bool) {
+	limit := l.limit(client, write)
+	if limit.Rate <= 0 {
+		return 0, true
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	key := bucketKey{client, write}
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.dropFull(now)
+		}
+		b = &bucket{tokens: limit.burst(), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(limit.burst(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), false
+}
+
+// dropFull throws away the buckets that would be full by now, since a new one starts
+// out full anyway. Called with the lock held
+func (l *rateLimiter) dropFull(now time.Time) {
+	for key, b := range l.buckets {
+		limit := l.limit(key.client, key.write)
+		if b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= limit.burst() {
+			delete(l.buckets, key)
+		}
+	}
+}
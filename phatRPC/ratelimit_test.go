@@ -0,0 +1,48 @@
+package phatRPC
+
+import (
+	"github.com/mgentili/goPhat/phatdb"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(Config{
+		RateLimits:       RateLimits{Writes: RateLimit{Rate: 10, Burst: 2}},
+		ClientRateLimits: map[string]RateLimits{"digest:admin": {}},
+	})
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, ok := l.allow("a", true, now); !ok {
+			t.Fatalf("Expected write %d to be let in", i)
+		}
+	}
+	wait, ok := l.allow("a", true, now)
+	if ok || wait != 100*time.Millisecond {
+		t.Errorf("Expected to have to wait 100ms for a token, got %v %v", wait, ok)
+	}
+	if _, ok := l.allow("a", true, now.Add(100*time.Millisecond)); !ok {
+		t.Errorf("Expected a token to be back after 100ms")
+	}
+	// other clients, reads and overridden clients have their own limits
+	if _, ok := l.allow("b", true, now); !ok {
+		t.Errorf("Expected another client's write to be let in")
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := l.allow("a", false, now); !ok {
+			t.Fatalf("Expected reads not to be limited")
+		}
+		if _, ok := l.allow("digest:admin", true, now); !ok {
+			t.Fatalf("Expected the admin's writes not to be limited")
+		}
+	}
+
+	args := &phatdb.DBCommand{Session: "s1"}
+	if clientIdentity(args) != "s1" {
+		t.Errorf("Expected an unauthenticated client to be told apart by session")
+	}
+	args.Auth = []phatdb.Identity{{"digest", "admin"}}
+	if clientIdentity(args) != "digest:admin" {
+		t.Errorf("Expected an authenticated client to be told apart by identity, got %s", clientIdentity(args))
+	}
+}
@@ -0,0 +1,113 @@
+package phatRPC
+
+import (
+	"errors"
+	"github.com/mgentili/goPhat/phatdb"
+	"github.com/mgentili/goPhat/vr"
+	"time"
+)
+
+// SessionState is the reply to AttachSession
+type SessionState struct {
+	phatdb.SessionInfo
+	// the last write numbered by the session that this server has heard of (see
+	// phatdb.DBCommand.SeqNumber)
+	SeqNumber uint64
+}
+
+// AttachSession is called by a client when it connects to a master, so that a session
+// carries on across failovers: the client says how many writes it has numbered, and
+// gets back what the tree holds for its session (which survives the failover, being
+// replicated like everything else)
+func (s *Server) AttachSession(args *phatdb.DBCommand, reply *SessionState) error {
+	if s.ReplicaServer.Rstate.Status != vr.Normal {
+		return errors.New("Master Failover")
+	}
+	if !s.ReplicaServer.IsMaster() {
+		return s.notMaster()
+	}
+	if err := s.enter(); err != nil {
+		return err
+	}
+	defer s.calls.Done()
+	s.confine(args)
+	check := phatdb.DBCommand{Command: "SESSION", Session: args.Session, Root: args.Root}
+	argsWithChannel := phatdb.DBCommandWithChannel{&check, make(chan *phatdb.DBResponse, 1)}
+	s.InputChan <- argsWithChannel
+	resp := <-argsWithChannel.Done
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	reply.SessionInfo = resp.Reply.(phatdb.SessionInfo)
+	reply.SeqNumber = s.noteSeqNumber(args.Session, args.SeqNumber)
+	return nil
+}
+
+// noteSeqNumber records that session has numbered seq writes, returning the most it's
+// known to have numbered
+func (s *Server) noteSeqNumber(session string, seq uint64) uint64 {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+	if seq > s.sessions[session] {
+		s.sessions[session] = seq
+	}
+	return s.sessions[session]
+}
+
+// expireSessions periodically expires the sessions (see phatdb's OPEN_SESSION) that
+// haven't been renewed in time while we're master. Like expireNodes, the expiry goes
+// through VR, so every replica closes them at the same op. A new master renews every
+// session first, since nobody could renew theirs while there was no master
+func (s *Server) expireSessions() {
+	defer s.background.Done()
+	renewed, renewedView := false, uint(0)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(SESSION_CHECK_INTERVAL):
+		}
+		if !s.ReplicaServer.IsMaster() {
+			renewed = false
+			continue
+		}
+		if view := s.ReplicaServer.Rstate.View; !renewed || view != renewedView {
+			renew := phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "RENEW_SESSIONS", Time: time.Now()}, make(chan *phatdb.DBResponse, 1)}
+			if err := s.ReplicaServer.RunVR(CommandFunctor{renew}); err != nil {
+				s.debug(DEBUG, "Couldn't replicate the renewal: %v", err)
+				continue
+			}
+			<-renew.Done
+			renewed, renewedView = true, view
+			continue
+		}
+		now := time.Now()
+		check := phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "EXPIRED_SESSIONS", Time: now}, make(chan *phatdb.DBResponse, 1)}
+		s.InputChan <- check
+		expired, _ := (<-check.Done).Reply.([]string)
+		for _, session := range expired {
+			expire := phatdb.DBCommandWithChannel{&phatdb.DBCommand{Command: "EXPIRE_SESSION", Session: session, Time: now}, make(chan *phatdb.DBResponse, 1)}
+			if err := s.ReplicaServer.RunVR(CommandFunctor{expire}); err != nil {
+				s.debug(DEBUG, "Couldn't replicate the expiry of session %s: %v", session, err)
+				continue
+			}
+			result := <-expire.Done
+			s.debug(DEBUG, "Expired session %s: %v %s", session, result.Reply, result.Error)
+		}
+	}
+}
+
+// forgetSession drops what the server keeps for a session once it's been closed or has
+// expired: its write numbers, the replies to its writes, and its invalidation watcher
+func (s *Server) forgetSession(session string) {
+	s.sessionsLock.Lock()
+	delete(s.sessions, session)
+	s.sessionsLock.Unlock()
+	s.dedup.forget(session)
+	s.watchersLock.Lock()
+	if w, ok := s.watchers[session]; ok {
+		w.cancel()
+		delete(s.watchers, session)
+	}
+	s.watchersLock.Unlock()
+}
@@ -0,0 +1,115 @@
+package phatRPC
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// what calls get once the server has started shutting down
+var ErrShutdown = errors.New("Server shutting down")
+
+// accept serves client connections from listener, encoding calls with codec, until the
+// listener is closed, keeping track of them so Shutdown can close them
+func (s *Server) accept(listener net.Listener, codec serverCodec) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.debug(DEBUG, "Stopped accepting client connections: %v", err)
+			return
+		}
+		s.connsLock.Lock()
+		if s.shuttingDown {
+			s.connsLock.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = true
+		s.connsLock.Unlock()
+		go func() {
+			s.rpcServer.ServeCodec(s.newConnCodec(conn, codec))
+			s.connsLock.Lock()
+			delete(s.conns, conn)
+			s.connsLock.Unlock()
+		}()
+	}
+}
+
+// enter is called at the start of each client call that uses the database, so
+// Shutdown can wait for it. If it doesn't return an error, s.calls.Done must be called
+// once the call's finished
+func (s *Server) enter() error {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	if s.shuttingDown {
+		return ErrShutdown
+	}
+	s.calls.Add(1)
+	return nil
+}
+
+// Shutdown stops the server: it stops accepting connections, waits for the calls in
+// progress to finish (long polls like WatchExists return straight away), closes the
+// clients' connections, stops the database and detaches the server from its replica,
+// so what VR commits from then on goes nowhere. If ctx is done before the calls have
+// finished, it returns ctx.Err() and leaves the database running; calling Shutdown again
+// carries on from there
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connsLock.Lock()
+	if !s.shuttingDown {
+		s.shuttingDown = true
+		close(s.done)
+		s.listener.Close()
+		if s.jsonListener != nil {
+			s.jsonListener.Close()
+		}
+		if s.metricsListener != nil {
+			s.metricsListener.Close()
+		}
+		if s.adminListener != nil {
+			s.adminListener.Close()
+		}
+	}
+	s.connsLock.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		s.calls.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.connsLock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsLock.Unlock()
+
+	// expireNodes and purgeTombstones may be waiting for a commit, which has to get
+	// through to them before we're detached
+	s.detachLock.Lock()
+	alreadyDetached := s.detached
+	s.detached = true
+	s.detachLock.Unlock()
+	if alreadyDetached {
+		return nil
+	}
+	stopped := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		// they're stuck in VR, which won't get anywhere now anyway: the DB is safe
+		// from them since we're detached, so carry on
+	}
+	close(s.InputChan)
+	s.debug(DEBUG, "Server shut down")
+	return nil
+}
@@ -0,0 +1,54 @@
+package phatRPC
+
+import (
+	"context"
+	"github.com/mgentili/goPhat/phatdb"
+	"github.com/mgentili/goPhat/vr"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	// a replica that's never started thinks it's the master of view 0, which is all the
+	// server needs to answer calls that don't go through VR
+	if vr.NREPLICAS == 0 {
+		vr.NREPLICAS = 3
+	}
+	address := "127.0.0.1:9399"
+	s, err := NewServer(address, &vr.Replica{}, Config{})
+	if err != nil {
+		t.Fatalf("Couldn't start the server: %s", err)
+	}
+	conn, err := rpc.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Couldn't connect: %s", err)
+	}
+	reply := &phatdb.DBResponse{}
+	if err := conn.Call("Server.RPCDB", &phatdb.DBCommand{Command: "EXISTS", Path: "/", Stale: true}, reply); err != nil || reply.Reply != true {
+		t.Fatalf("Expected / to exist, got %v %v", reply, err)
+	}
+	// a long poll in progress shouldn't hold shutting down up
+	watch := conn.Go("Server.WatchExists", &phatdb.DBCommand{Path: "/nothing"}, &phatdb.DBResponse{}, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %s", err)
+	}
+	select {
+	case <-watch.Done:
+	case <-time.After(time.Second):
+		t.Errorf("Expected the watch to have been let go")
+	}
+	if err := conn.Call("Server.RPCDB", &phatdb.DBCommand{Command: "EXISTS", Path: "/", Stale: true}, reply); err == nil {
+		t.Errorf("Expected calls to fail once the server's shut down")
+	}
+	if _, err := rpc.Dial("tcp", address); err == nil {
+		t.Errorf("Expected the server to have stopped listening")
+	}
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Expected shutting down again to do nothing, got %s", err)
+	}
+}
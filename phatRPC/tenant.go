@@ -0,0 +1,96 @@
+package phatRPC
+
+import (
+	"github.com/mgentili/goPhat/phatdb"
+)
+
+// Tenant is a team sharing the deployment with others. Its clients are confined to
+// their own part of the tree, which can only grow so big, and share one rate limit
+type Tenant struct {
+	// the identities ("scheme:id", as sent with commands or proven with AUTH) whose
+	// clients belong to the tenant
+	Identities []string
+	// the node the tenant's clients see as /. Paths they send are taken as relative to
+	// it, and can't get out of it
+	Root string
+	// limits on the size of the tenant's subtree (MaxNodes and MaxBytes are the useful
+	// ones). Checked as each write is applied, as for quotas set with SET_QUOTA
+	Quota phatdb.Quota
+	// limits on the calls of all the tenant's clients together
+	Rate RateLimits
+}
+
+// tenantLimitKey is the name a tenant's calls are rate limited under
+func tenantLimitKey(name string) string {
+	return "tenant:" + name
+}
+
+// tenantsByIdentity returns which tenant each identity belongs to
+func tenantsByIdentity(tenants map[string]Tenant) map[string]string {
+	byIdentity := make(map[string]string)
+	for name, tenant := range tenants {
+		for _, id := range tenant.Identities {
+			byIdentity[id] = name
+		}
+	}
+	return byIdentity
+}
+
+// identify replaces the identities args came with with the ones its session has proven
+// with AUTH (see phatdb.DBCommand.AuthToken), plus phatdb.Admin if one of them is in
+// Config.Admins. The servers never take a client's word for who it is
+func (s *Server) identify(args *phatdb.DBCommand) {
+	args.Auth = s.db.Identities(args.Session, args.AuthToken)
+	for _, id := range args.Auth {
+		if s.admins[id.Scheme+":"+id.Id] {
+			args.Auth = append(args.Auth, phatdb.Admin)
+			break
+		}
+	}
+}
+
+// tenantOf returns the name of the tenant the sender of args belongs to, going by the
+// identities its session has proven with AUTH, or "" if it isn't one of the tenants'
+func (s *Server) tenantOf(args *phatdb.DBCommand) string {
+	if len(s.tenants) == 0 {
+		return ""
+	}
+	for _, id := range args.Auth {
+		if name, ok := s.tenantIds[id.Scheme+":"+id.Id]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+// confine puts args inside its sender's tenant's namespace, under its quota. Only
+// servers get to set identities and quotas on commands, so any the client sent are
+// thrown away
+func (s *Server) confine(args *phatdb.DBCommand) {
+	s.identify(args)
+	args.TenantQuota = nil
+	name := s.tenantOf(args)
+	if name == "" {
+		return
+	}
+	tenant := s.tenants[name]
+	// not path.Join: ".." is just a name to the tree, so it mustn't get out of Root
+	if args.Root == "" {
+		args.Root = tenant.Root
+	} else {
+		args.Root = tenant.Root + "/" + args.Root
+	}
+	if tenant.Quota != (phatdb.Quota{}) {
+		quota := tenant.Quota
+		args.TenantQuota = &quota
+	}
+}
+
+// limitKey is who args's call counts against for rate limiting: its sender's tenant,
+// if it has one, or the sender itself
+func (s *Server) limitKey(args *phatdb.DBCommand) string {
+	if name := s.tenantOf(args); name != "" {
+		return tenantLimitKey(name)
+	}
+	return clientIdentity(args)
+}
@@ -0,0 +1,69 @@
+package phatRPC
+
+import (
+	"github.com/mgentili/goPhat/phatdb"
+	"testing"
+)
+
+func TestTenants(t *testing.T) {
+	tenants := map[string]Tenant{
+		"red":  {Identities: []string{"digest:alice", "digest:bob"}, Root: "/tenants/red", Quota: phatdb.Quota{MaxNodes: 10}},
+		"blue": {Identities: []string{"digest:carol"}, Root: "/tenants/blue"},
+	}
+	s := &Server{db: phatdb.NewDatabase(), tenants: tenants, tenantIds: tenantsByIdentity(tenants)}
+	s.db.Apply(&phatdb.DBCommand{Command: "AUTH", Session: "bob", Auth: []phatdb.Identity{{"digest", "bob"}}, Value: "tb"})
+	s.db.Apply(&phatdb.DBCommand{Command: "AUTH", Session: "carol", Auth: []phatdb.Identity{{"digest", "carol"}}, Value: "tc"})
+
+	args := &phatdb.DBCommand{Command: "CREATE", Path: "/a", Session: "bob", AuthToken: "tb"}
+	s.confine(args)
+	if args.Root != "/tenants/red" || args.TenantQuota == nil || args.TenantQuota.MaxNodes != 10 {
+		t.Errorf("Expected bob's command to be confined to red's namespace and quota, got %+v", args)
+	}
+	if key := s.limitKey(args); key != tenantLimitKey("red") {
+		t.Errorf("Expected bob's calls to count against red, got %s", key)
+	}
+
+	// a client's own root is inside the tenant's, ".." or not
+	args = &phatdb.DBCommand{Command: "GET", Root: "../red", Path: "/a", Session: "carol", AuthToken: "tc",
+		TenantQuota: &phatdb.Quota{MaxNodes: 1000}}
+	s.confine(args)
+	if args.Root != "/tenants/blue/../red" || args.TenantQuota != nil {
+		t.Errorf("Expected carol's command to stay in blue's namespace, without a quota, got %+v", args)
+	}
+
+	// claiming to be in a tenant isn't enough
+	args = &phatdb.DBCommand{Command: "CREATE", Path: "/a", Session: "s1", Auth: []phatdb.Identity{{"digest", "bob"}}}
+	s.confine(args)
+	if args.Root != "" || len(args.Auth) != 0 {
+		t.Errorf("Expected a command just claiming to be bob not to be confined as him, got %+v", args)
+	}
+
+	// clients outside the tenants are left alone, but can't set their own quota
+	args = &phatdb.DBCommand{Command: "CREATE", Path: "/a", Session: "s1", TenantQuota: &phatdb.Quota{MaxNodes: 1}}
+	s.confine(args)
+	if args.Root != "" || args.TenantQuota != nil {
+		t.Errorf("Expected a command from outside the tenants to be left alone, got %+v", args)
+	}
+	if key := s.limitKey(args); key != "s1" {
+		t.Errorf("Expected s1's calls to count against itself, got %s", key)
+	}
+}
+
+func TestAdmins(t *testing.T) {
+	s := &Server{db: phatdb.NewDatabase(), admins: map[string]bool{"digest:root": true}}
+	s.db.Apply(&phatdb.DBCommand{Command: "AUTH", Session: "root", Auth: []phatdb.Identity{{"digest", "root"}}, Value: "tr"})
+
+	args := &phatdb.DBCommand{Command: "SET_READONLY", Path: "/", Session: "root", AuthToken: "tr"}
+	s.identify(args)
+	if err := s.db.CheckAccess(args); err != nil {
+		t.Errorf("Expected an admin to be let through, got %v (as %v)", err, args.Auth)
+	}
+	// neither claiming to be an admin, nor to be one of the admins, is enough
+	for _, auth := range [][]phatdb.Identity{{phatdb.Admin}, {{"digest", "root"}}} {
+		args = &phatdb.DBCommand{Command: "SET_READONLY", Path: "/", Session: "s1", Auth: auth}
+		s.identify(args)
+		if err := s.db.CheckAccess(args); err != phatdb.ErrNotAuthorized {
+			t.Errorf("Expected a client claiming to be %v to be turned away, got %v", auth, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package phatRPC
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/mgentili/goPhat/phatdb"
+	"github.com/mgentili/goPhat/vr"
+	"math/big"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+// selfSigned makes a certificate for 127.0.0.1, and a pool that trusts it
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Couldn't make a key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "phat test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Couldn't make a certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Couldn't parse the certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestTLS(t *testing.T) {
+	if vr.NREPLICAS == 0 {
+		vr.NREPLICAS = 3
+	}
+	if _, err := NewServer("127.0.0.1:9396", &vr.Replica{}, Config{TLS: &tls.Config{}}); err == nil {
+		t.Errorf("Expected a TLS config without a certificate to be turned down")
+	}
+
+	cert, pool := selfSigned(t)
+	address := "127.0.0.1:9396"
+	s, err := NewServer(address, &vr.Replica{}, Config{TLS: &tls.Config{Certificates: []tls.Certificate{cert}}})
+	if err != nil {
+		t.Fatalf("Couldn't start the server: %s", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	}()
+
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("Couldn't connect over TLS: %s", err)
+	}
+	rpcConn := rpc.NewClient(conn)
+	defer rpcConn.Close()
+	reply := &phatdb.DBResponse{}
+	if err := rpcConn.Call("Server.RPCDB", &phatdb.DBCommand{Command: "EXISTS", Path: "/", Stale: true}, reply); err != nil || reply.Reply != true {
+		t.Errorf("Expected / to exist, got %v %v", reply, err)
+	}
+
+	// someone talking plaintext doesn't get anywhere
+	plain, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Couldn't connect: %s", err)
+	}
+	plainConn := rpc.NewClient(plain)
+	defer plainConn.Close()
+	call := plainConn.Go("Server.RPCDB", &phatdb.DBCommand{Command: "EXISTS", Path: "/", Stale: true}, &phatdb.DBResponse{}, nil)
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			t.Errorf("Expected a plaintext call to fail")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected a plaintext call to fail, not hang")
+	}
+}
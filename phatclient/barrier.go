@@ -0,0 +1,116 @@
+package phatclient
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+)
+
+// the child of a barrier's node that's created once everyone has entered
+const barrierReady = "ready"
+
+// Barrier is a double barrier: nobody gets past Enter until count clients have entered,
+// and nobody gets past Leave until all of them have left. Each client that enters has an
+// ephemeral node under the barrier's node, named after its session, so a client whose
+// session ends leaves without having to. A barrier can be used again once everyone has
+// left
+type Barrier struct {
+	c     *PhatClient
+	path  string
+	count int
+}
+
+// NewBarrier returns a barrier for count clients at subpath, which is created the first
+// time anyone enters if it doesn't exist
+func (c *PhatClient) NewBarrier(subpath string, count int) *Barrier {
+	return &Barrier{c: c, path: subpath, count: count}
+}
+
+func (b *Barrier) node() string {
+	return path.Join(b.path, b.c.Cli.Uid)
+}
+
+// participants returns how many clients are in the barrier
+func (b *Barrier) participants(ctx context.Context) (int, error) {
+	kids, err := b.c.GetChildrenCtx(ctx, b.path)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, kid := range kids {
+		if kid != barrierReady {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Enter joins the barrier and waits for everyone else to
+func (b *Barrier) Enter() error {
+	return b.EnterCtx(context.Background())
+}
+
+// EnterCtx is Enter, giving up once ctx is done
+func (b *Barrier) EnterCtx(ctx context.Context) error {
+	if _, err := b.c.CreateCtx(ctx, b.path, ""); err != nil && err.Error() != os.ErrExist.Error() {
+		return err
+	}
+	if _, err := b.c.CreateEphemeralCtx(ctx, b.node(), ""); err != nil && err.Error() != os.ErrExist.Error() {
+		return err
+	}
+	// watch before counting, so the last one in can't be missed
+	ready, created, err := b.c.ExistsWCtx(ctx, path.Join(b.path, barrierReady))
+	if err != nil || ready {
+		return err
+	}
+	n, err := b.participants(ctx)
+	if err != nil {
+		return err
+	}
+	if n >= b.count {
+		_, err := b.c.CreateCtx(ctx, path.Join(b.path, barrierReady), "")
+		if err != nil && err.Error() != os.ErrExist.Error() {
+			return err
+		}
+		return nil
+	}
+	select {
+	case <-created:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Leave leaves the barrier and waits for everyone else to
+func (b *Barrier) Leave() error {
+	return b.LeaveCtx(context.Background())
+}
+
+// LeaveCtx is Leave, giving up once ctx is done
+func (b *Barrier) LeaveCtx(ctx context.Context) error {
+	if err := b.c.DeleteCtx(ctx, b.node()); err != nil && err.Error() != os.ErrNotExist.Error() {
+		return err
+	}
+	for {
+		n, err := b.participants(ctx)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(b.c.Cli.Options.RetryDelay):
+		}
+	}
+	// ready for next time
+	err := b.c.DeleteCtx(ctx, path.Join(b.path, barrierReady))
+	if err != nil && err.Error() != os.ErrNotExist.Error() {
+		return err
+	}
+	return nil
+}
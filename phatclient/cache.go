@@ -0,0 +1,147 @@
+package phatclient
+
+import (
+	"github.com/mgentili/goPhat/phatRPC"
+	"github.com/mgentili/goPhat/phatdb"
+	"net/rpc"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how many nodes the cache holds before it's emptied and starts over
+const MaxCacheEntries = 10000
+
+// cache holds the results of GetData until the servers say they've changed
+type cache struct {
+	lock     sync.Mutex
+	disabled bool
+	nodes    map[string]*phatdb.DataNode
+	// bumped by every invalidation, so a GET that raced with one isn't cached
+	generation uint64
+	// whether the invalidation goroutine is running
+	watching bool
+}
+
+// SetCache turns caching of GetData results on (the default) or off
+func (c *PhatClient) SetCache(enabled bool) {
+	c.Cache.lock.Lock()
+	defer c.Cache.lock.Unlock()
+	c.Cache.disabled = !enabled
+	c.Cache.nodes = nil
+	c.Cache.generation++
+}
+
+// cached returns the cached data for subpath, if there is any, along with the generation
+// to pass to cacheStore once it's been fetched otherwise
+func (c *PhatClient) cached(subpath string) (*phatdb.DataNode, uint64) {
+	c.Cache.lock.Lock()
+	defer c.Cache.lock.Unlock()
+	if c.Cache.disabled {
+		return nil, c.Cache.generation
+	}
+	if !c.Cache.watching {
+		c.Cache.watching = true
+		go c.watchInvalidations()
+	}
+	if n, ok := c.Cache.nodes[cleanPath(subpath)]; ok {
+		copy := *n
+		return &copy, c.Cache.generation
+	}
+	return nil, c.Cache.generation
+}
+
+// cacheStore caches the data fetched for subpath, unless something's been invalidated
+// since generation
+func (c *PhatClient) cacheStore(subpath string, n *phatdb.DataNode, generation uint64) {
+	c.Cache.lock.Lock()
+	defer c.Cache.lock.Unlock()
+	if c.Cache.disabled || c.Cache.generation != generation {
+		return
+	}
+	if c.Cache.nodes == nil || len(c.Cache.nodes) >= MaxCacheEntries {
+		c.Cache.nodes = make(map[string]*phatdb.DataNode)
+	}
+	copy := *n
+	c.Cache.nodes[cleanPath(subpath)] = &copy
+}
+
+// invalidate drops the cached nodes at and under the given paths, and their parents (whose
+// child counts change), or everything if all is set
+func (c *PhatClient) invalidate(paths []string, all bool) {
+	c.Cache.lock.Lock()
+	defer c.Cache.lock.Unlock()
+	c.Cache.generation++
+	if all {
+		c.Cache.nodes = nil
+		return
+	}
+	for _, p := range paths {
+		p = cleanPath(p)
+		delete(c.Cache.nodes, path.Dir(p))
+		for cachedPath := range c.Cache.nodes {
+			if cachedPath == p || strings.HasPrefix(cachedPath, p+"/") || p == "/" {
+				delete(c.Cache.nodes, cachedPath)
+			}
+		}
+	}
+}
+
+// invalidateCommand drops whatever a command we're about to send might change
+func (c *PhatClient) invalidateCommand(args *phatdb.DBCommand) {
+	if isRead(args.Command) {
+		return
+	}
+	switch args.Command {
+	case "OPEN_SESSION", "KEEPALIVE", "AUTH":
+		// nothing in the tree changes
+	case "CREATE", "CREATE_SEQ", "SET", "SET_VERSION", "GETSET", "APPEND", "INCR", "SETACL", "LOCK", "UNLOCK", "DELETE", "DELETE_VERSION", "DELETE_RECURSIVE", "COPY", "MOVE":
+		c.invalidate([]string{args.Path, args.Target}, false)
+	default:
+		// e.g. MULTI or CLOSE_SESSION, which are more trouble than they're worth to pick apart
+		c.invalidate(nil, true)
+	}
+}
+
+// watchInvalidations keeps a Server.Invalidations call open, dropping whatever it says
+// has changed from the cache, until the client is closed or caching is turned off
+func (c *PhatClient) watchInvalidations() {
+	args := &phatdb.DBCommand{Session: c.Cli.Uid, Root: c.Root}
+	root := cleanPath(args.Root)
+	for {
+		c.Cache.lock.Lock()
+		if c.Cache.disabled {
+			c.Cache.watching = false
+			c.Cache.lock.Unlock()
+			return
+		}
+		c.Cache.lock.Unlock()
+		reply := &phatRPC.Invalidations{}
+		conn, _ := c.Cli.Conn()
+		err := conn.Call("Server.Invalidations", args, reply)
+		if err == rpc.ErrShutdown && atomic.LoadInt32(&c.closed) == 1 {
+			return
+		}
+		if err != nil {
+			c.debug(DEBUG, "Getting invalidations failed: %v", err)
+			// we may have missed some
+			c.invalidate(nil, true)
+			time.Sleep(c.Cli.Options.RetryDelay)
+			c.Cli.ReconnectFrom(conn, err)
+			continue
+		}
+		// the server sends real paths, but we cache them relative to our root
+		for i, p := range reply.Paths {
+			if root != "/" {
+				reply.Paths[i] = strings.TrimPrefix(p, root)
+			}
+		}
+		c.invalidate(reply.Paths, reply.Reset)
+	}
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
@@ -0,0 +1,147 @@
+// Package chaos makes a client's connections to the servers misbehave, so applications
+// can check that they cope with what goPhat does when things go wrong: calls that time
+// out, calls that go through but whose replies are lost (so they're retried), and lost
+// connections. Which faults happen when is decided by a seeded random schedule, so a
+// failing run can be repeated
+package chaos
+
+import (
+	"github.com/mgentili/goPhat/client"
+	"github.com/mgentili/goPhat/phatclient"
+	"io"
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Schedule says how often each fault happens, as the chance of it happening to any one
+// reply
+type Schedule struct {
+	Seed       int64
+	Drop       float64       // the reply is thrown away, so the call times out even though it went through
+	Delay      float64       // the reply is held up for DelayFor (which should be more than Options.Timeout, to time the call out)
+	DelayFor   time.Duration // (defaults to a second)
+	Disconnect float64       // the connection is closed instead of the reply arriving
+}
+
+// Stats counts the faults injected so far
+type Stats struct {
+	Replies     int64
+	Dropped     int64
+	Delayed     int64
+	Disconnects int64
+}
+
+// Injector injects faults into the connections made with its Codec
+type Injector struct {
+	schedule Schedule
+	lock     sync.Mutex
+	rand     *rand.Rand
+	stats    Stats
+	disabled bool
+}
+
+// New returns an Injector following schedule
+func New(schedule Schedule) *Injector {
+	if schedule.DelayFor == 0 {
+		schedule.DelayFor = time.Second
+	}
+	return &Injector{schedule: schedule, rand: rand.New(rand.NewSource(schedule.Seed))}
+}
+
+// NewClient is phatclient.NewClientWithOptions, with i's faults injected into its calls
+func (i *Injector) NewClient(servers []string, id uint, uid string, opts client.Options) (*phatclient.PhatClient, error) {
+	return phatclient.NewClientWithOptions(servers, id, uid, i.Options(opts))
+}
+
+// Options returns opts with i's faults injected into its Codec
+func (i *Injector) Options(opts client.Options) client.Options {
+	opts.Codec = i.Codec(opts.Codec)
+	return opts
+}
+
+// Codec wraps inner (client.GobCodec if nil) so that it injects i's faults
+func (i *Injector) Codec(inner client.Codec) client.Codec {
+	if inner == nil {
+		inner = client.GobCodec
+	}
+	return func(conn io.ReadWriteCloser) rpc.ClientCodec {
+		return &codec{ClientCodec: inner(conn), i: i}
+	}
+}
+
+// SetEnabled turns fault injection on (the default) or off, e.g. while a test sets up
+func (i *Injector) SetEnabled(enabled bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.disabled = !enabled
+}
+
+// Stats returns the faults injected so far
+func (i *Injector) Stats() Stats {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.stats
+}
+
+type fault int
+
+const (
+	none fault = iota
+	drop
+	delay
+	disconnect
+)
+
+// next decides what happens to the next reply
+func (i *Injector) next() fault {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.stats.Replies++
+	if i.disabled {
+		return none
+	}
+	// always draw the same number of times, so the schedule doesn't depend on the odds
+	r := i.rand.Float64()
+	s := i.schedule
+	switch {
+	case r < s.Drop:
+		i.stats.Dropped++
+		return drop
+	case r < s.Drop+s.Delay:
+		i.stats.Delayed++
+		return delay
+	case r < s.Drop+s.Delay+s.Disconnect:
+		i.stats.Disconnects++
+		return disconnect
+	}
+	return none
+}
+
+type codec struct {
+	rpc.ClientCodec
+	i *Injector
+}
+
+func (c *codec) ReadResponseHeader(r *rpc.Response) error {
+	for {
+		if err := c.ClientCodec.ReadResponseHeader(r); err != nil {
+			return err
+		}
+		switch c.i.next() {
+		case drop:
+			// the reply's body has to be read all the same
+			if err := c.ClientCodec.ReadResponseBody(nil); err != nil {
+				return err
+			}
+			continue
+		case delay:
+			time.Sleep(c.i.schedule.DelayFor)
+		case disconnect:
+			c.ClientCodec.Close()
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+}
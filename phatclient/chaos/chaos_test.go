@@ -0,0 +1,60 @@
+package chaos
+
+import (
+	"github.com/mgentili/goPhat/client"
+	"github.com/mgentili/goPhat/level_log"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type echo struct {
+	calls int64 // updated by the server's goroutines, so only through sync/atomic
+}
+
+func (e *echo) Call(args int, reply *int) error {
+	atomic.AddInt64(&e.calls, 1)
+	*reply = args
+	return nil
+}
+
+func TestInjector(t *testing.T) {
+	server := rpc.NewServer()
+	e := &echo{}
+	server.RegisterName("Server", e)
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	i := New(Schedule{Seed: 1, Drop: 0.3, Delay: 0.2, DelayFor: 50 * time.Millisecond})
+	c := &client.Client{Log: level_log.NewLL(ioutil.Discard, "")}
+	c.Options = client.Options{Timeout: 20 * time.Millisecond, GiveUp: 5 * time.Second, RetryDelay: time.Millisecond}
+	c.RpcClient = rpc.NewClientWithCodec(i.Codec(nil)(clientConn))
+	for n := 0; n < 20; n++ {
+		var reply int
+		if err := c.ProcessCallWithRetry("Server.Call", n, &reply); err != nil || reply != n {
+			t.Fatalf("Expected call %d to get through in the end, got %d %v", n, reply, err)
+		}
+	}
+	stats := i.Stats()
+	if stats.Dropped == 0 || stats.Delayed == 0 {
+		t.Errorf("Expected some replies to be dropped and delayed, got %+v", stats)
+	}
+	// every fault made the client retry, so the server saw more calls than we made
+	if calls := atomic.LoadInt64(&e.calls); calls <= 20 || c.Metrics().Retries == 0 {
+		t.Errorf("Expected retries, got %d calls and %+v", calls, c.Metrics())
+	}
+
+	// the same seed makes the same faults
+	a, b := New(Schedule{Seed: 7, Drop: 0.5}), New(Schedule{Seed: 7, Drop: 0.5})
+	for n := 0; n < 100; n++ {
+		if a.next() != b.next() {
+			t.Fatalf("Expected the same schedule from the same seed")
+		}
+	}
+	a.SetEnabled(false)
+	if a.next() != none {
+		t.Errorf("Expected no faults once disabled")
+	}
+}
@@ -0,0 +1,58 @@
+package phatclient
+
+import (
+	"errors"
+	"os"
+
+	"github.com/mgentili/goPhat/client"
+	"github.com/mgentili/goPhat/phatdb"
+)
+
+// Error is what calls return for an error the servers replied with, when its code
+// doesn't have an error of its own in codeErrors
+type Error struct {
+	Code    phatdb.ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// the errors calls return for each code, so callers can compare against them
+var codeErrors = map[phatdb.ErrorCode]error{
+	phatdb.CodeNoNode:         os.ErrNotExist,
+	phatdb.CodeNodeExists:     os.ErrExist,
+	phatdb.CodeBadVersion:     phatdb.ErrBadVersion,
+	phatdb.CodeSessionExpired: phatdb.ErrSessionExpired,
+	phatdb.CodeNotAuthorized:  phatdb.ErrNotAuthorized,
+	phatdb.CodeBusy:           client.ErrServerBusy,
+}
+
+// responseError returns the error a reply carries, if it has one
+func responseError(reply *phatdb.DBResponse) error {
+	if reply.Error == "" {
+		return nil
+	}
+	code := reply.Code
+	if code == phatdb.CodeOK {
+		// from a server that doesn't send codes
+		code = phatdb.CodeOf(reply.Error)
+	}
+	if err, ok := codeErrors[code]; ok && err.Error() == reply.Error {
+		return err
+	}
+	return &Error{Code: code, Message: reply.Error}
+}
+
+// Code returns what kind of error err, returned by one of the client's calls, is
+func Code(err error) phatdb.ErrorCode {
+	if err == nil {
+		return phatdb.CodeOK
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return phatdb.CodeOf(err.Error())
+}
@@ -0,0 +1,85 @@
+package phatclient
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/mgentili/goPhat/phatdb"
+)
+
+// GetJSON unmarshals the JSON in subpath's value into v, returning the node's stats (e.g.
+// for the version to pass to SetJSONVersion)
+func (c *PhatClient) GetJSON(subpath string, v interface{}) (*phatdb.StatNode, error) {
+	return c.GetJSONCtx(context.Background(), subpath, v)
+}
+
+// GetJSONCtx is GetJSON, giving up once ctx is done
+func (c *PhatClient) GetJSONCtx(ctx context.Context, subpath string, v interface{}) (*phatdb.StatNode, error) {
+	n, err := c.GetDataCtx(ctx, subpath)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(n.Value, v); err != nil {
+		return nil, err
+	}
+	return n.Stats, nil
+}
+
+// SetJSON sets subpath's value to v, marshaled to JSON
+func (c *PhatClient) SetJSON(subpath string, v interface{}) error {
+	return c.SetJSONCtx(context.Background(), subpath, v)
+}
+
+// SetJSONCtx is SetJSON, giving up once ctx is done
+func (c *PhatClient) SetJSONCtx(ctx context.Context, subpath string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.SetDataCtx(ctx, subpath, string(data))
+}
+
+// SetJSONVersion is SetJSON, but only if the node is still at version (as for
+// SetDataVersion)
+func (c *PhatClient) SetJSONVersion(subpath string, v interface{}, version uint64) (*phatdb.StatNode, error) {
+	return c.SetJSONVersionCtx(context.Background(), subpath, v, version)
+}
+
+// SetJSONVersionCtx is SetJSONVersion, giving up once ctx is done
+func (c *PhatClient) SetJSONVersionCtx(ctx context.Context, subpath string, v interface{}, version uint64) (*phatdb.StatNode, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	n, err := c.SetDataVersionCtx(ctx, subpath, string(data), version)
+	if err != nil {
+		return nil, err
+	}
+	return n.Stats, nil
+}
+
+// UpdateJSON reads subpath's JSON into v, lets update change v, and writes it back, as
+// long as nobody else wrote in between; if they did, it starts again. update can return
+// an error to give up without writing
+func (c *PhatClient) UpdateJSON(subpath string, v interface{}, update func() error) (*phatdb.StatNode, error) {
+	return c.UpdateJSONCtx(context.Background(), subpath, v, update)
+}
+
+// UpdateJSONCtx is UpdateJSON, giving up once ctx is done
+func (c *PhatClient) UpdateJSONCtx(ctx context.Context, subpath string, v interface{}, update func() error) (*phatdb.StatNode, error) {
+	for {
+		stats, err := c.GetJSONCtx(ctx, subpath, v)
+		if err != nil {
+			return nil, err
+		}
+		if err := update(); err != nil {
+			return nil, err
+		}
+		stats, err = c.SetJSONVersionCtx(ctx, subpath, v, stats.Version)
+		if err == nil || err.Error() != phatdb.ErrBadVersion.Error() {
+			return stats, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
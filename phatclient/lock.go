@@ -0,0 +1,154 @@
+package phatclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mgentili/goPhat/phatdb"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sequencer identifies one holding of a Lock. The lock's holder passes it along with its
+// requests to other services, which can check it (see CheckSequencer) or just remember the
+// biggest Token they've seen for the Path and turn away anything smaller
+type Sequencer struct {
+	Path  string
+	Token uint64
+}
+
+// String encodes the sequencer for passing around (see ParseSequencer)
+func (s Sequencer) String() string {
+	return fmt.Sprintf("%d:%s", s.Token, s.Path)
+}
+
+// ParseSequencer decodes a sequencer encoded by String
+func ParseSequencer(s string) (Sequencer, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return Sequencer{}, errors.New("malformed sequencer")
+	}
+	token, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return Sequencer{}, errors.New("malformed sequencer")
+	}
+	return Sequencer{Path: parts[1], Token: token}, nil
+}
+
+// CheckSequencer returns whether seq's holding of its lock is still current, i.e. the
+// lock is held and nobody's taken it since
+func (c *PhatClient) CheckSequencer(seq Sequencer) (bool, error) {
+	return c.CheckSequencerCtx(context.Background(), seq)
+}
+
+// CheckSequencerCtx is CheckSequencer, giving up once ctx is done
+func (c *PhatClient) CheckSequencerCtx(ctx context.Context, seq Sequencer) (bool, error) {
+	stats, err := c.GetStatsCtx(ctx, seq.Path)
+	if err != nil {
+		return false, err
+	}
+	return stats.LockHolder != "" && stats.LockToken == seq.Token, nil
+}
+
+// Lock is a distributed mutex on a node, built on the servers' advisory locks (see
+// PhatClient.Lock). It belongs to the client's session, so the servers release it if
+// the session ends (e.g. the client is closed) without releasing it first
+type Lock struct {
+	c     *PhatClient
+	path  string
+	lock  sync.Mutex
+	held  bool
+	token uint64
+}
+
+// NewLock returns a Lock on the node at subpath, which is created the first time the
+// lock is taken if it doesn't exist
+func (c *PhatClient) NewLock(subpath string) *Lock {
+	return &Lock{c: c, path: subpath}
+}
+
+// TryLock takes the lock if nobody else has it, returning whether it did
+func (l *Lock) TryLock() (bool, error) {
+	return l.TryLockCtx(context.Background())
+}
+
+// TryLockCtx is TryLock, giving up once ctx is done
+func (l *Lock) TryLockCtx(ctx context.Context) (bool, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	token, err := l.c.LockCtx(ctx, l.path)
+	if err != nil && err.Error() != phatdb.ErrLocked.Error() {
+		// maybe the node isn't there yet; if it is, this fails and so does the retry
+		l.c.CreateCtx(ctx, l.path, "")
+		token, err = l.c.LockCtx(ctx, l.path)
+	}
+	if err != nil {
+		if err.Error() == phatdb.ErrLocked.Error() {
+			return false, nil
+		}
+		return false, err
+	}
+	l.held = true
+	l.token = token
+	return true, nil
+}
+
+// Acquire waits until it gets the lock or ctx is done, returning the lock's fencing token
+// (see Token)
+func (l *Lock) Acquire(ctx context.Context) (uint64, error) {
+	for {
+		ok, err := l.TryLockCtx(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return l.Token(), nil
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(l.c.Cli.Options.RetryDelay):
+		}
+	}
+}
+
+// Release gives up the lock
+func (l *Lock) Release() error {
+	return l.ReleaseCtx(context.Background())
+}
+
+// ReleaseCtx is Release, giving up once ctx is done
+func (l *Lock) ReleaseCtx(ctx context.Context) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := l.c.UnlockCtx(ctx, l.path); err != nil {
+		return err
+	}
+	l.held = false
+	return nil
+}
+
+// Token returns the fencing token from when the lock was last taken. Each holder of the
+// lock gets a bigger one, so services the holder talks to can turn away an older holder
+func (l *Lock) Token() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.token
+}
+
+// Sequencer returns the sequencer for the lock's current holding
+func (l *Lock) Sequencer() Sequencer {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return Sequencer{Path: l.path, Token: l.token}
+}
+
+// Held returns whether the lock was taken (and not released) through l. It can't know
+// whether the session has since ended
+func (l *Lock) Held() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.held
+}
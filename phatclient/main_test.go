@@ -0,0 +1,21 @@
+package phatclient
+
+import (
+	"github.com/mgentili/goPhat/vr"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+// TestMain keeps the test cluster's snapshots out of the source tree
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "phatclient")
+	if err != nil {
+		log.Fatalf("Couldn't make a directory for snapshots: %s", err)
+	}
+	vr.SnapshotDir = dir
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,90 @@
+package phatclient
+
+import (
+	"context"
+	"github.com/mgentili/goPhat/phatdb"
+)
+
+// Multi collects operations to send as one MULTI, which the servers apply atomically:
+// either all of them succeed or none of them are applied. Build one with PhatClient.Multi
+// and send it with Commit
+type Multi struct {
+	c   *PhatClient
+	ops []*phatdb.DBCommand
+}
+
+// Multi starts a new transaction
+func (c *PhatClient) Multi() *Multi {
+	return &Multi{c: c}
+}
+
+func (m *Multi) add(op *phatdb.DBCommand) *Multi {
+	m.ops = append(m.ops, op)
+	return m
+}
+
+// Create adds a CREATE. Its result is the new node's *phatdb.DataNode
+func (m *Multi) Create(subpath string, data string) *Multi {
+	return m.add(&phatdb.DBCommand{Command: "CREATE", Path: subpath, Value: data})
+}
+
+// CreateSequential adds a CREATE_SEQ. Its result is the path that was created
+func (m *Multi) CreateSequential(subpath string, data string) *Multi {
+	return m.add(&phatdb.DBCommand{Command: "CREATE_SEQ", Path: subpath, Value: data})
+}
+
+// Set adds a SET
+func (m *Multi) Set(subpath string, data string) *Multi {
+	return m.add(&phatdb.DBCommand{Command: "SET", Path: subpath, Value: data})
+}
+
+// SetVersion adds a SET_VERSION. Its result is the node's *phatdb.DataNode
+func (m *Multi) SetVersion(subpath string, data string, version uint64) *Multi {
+	return m.add(&phatdb.DBCommand{Command: "SET_VERSION", Path: subpath, Value: data, Version: version})
+}
+
+// Delete adds a DELETE. Its result is the deleted node's phatdb.StatNode
+func (m *Multi) Delete(subpath string) *Multi {
+	return m.add(&phatdb.DBCommand{Command: "DELETE", Path: subpath})
+}
+
+// DeleteVersion adds a DELETE_VERSION
+func (m *Multi) DeleteVersion(subpath string, version uint64) *Multi {
+	return m.add(&phatdb.DBCommand{Command: "DELETE_VERSION", Path: subpath, Version: version})
+}
+
+// CheckVersion fails the transaction unless the node is at version
+func (m *Multi) CheckVersion(subpath string, version uint64) *Multi {
+	return m.add(&phatdb.DBCommand{Command: "CHECK_VERSION", Path: subpath, Version: version})
+}
+
+// Get adds a GET, which sees the writes before it. Its result is a *phatdb.DataNode.
+// For batches of nothing but reads, MGetData is cheaper
+func (m *Multi) Get(subpath string) *Multi {
+	return m.add(&phatdb.DBCommand{Command: "GET", Path: subpath})
+}
+
+// Commit sends the transaction, returning the result of each operation in order
+func (m *Multi) Commit() ([]interface{}, error) {
+	return m.CommitCtx(context.Background())
+}
+
+// CommitCtx is Commit, giving up once ctx is done
+func (m *Multi) CommitCtx(ctx context.Context) ([]interface{}, error) {
+	args := &phatdb.DBCommand{Command: "MULTI", Ops: m.ops, Session: m.c.Cli.Uid}
+	reply, err := m.c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	responses := reply.Reply.([]phatdb.DBResponse)
+	results := make([]interface{}, len(responses))
+	for i, resp := range responses {
+		results[i] = resp.Reply
+		if _, ok := resp.Reply.(phatdb.DataNode); ok {
+			if results[i], err = toDataNode(resp.Reply); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return results, nil
+}
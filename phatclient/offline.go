@@ -0,0 +1,136 @@
+package phatclient
+
+import (
+	"context"
+	"errors"
+	"github.com/mgentili/goPhat/client"
+	"github.com/mgentili/goPhat/phatdb"
+	"sync"
+)
+
+// how many writes the offline queue holds if OfflineOptions doesn't say
+const DefaultMaxQueued = 1000
+
+var (
+	// a write was queued to be sent once the client reconnects (see EnableOfflineQueue)
+	ErrQueued = errors.New("write queued until the client reconnects")
+	// a write couldn't be sent or queued, because the offline queue's full
+	ErrQueueFull = errors.New("offline queue is full")
+)
+
+// OfflineOptions configures the offline queue (see EnableOfflineQueue)
+type OfflineOptions struct {
+	MaxQueued int // writes held at most (DefaultMaxQueued)
+	// called with each write turned away because the queue's full
+	Overflow func(args *phatdb.DBCommand)
+	// called with each queued write that fails once it's sent
+	Failed func(args *phatdb.DBCommand, err error)
+}
+
+// offlineQueue holds writes made while the client couldn't reach the master
+type offlineQueue struct {
+	lock      sync.Mutex
+	enabled   bool
+	opts      OfflineOptions
+	pending   []*phatdb.DBCommand
+	replaying bool
+}
+
+// EnableOfflineQueue makes writes that can't reach the master (because the client is
+// disconnected, or they time out) queue up and be sent, in order, once it reconnects,
+// rather than fail. They fail with ErrQueued instead, so the caller knows the write
+// hasn't happened yet. A write that timed out may have gone through before it was
+// queued; it's sent again with the same number (see phatdb.DBCommand.SeqNumber), so the
+// servers can tell. Only for applications that can live with their writes being late
+func (c *PhatClient) EnableOfflineQueue(opts OfflineOptions) {
+	if opts.MaxQueued == 0 {
+		opts.MaxQueued = DefaultMaxQueued
+	}
+	q := &c.offline
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.enabled = true
+	q.opts = opts
+}
+
+// Queued returns how many writes are waiting to be sent
+func (c *PhatClient) Queued() int {
+	q := &c.offline
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending)
+}
+
+// queueWrite queues args if the offline queue's on, args is a write, and it has to wait:
+// the client's disconnected, or there are writes ahead of it. It returns whether it
+// did, and the error to return for it
+func (c *PhatClient) queueWrite(args *phatdb.DBCommand, failed error) (bool, error) {
+	// renewing the session (or authenticating) late is no use
+	if isRead(args.Command) || args.Command == "OPEN_SESSION" || args.Command == "KEEPALIVE" || args.Command == "AUTH" {
+		return false, nil
+	}
+	q := &c.offline
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.enabled {
+		return false, nil
+	}
+	if failed == nil && len(q.pending) == 0 && c.Cli.Connected() {
+		return false, nil
+	}
+	if failed != nil && failed != client.ErrGaveUp && failed != client.ErrCallTimedOut {
+		return false, nil
+	}
+	if len(q.pending) >= q.opts.MaxQueued {
+		if q.opts.Overflow != nil {
+			q.opts.Overflow(args)
+		}
+		return true, ErrQueueFull
+	}
+	q.pending = append(q.pending, args)
+	return true, ErrQueued
+}
+
+// replayQueued sends the queued writes, in order, stopping if the client can't reach the
+// master again
+func (c *PhatClient) replayQueued() {
+	q := &c.offline
+	q.lock.Lock()
+	if q.replaying || len(q.pending) == 0 {
+		q.lock.Unlock()
+		return
+	}
+	q.replaying = true
+	q.lock.Unlock()
+	defer func() {
+		q.lock.Lock()
+		q.replaying = false
+		q.lock.Unlock()
+	}()
+	for {
+		q.lock.Lock()
+		if len(q.pending) == 0 {
+			q.lock.Unlock()
+			return
+		}
+		args := q.pending[0]
+		failed := q.opts.Failed
+		q.lock.Unlock()
+
+		reply := &phatdb.DBResponse{}
+		err := c.Cli.ProcessCallWithRetryCtx(context.Background(), "Server.RPCDB", args, reply)
+		if err == client.ErrGaveUp || err == client.ErrCallTimedOut {
+			c.debug(DEBUG, "Replaying queued writes failed, will try again: %s", err)
+			return
+		}
+		if err == nil {
+			err = responseError(reply)
+		}
+		if err != nil && failed != nil {
+			failed(args, err)
+		}
+		q.lock.Lock()
+		q.pending = q.pending[1:]
+		q.lock.Unlock()
+	}
+}
@@ -1,155 +1,542 @@
 package phatclient
 
 import (
+	"context"
 	"encoding/gob"
-	"errors"
 	"github.com/mgentili/goPhat/client"
 	"github.com/mgentili/goPhat/phatdb"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
+	// how long a single call waits, unless NewClientWithOptions says otherwise
 	DefaultTimeout = time.Duration(5) * time.Second
-	ClientTimeout  = time.Duration(3) * time.Second
-	ServerTimeout  = time.Duration(2) * time.Second
-	DEBUG          = 0
-	STATUS         = 1
-	CALL           = 2
+	// Deprecated: unused, set client.Options instead
+	ClientTimeout = time.Duration(3) * time.Second
+	// Deprecated: unused, set client.Options instead
+	ServerTimeout = time.Duration(2) * time.Second
+	DEBUG         = 0
+	STATUS        = 1
+	CALL          = 2
 )
 
+// PhatClient can be used from any number of goroutines at once; their calls share one
+// connection, so many can be in flight together
 type PhatClient struct {
 	Cli *client.Client
+	// if set, all paths are relative to this node, which lets several applications
+	// share a cluster without seeing each other's nodes (see SetRoot, which is for
+	// before the client's shared)
+	Root string
+	// set (to 1) by Close, so watches know to stop
+	closed int32
+	// set (to 1) while the session's being kept open (see StartSession)
+	keepingAlive int32
+	// the token the servers issued when the client first proved who it is (see
+	// Authenticate)
+	authToken string
+	authLock  sync.Mutex
+	// how many writes have been sent, for numbering them (see prepare)
+	seqNumber uint64
+	// GetData results, kept until the servers say they've changed (see SetCache)
+	Cache cache
+	// writes waiting for the client to reconnect (see EnableOfflineQueue)
+	offline offlineQueue
 }
 
 func (c *PhatClient) debug(level int, format string, args ...interface{}) {
 	c.Cli.Log.Printf(level, format, args...)
 }
 
+// StringToError turns an error message from the servers back into an error, as calls
+// return it (see Code)
 func StringToError(s string) error {
-	if s == "" {
-		return nil
-	}
-	return errors.New(s)
+	return responseError(&phatdb.DBResponse{Error: s})
 }
 
 // NewClient creates a new client connected to the server with given id
 // and attempts to connect to the master server
 func NewClient(servers []string, id uint, uid string) (*PhatClient, error) {
-	var err error
-	c := new(PhatClient)
-	c.Cli, err = client.NewClient(servers, id, uid)
+	return NewClientWithOptions(servers, id, uid, client.Options{})
+}
+
+// NewClientWithOptions is NewClient with a different timeout, retry policy or logger.
+// The timeout defaults to DefaultTimeout
+func NewClientWithOptions(servers []string, id uint, uid string, opts client.Options) (*PhatClient, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	cli, err := client.NewClientWithOptions(servers, id, uid, opts)
 	if err != nil {
 		return nil, err
 	}
+	return newPhatClient(cli), nil
+}
+
+// NewClientWait is NewClient, except that rather than failing if the cluster isn't ready
+// (e.g. it's still starting up and hasn't elected a master), it keeps trying until deadline
+func NewClientWait(servers []string, id uint, uid string, deadline time.Time) (*PhatClient, error) {
+	return NewClientWaitWithOptions(servers, id, uid, deadline, client.Options{})
+}
+
+// NewClientWaitWithOptions is NewClientWait with a different timeout, retry policy or
+// logger, as for NewClientWithOptions
+func NewClientWaitWithOptions(servers []string, id uint, uid string, deadline time.Time, opts client.Options) (*PhatClient, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	cli, err := client.NewClientWaitWithOptions(servers, id, uid, deadline, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newPhatClient(cli), nil
+}
+
+func newPhatClient(cli *client.Client) *PhatClient {
+	c := &PhatClient{Cli: cli}
 
 	// We need to register the DataNode and StatNode before we can use them in gob
 	gob.Register(phatdb.DataNode{})
 	gob.Register(phatdb.StatNode{})
 	gob.Register(phatdb.DBResponse{})
+	gob.Register([]phatdb.ACL{})
+	gob.Register([]phatdb.DBResponse{})
+	gob.Register(phatdb.Quota{})
+	gob.Register([]phatdb.ListEntry{})
+	gob.Register([]phatdb.Tombstone{})
+	gob.Register([]phatdb.AuditEntry{})
+	gob.Register(phatdb.SessionInfo{})
 
-	return c, nil
+	// carry the session over to every master the client connects to from now on
+	if err := c.Cli.SetAttach(c.attachSession); err != nil {
+		c.debug(DEBUG, "Couldn't attach session: %s", err)
+	}
+	return c
 }
 
-// processCallWithRetry tries to make a client call until a timeout triggers
-// retries happen when the RPC call fails
-func (c *PhatClient) processCallWithRetry(args *phatdb.DBCommand) (*phatdb.DBResponse, error) {
-	reply := &phatdb.DBResponse{}
-	timer := time.NewTimer(DefaultTimeout)
-	giveupTimer := time.NewTimer(DefaultTimeout * 10)
+// commands whose Value is node data, which compressArgs can compress
+var valueCommands = map[string]bool{
+	"CREATE":      true,
+	"CREATE_SEQ":  true,
+	"SET":         true,
+	"SET_VERSION": true,
+	"GETSET":      true,
+	"APPEND":      true,
+}
 
-	var replyErr error
+// compressArgs compresses big values before they're sent, so the command is
+// smaller on the wire and in the replicated log
+func compressArgs(args *phatdb.DBCommand) {
+	if !valueCommands[args.Command] || args.Flags&phatdb.COMPRESSED != 0 ||
+		phatdb.CompressThreshold == 0 || len(args.Value) < phatdb.CompressThreshold {
+		return
+	}
+	if c := phatdb.Compress([]byte(args.Value)); len(c) < len(args.Value) {
+		args.Value = string(c)
+		args.Flags |= phatdb.COMPRESSED
+	}
+}
 
-	for {
-		dbCall := c.Cli.RpcClient.Go("Server.RPCDB", args, reply, nil)
-		select {
-		case <-giveupTimer.C:
-			c.debug(DEBUG, "Client completely giving up on this call")
-			return nil, errors.New("Completely timed out")
-		case <-timer.C:
-			c.debug(DEBUG, "Single call timed out")
-			c.Cli.ConnectToMaster()
-			timer.Reset(DefaultTimeout)
-		case <-dbCall.Done:
-			if dbCall.Error == nil {
-				c.debug(STATUS, "Call done with no error")
-				replyErr = StringToError(reply.Error)
-				if replyErr != nil {
-					return nil, replyErr
-				}
-				return reply, nil
-			}
-			c.debug(DEBUG, "Call failed with error %v", dbCall.Error)
-			time.Sleep(DefaultTimeout / 10)
-			//error possibilities 1) network failure 2) server can't process request
-			c.Cli.ConnectToMaster()
+// toDataNode turns a reply into a DataNode with its plain (uncompressed) value
+func toDataNode(reply interface{}) (*phatdb.DataNode, error) {
+	n := reply.(phatdb.DataNode)
+	val, err := n.Plain()
+	if err != nil {
+		return nil, err
+	}
+	n.Value = val
+	n.Compressed = false
+	return &n, nil
+}
+
+// SetRoot confines the client to the subtree at root: paths it sends and gets back are
+// relative to root, and nothing outside it can be reached. "" or "/" lifts the restriction
+func (c *PhatClient) SetRoot(root string) {
+	if root == "/" {
+		root = ""
+	}
+	c.Root = root
+}
+
+// commands that don't change anything
+func isRead(command string) bool {
+	return !phatdb.IsWrite(command)
+}
+
+// Authenticate proves to the servers who this client is, for their ACL checks and audit
+// log, for as long as its session lasts. The servers check the credentials (see
+// phatdb.Authenticate): they ignore any identity a client just claims
+func (c *PhatClient) Authenticate(scheme string, credentials string) error {
+	return c.AuthenticateCtx(context.Background(), scheme, credentials)
+}
+
+// AuthenticateCtx is Authenticate, giving up once ctx is done
+func (c *PhatClient) AuthenticateCtx(ctx context.Context, scheme string, credentials string) error {
+	args := &phatdb.DBCommand{Command: "AUTH", Scheme: scheme, Value: credentials}
+	resp, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return err
+	}
+	// the servers only count what the session's proven for commands carrying this
+	if token, ok := resp.Reply.(string); ok {
+		c.authLock.Lock()
+		c.authToken = token
+		c.authLock.Unlock()
+	}
+	return nil
+}
+
+// prepare gets a command ready to be sent. Writes are numbered, so the servers can tell
+// a retry from a new request
+func (c *PhatClient) prepare(args *phatdb.DBCommand) {
+	compressArgs(args)
+	if args.Root == "" {
+		args.Root = c.Root
+	}
+	if args.Session == "" {
+		args.Session = c.Cli.Uid
+	}
+	c.authLock.Lock()
+	if args.AuthToken == "" {
+		args.AuthToken = c.authToken
+	}
+	c.authLock.Unlock()
+	if !isRead(args.Command) && args.SeqNumber == 0 {
+		args.SeqNumber = atomic.AddUint64(&c.seqNumber, 1)
+	}
+}
+
+// processCallWithRetry sends a command (see client.ProcessCallWithRetry for the retries),
+// turning errors in the reply into errors. The command is traced as ctx says (see
+// client.WithTraceID), or gets a trace id of its own
+func (c *PhatClient) processCallWithRetry(ctx context.Context, args *phatdb.DBCommand) (*phatdb.DBResponse, error) {
+	c.prepare(args)
+	if args.TraceID == "" {
+		args.TraceID = client.TraceID(ctx)
+	}
+	if args.TraceID == "" {
+		args.TraceID = client.NewTraceID()
+	}
+	ctx = client.WithTraceID(ctx, args.TraceID)
+	c.invalidateCommand(args)
+	if queued, err := c.queueWrite(args, nil); queued {
+		return nil, err
+	}
+	reply := &phatdb.DBResponse{}
+	call := c.Cli.ProcessCallWithRetryCtx
+	if args.Stale {
+		call = c.Cli.ProcessStaleCallCtx
+	}
+	if err := call(ctx, "Server.RPCDB", args, reply); err != nil {
+		if queued, queueErr := c.queueWrite(args, err); queued {
+			return nil, queueErr
 		}
+		return nil, err
+	}
+	if err := responseError(reply); err != nil {
+		return nil, err
 	}
+	return reply, nil
 }
 
 func (c *PhatClient) Create(subpath string, initialdata string) (*phatdb.DataNode, error) {
+	return c.CreateCtx(context.Background(), subpath, initialdata)
+}
+
+// CreateCtx is Create, giving up once ctx is done
+func (c *PhatClient) CreateCtx(ctx context.Context, subpath string, initialdata string) (*phatdb.DataNode, error) {
 	c.debug(STATUS, "Creating file %s with data %s", subpath, initialdata)
-	args := &phatdb.DBCommand{"CREATE", subpath, initialdata}
-	reply := &phatdb.DBResponse{}
-	err := c.Cli.ProcessCallWithRetry("Server.RPCDB", args, reply)
+	args := &phatdb.DBCommand{Command: "CREATE", Path: subpath, Value: initialdata, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
 	if err != nil {
 		c.debug(DEBUG, "Create file %s errored %s", subpath, err)
 		return nil, err
 	}
-	replyErr := StringToError(reply.Error)
-	if replyErr != nil {
-		c.debug(DEBUG, "Create file %s errored %s", subpath, replyErr)
-		return nil, replyErr
-	}
 	c.debug(CALL, "Finished creating file %s with data %s", subpath, initialdata)
-	n := reply.Reply.(phatdb.DataNode)
-	return &n, err
+	return toDataNode(reply.Reply)
+}
+
+// CreateContainer creates a node that is deleted once its last child is, e.g. the
+// parent of a lock or queue
+func (c *PhatClient) CreateContainer(subpath string, initialdata string) (*phatdb.DataNode, error) {
+	return c.CreateContainerCtx(context.Background(), subpath, initialdata)
+}
+
+// CreateContainerCtx is CreateContainer, giving up once ctx is done
+func (c *PhatClient) CreateContainerCtx(ctx context.Context, subpath string, initialdata string) (*phatdb.DataNode, error) {
+	args := &phatdb.DBCommand{Command: "CREATE", Path: subpath, Value: initialdata,
+		Flags: phatdb.CONTAINER, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return toDataNode(reply.Reply)
+}
+
+// CreateEphemeral creates a node that is deleted once this client's session ends
+func (c *PhatClient) CreateEphemeral(subpath string, initialdata string) (*phatdb.DataNode, error) {
+	return c.CreateEphemeralCtx(context.Background(), subpath, initialdata)
+}
+
+// CreateEphemeralCtx is CreateEphemeral, giving up once ctx is done
+func (c *PhatClient) CreateEphemeralCtx(ctx context.Context, subpath string, initialdata string) (*phatdb.DataNode, error) {
+	c.debug(STATUS, "Creating ephemeral file %s with data %s", subpath, initialdata)
+	args := &phatdb.DBCommand{Command: "CREATE", Path: subpath, Value: initialdata,
+		Flags: phatdb.EPHEMERAL, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		c.debug(DEBUG, "Create ephemeral file %s errored %s", subpath, err)
+		return nil, err
+	}
+	return toDataNode(reply.Reply)
+}
+
+// CreateTTL creates a node that is deleted once it hasn't been set for ttl
+func (c *PhatClient) CreateTTL(subpath string, initialdata string, ttl time.Duration) (*phatdb.DataNode, error) {
+	return c.CreateTTLCtx(context.Background(), subpath, initialdata, ttl)
+}
+
+// CreateTTLCtx is CreateTTL, giving up once ctx is done
+func (c *PhatClient) CreateTTLCtx(ctx context.Context, subpath string, initialdata string, ttl time.Duration) (*phatdb.DataNode, error) {
+	args := &phatdb.DBCommand{Command: "CREATE", Path: subpath, Value: initialdata, TTL: ttl, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		c.debug(DEBUG, "Create TTL file %s errored %s", subpath, err)
+		return nil, err
+	}
+	return toDataNode(reply.Reply)
+}
+
+// CreateSequential creates a node with a unique, increasing counter appended to its name
+// and returns the path that was actually created
+func (c *PhatClient) CreateSequential(subpath string, initialdata string, ephemeral bool) (string, error) {
+	return c.CreateSequentialCtx(context.Background(), subpath, initialdata, ephemeral)
+}
+
+// CreateSequentialCtx is CreateSequential, giving up once ctx is done
+func (c *PhatClient) CreateSequentialCtx(ctx context.Context, subpath string, initialdata string, ephemeral bool) (string, error) {
+	args := &phatdb.DBCommand{Command: "CREATE_SEQ", Path: subpath, Value: initialdata, Session: c.Cli.Uid}
+	if ephemeral {
+		args.Flags = phatdb.EPHEMERAL
+	}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		c.debug(DEBUG, "Create sequential file %s errored %s", subpath, err)
+		return "", err
+	}
+	return reply.Reply.(string), nil
 }
 
 func (c *PhatClient) GetData(subpath string) (*phatdb.DataNode, error) {
-	args := &phatdb.DBCommand{"GET", subpath, ""}
-	reply := &phatdb.DBResponse{}
-	err := c.Cli.ProcessCallWithRetry("Server.RPCDB", args, reply)
+	return c.GetDataCtx(context.Background(), subpath)
+}
+
+// GetDataCtx is GetData, giving up once ctx is done
+func (c *PhatClient) GetDataCtx(ctx context.Context, subpath string) (*phatdb.DataNode, error) {
+	n, generation := c.cached(subpath)
+	if n != nil {
+		return n, nil
+	}
+	args := &phatdb.DBCommand{Command: "GET", Path: subpath}
+	reply, err := c.processCallWithRetry(ctx, args)
 	if err != nil {
+		c.debug(DEBUG, "Get file %s errored %s", subpath, err)
 		return nil, err
 	}
-	replyErr := StringToError(reply.Error)
-	if replyErr != nil {
-		c.debug(DEBUG, "Get file %s errored %s", subpath, replyErr)
-		return nil, replyErr
+	n, err = toDataNode(reply.Reply)
+	if err == nil {
+		c.cacheStore(subpath, n, generation)
 	}
-	n := reply.Reply.(phatdb.DataNode)
+	return n, err
+}
 
-	return &n, err
+// GetDataVersion gets subpath's data as of an older version, as long as the servers
+// still have it (see phatdb.HistoryLength)
+func (c *PhatClient) GetDataVersion(subpath string, version uint64) (*phatdb.DataNode, error) {
+	return c.GetDataVersionCtx(context.Background(), subpath, version)
+}
+
+// GetDataVersionCtx is GetDataVersion, giving up once ctx is done
+func (c *PhatClient) GetDataVersionCtx(ctx context.Context, subpath string, version uint64) (*phatdb.DataNode, error) {
+	args := &phatdb.DBCommand{Command: "GET_VERSION", Path: subpath, Version: version, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return toDataNode(reply.Reply)
+}
+
+// GetDataIfModified gets subpath's data unless have, a copy from earlier, is still
+// current, in which case only have's version goes to the server and back. It returns the
+// current data (have itself, if it's current) and whether it had changed
+func (c *PhatClient) GetDataIfModified(subpath string, have *phatdb.DataNode) (*phatdb.DataNode, bool, error) {
+	return c.GetDataIfModifiedCtx(context.Background(), subpath, have)
+}
+
+// GetDataIfModifiedCtx is GetDataIfModified, giving up once ctx is done
+func (c *PhatClient) GetDataIfModifiedCtx(ctx context.Context, subpath string, have *phatdb.DataNode) (*phatdb.DataNode, bool, error) {
+	if have == nil || have.Stats == nil {
+		n, err := c.GetDataCtx(ctx, subpath)
+		return n, err == nil, err
+	}
+	args := &phatdb.DBCommand{Command: "GET_IF_MODIFIED", Path: subpath, Version: have.Stats.Version, CreateOp: have.Stats.CreateOp}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil && err.Error() == phatdb.ErrNotModified.Error() {
+		return have, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := toDataNode(reply.Reply)
+	return n, err == nil, err
+}
+
+// MGetData gets the data of several nodes in one call. The data and error for each
+// path are at the same index as the path; err is only set if the call itself failed
+func (c *PhatClient) MGetData(subpaths []string) (nodes []*phatdb.DataNode, errs []error, err error) {
+	return c.MGetDataCtx(context.Background(), subpaths)
+}
+
+// MGetDataCtx is MGetData, giving up once ctx is done
+func (c *PhatClient) MGetDataCtx(ctx context.Context, subpaths []string) (nodes []*phatdb.DataNode, errs []error, err error) {
+	args := &phatdb.DBCommand{Command: "MGET", Paths: subpaths, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	results := reply.Reply.([]phatdb.DBResponse)
+	nodes = make([]*phatdb.DataNode, len(results))
+	errs = make([]error, len(results))
+	for i, result := range results {
+		if errs[i] = responseError(&result); errs[i] == nil {
+			nodes[i], errs[i] = toDataNode(result.Reply)
+		}
+	}
+	return nodes, errs, nil
 }
 
 func (c *PhatClient) SetData(subpath string, data string) error {
+	return c.SetDataCtx(context.Background(), subpath, data)
+}
+
+// SetDataCtx is SetData, giving up once ctx is done
+func (c *PhatClient) SetDataCtx(ctx context.Context, subpath string, data string) error {
 	c.debug(STATUS, "Setting Data")
-	args := &phatdb.DBCommand{"SET", subpath, data}
-	reply := &phatdb.DBResponse{}
-	err := c.Cli.ProcessCallWithRetry("Server.RPCDB", args, reply)
+	args := &phatdb.DBCommand{Command: "SET", Path: subpath, Value: data}
+	_, err := c.processCallWithRetry(ctx, args)
 	if err != nil {
-		return err
-	}
-	replyErr := StringToError(reply.Error)
-	if replyErr != nil {
-		c.debug(DEBUG, "Set file %s errored %s", subpath, replyErr)
-		return replyErr
+		c.debug(DEBUG, "Set file %s errored %s", subpath, err)
 	}
 	return err
 }
 
+// SetDataVersion only sets the data if the node is still at the given version
+// (e.g. the one returned by GetData), so concurrent updates aren't lost.
+// Returns the node with its new version
+func (c *PhatClient) SetDataVersion(subpath string, data string, version uint64) (*phatdb.DataNode, error) {
+	return c.SetDataVersionCtx(context.Background(), subpath, data, version)
+}
+
+// SetDataVersionCtx is SetDataVersion, giving up once ctx is done
+func (c *PhatClient) SetDataVersionCtx(ctx context.Context, subpath string, data string, version uint64) (*phatdb.DataNode, error) {
+	args := &phatdb.DBCommand{Command: "SET_VERSION", Path: subpath, Value: data, Version: version, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		c.debug(DEBUG, "Set file %s at version %d errored %s", subpath, version, err)
+		return nil, err
+	}
+	return toDataNode(reply.Reply)
+}
+
+// GetSet sets subpath's data, returning its data and stats from just before the set
+func (c *PhatClient) GetSet(subpath string, data string) (*phatdb.DataNode, error) {
+	return c.GetSetCtx(context.Background(), subpath, data)
+}
+
+// GetSetCtx is GetSet, giving up once ctx is done
+func (c *PhatClient) GetSetCtx(ctx context.Context, subpath string, data string) (*phatdb.DataNode, error) {
+	args := &phatdb.DBCommand{Command: "GETSET", Path: subpath, Value: data, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return toDataNode(reply.Reply)
+}
+
+// Append adds data to the end of subpath's data, returning the node's new stats
+func (c *PhatClient) Append(subpath string, data string) (*phatdb.StatNode, error) {
+	return c.AppendCtx(context.Background(), subpath, data)
+}
+
+// AppendCtx is Append, giving up once ctx is done
+func (c *PhatClient) AppendCtx(ctx context.Context, subpath string, data string) (*phatdb.StatNode, error) {
+	args := &phatdb.DBCommand{Command: "APPEND", Path: subpath, Value: data, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	n := reply.Reply.(phatdb.StatNode)
+	return &n, nil
+}
+
+// Incr adds delta to the number stored at subpath, returning the new value
+func (c *PhatClient) Incr(subpath string, delta int64) (int64, error) {
+	return c.IncrCtx(context.Background(), subpath, delta)
+}
+
+// IncrCtx is Incr, giving up once ctx is done
+func (c *PhatClient) IncrCtx(ctx context.Context, subpath string, delta int64) (int64, error) {
+	args := &phatdb.DBCommand{Command: "INCR", Path: subpath, Delta: delta, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Reply.(int64), nil
+}
+
 func (c *PhatClient) GetChildren(subpath string) ([]string, error) {
-	args := &phatdb.DBCommand{"CHILDREN", subpath, ""}
-	reply, err := c.processCallWithRetry(args)
+	return c.GetChildrenCtx(context.Background(), subpath)
+}
+
+// GetChildrenCtx is GetChildren, giving up once ctx is done
+func (c *PhatClient) GetChildrenCtx(ctx context.Context, subpath string) ([]string, error) {
+	args := &phatdb.DBCommand{Command: "CHILDREN", Path: subpath}
+	reply, err := c.processCallWithRetry(ctx, args)
 	if err != nil {
 		return nil, err
 	}
 	return reply.Reply.([]string), err
 }
 
+// GetChildrenPage returns up to limit sorted names of subpath's children that start with
+// prefix and come after after. To page through all the children, pass the last name
+// returned as after until fewer than limit names come back
+func (c *PhatClient) GetChildrenPage(subpath, prefix, after string, limit int) ([]string, error) {
+	return c.GetChildrenPageCtx(context.Background(), subpath, prefix, after, limit)
+}
+
+// GetChildrenPageCtx is GetChildrenPage, giving up once ctx is done
+func (c *PhatClient) GetChildrenPageCtx(ctx context.Context, subpath, prefix, after string, limit int) ([]string, error) {
+	args := &phatdb.DBCommand{Command: "CHILDREN", Path: subpath, Prefix: prefix, After: after, Limit: limit}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil || reply.Reply == nil {
+		return nil, err
+	}
+	return reply.Reply.([]string), err
+}
+
 func (c *PhatClient) GetStats(subpath string) (*phatdb.StatNode, error) {
-	args := &phatdb.DBCommand{"STAT", subpath, ""}
-	reply, err := c.processCallWithRetry(args)
+	return c.GetStatsCtx(context.Background(), subpath)
+}
+
+// GetStatsCtx is GetStats, giving up once ctx is done
+func (c *PhatClient) GetStatsCtx(ctx context.Context, subpath string) (*phatdb.StatNode, error) {
+	args := &phatdb.DBCommand{Command: "STAT", Path: subpath}
+	reply, err := c.processCallWithRetry(ctx, args)
 	if err != nil {
 		return nil, err
 	}
@@ -157,16 +544,345 @@ func (c *PhatClient) GetStats(subpath string) (*phatdb.StatNode, error) {
 	return &n, err
 }
 
+// SetACL replaces the access control list of a node
+func (c *PhatClient) SetACL(subpath string, acl []phatdb.ACL) error {
+	return c.SetACLCtx(context.Background(), subpath, acl)
+}
+
+// SetACLCtx is SetACL, giving up once ctx is done
+func (c *PhatClient) SetACLCtx(ctx context.Context, subpath string, acl []phatdb.ACL) error {
+	args := &phatdb.DBCommand{Command: "SETACL", Path: subpath, ACL: acl, Session: c.Cli.Uid}
+	_, err := c.processCallWithRetry(ctx, args)
+	return err
+}
+
+func (c *PhatClient) GetACL(subpath string) ([]phatdb.ACL, error) {
+	return c.GetACLCtx(context.Background(), subpath)
+}
+
+// GetACLCtx is GetACL, giving up once ctx is done
+func (c *PhatClient) GetACLCtx(ctx context.Context, subpath string) ([]phatdb.ACL, error) {
+	args := &phatdb.DBCommand{Command: "GETACL", Path: subpath, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Reply == nil {
+		return nil, nil
+	}
+	return reply.Reply.([]phatdb.ACL), nil
+}
+
+// List returns the nodes matching a glob pattern such as /services/*/endpoints,
+// along with their data if withData is set
+func (c *PhatClient) List(pattern string, withData bool) ([]phatdb.ListEntry, error) {
+	return c.ListCtx(context.Background(), pattern, withData)
+}
+
+// ListCtx is List, giving up once ctx is done
+func (c *PhatClient) ListCtx(ctx context.Context, pattern string, withData bool) ([]phatdb.ListEntry, error) {
+	return c.list(ctx, pattern, 0, withData)
+}
+
+// ListPrefix returns every node whose path starts with prefix
+func (c *PhatClient) ListPrefix(prefix string, withData bool) ([]phatdb.ListEntry, error) {
+	return c.ListPrefixCtx(context.Background(), prefix, withData)
+}
+
+// ListPrefixCtx is ListPrefix, giving up once ctx is done
+func (c *PhatClient) ListPrefixCtx(ctx context.Context, prefix string, withData bool) ([]phatdb.ListEntry, error) {
+	return c.list(ctx, prefix, phatdb.LIST_PREFIX, withData)
+}
+
+func (c *PhatClient) list(ctx context.Context, p string, flags int, withData bool) ([]phatdb.ListEntry, error) {
+	if withData {
+		flags |= phatdb.LIST_DATA
+	}
+	args := &phatdb.DBCommand{Command: "LIST", Path: p, Flags: flags, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil || reply.Reply == nil {
+		return nil, err
+	}
+	entries := reply.Reply.([]phatdb.ListEntry)
+	for i := range entries {
+		if entries[i].Data != nil {
+			if entries[i].Data, err = toDataNode(*entries[i].Data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+// Sync waits until every write committed before it has been applied, so reads made
+// after it see them
+func (c *PhatClient) Sync() error {
+	return c.SyncCtx(context.Background())
+}
+
+// SyncCtx is Sync, giving up once ctx is done
+func (c *PhatClient) SyncCtx(ctx context.Context) error {
+	args := &phatdb.DBCommand{Command: "SYNC", Session: c.Cli.Uid}
+	_, err := c.processCallWithRetry(ctx, args)
+	return err
+}
+
+// SetReadOnly turns the database's read-only mode on or off. While it's on every
+// write fails (with phatdb.ErrReadOnly's message), but reads keep working. Only a
+// client that has authenticated as one of the servers' admins can do it
+func (c *PhatClient) SetReadOnly(readOnly bool) error {
+	return c.SetReadOnlyCtx(context.Background(), readOnly)
+}
+
+// SetReadOnlyCtx is SetReadOnly, giving up once ctx is done
+func (c *PhatClient) SetReadOnlyCtx(ctx context.Context, readOnly bool) error {
+	args := &phatdb.DBCommand{Command: "SET_READONLY", Path: "/", Value: strconv.FormatBool(readOnly), Session: c.Cli.Uid}
+	_, err := c.processCallWithRetry(ctx, args)
+	return err
+}
+
+// SetQuota limits the size of the subtree under subpath (nil removes the quota)
+func (c *PhatClient) SetQuota(subpath string, quota *phatdb.Quota) error {
+	return c.SetQuotaCtx(context.Background(), subpath, quota)
+}
+
+// SetQuotaCtx is SetQuota, giving up once ctx is done
+func (c *PhatClient) SetQuotaCtx(ctx context.Context, subpath string, quota *phatdb.Quota) error {
+	args := &phatdb.DBCommand{Command: "SET_QUOTA", Path: subpath, Quota: quota, Session: c.Cli.Uid}
+	_, err := c.processCallWithRetry(ctx, args)
+	return err
+}
+
+func (c *PhatClient) GetQuota(subpath string) (*phatdb.Quota, error) {
+	return c.GetQuotaCtx(context.Background(), subpath)
+}
+
+// GetQuotaCtx is GetQuota, giving up once ctx is done
+func (c *PhatClient) GetQuotaCtx(ctx context.Context, subpath string) (*phatdb.Quota, error) {
+	args := &phatdb.DBCommand{Command: "GET_QUOTA", Path: subpath, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil || reply.Reply == nil {
+		return nil, err
+	}
+	q := reply.Reply.(phatdb.Quota)
+	return &q, nil
+}
+
+// StartAudit starts recording who changes anything under subpath (see AuditLog)
+func (c *PhatClient) StartAudit(subpath string) error {
+	return c.StartAuditCtx(context.Background(), subpath)
+}
+
+// StartAuditCtx is StartAudit, giving up once ctx is done
+func (c *PhatClient) StartAuditCtx(ctx context.Context, subpath string) error {
+	args := &phatdb.DBCommand{Command: "START_AUDIT", Path: subpath, Session: c.Cli.Uid}
+	_, err := c.processCallWithRetry(ctx, args)
+	return err
+}
+
+// StopAudit stops recording changes under subpath. The entries already recorded are kept
+func (c *PhatClient) StopAudit(subpath string) error {
+	return c.StopAuditCtx(context.Background(), subpath)
+}
+
+// StopAuditCtx is StopAudit, giving up once ctx is done
+func (c *PhatClient) StopAuditCtx(ctx context.Context, subpath string) error {
+	args := &phatdb.DBCommand{Command: "STOP_AUDIT", Path: subpath, Session: c.Cli.Uid}
+	_, err := c.processCallWithRetry(ctx, args)
+	return err
+}
+
+// AuditLog returns the last limit (0 for all) recorded changes to subpath and its subtree,
+// oldest first
+func (c *PhatClient) AuditLog(subpath string, limit int) ([]phatdb.AuditEntry, error) {
+	return c.AuditLogCtx(context.Background(), subpath, limit)
+}
+
+// AuditLogCtx is AuditLog, giving up once ctx is done
+func (c *PhatClient) AuditLogCtx(ctx context.Context, subpath string, limit int) ([]phatdb.AuditEntry, error) {
+	args := &phatdb.DBCommand{Command: "AUDIT_LOG", Path: subpath, Limit: limit, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Reply.([]phatdb.AuditEntry), nil
+}
+
 // Delete deletes a node if it doesn't have any children
 func (c *PhatClient) Delete(subpath string) error {
-	args := &phatdb.DBCommand{"DELETE", subpath, ""}
-	_, err := c.processCallWithRetry(args)
+	return c.DeleteCtx(context.Background(), subpath)
+}
+
+// DeleteCtx is Delete, giving up once ctx is done
+func (c *PhatClient) DeleteCtx(ctx context.Context, subpath string) error {
+	args := &phatdb.DBCommand{Command: "DELETE", Path: subpath}
+	_, err := c.processCallWithRetry(ctx, args)
+	return err
+}
+
+// DeleteRecursive deletes a node along with everything under it
+func (c *PhatClient) DeleteRecursive(subpath string) error {
+	return c.DeleteRecursiveCtx(context.Background(), subpath)
+}
+
+// DeleteRecursiveCtx is DeleteRecursive, giving up once ctx is done
+func (c *PhatClient) DeleteRecursiveCtx(ctx context.Context, subpath string) error {
+	args := &phatdb.DBCommand{Command: "DELETE_RECURSIVE", Path: subpath, Session: c.Cli.Uid}
+	_, err := c.processCallWithRetry(ctx, args)
+	return err
+}
+
+// Lock takes the advisory lock on subpath for this client's session, returning its
+// fencing token. The lock is released by Unlock or when the session ends
+func (c *PhatClient) Lock(subpath string) (uint64, error) {
+	return c.LockCtx(context.Background(), subpath)
+}
+
+// LockCtx is Lock, giving up once ctx is done
+func (c *PhatClient) LockCtx(ctx context.Context, subpath string) (uint64, error) {
+	args := &phatdb.DBCommand{Command: "LOCK", Path: subpath, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Reply.(uint64), nil
+}
+
+func (c *PhatClient) Unlock(subpath string) error {
+	return c.UnlockCtx(context.Background(), subpath)
+}
+
+// UnlockCtx is Unlock, giving up once ctx is done
+func (c *PhatClient) UnlockCtx(ctx context.Context, subpath string) error {
+	args := &phatdb.DBCommand{Command: "UNLOCK", Path: subpath, Session: c.Cli.Uid}
+	_, err := c.processCallWithRetry(ctx, args)
+	return err
+}
+
+// Copy copies subpath to target. flags are phatdb.WITH_SUBTREE to copy the whole
+// subtree and phatdb.RESET_VERSIONS to start the copies' versions over
+func (c *PhatClient) Copy(subpath string, target string, flags int) (*phatdb.DataNode, error) {
+	return c.CopyCtx(context.Background(), subpath, target, flags)
+}
+
+// CopyCtx is Copy, giving up once ctx is done
+func (c *PhatClient) CopyCtx(ctx context.Context, subpath string, target string, flags int) (*phatdb.DataNode, error) {
+	return c.copyOrMove(ctx, "COPY", subpath, target, flags)
+}
+
+// Move atomically moves (renames) subpath to target, with the same flags as Copy
+func (c *PhatClient) Move(subpath string, target string, flags int) (*phatdb.DataNode, error) {
+	return c.MoveCtx(context.Background(), subpath, target, flags)
+}
+
+// MoveCtx is Move, giving up once ctx is done
+func (c *PhatClient) MoveCtx(ctx context.Context, subpath string, target string, flags int) (*phatdb.DataNode, error) {
+	return c.copyOrMove(ctx, "MOVE", subpath, target, flags)
+}
+
+func (c *PhatClient) copyOrMove(ctx context.Context, command string, subpath string, target string, flags int) (*phatdb.DataNode, error) {
+	args := &phatdb.DBCommand{Command: command, Path: subpath, Target: target, Flags: flags, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return toDataNode(reply.Reply)
+}
+
+// Exists returns whether there's a node at subpath
+func (c *PhatClient) Exists(subpath string) (bool, error) {
+	return c.ExistsCtx(context.Background(), subpath)
+}
+
+// ExistsCtx is Exists, giving up once ctx is done
+func (c *PhatClient) ExistsCtx(ctx context.Context, subpath string) (bool, error) {
+	args := &phatdb.DBCommand{Command: "EXISTS", Path: subpath, Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return false, err
+	}
+	return reply.Reply.(bool), nil
+}
+
+// ExistsW is Exists, but if there's no node at subpath it also leaves a watch: the
+// returned channel is closed once the node is created
+func (c *PhatClient) ExistsW(subpath string) (bool, <-chan struct{}, error) {
+	return c.ExistsWCtx(context.Background(), subpath)
+}
+
+// ExistsWCtx is ExistsW, giving up on the check (though not the watch) once ctx is done
+func (c *PhatClient) ExistsWCtx(ctx context.Context, subpath string) (bool, <-chan struct{}, error) {
+	exists, err := c.ExistsCtx(ctx, subpath)
+	if err != nil || exists {
+		return exists, nil, err
+	}
+	created := make(chan struct{})
+	go c.watchExists(subpath, created)
+	return false, created, nil
+}
+
+// watchExists keeps a WatchExists call open until subpath exists, then closes created.
+// It gives up (without closing created) once the client is closed
+func (c *PhatClient) watchExists(subpath string, created chan struct{}) {
+	args := &phatdb.DBCommand{Command: "EXISTS", Path: subpath, Session: c.Cli.Uid}
+	c.prepare(args)
+	for {
+		reply := &phatdb.DBResponse{}
+		conn, _ := c.Cli.Conn()
+		err := conn.Call("Server.WatchExists", args, reply)
+		if err == rpc.ErrShutdown && atomic.LoadInt32(&c.closed) == 1 {
+			return
+		}
+		if err == nil && reply.Reply == true {
+			close(created)
+			return
+		}
+		if err != nil || reply.Error != "" {
+			c.debug(DEBUG, "Watch on %s failed: %v %s", subpath, err, reply.Error)
+			time.Sleep(c.Cli.Options.RetryDelay)
+			c.Cli.ReconnectFrom(conn, err)
+		}
+	}
+}
+
+// Close ends this client's session, deleting any ephemeral nodes it created and
+// releasing its locks
+func (c *PhatClient) Close() error {
+	return c.CloseCtx(context.Background())
+}
+
+// CloseCtx is Close, giving up once ctx is done
+func (c *PhatClient) CloseCtx(ctx context.Context) error {
+	args := &phatdb.DBCommand{Command: "CLOSE_SESSION", Session: c.Cli.Uid}
+	_, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&c.closed, 1)
+	conn, _ := c.Cli.Conn()
+	return conn.Close()
+}
+
+// DeleteVersion deletes a node only if it is still at the given version
+func (c *PhatClient) DeleteVersion(subpath string, version uint64) error {
+	return c.DeleteVersionCtx(context.Background(), subpath, version)
+}
+
+// DeleteVersionCtx is DeleteVersion, giving up once ctx is done
+func (c *PhatClient) DeleteVersionCtx(ctx context.Context, subpath string, version uint64) error {
+	args := &phatdb.DBCommand{Command: "DELETE_VERSION", Path: subpath, Version: version, Session: c.Cli.Uid}
+	_, err := c.processCallWithRetry(ctx, args)
 	return err
 }
 
 func (c *PhatClient) GetHash() (string, error) {
-	args := &phatdb.DBCommand{"SHA256", "", ""}
-	reply, err := c.processCallWithRetry(args)
+	return c.GetHashCtx(context.Background())
+}
+
+// GetHashCtx is GetHash, giving up once ctx is done
+func (c *PhatClient) GetHashCtx(ctx context.Context) (string, error) {
+	args := &phatdb.DBCommand{Command: "SHA256"}
+	reply, err := c.processCallWithRetry(ctx, args)
 	if err != nil {
 		return "", err
 	}
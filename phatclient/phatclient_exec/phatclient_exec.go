@@ -40,8 +40,8 @@ func main() {
 	n, err := cli.GetData("/dev/null")
 	if err != nil {
 		log.Printf("Expected no error from GetData, got %s", err)
-	} else if "empty" != n.Value {
-		log.Printf("Expected %s, got %s", "empty", n.Value)
+	} else if "empty" != string(n.Value) {
+		log.Printf("Expected %s, got %s", "empty", string(n.Value))
 	}
 
 	fmt.Println("Setting /dev -- should succeed")
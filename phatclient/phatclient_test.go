@@ -1,11 +1,24 @@
 package phatclient
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
 	"fmt"
+	"github.com/mgentili/goPhat/client"
+	"github.com/mgentili/goPhat/level_log"
 	"github.com/mgentili/goPhat/phatRPC"
+	"github.com/mgentili/goPhat/phatdb"
 	"github.com/mgentili/goPhat/vr"
+	"io"
+	"io/ioutil"
 	"log"
+	"net/rpc"
+	"sync"
 	"testing"
+	"time"
 )
 
 const BASE = 9000
@@ -16,12 +29,13 @@ var client_config = []string{"127.0.0.1:6000", "127.0.0.1:6001", "127.0.0.1:6002
 func TestClientConnection(t *testing.T) {
 	for i := 0; i < 3; i = i + 1 {
 		newReplica := vr.RunAsReplica(uint(i), replica_config)
-		phatRPC.StartServer(client_config[i], newReplica)
+		phatRPC.StartServerWithConfig(client_config[i], newReplica, phatRPC.Config{ForwardWrites: true, ReadBatchWindow: time.Millisecond, ResponseCacheSize: 100})
 	}
 
-	cli, err := NewClient(client_config, 1, "1unique")
+	// the cluster's only just started, so it may not have a master yet
+	cli, err := NewClientWait(client_config, 1, "1unique", time.Now().Add(10*time.Second))
 	if err != nil {
-		log.Printf(err.Error())
+		t.Fatalf("Cluster never came up: %s", err)
 	}
 
 	/*h, _ := cli.GetHash()
@@ -39,28 +53,532 @@ func TestClientConnection(t *testing.T) {
 	fmt.Println("Creating /dev/null -- should succeed")
 	_, err = cli.Create("/dev/null", "empty")
 	if err != nil {
-		t.Errorf(fmt.Sprintf("Expected no error from Create, got %s"), err)
+		t.Errorf("Expected no error from Create, got %s", err)
 	}
 
 	fmt.Println("Trying to get /dev/null -- should succeed")
 	n, err := cli.GetData("/dev/null")
 	if err != nil {
-		t.Errorf(fmt.Sprintf("Expected no error from GetData, got %s"), err)
-	} else if "empty" != n.Value {
-		t.Errorf(fmt.Sprintf("Expected %s, got %s", "empty", n.Value))
+		t.Errorf("Expected no error from GetData, got %s", err)
+	} else if "empty" != string(n.Value) {
+		t.Errorf("Expected %s, got %s", "empty", string(n.Value))
 	}
 
 	fmt.Println("Setting /dev -- should succeed")
 	err = cli.SetData("/dev", "something")
 	if err != nil {
-		t.Errorf(fmt.Sprintf("Expected no error from SetData, got %s"), err)
+		t.Errorf("Expected no error from SetData, got %s", err)
 	}
 
 	fmt.Println("Trying to get /dev -- should succeed")
 	n, err = cli.GetData("/dev")
 	if err != nil {
-		t.Errorf(fmt.Sprintf("Expected no error from GetData, got %s"), err)
-	} else if "something" != n.Value {
-		t.Errorf(fmt.Sprintf("Expected %s, got %s", "something", n.Value))
+		t.Errorf("Expected no error from GetData, got %s", err)
+	} else if "something" != string(n.Value) {
+		t.Errorf("Expected %s, got %s", "something", string(n.Value))
+	}
+	fmt.Println("Checking /dev/zero exists -- shouldn't, so watch it")
+	exists, created, err := cli.ExistsW("/dev/zero")
+	if err != nil || exists {
+		t.Errorf("Expected /dev/zero not to exist, got %v %v", exists, err)
+	}
+	if _, err = cli.Create("/dev/zero", ""); err != nil {
+		t.Errorf("Expected no error from Create, got %s", err)
+	}
+	select {
+	case <-created:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Watch on /dev/zero didn't fire")
+	}
+	if exists, err = cli.Exists("/dev/zero"); err != nil || !exists {
+		t.Errorf("Expected /dev/zero to exist, got %v %v", exists, err)
+	}
+
+	fmt.Println("Caching /dev in another client, then changing it")
+	cli2, err := NewClient(client_config, 1, "2unique")
+	if err != nil {
+		t.Fatalf("Expected no error from NewClient, got %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		// the first read (or so) races with the cache starting up
+		cli2.GetData("/dev")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = cli.SetData("/dev", "changed"); err != nil {
+		t.Errorf("Expected no error from SetData, got %s", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, err = cli2.GetData("/dev")
+		if err == nil && string(n.Value) == "changed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("Cached /dev was never invalidated, still got %v %v", n, err)
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fmt.Println("Taking a lock in one client, then the other")
+	lock1, lock2 := cli.NewLock("/locks/a"), cli2.NewLock("/locks/a")
+	token, err := lock1.Acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error from Acquire, got %s", err)
+	}
+	if ok, err := lock2.TryLock(); ok || err != nil {
+		t.Errorf("Expected TryLock of a held lock to fail, got %v %v", ok, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if _, err = lock2.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Acquire to time out, got %v", err)
+	}
+	cancel()
+	acquired := make(chan uint64)
+	go func() {
+		token, _ := lock2.Acquire(context.Background())
+		acquired <- token
+	}()
+	if err = lock1.Release(); err != nil {
+		t.Errorf("Expected no error from Release, got %s", err)
+	}
+	select {
+	case token2 := <-acquired:
+		if token2 <= token {
+			t.Errorf("Expected a bigger fencing token than %d, got %d", token, token2)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Acquire didn't get the released lock")
+	}
+
+	fmt.Println("Checking the first holder's sequencer is stale")
+	seq, err := ParseSequencer(lock1.Sequencer().String())
+	if err != nil || seq != lock1.Sequencer() {
+		t.Errorf("Sequencer didn't round trip: %v %v", seq, err)
+	}
+	if ok, err := cli.CheckSequencer(seq); ok || err != nil {
+		t.Errorf("Expected the released lock's sequencer to be stale, got %v %v", ok, err)
+	}
+	if ok, err := cli.CheckSequencer(lock2.Sequencer()); !ok || err != nil {
+		t.Errorf("Expected the new holder's sequencer to be current, got %v %v", ok, err)
+	}
+
+	fmt.Println("Canceling a call")
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err = cli.GetStatsCtx(ctx, "/dev"); err != context.Canceled {
+		t.Errorf("Expected a canceled call to fail with context.Canceled, got %v", err)
+	}
+
+	fmt.Println("Running a transaction")
+	results, err := cli.Multi().Create("/multi", "a").Set("/multi", "b").Get("/multi").Commit()
+	if err != nil {
+		t.Fatalf("Expected no error from Commit, got %s", err)
+	}
+	if n := results[2].(*phatdb.DataNode); string(n.Value) != "b" {
+		t.Errorf("Expected the transaction's GET to see its SET, got %s", n.Value)
+	}
+	if _, err = cli.Multi().Delete("/multi").Delete("/missing").Commit(); err == nil {
+		t.Errorf("Expected a transaction with a failing op to fail")
+	}
+	if exists, _ := cli.Exists("/multi"); !exists {
+		t.Errorf("Expected a failed transaction not to delete /multi")
+	}
+
+	fmt.Println("Reading /dev from the followers")
+	cli3, err := NewClientWithOptions(client_config, 1, "3unique", client.Options{ReadFromFollowers: true})
+	if err != nil {
+		t.Fatalf("Expected no error from NewClientWithOptions, got %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		// a replica may not have caught up yet, so wait for the value
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			n, err = cli3.GetDataStale("/dev")
+			if err == nil && string(n.Value) == "changed" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("Stale read %d got %v %v", i, n, err)
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	fmt.Println("Locking /secret down to one user")
+	if err = cli3.Authenticate("digest", "alice:secret"); err != nil {
+		t.Errorf("Expected no error from Authenticate, got %s", err)
+	}
+	cli3.Create("/secret", "shh")
+	acl := []phatdb.ACL{{Scheme: "digest", Id: phatdb.DigestId("alice:secret"), Perms: phatdb.PERM_ALL}}
+	if err = cli3.SetACL("/secret", acl); err != nil {
+		t.Errorf("Expected no error from SetACL, got %s", err)
+	}
+	if _, err = cli3.GetDataVersion("/secret", 1); err != nil {
+		t.Errorf("Expected alice to be able to read /secret, got %s", err)
+	}
+	if _, err = cli.GetDataVersion("/secret", 1); err != phatdb.ErrNotAuthorized {
+		t.Errorf("Expected anyone else reading /secret to fail, got %v", err)
+	}
+	if err = cli.SetData("/secret", "told"); err != phatdb.ErrNotAuthorized {
+		t.Errorf("Expected anyone else writing /secret to fail, got %v", err)
+	}
+	// proving who you are works too
+	if err = cli.Authenticate("digest", "alice:wrong"); err != nil {
+		t.Errorf("Expected no error from Authenticate, got %s", err)
+	}
+	if _, err = cli.GetDataVersion("/secret", 1); err == nil {
+		t.Errorf("Expected the wrong password not to get into /secret")
+	}
+	if err = cli.Authenticate("digest", "alice:secret"); err != nil {
+		t.Errorf("Expected no error from Authenticate, got %s", err)
+	}
+	if _, err = cli.GetDataVersion("/secret", 1); err != nil {
+		t.Errorf("Expected an authenticated alice to be able to read /secret, got %s", err)
+	}
+	if err = cli.Authenticate("nonsense", "alice"); err == nil || err.Error() != phatdb.ErrUnknownScheme.Error() {
+		t.Errorf("Expected an unknown scheme to be turned away, got %v", err)
+	}
+
+	fmt.Println("Deleting /dev/zero, at the wrong version and then the right one")
+	stats, err := cli.GetStats("/dev/zero")
+	if err != nil {
+		t.Fatalf("Expected no error from GetStats, got %s", err)
+	}
+	if err = cli.DeleteVersion("/dev/zero", stats.Version+1); err != phatdb.ErrBadVersion || Code(err) != phatdb.CodeBadVersion {
+		t.Errorf("Expected DeleteVersion at the wrong version to fail with BadVersion, got %v", err)
+	}
+	if err = cli.DeleteVersion("/dev/zero", stats.Version); err != nil {
+		t.Errorf("Expected no error from DeleteVersion, got %s", err)
+	}
+	if err = cli.Delete("/dev/null"); err != nil {
+		t.Errorf("Expected no error from Delete, got %s", err)
+	}
+	for _, p := range []string{"/dev/zero", "/dev/null"} {
+		if exists, err := cli.Exists(p); exists || err != nil {
+			t.Errorf("Expected %s to be gone, got %v %v", p, exists, err)
+		}
+	}
+
+	fmt.Println("Streaming a value bigger than a node, with a break in the upload")
+	StreamChunkSize = 4 << 10
+	big := make([]byte, 5*StreamChunkSize+100)
+	rand.Read(big)
+	w, err := cli.CreateStream("/big")
+	if err != nil {
+		t.Fatalf("Expected no error from CreateStream, got %s", err)
+	}
+	w.Write(big[:2*StreamChunkSize+10])
+	if _, err = cli.OpenStream("/big"); err != ErrStreamIncomplete {
+		t.Errorf("Expected an unfinished stream not to open, got %v", err)
+	}
+	w, offset, err := cli.ResumeStream("/big")
+	if err != nil || offset != int64(2*StreamChunkSize) {
+		t.Fatalf("Expected to resume at %d, got %d %v", 2*StreamChunkSize, offset, err)
+	}
+	w.Write(big[offset:])
+	if err = w.Close(); err != nil {
+		t.Errorf("Expected no error closing the stream, got %s", err)
+	}
+	var got bytes.Buffer
+	if n, err := cli.GetStream("/big", &got); err != nil || n != int64(len(big)) || !bytes.Equal(got.Bytes(), big) {
+		t.Errorf("Expected to read back %d bytes, got %d %v", len(big), n, err)
+	}
+	r, _ := cli.OpenStream("/big")
+	r.Seek(int64(3*StreamChunkSize-1), io.SeekStart)
+	rest, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(rest, big[3*StreamChunkSize-1:]) {
+		t.Errorf("Expected to read from the middle of the stream, got %d bytes %v", len(rest), err)
+	}
+	// replacing it leaves the old stream readable until the new one's closed
+	w, err = cli.CreateStream("/big")
+	if err != nil {
+		t.Fatalf("Expected no error from CreateStream, got %s", err)
+	}
+	w.Write(big[:StreamChunkSize+1])
+	got.Reset()
+	if n, err := cli.GetStream("/big", &got); err != nil || n != int64(len(big)) {
+		t.Errorf("Expected the old stream while the new one's being written, got %d bytes %v", n, err)
+	}
+	if err = w.Close(); err != nil {
+		t.Errorf("Expected no error closing the stream, got %s", err)
+	}
+	got.Reset()
+	if n, err := cli.GetStream("/big", &got); err != nil || !bytes.Equal(got.Bytes(), big[:StreamChunkSize+1]) {
+		t.Errorf("Expected the new stream once it's closed, got %d bytes %v", n, err)
+	}
+
+	fmt.Println("Getting /dev only if it's changed")
+	dev, err := cli.GetData("/dev")
+	if err != nil {
+		t.Fatalf("Expected no error from GetData, got %s", err)
+	}
+	if n, modified, err := cli.GetDataIfModified("/dev", dev); err != nil || modified || n != dev {
+		t.Errorf("Expected /dev not to have changed, got %v %v", modified, err)
+	}
+	cli.SetData("/dev", "something else")
+	if n, modified, err := cli.GetDataIfModified("/dev", dev); err != nil || !modified || string(n.Value) != "something else" {
+		t.Errorf("Expected /dev to have changed, got %v %v", modified, err)
+	}
+
+	fmt.Println("Picking up a session in a new client")
+	again, err := NewClient(client_config, 0, "2unique")
+	if err != nil {
+		t.Fatalf("Couldn't connect: %s", err)
+	}
+	if again.seqNumber == 0 || again.seqNumber != cli2.seqNumber {
+		t.Errorf("Expected the new client to carry on from write %d, got %d", cli2.seqNumber, again.seqNumber)
+	}
+	if info, err := again.Session(); err != nil || len(info.Locks) != 1 || info.Locks[0] != "/locks/a" {
+		t.Errorf("Expected the session to still hold /locks/a, got %+v %v", info, err)
+	}
+
+	fmt.Println("Writing through a server that isn't the master")
+	if ping, err := cli.Cli.Ping(context.Background()); err != nil || ping.Role != client.RoleMaster || ping.Skew > time.Second || ping.Skew < -time.Second {
+		t.Errorf("Expected the master to answer a ping, got %+v %v", ping, err)
+	}
+	if hello := cli.Cli.ServerHello(); hello.Version != client.ProtocolVersion || !hello.Has(client.FeatureForwarding) {
+		t.Errorf("Expected the server to say it forwards writes, got %+v", hello)
+	}
+	follower := (cli.Cli.Master() + 1) % uint(len(client_config))
+	conn, err := rpc.Dial("tcp", client_config[follower])
+	if err != nil {
+		t.Fatalf("Couldn't connect to server %d: %s", follower, err)
+	}
+	reply := &phatdb.DBResponse{}
+	err = conn.Call("Server.RPCDB", &phatdb.DBCommand{Command: "CREATE", Path: "/forwarded", Value: "yes"}, reply)
+	if err != nil || reply.Error != "" {
+		t.Errorf("Expected server %d to forward the write, got %v %v", follower, reply, err)
+	}
+	if n, err := cli.GetData("/forwarded"); err != nil || string(n.Value) != "yes" {
+		t.Errorf("Expected the forwarded write to have happened, got %v %v", n, err)
+	}
+	// nor can clients send what only the servers should
+	if err := conn.Call("Server.RPCDB", &phatdb.DBCommand{Command: "RENEW_SESSIONS"}, reply); err != nil || reply.Error != phatdb.ErrNotAuthorized.Error() {
+		t.Errorf("Expected RENEW_SESSIONS from a client to be turned away, got %v %v", reply, err)
+	}
+	// reads still get sent to the master
+	if err := conn.Call("Server.RPCDB", &phatdb.DBCommand{Command: "GET", Path: "/forwarded"}, reply); err == nil {
+		t.Errorf("Expected a read from server %d to be redirected", follower)
+	}
+	conn.Close()
+
+	fmt.Println("Retrying a committed write")
+	cli.Create("/counters/retried", "0")
+	incr := &phatdb.DBCommand{Command: "INCR", Path: "/counters/retried", Delta: 1}
+	first, err := cli.processCallWithRetry(context.Background(), incr)
+	if err != nil {
+		t.Fatalf("INCR failed: %s", err)
+	}
+	// the same command keeps its number, so it's a retry as far as the servers can tell
+	second, err := cli.processCallWithRetry(context.Background(), incr)
+	if err != nil || second.Reply != first.Reply {
+		t.Errorf("Expected the retry to get the same reply, got %v %v", second, err)
+	}
+	if n, err := cli.Incr("/counters/retried", 0); err != nil || n != 1 {
+		t.Errorf("Expected the counter to have gone up once, got %d %v", n, err)
+	}
+
+	fmt.Println("Expiring sessions that aren't kept alive")
+	if err := cli2.StartSession(time.Second); err != nil {
+		t.Fatalf("Couldn't start a session: %s", err)
+	}
+	cli2.CreateEphemeral("/sessions/kept", "")
+	cli4, err := NewClient(client_config, 0, "4unique")
+	if err != nil {
+		t.Fatalf("Couldn't connect: %s", err)
+	}
+	// opened, but never renewed
+	if _, err := cli4.processCallWithRetry(context.Background(), &phatdb.DBCommand{Command: "OPEN_SESSION", Session: "4unique", TTL: time.Second}); err != nil {
+		t.Fatalf("Couldn't open a session: %s", err)
+	}
+	cli4.CreateEphemeral("/sessions/dropped", "")
+	expireBy := time.Now().Add(10 * time.Second)
+	for exists, _ := cli.Exists("/sessions/dropped"); exists; exists, _ = cli.Exists("/sessions/dropped") {
+		if time.Now().After(expireBy) {
+			t.Fatalf("Expected the session that wasn't renewed to expire")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if exists, err := cli.Exists("/sessions/kept"); err != nil || !exists {
+		t.Errorf("Expected the session that was renewed to last, got %v %v", exists, err)
+	}
+
+	fmt.Println("Sharing one client between goroutines")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := fmt.Sprintf("/shared/%d", i)
+			if _, err := cli.Create(p, p); err != nil {
+				t.Errorf("Expected no error creating %s, got %s", p, err)
+			}
+			if n, err := cli.GetData(p); err != nil || string(n.Value) != p {
+				t.Errorf("Expected to read back %s, got %v", p, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	fmt.Println("Keeping JSON config in /config/app")
+	type config struct {
+		Replicas int
+		Tags     []string
+	}
+	cli.Create("/config/app", "")
+	if err = cli.SetJSON("/config/app", config{Replicas: 1}); err != nil {
+		t.Errorf("Expected no error from SetJSON, got %s", err)
+	}
+	var conf config
+	stats, err = cli.UpdateJSON("/config/app", &conf, func() error {
+		conf.Replicas++
+		conf.Tags = append(conf.Tags, "web")
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected no error from UpdateJSON, got %s", err)
+	}
+	conf = config{}
+	if _, err := cli2.GetJSON("/config/app", &conf); err != nil || conf.Replicas != 2 || len(conf.Tags) != 1 {
+		t.Errorf("Expected 2 replicas tagged web, got %+v %v", conf, err)
+	}
+	if _, err = cli.SetJSONVersion("/config/app", conf, stats.Version-1); err == nil {
+		t.Errorf("Expected SetJSONVersion at an old version to fail")
+	}
+
+	fmt.Println("Two clients meeting at a barrier")
+	b1, b2 := cli.NewBarrier("/barriers/b", 2), cli2.NewBarrier("/barriers/b", 2)
+	entered := make(chan error)
+	go func() { entered <- b1.Enter() }()
+	select {
+	case err = <-entered:
+		t.Errorf("Expected to wait at the barrier alone, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err = b2.Enter(); err != nil {
+		t.Errorf("Expected no error entering the barrier, got %s", err)
+	}
+	select {
+	case err = <-entered:
+		if err != nil {
+			t.Errorf("Expected no error entering the barrier, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected both clients to get through the barrier")
+	}
+	left := make(chan error)
+	go func() { left <- b1.Leave() }()
+	if err = b2.Leave(); err != nil {
+		t.Errorf("Expected no error leaving the barrier, got %s", err)
+	}
+	if err = <-left; err != nil {
+		t.Errorf("Expected no error leaving the barrier, got %s", err)
+	}
+	if kids, err := cli.GetChildren("/barriers/b"); err != nil || len(kids) != 0 {
+		t.Errorf("Expected the barrier to be empty, got %v %v", kids, err)
+	}
+
+	fmt.Println("Registering and discovering a service")
+	ctx, cancel = context.WithCancel(context.Background())
+	members := cli.WatchService(ctx, "web")
+	if m := <-members; len(m) != 0 {
+		t.Errorf("Expected no members at first, got %v", m)
+	}
+	reg1, err := cli.Register("web", "10.0.0.1:80")
+	if err != nil {
+		t.Fatalf("Expected no error from Register, got %s", err)
+	}
+	cli2.Register("web", "10.0.0.2:80")
+	if endpoints, err := cli.Discover("web"); err != nil || len(endpoints) != 2 || endpoints[0] != "10.0.0.1:80" {
+		t.Errorf("Expected both endpoints, oldest first, got %v %v", endpoints, err)
+	}
+	reg1.Deregister()
+	giveUp := time.After(10 * time.Second)
+	for m := []string{}; len(m) != 1 || m[0] != "10.0.0.2:80"; {
+		select {
+		case m = <-members:
+		case <-giveUp:
+			t.Fatalf("Expected the watch to see 10.0.0.1:80 leave")
+		}
+	}
+	cancel()
+}
+
+func TestPrepareNumbersWrites(t *testing.T) {
+	c := &PhatClient{Cli: &client.Client{Uid: "u"}}
+	set := &phatdb.DBCommand{Command: "SET", Path: "/a"}
+	get := &phatdb.DBCommand{Command: "GET", Path: "/a"}
+	set2 := &phatdb.DBCommand{Command: "SET", Path: "/a"}
+	c.prepare(set)
+	c.prepare(get)
+	c.prepare(set2)
+	if set.SeqNumber != 1 || get.SeqNumber != 0 || set2.SeqNumber != 2 || set.Session != "u" {
+		t.Errorf("Expected writes numbered 1 and 2 in session u, got %+v %+v %+v", set, get, set2)
+	}
+	// retries keep their number
+	c.prepare(set)
+	if set.SeqNumber != 1 {
+		t.Errorf("Expected a retry to keep its number, got %d", set.SeqNumber)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	c := &PhatClient{}
+	for _, p := range []string{"/a", "/a/c", "/a/c/x", "/b"} {
+		c.cacheStore(p, &phatdb.DataNode{Stats: &phatdb.StatNode{}}, c.Cache.generation)
+	}
+	// a change to /a/c changes /a's children too
+	c.invalidate([]string{"/a/c"}, false)
+	for p, want := range map[string]bool{"/a": false, "/a/c": false, "/a/c/x": false, "/b": true} {
+		if _, ok := c.Cache.nodes[p]; ok != want {
+			t.Errorf("Expected %s cached: %v, got %v", p, want, ok)
+		}
+	}
+}
+
+func TestStreamWriteFails(t *testing.T) {
+	defer func(size int) { StreamChunkSize = size }(StreamChunkSize)
+	StreamChunkSize = 16
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c := &PhatClient{Cli: &client.Client{Uid: "u", Log: level_log.NewLL(ioutil.Discard, "")}}
+	w := &StreamWriter{c: c, ctx: ctx, path: "/s", upload: uploadPath("/s"), hash: sha1.New()}
+	w.buf = []byte("held")
+	// none of p was uploaded, so none of it was written, and it isn't kept either
+	if n, err := w.Write(make([]byte, 20)); n != 0 || err == nil {
+		t.Errorf("Expected nothing written, got %d %v", n, err)
+	}
+	if string(w.buf) != "held" {
+		t.Errorf("Expected only the earlier writes to be held, got %q", w.buf)
+	}
+}
+
+func TestOfflineQueue(t *testing.T) {
+	c := &PhatClient{Cli: &client.Client{Uid: "u"}}
+	set := &phatdb.DBCommand{Command: "SET", Path: "/a"}
+	set2 := &phatdb.DBCommand{Command: "SET", Path: "/b"}
+	get := &phatdb.DBCommand{Command: "GET", Path: "/a"}
+	if queued, _ := c.queueWrite(set, client.ErrGaveUp); queued {
+		t.Errorf("Expected nothing queued until the queue's enabled")
+	}
+	var overflowed *phatdb.DBCommand
+	c.EnableOfflineQueue(OfflineOptions{MaxQueued: 1, Overflow: func(args *phatdb.DBCommand) { overflowed = args }})
+	if queued, _ := c.queueWrite(set, errors.New("no such node")); queued {
+		t.Errorf("Expected a write that failed on the server not to be queued")
+	}
+	if queued, err := c.queueWrite(set, client.ErrGaveUp); !queued || err != ErrQueued {
+		t.Errorf("Expected a write that timed out to be queued, got %v", err)
+	}
+	if queued, _ := c.queueWrite(get, client.ErrGaveUp); queued {
+		t.Errorf("Expected reads never to be queued")
+	}
+	// writes behind a queued one wait their turn, even when connected
+	if queued, err := c.queueWrite(set2, nil); !queued || err != ErrQueueFull || overflowed != set2 {
+		t.Errorf("Expected the second write to overflow the queue, got %v", err)
+	}
+	if c.Queued() != 1 {
+		t.Errorf("Expected 1 queued write, got %d", c.Queued())
 	}
 }
@@ -0,0 +1,129 @@
+package phatclient
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+)
+
+// the node services register under, one child per service
+const ServicesRoot = "/services"
+
+// Registration is one endpoint of a service, registered with Register. It's an ephemeral
+// node, so it goes away by itself if the client's session ends
+type Registration struct {
+	c        *PhatClient
+	Service  string
+	Endpoint string
+	Path     string // the registration's node
+}
+
+func servicePath(service string) string {
+	return path.Join(ServicesRoot, service)
+}
+
+// Register adds endpoint (e.g. "host:port") to service, until Deregister is called or
+// the session ends
+func (c *PhatClient) Register(service string, endpoint string) (*Registration, error) {
+	return c.RegisterCtx(context.Background(), service, endpoint)
+}
+
+// RegisterCtx is Register, giving up once ctx is done
+func (c *PhatClient) RegisterCtx(ctx context.Context, service string, endpoint string) (*Registration, error) {
+	p, err := c.CreateSequentialCtx(ctx, servicePath(service)+"/member-", endpoint, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Registration{c: c, Service: service, Endpoint: endpoint, Path: p}, nil
+}
+
+// Deregister takes the endpoint out of the service
+func (r *Registration) Deregister() error {
+	return r.DeregisterCtx(context.Background())
+}
+
+// DeregisterCtx is Deregister, giving up once ctx is done
+func (r *Registration) DeregisterCtx(ctx context.Context) error {
+	err := r.c.DeleteCtx(ctx, r.Path)
+	if err != nil && err.Error() != os.ErrNotExist.Error() {
+		return err
+	}
+	return nil
+}
+
+// Discover returns the endpoints registered for service, oldest first
+func (c *PhatClient) Discover(service string) ([]string, error) {
+	return c.DiscoverCtx(context.Background(), service)
+}
+
+// DiscoverCtx is Discover, giving up once ctx is done
+func (c *PhatClient) DiscoverCtx(ctx context.Context, service string) ([]string, error) {
+	kids, err := c.GetChildrenCtx(ctx, servicePath(service))
+	if err != nil && err.Error() == os.ErrNotExist.Error() {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(kids))
+	for i, kid := range kids {
+		paths[i] = path.Join(servicePath(service), kid)
+	}
+	nodes, errs, err := c.MGetDataCtx(ctx, paths)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := []string{}
+	for i, n := range nodes {
+		// members can leave in between
+		if errs[i] == nil {
+			endpoints = append(endpoints, string(n.Value))
+		}
+	}
+	return endpoints, nil
+}
+
+// WatchService sends service's endpoints (as Discover returns them) on the returned
+// channel straight away and then whenever they change, until ctx is done. Changes are
+// noticed by checking every Options.RetryDelay
+func (c *PhatClient) WatchService(ctx context.Context, service string) <-chan []string {
+	changes := make(chan []string)
+	go func() {
+		defer close(changes)
+		var seen []string
+		sent := false
+		for {
+			endpoints, err := c.DiscoverCtx(ctx, service)
+			if err != nil {
+				c.debug(DEBUG, "Watch on service %s failed: %s", service, err)
+			} else if !sent || !sameStrings(endpoints, seen) {
+				select {
+				case changes <- endpoints:
+				case <-ctx.Done():
+					return
+				}
+				seen = endpoints
+				sent = true
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(c.Cli.Options.RetryDelay):
+			}
+		}
+	}()
+	return changes
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package phatclient
+
+import (
+	"context"
+	"errors"
+	"github.com/mgentili/goPhat/client"
+	"github.com/mgentili/goPhat/phatRPC"
+	"github.com/mgentili/goPhat/phatdb"
+	"net/rpc"
+	"sync/atomic"
+	"time"
+)
+
+// attachSession carries the client's session over to a master it's just connected to:
+// the master learns how many writes the session has numbered, so it can tell retries
+// from new writes, and the session's ephemeral nodes and locks, being in the replicated
+// tree, are still there. Watches and the cache pick up with the new master by themselves
+func (c *PhatClient) attachSession(conn *rpc.Client) error {
+	args := &phatdb.DBCommand{Session: c.Cli.Uid, Root: c.Root, SeqNumber: atomic.LoadUint64(&c.seqNumber)}
+	reply := &phatRPC.SessionState{}
+	call := conn.Go("Server.AttachSession", args, reply, nil)
+	timer := time.NewTimer(c.Cli.Options.Timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+	case <-timer.C:
+		return errors.New("attaching session timed out")
+	}
+	if call.Error != nil {
+		return call.Error
+	}
+	// a client started again under the same uid carries on numbering from where the
+	// session got to, or its writes would look like retries
+	for {
+		seq := atomic.LoadUint64(&c.seqNumber)
+		if reply.SeqNumber <= seq || atomic.CompareAndSwapUint64(&c.seqNumber, seq, reply.SeqNumber) {
+			break
+		}
+	}
+	c.debug(STATUS, "Attached session %s: %d ephemeral nodes, %d locks, last write %d",
+		reply.Session, len(reply.Ephemeral), len(reply.Locks), reply.SeqNumber)
+	go c.replayQueued()
+	return nil
+}
+
+// Session returns the ephemeral nodes and locks the client's session holds
+func (c *PhatClient) Session() (*phatdb.SessionInfo, error) {
+	return c.SessionCtx(context.Background())
+}
+
+// SessionCtx is Session, giving up once ctx is done
+func (c *PhatClient) SessionCtx(ctx context.Context) (*phatdb.SessionInfo, error) {
+	args := &phatdb.DBCommand{Command: "SESSION", Session: c.Cli.Uid}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	info := reply.Reply.(phatdb.SessionInfo)
+	return &info, nil
+}
+
+// StartSession opens the client's session on the servers with the given timeout, and
+// keeps it open by renewing it every third of that until Close. If the servers don't
+// hear from the client for timeout (say it's cut off from them), they expire the
+// session: its ephemeral nodes are deleted and its locks are released, just as if it
+// had closed, and the client's Events report SessionExpired. Without it, a session
+// lasts until the client closes it
+func (c *PhatClient) StartSession(timeout time.Duration) error {
+	return c.StartSessionCtx(context.Background(), timeout)
+}
+
+// StartSessionCtx is StartSession, giving up on opening the session once ctx is done
+func (c *PhatClient) StartSessionCtx(ctx context.Context, timeout time.Duration) error {
+	args := &phatdb.DBCommand{Command: "OPEN_SESSION", Session: c.Cli.Uid, TTL: timeout}
+	if _, err := c.processCallWithRetry(ctx, args); err != nil {
+		return err
+	}
+	if atomic.CompareAndSwapInt32(&c.keepingAlive, 0, 1) {
+		go c.keepAlive(timeout)
+	}
+	return nil
+}
+
+// keepAlive renews the session until the client's closed or the session expires
+func (c *PhatClient) keepAlive(timeout time.Duration) {
+	defer atomic.StoreInt32(&c.keepingAlive, 0)
+	// a renewal that takes longer than this is no use anyway
+	ctx := client.WithCallOptions(context.Background(), client.CallOptions{GiveUp: timeout / 3})
+	for atomic.LoadInt32(&c.closed) == 0 {
+		time.Sleep(timeout / 3)
+		if atomic.LoadInt32(&c.closed) != 0 {
+			return
+		}
+		args := &phatdb.DBCommand{Command: "KEEPALIVE", Session: c.Cli.Uid}
+		_, err := c.processCallWithRetry(ctx, args)
+		if err != nil && err.Error() == phatdb.ErrSessionExpired.Error() {
+			c.debug(STATUS, "Session %s has expired", c.Cli.Uid)
+			c.Cli.ReportSessionExpired()
+			return
+		}
+		if err != nil {
+			c.debug(DEBUG, "Couldn't renew session %s: %s", c.Cli.Uid, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package phatclient
+
+import (
+	"context"
+	"github.com/mgentili/goPhat/phatdb"
+)
+
+// The Stale reads may be answered by any replica, so they can miss the latest writes.
+// They only spread the load if the client was made with client.Options.ReadFromFollowers
+
+// GetDataStale is GetData, for when slightly out of date data will do
+func (c *PhatClient) GetDataStale(subpath string) (*phatdb.DataNode, error) {
+	return c.GetDataStaleCtx(context.Background(), subpath)
+}
+
+// GetDataStaleCtx is GetDataStale, giving up once ctx is done
+func (c *PhatClient) GetDataStaleCtx(ctx context.Context, subpath string) (*phatdb.DataNode, error) {
+	args := &phatdb.DBCommand{Command: "GET", Path: subpath, Stale: true}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return toDataNode(reply.Reply)
+}
+
+// GetChildrenStale is GetChildren, for when slightly out of date children will do
+func (c *PhatClient) GetChildrenStale(subpath string) ([]string, error) {
+	return c.GetChildrenStaleCtx(context.Background(), subpath)
+}
+
+// GetChildrenStaleCtx is GetChildrenStale, giving up once ctx is done
+func (c *PhatClient) GetChildrenStaleCtx(ctx context.Context, subpath string) ([]string, error) {
+	args := &phatdb.DBCommand{Command: "CHILDREN", Path: subpath, Stale: true}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return reply.Reply.([]string), nil
+}
+
+// GetStatsStale is GetStats, for when slightly out of date stats will do
+func (c *PhatClient) GetStatsStale(subpath string) (*phatdb.StatNode, error) {
+	return c.GetStatsStaleCtx(context.Background(), subpath)
+}
+
+// GetStatsStaleCtx is GetStatsStale, giving up once ctx is done
+func (c *PhatClient) GetStatsStaleCtx(ctx context.Context, subpath string) (*phatdb.StatNode, error) {
+	args := &phatdb.DBCommand{Command: "STAT", Path: subpath, Stale: true}
+	reply, err := c.processCallWithRetry(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	n := reply.Reply.(phatdb.StatNode)
+	return &n, nil
+}
@@ -0,0 +1,361 @@
+package phatclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"github.com/mgentili/goPhat/phatdb"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Streams are values too big to send (or store) in one piece. A stream at a path is
+// kept as chunk children of the node there, numbered in order, while the node's own value
+// says how big the stream is and how many chunks it has once it's complete. Every chunk
+// but the last is StreamChunkSize bytes, which is how an interrupted upload knows where
+// to pick up again (see ResumeStream). Uploads go to a node next to the stream's (see
+// uploadPath), which takes its place once it's complete
+
+// bytes in each chunk of a stream. Must be the same for everyone writing a given stream,
+// and under phatdb.MaxValueSize
+var StreamChunkSize = 256 << 10
+
+const (
+	streamPartial      = "phat-stream partial"
+	streamFormat       = "phat-stream size=%d chunks=%d sha1=%x"
+	streamChunkPrefix  = "chunk-"
+	streamUploadSuffix = ".phat-stream-upload"
+)
+
+var (
+	ErrNotStream        = errors.New("node isn't a stream")
+	ErrStreamIncomplete = errors.New("stream is still being written")
+	ErrStreamCorrupt    = errors.New("stream doesn't match its checksum")
+	ErrStreamClosed     = errors.New("stream is closed")
+)
+
+func chunkPath(subpath string, i int) string {
+	return path.Join(subpath, fmt.Sprintf("%s%08d", streamChunkPrefix, i))
+}
+
+// uploadPath is where an upload to the stream at subpath is kept until it's closed
+func uploadPath(subpath string) string {
+	return path.Clean(subpath) + streamUploadSuffix
+}
+
+// chunkIndex returns the number of the chunk with the given name
+func chunkIndex(name string) (int, bool) {
+	var i int
+	if !strings.HasPrefix(name, streamChunkPrefix) {
+		return 0, false
+	}
+	if _, err := fmt.Sscanf(name[len(streamChunkPrefix):], "%d", &i); err != nil {
+		return 0, false
+	}
+	return i, true
+}
+
+// StreamWriter uploads a stream a chunk at a time. Nothing is visible to readers until
+// Close, and an upload that's cut off can be finished later with ResumeStream
+type StreamWriter struct {
+	c      *PhatClient
+	ctx    context.Context
+	path   string
+	upload string // see uploadPath
+	buf    []byte
+	chunks int
+	size   int64
+	hash   hash.Hash
+	closed bool
+}
+
+// CreateStream starts uploading a stream to subpath, creating the node if need be and
+// replacing any stream already there once the upload is closed
+func (c *PhatClient) CreateStream(subpath string) (*StreamWriter, error) {
+	return c.CreateStreamCtx(context.Background(), subpath)
+}
+
+// CreateStreamCtx is CreateStream, with every call it makes giving up once ctx is done
+func (c *PhatClient) CreateStreamCtx(ctx context.Context, subpath string) (*StreamWriter, error) {
+	upload := uploadPath(subpath)
+	if err := c.setOrCreate(ctx, upload, streamPartial); err != nil {
+		return nil, err
+	}
+	// otherwise a resumed upload could mistake an abandoned upload's chunks for its own
+	if err := c.deleteChunks(ctx, upload, 0); err != nil {
+		return nil, err
+	}
+	return &StreamWriter{c: c, ctx: ctx, path: subpath, upload: upload, hash: sha1.New()}, nil
+}
+
+// ResumeStream picks an unfinished upload to subpath back up. It returns the writer and
+// how many bytes of the stream are already stored; the caller carries on writing from
+// there. The stored chunks are read back to work out the stream's checksum
+func (c *PhatClient) ResumeStream(subpath string) (*StreamWriter, int64, error) {
+	return c.ResumeStreamCtx(context.Background(), subpath)
+}
+
+// ResumeStreamCtx is ResumeStream, with every call it makes giving up once ctx is done
+func (c *PhatClient) ResumeStreamCtx(ctx context.Context, subpath string) (*StreamWriter, int64, error) {
+	upload := uploadPath(subpath)
+	n, err := c.GetDataCtx(ctx, upload)
+	if err != nil {
+		return nil, 0, err
+	}
+	if string(n.Value) != streamPartial {
+		return nil, 0, ErrNotStream
+	}
+	w := &StreamWriter{c: c, ctx: ctx, path: subpath, upload: upload, hash: sha1.New()}
+	// only the full chunks at the start count: the last one may have been cut short
+	for {
+		chunk, err := c.GetDataCtx(ctx, chunkPath(upload, w.chunks))
+		if err != nil && err.Error() == os.ErrNotExist.Error() {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(chunk.Value) != StreamChunkSize {
+			break
+		}
+		w.hash.Write(chunk.Value)
+		w.chunks++
+		w.size += int64(len(chunk.Value))
+	}
+	return w, w.size, nil
+}
+
+// Write adds p to the stream, uploading every chunk it fills. If an upload fails, it
+// returns how much of p made it into the uploaded chunks, and the rest of p is dropped
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, ErrStreamClosed
+	}
+	// bytes from earlier writes still waiting for their chunk to fill
+	held := len(w.buf)
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= StreamChunkSize {
+		if err := w.flush(w.buf[:StreamChunkSize]); err != nil {
+			written := 0
+			if held < 0 {
+				written, held = -held, 0
+			}
+			w.buf = w.buf[:held]
+			return written, err
+		}
+		w.buf = w.buf[StreamChunkSize:]
+		held -= StreamChunkSize
+	}
+	return len(p), nil
+}
+
+func (w *StreamWriter) flush(chunk []byte) error {
+	if err := w.c.setOrCreate(w.ctx, chunkPath(w.upload, w.chunks), string(chunk)); err != nil {
+		return err
+	}
+	w.hash.Write(chunk)
+	w.chunks++
+	w.size += int64(len(chunk))
+	return nil
+}
+
+// Close uploads what's left of the stream and makes it visible to readers, replacing
+// whatever was at the stream's path
+func (w *StreamWriter) Close() error {
+	if w.closed {
+		return ErrStreamClosed
+	}
+	if len(w.buf) > 0 {
+		if err := w.flush(w.buf); err != nil {
+			return err
+		}
+		w.buf = nil
+	}
+	if err := w.c.deleteChunks(w.ctx, w.upload, w.chunks); err != nil {
+		return err
+	}
+	exists, err := w.c.ExistsCtx(w.ctx, w.path)
+	if err != nil {
+		return err
+	}
+	// swap the upload in all at once, so readers see either the old stream or the new one
+	m := w.c.Multi()
+	if exists {
+		m.add(&phatdb.DBCommand{Command: "DELETE_RECURSIVE", Path: w.path})
+	}
+	m.add(&phatdb.DBCommand{Command: "MOVE", Path: w.upload, Target: w.path, Flags: phatdb.WITH_SUBTREE})
+	m.Set(w.path, fmt.Sprintf(streamFormat, w.size, w.chunks, w.hash.Sum(nil)))
+	if _, err := m.CommitCtx(w.ctx); err != nil {
+		return err
+	}
+	w.closed = true
+	return nil
+}
+
+// setOrCreate sets the node at subpath to data, creating it if it doesn't exist
+func (c *PhatClient) setOrCreate(ctx context.Context, subpath string, data string) error {
+	err := c.SetDataCtx(ctx, subpath, data)
+	if err != nil && err.Error() == os.ErrNotExist.Error() {
+		_, err = c.CreateCtx(ctx, subpath, data)
+	}
+	return err
+}
+
+// deleteChunks deletes the chunks of the stream at subpath numbered from on up
+func (c *PhatClient) deleteChunks(ctx context.Context, subpath string, from int) error {
+	kids, err := c.GetChildrenCtx(ctx, subpath)
+	if err != nil {
+		return err
+	}
+	for _, kid := range kids {
+		if i, ok := chunkIndex(kid); ok && i >= from {
+			err := c.DeleteCtx(ctx, path.Join(subpath, kid))
+			if err != nil && err.Error() != os.ErrNotExist.Error() {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// StreamReader downloads a stream a chunk at a time. It can Seek, so a download that's
+// cut off can carry on from where it got to
+type StreamReader struct {
+	c      *PhatClient
+	ctx    context.Context
+	path   string
+	size   int64
+	chunks int
+	sum    []byte
+	offset int64
+	chunk  []byte // what's left of the chunk being read
+	hash   hash.Hash
+}
+
+// OpenStream starts downloading the stream at subpath
+func (c *PhatClient) OpenStream(subpath string) (*StreamReader, error) {
+	return c.OpenStreamCtx(context.Background(), subpath)
+}
+
+// OpenStreamCtx is OpenStream, with every call it makes giving up once ctx is done
+func (c *PhatClient) OpenStreamCtx(ctx context.Context, subpath string) (*StreamReader, error) {
+	n, err := c.GetDataCtx(ctx, subpath)
+	if err != nil && err.Error() == os.ErrNotExist.Error() {
+		// the first upload to subpath may just not be done yet
+		if uploading, _ := c.ExistsCtx(ctx, uploadPath(subpath)); uploading {
+			return nil, ErrStreamIncomplete
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if string(n.Value) == streamPartial {
+		return nil, ErrStreamIncomplete
+	}
+	r := &StreamReader{c: c, ctx: ctx, path: subpath, hash: sha1.New()}
+	if _, err := fmt.Sscanf(string(n.Value), streamFormat, &r.size, &r.chunks, &r.sum); err != nil {
+		return nil, ErrNotStream
+	}
+	return r, nil
+}
+
+// Size returns the length of the stream in bytes
+func (r *StreamReader) Size() int64 {
+	return r.size
+}
+
+// Read reads the next bytes of the stream. Read from the start without seeking, the
+// stream is checked against its checksum at the end
+func (r *StreamReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		if r.hash != nil && !bytes.Equal(r.hash.Sum(nil), r.sum) {
+			return 0, ErrStreamCorrupt
+		}
+		return 0, io.EOF
+	}
+	if len(r.chunk) == 0 {
+		i := int(r.offset / int64(StreamChunkSize))
+		if i >= r.chunks {
+			return 0, ErrStreamCorrupt
+		}
+		n, err := r.c.GetDataCtx(r.ctx, chunkPath(r.path, i))
+		if err != nil {
+			return 0, err
+		}
+		skip := r.offset % int64(StreamChunkSize)
+		if skip > int64(len(n.Value)) {
+			return 0, ErrStreamCorrupt
+		}
+		r.chunk = n.Value[skip:]
+		if len(r.chunk) == 0 {
+			return 0, ErrStreamCorrupt
+		}
+	}
+	read := copy(p, r.chunk)
+	if r.hash != nil {
+		r.hash.Write(r.chunk[:read])
+	}
+	r.chunk = r.chunk[read:]
+	r.offset += int64(read)
+	return read, nil
+}
+
+// Seek moves to another point in the stream, as for io.Seeker. Once it has, the stream
+// is no longer checked against its checksum
+func (r *StreamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.offset, errors.New("bad whence")
+	}
+	if offset < 0 {
+		return r.offset, errors.New("negative offset")
+	}
+	if offset != r.offset {
+		r.hash = nil
+		r.chunk = nil
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+// PutStream uploads everything in src as the stream at subpath, returning its size
+func (c *PhatClient) PutStream(subpath string, src io.Reader) (int64, error) {
+	return c.PutStreamCtx(context.Background(), subpath, src)
+}
+
+// PutStreamCtx is PutStream, giving up once ctx is done
+func (c *PhatClient) PutStreamCtx(ctx context.Context, subpath string, src io.Reader) (int64, error) {
+	w, err := c.CreateStreamCtx(ctx, subpath)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(w, src)
+	if err != nil {
+		return n, err
+	}
+	return n, w.Close()
+}
+
+// GetStream downloads the stream at subpath into dst, returning its size
+func (c *PhatClient) GetStream(subpath string, dst io.Writer) (int64, error) {
+	return c.GetStreamCtx(context.Background(), subpath, dst)
+}
+
+// GetStreamCtx is GetStream, giving up once ctx is done
+func (c *PhatClient) GetStreamCtx(ctx context.Context, subpath string, dst io.Writer) (int64, error) {
+	r, err := c.OpenStreamCtx(ctx, subpath)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(dst, r)
+}
@@ -0,0 +1,155 @@
+package phatdb
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// permission bits for an ACL entry
+const (
+	PERM_READ = 1 << iota
+	PERM_WRITE
+	PERM_CREATE
+	PERM_DELETE
+	PERM_ADMIN
+	PERM_ALL = PERM_READ | PERM_WRITE | PERM_CREATE | PERM_DELETE | PERM_ADMIN
+)
+
+var ErrNotAuthorized = errors.New("not authorized")
+
+// the world:anyone identity matches every client
+var Anyone = Identity{"world", "anyone"}
+
+// the identity servers give clients that have authenticated as one of their admins
+// (and their own commands). The root has no ACL of its own, so only it can run the
+// commands that need PERM_ADMIN there
+var Admin = Identity{"phat", "admin"}
+
+// an identity a client has authenticated as, e.g. {"digest", "alice"}
+type Identity struct {
+	Scheme string
+	Id     string
+}
+
+// DigestId returns the id the digest scheme gives a client that authenticates with
+// "user:password": the user followed by a hash of the credentials, so ACLs don't hold
+// passwords. ACL entries for digest users need to use it too
+func DigestId(credentials string) string {
+	user := strings.SplitN(credentials, ":", 2)[0]
+	sum := sha1.Sum([]byte(credentials))
+	return user + ":" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+type ACL struct {
+	Scheme string
+	Id     string
+	Perms  int
+}
+
+// allowed returns whether any of the given identities has perm (all of its bits) on a node with the given ACL.
+// A node without any ACL entries is open to everyone
+func allowed(acl []ACL, perm int, auth []Identity) bool {
+	if len(acl) == 0 {
+		return true
+	}
+	for _, entry := range acl {
+		if entry.Perms&perm != perm {
+			continue
+		}
+		if entry.Scheme == Anyone.Scheme && entry.Id == Anyone.Id {
+			return true
+		}
+		for _, id := range auth {
+			if entry.Scheme == id.Scheme && entry.Id == id.Id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requiredPerm returns the permission a command needs, and whether it's checked on the
+// node's parent (e.g. you need CREATE on a directory to create files in it)
+func requiredPerm(command string) (perm int, onParent bool) {
+	switch command {
+	case "GET", "GET_VERSION", "GET_IF_MODIFIED", "CHILDREN", "GETACL", "GET_QUOTA", "COPY", "TOMBSTONES":
+		return PERM_READ, false
+	case "SET", "SET_VERSION", "APPEND", "LOCK", "UNLOCK":
+		return PERM_WRITE, false
+	case "GETSET", "INCR":
+		// it hands back the old value too
+		return PERM_READ | PERM_WRITE, false
+	case "CREATE", "CREATE_SEQ":
+		return PERM_CREATE, true
+	case "DELETE", "DELETE_VERSION", "DELETE_RECURSIVE", "MOVE":
+		return PERM_DELETE, true
+	case "SETACL", "SET_QUOTA", "SET_READONLY", "PURGE_TOMBSTONES", "START_AUDIT", "STOP_AUDIT", "AUDIT_LOG":
+		return PERM_ADMIN, false
+	}
+	return 0, false
+}
+
+// checkAccess makes sure the identities in req are allowed to run it
+func checkAccess(root *FileNode, req *DBCommand) error {
+	perm, onParent := requiredPerm(req.Command)
+	if perm == 0 {
+		return nil
+	}
+	parts := GetNodePath(req.Path)
+	if onParent && len(parts) > 0 && (req.Command != "CREATE_SEQ" || req.Path[len(req.Path)-1] != '/') {
+		parts = parts[:len(parts)-1]
+	}
+	n := root
+	// for parents, check the deepest existing ancestor (missing ones get created)
+	for _, part := range parts {
+		child, exists := n.Children[part]
+		if !exists {
+			if onParent {
+				break
+			}
+			// let the command itself report the missing node
+			return nil
+		}
+		n = child
+	}
+	if n.Data == nil {
+		// the root: anyone can use it, but only admins can administer it
+		if perm&PERM_ADMIN != 0 && !hasIdentity(req.Auth, Admin) {
+			return ErrNotAuthorized
+		}
+		return nil
+	}
+	if !allowed(n.Data.ACL, perm, req.Auth) {
+		return ErrNotAuthorized
+	}
+	return nil
+}
+
+// CheckAccess returns ErrNotAuthorized if req's sender isn't allowed to run it, as the
+// tree stands. The command is checked again when it's applied, so this is only for
+// turning it away early. It can be called while Serve is running
+func (db *Database) CheckAccess(req *DBCommand) error {
+	req = chrootCommand(req)
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return checkAccess(db.Root, withIdentities(db.Root, req))
+}
+
+func setACL(root *FileNode, path string, acl []ACL) (*StatNode, error) {
+	n, err := traverseToData(root, path)
+	if err != nil {
+		return nil, err
+	}
+	n.Data.ACL = acl
+	return n.Data.Stats, nil
+}
+
+func getACL(root *FileNode, path string) ([]ACL, error) {
+	n, err := traverseToData(root, path)
+	if err != nil {
+		return nil, err
+	}
+	return n.Data.ACL, nil
+}
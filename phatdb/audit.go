@@ -0,0 +1,129 @@
+package phatdb
+
+import (
+	"time"
+)
+
+// how many entries the audit log keeps before dropping the oldest ones
+var MaxAuditEntries = 10000
+
+// AuditEntry records one write to a node in an audited subtree (see START_AUDIT)
+type AuditEntry struct {
+	Path       string
+	Command    string
+	Session    string     // session that sent the command
+	Auth       []Identity // who it was authenticated as
+	Time       time.Time
+	OpNumber   uint64
+	OldVersion uint64 // 0 if the node didn't exist before
+	NewVersion uint64 // 0 if it doesn't exist after
+	TraceID    string // the command's TraceID
+}
+
+// startAudit starts recording writes to path and its subtree
+func startAudit(root *FileNode, path string) {
+	if root.Audited == nil {
+		root.Audited = make(map[string]bool)
+	}
+	root.Audited[cleanPath(path)] = true
+}
+
+// stopAudit stops recording writes to path's subtree. What's been recorded stays
+func stopAudit(root *FileNode, path string) {
+	delete(root.Audited, cleanPath(path))
+}
+
+func audited(root *FileNode, path string) bool {
+	for prefix := range root.Audited {
+		if under(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeVersion(root *FileNode, path string) uint64 {
+	n, err := traverseToNode(root, GetNodePath(path), false)
+	if err != nil || n.Data == nil {
+		return 0
+	}
+	return n.Data.Stats.Version
+}
+
+// auditVersions returns the current versions of the audited nodes req might change, so
+// recordAudit can tell what they were before
+func auditVersions(root *FileNode, req *DBCommand) map[string]uint64 {
+	if len(root.Audited) == 0 {
+		return nil
+	}
+	versions := make(map[string]uint64)
+	switch req.Command {
+	case "EXPIRE", "CLOSE_SESSION", "EXPIRE_SESSION":
+		// no telling which nodes these will delete, so take every audited one
+		var walk func(n *FileNode, path string)
+		walk = func(n *FileNode, path string) {
+			if n.Data != nil {
+				versions[path] = n.Data.Stats.Version
+			}
+			for name, child := range n.Children {
+				walk(child, cleanPath(path+"/"+name))
+			}
+		}
+		for prefix := range root.Audited {
+			if n, err := traverseToNode(root, GetNodePath(prefix), false); err == nil {
+				walk(n, prefix)
+			}
+		}
+	default:
+		for _, path := range []string{req.Path, req.Target} {
+			path = cleanPath(path)
+			if audited(root, path) {
+				versions[path] = nodeVersion(root, path)
+			}
+		}
+	}
+	return versions
+}
+
+// recordAudit appends an entry to the audit log for each audited path a write touched
+func recordAudit(root *FileNode, req *DBCommand, before map[string]uint64, paths []string) {
+	if len(root.Audited) == 0 {
+		return
+	}
+	for _, path := range paths {
+		path = cleanPath(path)
+		if !audited(root, path) {
+			continue
+		}
+		root.AuditLog = append(root.AuditLog, AuditEntry{
+			Path:       path,
+			Command:    req.Command,
+			Session:    req.Session,
+			Auth:       req.Auth,
+			Time:       req.Time,
+			OpNumber:   req.OpNumber,
+			OldVersion: before[path],
+			NewVersion: nodeVersion(root, path),
+			TraceID:    req.TraceID,
+		})
+	}
+	if extra := len(root.AuditLog) - MaxAuditEntries; MaxAuditEntries > 0 && extra > 0 {
+		root.AuditLog = append([]AuditEntry(nil), root.AuditLog[extra:]...)
+	}
+}
+
+// auditLog returns the recorded writes to path and its subtree, oldest first. With a
+// limit, only the last limit of them are returned
+func auditLog(root *FileNode, path string, limit int) []AuditEntry {
+	path = cleanPath(path)
+	entries := []AuditEntry{}
+	for _, entry := range root.AuditLog {
+		if under(entry.Path, path) {
+			entries = append(entries, entry)
+		}
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries
+}
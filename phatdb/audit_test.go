@@ -0,0 +1,80 @@
+package phatdb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	db := NewDatabase()
+	now := time.Now()
+	alice := []Identity{{Scheme: "user", Id: "alice"}}
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/config/db", Value: "a"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/scratch", Value: ""})
+	if resp := db.Apply(&DBCommand{Command: "START_AUDIT", Path: "/config"}); resp.Error != "" {
+		t.Fatalf("START_AUDIT failed: %s", resp.Error)
+	}
+	db.Apply(&DBCommand{Command: "SET", Path: "/config/db", Value: "b", Session: "s1", Auth: alice, Time: now, OpNumber: 7, TraceID: "t1"})
+	db.Apply(&DBCommand{Command: "SET", Path: "/scratch", Value: "not audited"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/config/cache", Value: "", Flags: EPHEMERAL, Session: "s1"})
+	db.Apply(&DBCommand{Command: "CLOSE_SESSION", Session: "s1"})
+	db.Apply(&DBCommand{Command: "MULTI", Ops: []*DBCommand{{Command: "DELETE", Path: "/config/db"}}})
+	entries := db.Apply(&DBCommand{Command: "AUDIT_LOG", Path: "/config"}).Reply.([]AuditEntry)
+	expected := []struct {
+		path, command string
+		old, new      uint64
+	}{
+		{"/config", "START_AUDIT", 0, 0},
+		{"/config/db", "SET", 1, 2},
+		{"/config/cache", "CREATE", 0, 1},
+		{"/config/cache", "CLOSE_SESSION", 1, 0},
+		{"/config/db", "DELETE", 2, 0},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d audit entries, got %v", len(expected), entries)
+	}
+	for i, e := range expected {
+		got := entries[i]
+		if got.Path != e.path || got.Command != e.command || got.OldVersion != e.old || got.NewVersion != e.new {
+			t.Errorf("Entry %d: expected %v, got %+v", i, e, got)
+		}
+	}
+	if got := entries[1]; got.Session != "s1" || got.Auth[0] != alice[0] || !got.Time.Equal(now) || got.OpNumber != 7 || got.TraceID != "t1" {
+		t.Errorf("SET's entry doesn't say who did it: %+v", got)
+	}
+	// Queries can narrow it down
+	if entries := auditLog(db.Root, "/config/db", 1); len(entries) != 1 || entries[0].Command != "DELETE" {
+		t.Errorf("Expected just the DELETE, got %v", entries)
+	}
+	// Stopping keeps what's there
+	db.Apply(&DBCommand{Command: "STOP_AUDIT", Path: "/config"})
+	db.Apply(&DBCommand{Command: "SET", Path: "/config", Value: "x"})
+	if entries := auditLog(db.Root, "/", 0); len(entries) != len(expected) {
+		t.Errorf("Expected the log to be left alone by STOP_AUDIT, got %v", entries)
+	}
+	// Only admins can read it
+	db.Apply(&DBCommand{Command: "SETACL", Path: "/config", ACL: []ACL{{Scheme: "user", Id: "bob", Perms: PERM_ALL}}})
+	if resp := db.Apply(&DBCommand{Command: "AUDIT_LOG", Path: "/config", Auth: alice}); resp.Error == "" {
+		t.Errorf("Expected AUDIT_LOG without ADMIN to fail")
+	}
+}
+
+func TestAuditLogOrder(t *testing.T) {
+	// every replica has to record the nodes a session or an expiry takes in the same order
+	start := time.Now()
+	run := func() string {
+		db := NewDatabase()
+		db.Apply(&DBCommand{Command: "START_AUDIT", Path: "/", Auth: []Identity{Admin}})
+		for i := 0; i < 10; i++ {
+			db.Apply(&DBCommand{Command: "CREATE", Path: fmt.Sprintf("/eph%d", i), Flags: EPHEMERAL, Session: "s1"})
+			db.Apply(&DBCommand{Command: "CREATE", Path: fmt.Sprintf("/ttl%d", i), TTL: time.Second, Time: start})
+		}
+		db.Apply(&DBCommand{Command: "CLOSE_SESSION", Session: "s1"})
+		db.Apply(&DBCommand{Command: "EXPIRE", Time: start.Add(time.Minute)})
+		return hashNode(db.Root)
+	}
+	if first, second := run(), run(); first != second {
+		t.Errorf("The same commands left different trees: %s and %s", first, second)
+	}
+}
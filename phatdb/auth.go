@@ -0,0 +1,114 @@
+package phatdb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrUnknownScheme  = errors.New("unknown authentication scheme")
+	ErrBadCredentials = errors.New("bad credentials")
+)
+
+// Authenticate checks a client's credentials for scheme, returning who they are. Only
+// the digest scheme is supported, with credentials "user:password". The password never
+// goes any further: AUTH commands are logged with the identity this returns
+func Authenticate(scheme string, credentials string) (Identity, error) {
+	switch scheme {
+	case "digest":
+		if !strings.Contains(credentials, ":") {
+			return Identity{}, ErrBadCredentials
+		}
+		return Identity{scheme, DigestId(credentials)}, nil
+	}
+	return Identity{}, ErrUnknownScheme
+}
+
+// authenticate records that req's session has authenticated as req.Auth, so commands
+// carrying the session's token are checked against them from now on, until the session
+// ends. A session's first AUTH gets the token the server issued in req.Value, and later
+// ones have to carry it, so nobody else can add to (and so use) its identities. It
+// returns the session's token
+func authenticate(root *FileNode, req *DBCommand) (string, error) {
+	session := req.Session
+	if session == "" {
+		return "", ErrNoSession
+	}
+	token, ok := root.AuthTokens[session]
+	if !ok {
+		if req.Value == "" {
+			return "", ErrBadCredentials
+		}
+		token = req.Value
+	} else if req.AuthToken != token {
+		return "", ErrNotAuthorized
+	}
+	if root.Identities == nil {
+		root.Identities = make(map[string][]Identity)
+	}
+	if root.AuthTokens == nil {
+		root.AuthTokens = make(map[string]string)
+	}
+	root.AuthTokens[session] = token
+	for _, id := range req.Auth {
+		if !hasIdentity(root.Identities[session], id) {
+			root.Identities[session] = append(root.Identities[session], id)
+		}
+	}
+	sessionsChanged(root)
+	return token, nil
+}
+
+// hasToken says whether token is the one session's AUTH issued
+func hasToken(root *FileNode, session string, token string) bool {
+	want, ok := root.AuthTokens[session]
+	return ok && token == want
+}
+
+func hasIdentity(ids []Identity, id Identity) bool {
+	for _, have := range ids {
+		if have == id {
+			return true
+		}
+	}
+	return false
+}
+
+// withIdentities returns req with the identities its session has authenticated as
+// added to the ones it came with, if it carries the session's token
+func withIdentities(root *FileNode, req *DBCommand) *DBCommand {
+	ids := root.Identities[req.Session]
+	if len(ids) == 0 || req.Session == "" || !hasToken(root, req.Session, req.AuthToken) {
+		return req
+	}
+	// the command itself is in the log, so work on a copy
+	authed := *req
+	authed.Auth = append([]Identity(nil), req.Auth...)
+	for _, id := range ids {
+		if !hasIdentity(authed.Auth, id) {
+			authed.Auth = append(authed.Auth, id)
+		}
+	}
+	return &authed
+}
+
+// Identities returns the identities session has authenticated as with AUTH, if token
+// is its token (see DBCommand.AuthToken). It can be called while Serve is running
+func (db *Database) Identities(session string, token string) []Identity {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if session == "" || !hasToken(db.Root, session, token) {
+		return nil
+	}
+	return append([]Identity(nil), db.Root.Identities[session]...)
+}
+
+// NewAuthToken returns a token for a server to issue with a session's first AUTH (see
+// DBCommand.AuthToken)
+func NewAuthToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
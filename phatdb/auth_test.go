@@ -0,0 +1,55 @@
+package phatdb
+
+import "testing"
+
+func TestAuthenticate(t *testing.T) {
+	if id, err := Authenticate("digest", "alice:secret"); err != nil || id != (Identity{"digest", DigestId("alice:secret")}) {
+		t.Errorf("Expected alice's digest identity, got %v %v", id, err)
+	}
+	if _, err := Authenticate("digest", "alice"); err != ErrBadCredentials {
+		t.Errorf("Expected credentials without a password to be turned away, got %v", err)
+	}
+	if _, err := Authenticate("world", "anyone"); err != ErrUnknownScheme {
+		t.Errorf("Expected the world scheme to be turned away, got %v", err)
+	}
+
+	db := NewDatabase()
+	alice := Identity{"digest", DigestId("alice:secret")}
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/secret", Value: "shh", ACL: []ACL{{alice.Scheme, alice.Id, PERM_ALL}}, Auth: []Identity{alice}})
+	if resp := db.Apply(&DBCommand{Command: "GET", Path: "/secret", Session: "s1"}); resp.Error != ErrNotAuthorized.Error() {
+		t.Errorf("Expected s1 not to be able to read /secret yet, got %v", resp)
+	}
+	before := hashNode(db.Root)
+	if resp := db.Apply(&DBCommand{Command: "AUTH", Session: "s1", Auth: []Identity{alice}, Value: "t1"}); resp.Error != "" || resp.Reply != "t1" {
+		t.Fatalf("Expected AUTH to issue t1, got %v", resp)
+	}
+	if hashNode(db.Root) == before {
+		t.Errorf("Expected who sessions are authenticated as to be part of the hash")
+	}
+	if resp := db.Apply(&DBCommand{Command: "GET", Path: "/secret", Session: "s1", AuthToken: "t1"}); resp.Error != "" {
+		t.Errorf("Expected s1 to be able to read /secret as alice, got %s", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "GET", Path: "/secret", Session: "s2"}); resp.Error != ErrNotAuthorized.Error() {
+		t.Errorf("Expected s2 still not to be able to read /secret, got %v", resp)
+	}
+	// the session alone isn't enough: anyone can send that
+	if resp := db.Apply(&DBCommand{Command: "GET", Path: "/secret", Session: "s1"}); resp.Error != ErrNotAuthorized.Error() {
+		t.Errorf("Expected s1 without its token not to be able to read /secret, got %v", resp)
+	}
+	if resp := db.Apply(&DBCommand{Command: "GET", Path: "/secret", Session: "s1", AuthToken: "t2"}); resp.Error != ErrNotAuthorized.Error() {
+		t.Errorf("Expected s1 with the wrong token not to be able to read /secret, got %v", resp)
+	}
+	// nor can someone else add to the session's identities without its token
+	mallory := Identity{"digest", DigestId("mallory:secret")}
+	if resp := db.Apply(&DBCommand{Command: "AUTH", Session: "s1", Auth: []Identity{mallory}, Value: "t2"}); resp.Error != ErrNotAuthorized.Error() {
+		t.Errorf("Expected AUTH without s1's token to be turned away, got %v", resp)
+	}
+	if resp := db.Apply(&DBCommand{Command: "AUTH", Session: "s1", Auth: []Identity{mallory}, Value: "t2", AuthToken: "t1"}); resp.Error != "" || resp.Reply != "t1" {
+		t.Errorf("Expected AUTH with s1's token to keep it, got %v", resp)
+	}
+	// the identities go with the session
+	db.Apply(&DBCommand{Command: "CLOSE_SESSION", Session: "s1"})
+	if resp := db.Apply(&DBCommand{Command: "GET", Path: "/secret", Session: "s1", AuthToken: "t1"}); resp.Error != ErrNotAuthorized.Error() {
+		t.Errorf("Expected s1 not to be able to read /secret once its session's closed, got %v", resp)
+	}
+}
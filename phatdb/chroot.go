@@ -0,0 +1,107 @@
+package phatdb
+
+import (
+	"strings"
+)
+
+// chrootCommand returns req with Root prepended to all of its paths (and its MULTI
+// sub-operations' paths), so the rest of the database only ever sees absolute ones.
+// The original is left alone, since it's what gets logged
+func chrootCommand(req *DBCommand) *DBCommand {
+	if req.Root == "" {
+		return req
+	}
+	abs := *req
+	abs.Root = ""
+	abs.quotaRoot = cleanPath(req.Root)
+	abs.Path = chrootPath(req.Root, req.Path)
+	if req.Command == "LIST" && req.Flags&LIST_PREFIX != 0 && !strings.HasSuffix(abs.Path, "/") {
+		// a prefix of the root itself would match its siblings too (/a matches /ab), so
+		// it's only what's under it
+		if abs.Path == abs.quotaRoot {
+			abs.Path += "/"
+		}
+	}
+	if req.Target != "" {
+		abs.Target = chrootPath(req.Root, req.Target)
+	}
+	if req.Paths != nil {
+		abs.Paths = make([]string, len(req.Paths))
+		for i, path := range req.Paths {
+			abs.Paths[i] = chrootPath(req.Root, path)
+		}
+	}
+	if req.Ops != nil {
+		abs.Ops = make([]*DBCommand, len(req.Ops))
+		for i, op := range req.Ops {
+			// sub-operations are always under the MULTI's root
+			sub := *op
+			sub.Root = req.Root
+			abs.Ops[i] = chrootCommand(&sub)
+		}
+	}
+	return &abs
+}
+
+// chrootPath returns path as seen from inside root. A trailing slash is kept, since
+// CREATE_SEQ uses it to mean "just a sequence number"
+func chrootPath(root string, path string) string {
+	abs := cleanPath(root + "/" + path)
+	if strings.HasSuffix(path, "/") && abs != "/" {
+		abs += "/"
+	}
+	return abs
+}
+
+// unchrootPath is the inverse of chrootPath
+func unchrootPath(root string, path string) string {
+	root = cleanPath(root)
+	if root == "/" {
+		return path
+	}
+	rel := strings.TrimPrefix(path, root)
+	if rel == "" {
+		return "/"
+	}
+	return rel
+}
+
+// unchrootReply rewrites the paths in a reply to abs (see chrootCommand) relative to root
+func unchrootReply(root string, abs *DBCommand, resp *DBResponse) {
+	if root == "" {
+		return
+	}
+	switch abs.Command {
+	case "CREATE_SEQ":
+		if path, ok := resp.Reply.(string); ok {
+			resp.Reply = unchrootPath(root, path)
+		}
+	case "LIST":
+		entries, _ := resp.Reply.([]ListEntry)
+		for i := range entries {
+			entries[i].Path = unchrootPath(root, entries[i].Path)
+		}
+	case "SESSION":
+		info, _ := resp.Reply.(SessionInfo)
+		info.Ephemeral = unchrootPaths(root, info.Ephemeral)
+		info.Locks = unchrootPaths(root, info.Locks)
+		resp.Reply = info
+	case "MULTI":
+		results, _ := resp.Reply.([]DBResponse)
+		for i := range results {
+			unchrootReply(root, abs.Ops[i], &results[i])
+		}
+	}
+}
+
+// unchrootPaths is unchrootPath for each of paths, leaving out those outside root
+func unchrootPaths(root string, paths []string) []string {
+	root = cleanPath(root)
+	inside := []string{}
+	for _, p := range paths {
+		if root == "/" || p == root || strings.HasPrefix(p, root+"/") {
+			inside = append(inside, unchrootPath(root, p))
+		}
+	}
+	return inside
+}
@@ -0,0 +1,76 @@
+package phatdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChroot(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/tenants/a", Value: ""})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/tenants/b", Value: ""})
+	var changes []Change
+	db.OnChange("/tenants/a", func(c Change) { changes = append(changes, c) })
+	// Paths are relative to the root, both ways
+	resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/config", Value: "a's", Root: "/tenants/a"})
+	if resp.Error != "" {
+		t.Fatalf("CREATE failed: %s", resp.Error)
+	}
+	if n, _ := getNode(db.Root, "/tenants/a/config"); n == nil || string(n.Value) != "a's" {
+		t.Errorf("CREATE under a root made %#v", n)
+	}
+	resp = db.Apply(&DBCommand{Command: "CREATE_SEQ", Path: "/jobs/", Value: "", Root: "/tenants/a"})
+	if resp.Reply != "/jobs/0000000000" {
+		t.Errorf("CREATE_SEQ under a root replied %v", resp.Reply)
+	}
+	resp = db.Apply(&DBCommand{Command: "LIST", Path: "/*", Root: "/tenants/a"})
+	entries := resp.Reply.([]ListEntry)
+	if len(entries) != 2 || entries[0].Path != "/config" || entries[1].Path != "/jobs" {
+		t.Errorf("LIST under a root replied %v", entries)
+	}
+	// prefixes don't reach past the root into its siblings
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/tenants/ab/secret", Value: ""})
+	for _, prefix := range []string{"", "/", "c"} {
+		resp = db.Apply(&DBCommand{Command: "LIST", Path: prefix, Flags: LIST_PREFIX, Root: "/tenants/a"})
+		for _, entry := range resp.Reply.([]ListEntry) {
+			if entry.Path != "/config" && !strings.HasPrefix(entry.Path, "/jobs") {
+				t.Errorf("LIST of prefix %q under a root replied %v", prefix, resp.Reply)
+				break
+			}
+		}
+	}
+	db.Apply(&DBCommand{Command: "DELETE_RECURSIVE", Path: "/tenants/ab"})
+	if len(changes) != 2 || changes[0].Path != "/tenants/a/config" {
+		t.Errorf("Triggers got %v", changes)
+	}
+	// Other tenants can't see it
+	if resp := db.Apply(&DBCommand{Command: "GET", Path: "/config", Root: "/tenants/b"}); resp.Error == "" {
+		t.Errorf("GET found another root's node")
+	}
+	if resp := db.Apply(&DBCommand{Command: "GET", Path: "/../a/config", Root: "/tenants/b"}); resp.Error == "" {
+		t.Errorf("GET escaped its root")
+	}
+	// MULTI applies the root to all of its operations
+	resp = db.Apply(&DBCommand{Command: "MULTI", Root: "/tenants/b", Ops: []*DBCommand{
+		{Command: "CREATE", Path: "/x", Value: "1"},
+		{Command: "CREATE_SEQ", Path: "/x/", Value: "2"},
+	}})
+	if resp.Error != "" {
+		t.Fatalf("MULTI failed: %s", resp.Error)
+	}
+	if results := resp.Reply.([]DBResponse); results[1].Reply != "/x/0000000000" {
+		t.Errorf("MULTI under a root replied %v", results[1].Reply)
+	}
+	if n, _ := getNode(db.Root, "/tenants/b/x"); n == nil {
+		t.Errorf("MULTI under a root didn't create /tenants/b/x")
+	}
+	// The log has the relative commands, and replays the same way
+	replayed := NewDatabase()
+	for _, name := range []string{"/tenants/a", "/tenants/b"} {
+		replayed.apply(&DBCommand{Command: "CREATE", Path: name})
+	}
+	replayed.apply(&DBCommand{Command: "CREATE", Path: "/config", Value: "a's", Root: "/tenants/a"})
+	if n, _ := getNode(replayed.Root, "/tenants/a/config"); n == nil {
+		t.Errorf("Replaying a command with a root didn't create the node")
+	}
+}
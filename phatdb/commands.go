@@ -0,0 +1,96 @@
+package phatdb
+
+// CommandKind is how a command has to be handled: whether it changes the tree, and so
+// has to go through VR, or can be answered straight from the tree. Every command apply
+// understands has to be in commands, or the servers will turn it away
+type CommandKind int
+
+const (
+	// not a command we know about
+	UnknownCommand CommandKind = iota
+	// only looks at the tree, so the master can answer it by itself
+	ReadCommand
+	// changes the tree, so has to go through VR (and be persisted)
+	WriteCommand
+	// doesn't change the tree, but has to be ordered with the writes, so goes through VR
+	OrderedCommand
+	// answered by whichever replica gets it, from its own tree
+	LocalCommand
+	// only sent by the servers themselves, never by clients
+	InternalCommand
+)
+
+var commands = map[string]CommandKind{
+	"GET":              ReadCommand,
+	"GET_VERSION":      ReadCommand,
+	"GET_IF_MODIFIED":  ReadCommand,
+	"MGET":             ReadCommand,
+	"CHILDREN":         ReadCommand,
+	"STAT":             ReadCommand,
+	"EXISTS":           ReadCommand,
+	"LIST":             ReadCommand,
+	"GETACL":           ReadCommand,
+	"GET_QUOTA":        ReadCommand,
+	"CHECK_VERSION":    ReadCommand,
+	"EXPIRED":          ReadCommand,
+	"TOMBSTONES":       ReadCommand,
+	"AUDIT_LOG":        ReadCommand,
+	"SESSION":          ReadCommand,
+	"EXPIRED_SESSIONS": ReadCommand,
+
+	"CREATE":           WriteCommand,
+	"CREATE_SEQ":       WriteCommand,
+	"DELETE":           WriteCommand,
+	"DELETE_VERSION":   WriteCommand,
+	"DELETE_RECURSIVE": WriteCommand,
+	"SET":              WriteCommand,
+	"SET_VERSION":      WriteCommand,
+	"GETSET":           WriteCommand,
+	"APPEND":           WriteCommand,
+	"INCR":             WriteCommand,
+	"COPY":             WriteCommand,
+	"MOVE":             WriteCommand,
+	"SETACL":           WriteCommand,
+	"SET_QUOTA":        WriteCommand,
+	"SET_READONLY":     WriteCommand,
+	"MULTI":            WriteCommand,
+	"CLOSE_SESSION":    WriteCommand,
+	"OPEN_SESSION":     WriteCommand,
+	"KEEPALIVE":        WriteCommand,
+	"RENEW_SESSIONS":   WriteCommand,
+	"EXPIRE_SESSION":   WriteCommand,
+	"AUTH":             WriteCommand,
+	"LOCK":             WriteCommand,
+	"UNLOCK":           WriteCommand,
+	"EXPIRE":           WriteCommand,
+	"PURGE_TOMBSTONES": WriteCommand,
+	"START_AUDIT":      WriteCommand,
+	"STOP_AUDIT":       WriteCommand,
+
+	"SYNC": OrderedCommand,
+
+	// the cached digests they fill in don't count as changing the tree, but they do
+	// mean these can't run in parallel with reads
+	"SHA256": LocalCommand,
+	"DIGEST": LocalCommand,
+
+	"SNAPSHOT":      InternalCommand,
+	"LOAD_SNAPSHOT": InternalCommand,
+	"READ_BATCH":    InternalCommand,
+}
+
+// Kind returns how command has to be handled
+func Kind(command string) CommandKind {
+	return commands[command]
+}
+
+// IsWrite returns whether command changes the tree
+func IsWrite(command string) bool {
+	return Kind(command) == WriteCommand
+}
+
+// Replicated returns whether command has to go through VR
+func Replicated(command string) bool {
+	kind := Kind(command)
+	return kind == WriteCommand || kind == OrderedCommand
+}
@@ -0,0 +1,111 @@
+package phatdb
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"testing"
+)
+
+// appliedCommands returns the commands applyCommand has a case for
+func appliedCommands(t *testing.T) map[string]bool {
+	file, err := parser.ParseFile(token.NewFileSet(), "phatdb_server.go", nil, 0)
+	if err != nil {
+		t.Fatalf("Couldn't parse phatdb_server.go: %s", err)
+	}
+	found := map[string]bool{}
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Name.Name != "applyCommand" {
+			continue
+		}
+		ast.Inspect(fn.Body, func(n ast.Node) bool {
+			sw, ok := n.(*ast.SwitchStmt)
+			if !ok {
+				return true
+			}
+			if sel, ok := sw.Tag.(*ast.SelectorExpr); !ok || sel.Sel.Name != "Command" {
+				return true
+			}
+			for _, stmt := range sw.Body.List {
+				for _, expr := range stmt.(*ast.CaseClause).List {
+					if lit, ok := expr.(*ast.BasicLit); ok {
+						command, _ := strconv.Unquote(lit.Value)
+						found[command] = true
+					}
+				}
+			}
+			return false
+		})
+	}
+	if len(found) == 0 {
+		t.Fatalf("Couldn't find applyCommand's commands")
+	}
+	return found
+}
+
+func TestCommandsRegistered(t *testing.T) {
+	applied := appliedCommands(t)
+	for command := range applied {
+		if Kind(command) == UnknownCommand {
+			t.Errorf("%s isn't registered in commands", command)
+		}
+	}
+	for command := range commands {
+		if !applied[command] {
+			t.Errorf("%s is registered but applyCommand doesn't handle it", command)
+		}
+	}
+}
+
+func TestCommandKinds(t *testing.T) {
+	for _, command := range []string{"GET", "MGET", "GET_VERSION", "CHILDREN"} {
+		if Kind(command) != ReadCommand || Replicated(command) {
+			t.Errorf("Expected %s to be a read", command)
+		}
+	}
+	for _, command := range []string{"CREATE", "INCR", "MULTI", "KEEPALIVE"} {
+		if !IsWrite(command) || !Replicated(command) {
+			t.Errorf("Expected %s to be a write", command)
+		}
+	}
+	if IsWrite("SYNC") || !Replicated("SYNC") {
+		t.Errorf("Expected SYNC to go through VR without being a write")
+	}
+	if Kind("NOT_A_COMMAND") != UnknownCommand || Replicated("NOT_A_COMMAND") {
+		t.Errorf("Expected NOT_A_COMMAND to be unknown")
+	}
+}
+
+func TestCommandsOnRoot(t *testing.T) {
+	// the root has no data, so nothing can be done to its value or stats
+	for _, command := range []string{"STAT", "GET", "GET_IF_MODIFIED", "GET_VERSION", "SET", "SET_VERSION", "GETSET",
+		"APPEND", "INCR", "CHECK_VERSION", "DELETE_VERSION", "SETACL", "GETACL", "LOCK", "UNLOCK", "CREATE"} {
+		db := NewDatabase()
+		resp := db.Apply(&DBCommand{Command: command, Path: "/", Session: "s1", Value: "1", Version: 1, Delta: 1, Auth: []Identity{Admin}})
+		if resp.Error != ErrRootNode.Error() {
+			t.Errorf("Expected %s on the root to fail with ErrRootNode, got %#v", command, resp)
+		}
+	}
+	// and no command can take a server down by being sent there
+	for command := range commands {
+		db := NewDatabase()
+		db.Apply(&DBCommand{Command: "CREATE", Path: "/a", Value: "1"})
+		reqs := []*DBCommand{
+			{Command: command, Path: "/", Target: "/b", Paths: []string{"/"}, Session: "s1", Value: "1", Version: 1, Delta: 1},
+			{Command: command, Path: "/a", Target: "/", Session: "s1"},
+			{Command: "MULTI", Ops: []*DBCommand{{Command: command, Path: "/", Target: "/b", Version: 1}}},
+		}
+		for _, req := range reqs {
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Errorf("%s %s (to %q) panicked: %v", req.Command, req.Path, req.Target, r)
+					}
+				}()
+				db.Apply(req)
+			}()
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package phatdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+)
+
+// values at least this long are stored compressed, if that makes them smaller
+// (0 turns compression off)
+var CompressThreshold = 4096
+
+// command flag: Value has been compressed with Compress (e.g. by a client, to keep
+// big SETs small on the wire and in the log). It's a high bit so it can be used
+// alongside any command's own flags
+const COMPRESSED = 1 << 16
+
+func Compress(val []byte) []byte {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(val)
+	w.Close()
+	return buf.Bytes()
+}
+
+func Decompress(val []byte) ([]byte, error) {
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(val)))
+}
+
+// decompressValue decompresses a value a client compressed. It fails with ErrTooLarge
+// as soon as the value inflates past MaxValueSize, so a small value can't take all of
+// a replica's memory
+func decompressValue(val []byte) ([]byte, error) {
+	if MaxValueSize <= 0 {
+		return Decompress(val)
+	}
+	plain, err := ioutil.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(val)), int64(MaxValueSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) > MaxValueSize {
+		return nil, ErrTooLarge
+	}
+	return plain, nil
+}
+
+// CheckCompressed fails if a COMPRESSED value in cmd (or in its MULTI's operations)
+// can't be decompressed or is too large once it is, so servers can turn the command
+// away before it's replicated
+func CheckCompressed(cmd *DBCommand) error {
+	if cmd.Flags&COMPRESSED != 0 {
+		if _, err := decompressValue([]byte(cmd.Value)); err != nil {
+			return err
+		}
+	}
+	for _, op := range cmd.Ops {
+		if err := CheckCompressed(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Plain returns the node's value, decompressing it if it's stored compressed
+func (d *DataNode) Plain() ([]byte, error) {
+	if !d.Compressed {
+		return d.Value, nil
+	}
+	return Decompress(d.Value)
+}
+
+// plainValue is Plain for nodes in our own tree, which we compressed ourselves
+func plainValue(d *DataNode) []byte {
+	val, err := d.Plain()
+	if err != nil {
+		panic("phatdb: corrupted compressed value: " + err.Error())
+	}
+	return val
+}
+
+// storedValue returns how to store val: compressed if it's big enough for that to help
+func storedValue(val string) (stored []byte, compressed bool) {
+	if CompressThreshold > 0 && len(val) >= CompressThreshold {
+		if c := Compress([]byte(val)); len(c) < len(val) {
+			return c, true
+		}
+	}
+	return []byte(val), false
+}
@@ -0,0 +1,62 @@
+package phatdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompressedValues(t *testing.T) {
+	db := NewDatabase()
+	big := strings.Repeat("compressible ", CompressThreshold)
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/big", Value: big})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/small", Value: "tiny"})
+	//
+	n, _ := getNode(db.Root, "/big")
+	if !n.Compressed || len(n.Value) >= len(big) || n.Stats.DataLength != uint64(len(big)) {
+		t.Errorf("Big value wasn't compressed: %d bytes stored, length %d", len(n.Value), n.Stats.DataLength)
+	}
+	if val, err := n.Plain(); err != nil || string(val) != big {
+		t.Errorf("Plain didn't return the original value (err: %v)", err)
+	}
+	if n, _ := getNode(db.Root, "/small"); n.Compressed {
+		t.Errorf("Small value was compressed")
+	}
+	// Commands can carry compressed values too
+	resp := db.Apply(&DBCommand{Command: "SET", Path: "/small", Value: string(Compress([]byte(big))), Flags: COMPRESSED})
+	if resp.Error != "" {
+		t.Fatalf("SET of a compressed value failed: %s", resp.Error)
+	}
+	if n, _ := getNode(db.Root, "/small"); string(plainValue(n)) != big {
+		t.Errorf("SET of a compressed value stored the wrong value")
+	}
+	if resp := db.Apply(&DBCommand{Command: "SET", Path: "/small", Value: "not flate", Flags: COMPRESSED}); resp.Error == "" {
+		t.Errorf("SET of a corrupted compressed value should fail")
+	}
+	// values that inflate past MaxValueSize are turned away, before and as they're applied
+	bomb := &DBCommand{Command: "SET", Path: "/small", Value: string(Compress(make([]byte, MaxValueSize+1))), Flags: COMPRESSED}
+	if err := CheckCompressed(&DBCommand{Command: "MULTI", Ops: []*DBCommand{bomb}}); err != ErrTooLarge {
+		t.Errorf("CheckCompressed of a value over MaxValueSize returned %v", err)
+	}
+	if resp := db.Apply(bomb); resp.Error != ErrTooLarge.Error() {
+		t.Errorf("SET of a compressed value over MaxValueSize returned %q", resp.Error)
+	}
+	// APPEND works on the plain value
+	db.Apply(&DBCommand{Command: "APPEND", Path: "/big", Value: "!"})
+	if n, _ := getNode(db.Root, "/big"); string(plainValue(n)) != big+"!" {
+		t.Errorf("APPEND to a compressed value went wrong")
+	}
+	// How values are stored doesn't change the digest
+	defer func(threshold int) { CompressThreshold = threshold }(CompressThreshold)
+	CompressThreshold = 0
+	other := NewDatabase()
+	other.Apply(&DBCommand{Command: "CREATE", Path: "/big", Value: big})
+	other.Apply(&DBCommand{Command: "CREATE", Path: "/small", Value: "tiny"})
+	other.Apply(&DBCommand{Command: "SET", Path: "/small", Value: big})
+	other.Apply(&DBCommand{Command: "APPEND", Path: "/big", Value: "!"})
+	if n, _ := getNode(other.Root, "/big"); n.Compressed {
+		t.Errorf("Value was compressed with compression off")
+	}
+	if hashNode(db.Root) != hashNode(other.Root) {
+		t.Errorf("Compressed and uncompressed trees hash differently")
+	}
+}
@@ -0,0 +1,77 @@
+package phatdb
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+var ErrUnknownCommand = errors.New("Unknown command")
+
+// ErrorCode says what kind of error a DBResponse carries, so clients can tell without
+// matching its message
+type ErrorCode int
+
+const (
+	CodeOK ErrorCode = iota
+	// an error without a code of its own: the message says what it is
+	CodeOther
+	CodeNotMaster
+	CodeNoNode
+	CodeNodeExists
+	CodeBadVersion
+	CodeSessionExpired
+	CodeBusy
+	CodeNotAuthorized
+)
+
+var codeNames = map[ErrorCode]string{
+	CodeOK:             "OK",
+	CodeOther:          "Other",
+	CodeNotMaster:      "NotMaster",
+	CodeNoNode:         "NoNode",
+	CodeNodeExists:     "NodeExists",
+	CodeBadVersion:     "BadVersion",
+	CodeSessionExpired: "SessionExpired",
+	CodeBusy:           "Busy",
+	CodeNotAuthorized:  "NotAuthorized",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return "Other"
+}
+
+var errorCodes = map[string]ErrorCode{
+	os.ErrNotExist.Error():    CodeNoNode,
+	os.ErrExist.Error():       CodeNodeExists,
+	ErrBadVersion.Error():     CodeBadVersion,
+	ErrSessionExpired.Error(): CodeSessionExpired,
+	ErrNotAuthorized.Error():  CodeNotAuthorized,
+}
+
+// Fail makes r the reply to a command that failed with err
+func (r *DBResponse) Fail(err error) {
+	r.Error = err.Error()
+	r.Code = CodeOf(r.Error)
+}
+
+// CodeOf returns the code for an error message. The servers' redirects and busy
+// replies count too, whichever of their forms they take
+func CodeOf(message string) ErrorCode {
+	if message == "" {
+		return CodeOK
+	}
+	if code, ok := errorCodes[message]; ok {
+		return code
+	}
+	switch {
+	case strings.HasPrefix(message, "Not master node"):
+		return CodeNotMaster
+	case strings.HasPrefix(message, "server busy"):
+		return CodeBusy
+	}
+	return CodeOther
+}
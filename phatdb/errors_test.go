@@ -0,0 +1,33 @@
+package phatdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestErrorCodes(t *testing.T) {
+	db := NewDatabase()
+	if resp := db.Apply(&DBCommand{Command: "GET", Path: "/missing"}); resp.Code != CodeNoNode || resp.Error != os.ErrNotExist.Error() {
+		t.Errorf("Expected a NoNode reply, got %+v", resp)
+	}
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/a", Value: "1"})
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/a", Value: "1"}); resp.Code != CodeNodeExists {
+		t.Errorf("Expected a NodeExists reply, got %+v", resp)
+	}
+	if resp := db.Apply(&DBCommand{Command: "GET", Path: "/a"}); resp.Code != CodeOK {
+		t.Errorf("Expected an OK reply, got %+v", resp)
+	}
+	if resp := db.Apply(&DBCommand{Command: "NOT_A_COMMAND"}); resp.Code != CodeOther || resp.Error != ErrUnknownCommand.Error() {
+		t.Errorf("Expected an Other reply, got %+v", resp)
+	}
+	for message, code := range map[string]ErrorCode{
+		"Not master node (master is 1)": CodeNotMaster,
+		"server busy, try again in 1s":  CodeBusy,
+		ErrNotAuthorized.Error():        CodeNotAuthorized,
+		ErrSessionExpired.Error():       CodeSessionExpired,
+	} {
+		if CodeOf(message) != code {
+			t.Errorf("Expected %q to be %v, got %v", message, code, CodeOf(message))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package phatdb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExportImportJSON(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/dev/null", Value: "empty"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/dev/random", Value: "\x00\xff"})
+	db.Apply(&DBCommand{Command: "CREATE_SEQ", Path: "/queue/item-", Value: "1"})
+	db.Apply(&DBCommand{Command: "SETACL", Path: "/dev/null", ACL: []ACL{{"digest", "alice", PERM_ALL}}})
+	db.Apply(&DBCommand{Command: "SET_QUOTA", Path: "/queue", Quota: &Quota{MaxChildren: 10}})
+	//
+	var buf bytes.Buffer
+	if err := ExportJSON(db.Root, &buf); err != nil {
+		t.Fatalf("ExportJSON failed: %v", err)
+	}
+	root, err := ImportJSON(&buf)
+	if err != nil {
+		t.Fatalf("ImportJSON failed: %v", err)
+	}
+	if hashNode(root) != hashNode(db.Root) {
+		t.Errorf("Imported tree differs: expected %s, received %s", hashNode(db.Root), hashNode(root))
+	}
+	if n, _ := traverseToNode(root, GetNodePath("/queue"), false); n.Quota == nil || n.Quota.MaxChildren != 10 || n.Sequence != 1 {
+		t.Errorf("Import lost /queue's quota or sequence: %#v", n)
+	}
+	if n, _ := getNode(root, "/dev/null"); len(n.ACL) != 1 {
+		t.Errorf("Import lost /dev/null's ACL: %#v", n.ACL)
+	}
+}
+
+func TestImportJSONFixture(t *testing.T) {
+	// parents that aren't listed are created
+	root, err := ImportJSON(strings.NewReader(`[{"path": "/services/web", "value": "d2ViOjgw", "stats": {"Version": 1}}]`))
+	if err != nil {
+		t.Fatalf("ImportJSON failed: %v", err)
+	}
+	if n, err := getNode(root, "/services/web"); err != nil || string(n.Value) != "web:80" {
+		t.Errorf("Fixture node wasn't imported: %#v (err: %v)", n, err)
+	}
+	if names, _ := getChildren(root, "/"); !areEqual(names, []string{"services"}) {
+		t.Errorf("Fixture parent wasn't created: %v", names)
+	}
+}
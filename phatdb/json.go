@@ -0,0 +1,111 @@
+package phatdb
+
+import (
+	"encoding/json"
+	"reflect"
+	"unicode/utf8"
+)
+
+// Commands and responses are sent as JSON to clients that don't speak gob (see
+// phatRPC's Config.JSONAddress). Two things don't survive plain encoding/json: values
+// that aren't UTF-8 (which it quietly mangles), and what type a response's Reply is
+// (which it can't know). So a command whose Value isn't UTF-8 carries it base64-encoded
+// in ValueBytes instead, and a response says what type its Reply is in Type
+
+// the types a DBResponse's Reply can be, by the name JSON responses give them. Pointers
+// go by the type they point to, as they do for gob
+var replyTypes = map[string]reflect.Type{}
+
+func init() {
+	for _, v := range []interface{}{
+		false, "", uint(0), uint64(0), int64(0), []string{}, []byte{},
+		DataNode{}, StatNode{}, Quota{}, SessionInfo{},
+		[]ACL{}, []ListEntry{}, []Tombstone{}, []AuditEntry{}, []DBResponse{},
+	} {
+		t := reflect.TypeOf(v)
+		replyTypes[t.String()] = t
+	}
+}
+
+// replyType returns the name of v's type, or "" if it isn't one a Reply can be (or is a
+// nil pointer, which is sent as null)
+func replyType(v interface{}) string {
+	val := reflect.ValueOf(v)
+	for val.Kind() == reflect.Ptr && !val.IsNil() {
+		val = val.Elem()
+	}
+	if !val.IsValid() || val.Kind() == reflect.Ptr {
+		return ""
+	}
+	t := val.Type()
+	if replyTypes[t.String()] == nil {
+		return ""
+	}
+	return t.String()
+}
+
+// dbCommand has DBCommand's fields but not its methods, so they don't recurse
+type dbCommand DBCommand
+
+type jsonCommand struct {
+	*dbCommand
+	ValueBytes []byte `json:",omitempty"`
+}
+
+func (c DBCommand) MarshalJSON() ([]byte, error) {
+	j := jsonCommand{dbCommand: (*dbCommand)(&c)}
+	if !utf8.ValidString(c.Value) {
+		j.ValueBytes = []byte(c.Value)
+		j.Value = ""
+	}
+	return json.Marshal(j)
+}
+
+func (c *DBCommand) UnmarshalJSON(data []byte) error {
+	j := jsonCommand{dbCommand: (*dbCommand)(c)}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	if j.ValueBytes != nil {
+		c.Value = string(j.ValueBytes)
+	}
+	return nil
+}
+
+type jsonResponse struct {
+	Reply interface{}
+	Type  string `json:",omitempty"`
+	Error string
+	Code  ErrorCode
+}
+
+func (r DBResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonResponse{r.Reply, replyType(r.Reply), r.Error, r.Code})
+}
+
+func (r *DBResponse) UnmarshalJSON(data []byte) error {
+	var j struct {
+		Reply json.RawMessage
+		Type  string
+		Error string
+		Code  ErrorCode
+	}
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	r.Reply, r.Error, r.Code = nil, j.Error, j.Code
+	if len(j.Reply) == 0 || string(j.Reply) == "null" {
+		return nil
+	}
+	// a reply of a type we don't know comes out however encoding/json decodes it
+	t, ok := replyTypes[j.Type]
+	if !ok {
+		return json.Unmarshal(j.Reply, &r.Reply)
+	}
+	v := reflect.New(t)
+	if err := json.Unmarshal(j.Reply, v.Interface()); err != nil {
+		return err
+	}
+	r.Reply = v.Elem().Interface()
+	return nil
+}
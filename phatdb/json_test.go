@@ -0,0 +1,67 @@
+package phatdb
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCommandJSON(t *testing.T) {
+	for _, cmd := range []DBCommand{
+		{Command: "SET", Path: "/a", Value: "text"},
+		{Command: "SET", Path: "/a", Value: "\xff\x00binary"},
+		{Command: "MULTI", Ops: []*DBCommand{{Command: "CREATE", Path: "/b", Value: "\xfe"}}},
+	} {
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			t.Fatalf("Couldn't encode %+v: %s", cmd, err)
+		}
+		var got DBCommand
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("Couldn't decode %s: %s", data, err)
+		}
+		if !reflect.DeepEqual(got, cmd) {
+			t.Errorf("Expected %+v back from %s, got %+v", cmd, data, got)
+		}
+	}
+	// what a client not written in Go would send
+	var cmd DBCommand
+	if err := json.Unmarshal([]byte(`{"Command": "CREATE", "Path": "/c", "Value": "hi"}`), &cmd); err != nil || cmd.Command != "CREATE" || cmd.Value != "hi" {
+		t.Errorf("Expected a CREATE of hi, got %+v %v", cmd, err)
+	}
+}
+
+func TestResponseJSON(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/a", Value: "1"})
+	for _, req := range []*DBCommand{
+		{Command: "GET", Path: "/a"},
+		{Command: "EXISTS", Path: "/a"},
+		{Command: "CHILDREN", Path: "/"},
+		{Command: "STAT", Path: "/a"},
+		{Command: "GET_ACL", Path: "/a"},
+		{Command: "MGET", Paths: []string{"/a", "/missing"}},
+		{Command: "GET", Path: "/missing"},
+	} {
+		resp := db.Apply(req)
+		data, err := json.Marshal(resp)
+		if err != nil {
+			t.Fatalf("Couldn't encode %+v: %s", resp, err)
+		}
+		var got DBResponse
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("Couldn't decode %s: %s", data, err)
+		}
+		// pointers come back as what they point to, as with gob
+		want := reflect.TypeOf(resp.Reply)
+		if want != nil && want.Kind() == reflect.Ptr {
+			want = want.Elem()
+		}
+		if reflect.TypeOf(got.Reply) != want || got.Error != resp.Error || got.Code != resp.Code {
+			t.Errorf("Expected a %v reply like %+v back from %s, got %#v", want, resp, data, got)
+		}
+		if again, _ := json.Marshal(got); string(again) != string(data) {
+			t.Errorf("Expected %s to encode the same again, got %s", data, again)
+		}
+	}
+}
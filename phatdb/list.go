@@ -0,0 +1,80 @@
+package phatdb
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+// flags for LIST
+const (
+	// treat the path as a plain prefix of the paths to return instead of a glob
+	LIST_PREFIX = 1 << iota
+	// return the data of every matching node along with its path
+	LIST_DATA
+)
+
+type ListEntry struct {
+	Path string
+	Data *DataNode // only set with LIST_DATA
+}
+
+// listNodes returns every node matching pattern, sorted by path. Patterns are matched a
+// path component at a time (see path.Match), so /services/*/endpoints matches
+// /services/web/endpoints but not /services/web/eu/endpoints. Nodes the caller can't
+// read are left out
+func listNodes(root *FileNode, pattern string, flags int, auth []Identity) ([]ListEntry, error) {
+	var entries []ListEntry
+	add := func(p string, n *FileNode) {
+		if n.Data != nil && !allowed(n.Data.ACL, PERM_READ, auth) {
+			return
+		}
+		if p == "" {
+			p = "/"
+		}
+		entry := ListEntry{Path: p}
+		if flags&LIST_DATA != 0 {
+			entry.Data = n.Data
+		}
+		entries = append(entries, entry)
+	}
+	if flags&LIST_PREFIX != 0 {
+		var walk func(n *FileNode, p string)
+		walk = func(n *FileNode, p string) {
+			for name, child := range n.Children {
+				childPath := p + "/" + name
+				if strings.HasPrefix(childPath, pattern) {
+					add(childPath, child)
+				} else if !strings.HasPrefix(pattern, childPath+"/") {
+					// nothing under here can match
+					continue
+				}
+				walk(child, childPath)
+			}
+		}
+		walk(root, "")
+	} else {
+		parts := GetNodePath(pattern)
+		// catch bad patterns even if there's nothing to match them against
+		for _, part := range parts {
+			if _, err := path.Match(part, ""); err != nil {
+				return nil, err
+			}
+		}
+		var walk func(n *FileNode, p string, depth int)
+		walk = func(n *FileNode, p string, depth int) {
+			if depth == len(parts) {
+				add(p, n)
+				return
+			}
+			for name, child := range n.Children {
+				if ok, _ := path.Match(parts[depth], name); ok {
+					walk(child, p+"/"+name, depth+1)
+				}
+			}
+		}
+		walk(root, "", 0)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
@@ -0,0 +1,50 @@
+package phatdb
+
+import (
+	"testing"
+)
+
+func listPaths(entries []ListEntry) []string {
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	return paths
+}
+
+func TestListNodes(t *testing.T) {
+	root := setup()
+	//
+	createNode(root, "/services/web/endpoints", "web:80")
+	createNode(root, "/services/db/endpoints", "db:5432")
+	createNode(root, "/services/db/eu/endpoints", "db-eu:5432")
+	createNode(root, "/servers/a", "")
+	// Globs match one component per path component
+	entries, err := listNodes(root, "/services/*/endpoints", 0, nil)
+	expected := []string{"/services/db/endpoints", "/services/web/endpoints"}
+	if err != nil || !areEqual(listPaths(entries), expected) {
+		t.Errorf("LIST glob: wanted %v, received %v (err: %v)", expected, listPaths(entries), err)
+	}
+	if entries[0].Data != nil {
+		t.Errorf("LIST returned data without LIST_DATA")
+	}
+	// Prefixes match anywhere in the path, including partial names
+	entries, err = listNodes(root, "/serv", LIST_PREFIX|LIST_DATA, nil)
+	expected = []string{"/servers", "/servers/a", "/services", "/services/db", "/services/db/endpoints",
+		"/services/db/eu", "/services/db/eu/endpoints", "/services/web", "/services/web/endpoints"}
+	if err != nil || !areEqual(listPaths(entries), expected) {
+		t.Errorf("LIST prefix: wanted %v, received %v (err: %v)", expected, listPaths(entries), err)
+	}
+	if string(entries[4].Data.Value) != "db:5432" {
+		t.Errorf("LIST_DATA returned the wrong data: %#v", entries[4].Data)
+	}
+	// Unreadable nodes are left out
+	setACL(root, "/services/web/endpoints", []ACL{{"digest", "alice", PERM_ALL}})
+	entries, _ = listNodes(root, "/services/*/endpoints", 0, nil)
+	if !areEqual(listPaths(entries), []string{"/services/db/endpoints"}) {
+		t.Errorf("LIST returned a node the caller can't read: %v", listPaths(entries))
+	}
+	if _, err := listNodes(root, "/services/[", 0, nil); err == nil {
+		t.Errorf("LIST accepted a bad pattern")
+	}
+}
@@ -0,0 +1,69 @@
+package phatdb
+
+import (
+	"errors"
+)
+
+var (
+	ErrLocked        = errors.New("node is locked by another session")
+	ErrNotLockHolder = errors.New("session doesn't hold the lock")
+)
+
+// lockNode makes session the holder of the node's advisory lock. Each new holder gets the
+// next fencing token (from a counter shared by the whole tree), which it can hand to other
+// services so they can turn away requests from an older holder. Locking a node you
+// already hold just returns your token
+func lockNode(root *FileNode, path string, session string) (uint64, error) {
+	if session == "" {
+		return 0, ErrNoSession
+	}
+	n, err := traverseToData(root, path)
+	if err != nil {
+		return 0, err
+	}
+	stats := n.Data.Stats
+	switch stats.LockHolder {
+	case session:
+	case "":
+		root.LockTokens += 1
+		stats.LockHolder = session
+		stats.LockToken = root.LockTokens
+	default:
+		return 0, ErrLocked
+	}
+	return stats.LockToken, nil
+}
+
+func unlockNode(root *FileNode, path string, session string) error {
+	n, err := traverseToData(root, path)
+	if err != nil {
+		return err
+	}
+	if session == "" || n.Data.Stats.LockHolder != session {
+		return ErrNotLockHolder
+	}
+	n.Data.Stats.LockHolder = ""
+	return nil
+}
+
+// releaseSessionLocks breaks every lock held by session, returning the paths of the
+// nodes that were unlocked
+func releaseSessionLocks(root *FileNode, session string) []string {
+	var released []string
+	if session == "" {
+		return released
+	}
+	var walk func(n *FileNode, path string)
+	walk = func(n *FileNode, path string) {
+		for name, child := range n.Children {
+			childPath := path + "/" + name
+			if child.Data.Stats.LockHolder == session {
+				child.Data.Stats.LockHolder = ""
+				released = append(released, childPath)
+			}
+			walk(child, childPath)
+		}
+	}
+	walk(root, "")
+	return released
+}
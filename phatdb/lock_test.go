@@ -0,0 +1,48 @@
+package phatdb
+
+import (
+	"testing"
+)
+
+func TestLockNode(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/lock"})
+	//
+	resp := db.Apply(&DBCommand{Command: "LOCK", Path: "/lock", Session: "s1"})
+	if resp.Error != "" || resp.Reply.(uint64) != 1 {
+		t.Fatalf("LOCK of a free node returned %#v", resp)
+	}
+	if resp := db.Apply(&DBCommand{Command: "LOCK", Path: "/lock", Session: "s1"}); resp.Error != "" || resp.Reply.(uint64) != 1 {
+		t.Errorf("Relocking by the holder returned %#v", resp)
+	}
+	if resp := db.Apply(&DBCommand{Command: "LOCK", Path: "/lock", Session: "s2"}); resp.Error != ErrLocked.Error() {
+		t.Errorf("LOCK of a held node returned %q", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "UNLOCK", Path: "/lock", Session: "s2"}); resp.Error != ErrNotLockHolder.Error() {
+		t.Errorf("UNLOCK by a non-holder returned %q", resp.Error)
+	}
+	db.Apply(&DBCommand{Command: "UNLOCK", Path: "/lock", Session: "s1"})
+	// The next holder gets a newer fencing token
+	if resp := db.Apply(&DBCommand{Command: "LOCK", Path: "/lock", Session: "s2"}); resp.Error != "" || resp.Reply.(uint64) != 2 {
+		t.Errorf("LOCK after UNLOCK returned %#v", resp)
+	}
+	// The lock is broken when its holder's session ends
+	db.Apply(&DBCommand{Command: "CLOSE_SESSION", Session: "s2"})
+	n, _ := getNode(db.Root, "/lock")
+	if n.Stats.LockHolder != "" || n.Stats.LockToken != 2 {
+		t.Errorf("CLOSE_SESSION didn't release the lock: %+v", n.Stats)
+	}
+	if hashNode(db.Root) != hashNode(copyTreeUncached(db.Root)) {
+		t.Errorf("Releasing locks left a stale digest")
+	}
+	if resp := db.Apply(&DBCommand{Command: "LOCK", Path: "/lock"}); resp.Error != ErrNoSession.Error() {
+		t.Errorf("LOCK without a session returned %q", resp.Error)
+	}
+	// Tokens keep growing even once the node's deleted and created again, so an old
+	// holder's token can't be mistaken for a new one
+	db.Apply(&DBCommand{Command: "DELETE", Path: "/lock"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/lock"})
+	if resp := db.Apply(&DBCommand{Command: "LOCK", Path: "/lock", Session: "s3"}); resp.Error != "" || resp.Reply.(uint64) != 3 {
+		t.Errorf("LOCK of a recreated node returned %#v", resp)
+	}
+}
@@ -0,0 +1,137 @@
+package phatdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// digest returns the node's Merkle digest: a hash of its own data along with the names
+// and digests of its children, so two subtrees are equal exactly when their digests are.
+// Digests are cached on the nodes until touchPath clears them, so after a write only the
+// nodes along its path need rehashing
+func (f *FileNode) digest() []byte {
+	if f.hash != nil {
+		return f.hash
+	}
+	h := sha256.New()
+	if d := f.Data; d != nil {
+		s := d.Stats
+		// hash the plain value: how it's stored isn't part of the state
+		fmt.Fprintf(h, "%q %d %d %d %q %d %d %d %d %d %q %d %t %v\n", plainValue(d), s.Version, s.CVersion, s.NumChildren,
+			s.EphemeralOwner, s.DataLength, s.Ctime.UnixNano(), s.Mtime.UnixNano(), s.CreateOp, s.TTL,
+			s.LockHolder, s.LockToken, s.Container, d.ACL)
+	}
+	if f.Quota != nil {
+		fmt.Fprintf(h, "quota %d %d\n", f.Quota.MaxBytes, f.Quota.MaxChildren)
+		if f.Quota.MaxNodes != 0 {
+			fmt.Fprintf(h, "quota nodes %d\n", f.Quota.MaxNodes)
+		}
+	}
+	fmt.Fprintf(h, "%d %t %d\n", f.Sequence, f.ReadOnly, f.LockTokens)
+	for _, rev := range f.History {
+		fmt.Fprintf(h, "rev %d %q %d\n", rev.Version, plainValue(&DataNode{Value: rev.Value, Compressed: rev.Compressed}), rev.Mtime.UnixNano())
+	}
+	for _, stone := range getTombstones(f, "/") {
+		fmt.Fprintf(h, "tombstone %q %q %d %d\n", stone.Path, stone.Command, stone.Deleted.UnixNano(), stone.DeleteOp)
+	}
+	audited := make([]string, 0, len(f.Audited))
+	for path := range f.Audited {
+		audited = append(audited, path)
+	}
+	sort.Strings(audited)
+	fmt.Fprintf(h, "audited %q %d\n", audited, len(f.AuditLog))
+	// the log is append-only, so its length and last entry are enough
+	if len(f.AuditLog) > 0 {
+		fmt.Fprintf(h, "audit %v\n", f.AuditLog[len(f.AuditLog)-1])
+	}
+	sessions := make([]string, 0, len(f.Sessions))
+	for session := range f.Sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Strings(sessions)
+	for _, session := range sessions {
+		lease := f.Sessions[session]
+		fmt.Fprintf(h, "session %q %d %d\n", session, lease.Timeout, lease.Renewed.UnixNano())
+	}
+	authed := make([]string, 0, len(f.Identities))
+	for session := range f.Identities {
+		authed = append(authed, session)
+	}
+	sort.Strings(authed)
+	for _, session := range authed {
+		fmt.Fprintf(h, "identities %q %v %q\n", session, f.Identities[session], f.AuthTokens[session])
+	}
+	names := make([]string, 0, len(f.Children))
+	for name := range f.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%q %x\n", name, f.Children[name].digest())
+	}
+	f.hash = h.Sum(nil)
+	return f.hash
+}
+
+// touchPath clears the cached digests of every node from the root down to path (as far as
+// it exists), which is everything whose subtree a write to path can have changed
+func touchPath(root *FileNode, path string) {
+	n := root
+	n.hash = nil
+	for _, part := range GetNodePath(path) {
+		child, ok := n.Children[part]
+		if !ok {
+			return
+		}
+		n = child
+		n.hash = nil
+	}
+}
+
+// subtreeDigest returns the hex digest of the subtree at path
+func subtreeDigest(root *FileNode, path string) (string, error) {
+	n, err := traverseToNode(root, GetNodePath(path), false)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(n.digest()), nil
+}
+
+// touchedPaths returns the paths a successful write command may have changed
+func touchedPaths(req *DBCommand, resp *DBResponse) []string {
+	return append(commandPaths(req, resp), resp.reaped...)
+}
+
+// commandPaths returns the paths a write command names or replies with
+func commandPaths(req *DBCommand, resp *DBResponse) []string {
+	switch req.Command {
+	case "CREATE_SEQ":
+		if path, ok := resp.Reply.(string); ok {
+			return []string{path}
+		}
+	case "EXPIRE", "CLOSE_SESSION", "EXPIRE_SESSION":
+		paths, _ := resp.Reply.([]string)
+		return paths
+	case "OPEN_SESSION", "KEEPALIVE", "RENEW_SESSIONS", "AUTH":
+		// only the root's session table changes (see sessionsChanged)
+		return nil
+	case "COPY", "MOVE":
+		return []string{req.Path, req.Target}
+	case "MULTI":
+		var paths []string
+		results, _ := resp.Reply.([]DBResponse)
+		for i := range results {
+			// reads and checks don't touch anything
+			if IsWrite(req.Ops[i].Command) {
+				paths = append(paths, touchedPaths(req.Ops[i], &results[i])...)
+			}
+		}
+		return paths
+	case "LOAD_SNAPSHOT":
+		// everything
+		return []string{"/"}
+	}
+	return []string{req.Path}
+}
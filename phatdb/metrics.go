@@ -0,0 +1,126 @@
+package phatdb
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often Serve refreshes the node count and size gauges (they need a walk of the tree)
+const METRICS_INTERVAL = 10 * time.Second
+
+// upper bounds of the latency histogram buckets (the last bucket catches everything else)
+var latencyBuckets = []time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// metrics are published through expvar, so servers can serve them at /debug/vars
+var (
+	commandCount   = expvar.NewMap("phatdb_commands")
+	commandErrors  = expvar.NewMap("phatdb_command_errors")
+	commandLatency = expvar.NewMap("phatdb_command_latency")
+	nodeCount      = expvar.NewInt("phatdb_nodes")
+	totalBytes     = expvar.NewInt("phatdb_bytes")
+	latencyLock    sync.Mutex
+)
+
+// Histogram counts durations in buckets. It's an expvar.Var, so it can be published
+// alongside the rest of the metrics
+type Histogram struct {
+	// upper bounds of the buckets (the last bucket catches everything else). Defaults to
+	// latencyBuckets; can't be changed once anything's been observed
+	Bounds []time.Duration
+	lock   sync.Mutex
+	counts []int64
+	sum    time.Duration
+}
+
+func (h *Histogram) bounds() []time.Duration {
+	if h.Bounds == nil {
+		return latencyBuckets
+	}
+	return h.Bounds
+}
+
+// Observe counts d in its bucket
+func (h *Histogram) Observe(d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	bounds := h.bounds()
+	if h.counts == nil {
+		h.counts = make([]int64, len(bounds)+1)
+	}
+	i := 0
+	for i < len(bounds) && d > bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += d
+}
+
+// Buckets returns the bucket bounds, how many durations went in each bucket (one more
+// than there are bounds) and what they added up to
+func (h *Histogram) Buckets() ([]time.Duration, []int64, time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	bounds := h.bounds()
+	counts := make([]int64, len(bounds)+1)
+	copy(counts, h.counts)
+	return bounds, counts, h.sum
+}
+
+// String is the JSON expvar wants, e.g. {"buckets": {"10µs": 3, ..., "+Inf": 0}, "count": 3, "sum_us": 12}
+func (h *Histogram) String() string {
+	bounds, counts, sum := h.Buckets()
+	var buckets []string
+	var total int64
+	for i, n := range counts {
+		total += n
+		bound := "+Inf"
+		if i < len(bounds) {
+			bound = bounds[i].String()
+		}
+		buckets = append(buckets, fmt.Sprintf("%q: %d", bound, n))
+	}
+	return fmt.Sprintf(`{"buckets": {%s}, "count": %d, "sum_us": %d}`,
+		strings.Join(buckets, ", "), total, sum/time.Microsecond)
+}
+
+// recordCommand counts a command and how long it took
+func recordCommand(command string, resp *DBResponse, took time.Duration) {
+	commandCount.Add(command, 1)
+	if resp.Error != "" {
+		commandErrors.Add(command, 1)
+	}
+	latencyLock.Lock()
+	h, ok := commandLatency.Get(command).(*Histogram)
+	if !ok {
+		h = new(Histogram)
+		commandLatency.Set(command, h)
+	}
+	latencyLock.Unlock()
+	h.Observe(took)
+}
+
+// updateSizeMetrics sets the node count and total size gauges from the tree
+func updateSizeMetrics(root *FileNode) {
+	var nodes, size int64
+	var walk func(n *FileNode)
+	walk = func(n *FileNode) {
+		for _, child := range n.Children {
+			nodes++
+			size += int64(len(child.Data.Value))
+			walk(child)
+		}
+	}
+	walk(root)
+	nodeCount.Set(nodes)
+	totalBytes.Set(size)
+}
@@ -0,0 +1,56 @@
+package phatdb
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	before, _ := commandCount.Get("CREATE").(*expvar.Int)
+	var created int64
+	if before != nil {
+		created = before.Value()
+	}
+	input := make(chan DBCommandWithChannel)
+	go DatabaseServer(input)
+	for _, cmd := range []*DBCommand{
+		{Command: "CREATE", Path: "/dev/null", Value: "empty"},
+		{Command: "CREATE", Path: "/dev/null", Value: "again"},
+	} {
+		req := DBCommandWithChannel{cmd, make(chan *DBResponse)}
+		input <- req
+		<-req.Done
+	}
+	//
+	if n := commandCount.Get("CREATE").(*expvar.Int).Value(); n != created+2 {
+		t.Errorf("Counted %d CREATEs, expected %d", n, created+2)
+	}
+	if commandErrors.Get("CREATE") == nil {
+		t.Errorf("The failed CREATE wasn't counted")
+	}
+	var hist struct {
+		Buckets map[string]int64
+		Count   int64
+	}
+	if err := json.Unmarshal([]byte(commandLatency.Get("CREATE").String()), &hist); err != nil {
+		t.Fatalf("Latency histogram isn't valid JSON: %v", err)
+	}
+	if hist.Count < 2 || len(hist.Buckets) != len(latencyBuckets)+1 {
+		t.Errorf("Latency histogram is %+v", hist)
+	}
+	//
+	root := setup()
+	createNode(root, "/a/b", "1234")
+	updateSizeMetrics(root)
+	if nodeCount.Value() != 2 || totalBytes.Value() != 4 {
+		t.Errorf("Size gauges are %d nodes and %d bytes, expected 2 and 4", nodeCount.Value(), totalBytes.Value())
+	}
+	h := new(Histogram)
+	h.Observe(50 * time.Microsecond)
+	h.Observe(time.Minute)
+	if h.counts[1] != 1 || h.counts[len(latencyBuckets)] != 1 {
+		t.Errorf("Durations went in the wrong buckets: %v", h.counts)
+	}
+}
@@ -0,0 +1,119 @@
+package phatdb
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// flags for COPY and MOVE
+const (
+	// take the node's whole subtree along (without it, only the node's own data is copied,
+	// and only nodes without children can be moved)
+	WITH_SUBTREE = 1 << iota
+	// start the new nodes' versions over, as if they had just been created
+	RESET_VERSIONS
+)
+
+var ErrMoveIntoSelf = errors.New("can't move a node under itself")
+
+// resetVersions makes every node in the subtree look newly created. Nodes that were
+// never created (version 0) stay that way
+func resetVersions(n *FileNode) {
+	n.hash = nil
+	if n.Data != nil {
+		if n.Data.Stats.Version > 0 {
+			n.Data.Stats.Version = 1
+		}
+		n.Data.Stats.CVersion = 0
+	}
+	for _, child := range n.Children {
+		resetVersions(child)
+	}
+}
+
+// attachNode puts n in the tree at path, which mustn't exist yet
+func attachNode(root *FileNode, path string, n *FileNode) error {
+	parts := GetNodePath(path)
+	if len(parts) == 0 {
+		return os.ErrExist
+	}
+	name := parts[len(parts)-1]
+	if MaxNameLength > 0 && len(name) > MaxNameLength {
+		return ErrNameTooLong
+	}
+	parent, err := traverseToNode(root, parts[:len(parts)-1], true)
+	if err != nil {
+		return err
+	}
+	if _, exists := parent.Children[name]; exists {
+		return os.ErrExist
+	}
+	if parent.Data != nil {
+		if parent.Data.Stats.EphemeralOwner != "" {
+			return ErrEphemeralParent
+		}
+		parent.Data.Stats.CVersion += 1
+		parent.Data.Stats.NumChildren = uint64(len(parent.Children)) + 1
+	}
+	parent.Children[name] = n
+	return nil
+}
+
+// copyNode copies the node at path (and its subtree, with WITH_SUBTREE) to target
+func copyNode(root *FileNode, path string, target string, flags int) (*DataNode, error) {
+	n, err := traverseToNode(root, GetNodePath(path), false)
+	if err != nil {
+		return nil, err
+	}
+	if n == root {
+		return nil, os.ErrInvalid
+	}
+	var c *FileNode
+	if flags&WITH_SUBTREE != 0 {
+		c = copyTree(n)
+	} else {
+		c = copyTree(&FileNode{Data: n.Data})
+	}
+	// copies aren't owned by anyone (and so don't go away with the original's owner)
+	c.Data.Stats.EphemeralOwner = ""
+	c.Data.Stats.LockHolder = ""
+	if flags&RESET_VERSIONS != 0 {
+		resetVersions(c)
+	}
+	if err := attachNode(root, target, c); err != nil {
+		return nil, err
+	}
+	return c.Data, nil
+}
+
+// moveNode moves the node at path (which has to be empty unless WITH_SUBTREE is set) to target
+func moveNode(root *FileNode, path string, target string, flags int) (*DataNode, error) {
+	n, err := traverseToNode(root, GetNodePath(path), false)
+	if err != nil {
+		return nil, err
+	}
+	if n == root {
+		return nil, ErrDeleteRoot
+	}
+	if flags&WITH_SUBTREE == 0 && len(n.Children) > 0 {
+		return nil, ErrNotEmpty
+	}
+	src := "/" + strings.Join(GetNodePath(path), "/")
+	dst := "/" + strings.Join(GetNodePath(target), "/")
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return nil, ErrMoveIntoSelf
+	}
+	// attach first, so emptying a container on the way out can't take the target's parent
+	if err := attachNode(root, target, n); err != nil {
+		return nil, err
+	}
+	// the move is all done if this fails, since the node was just found
+	if _, err := deleteNodeRecursive(root, path); err != nil {
+		return nil, err
+	}
+	if flags&RESET_VERSIONS != 0 {
+		resetVersions(n)
+	}
+	return n.Data, nil
+}
@@ -0,0 +1,59 @@
+package phatdb
+
+import (
+	"testing"
+)
+
+func TestCopyAndMove(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/app/v1", Value: "config"})
+	db.Apply(&DBCommand{Command: "SET", Path: "/app/v1", Value: "config2"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/app/v1/db", Value: "db"})
+	//
+	// Just the node, keeping its version
+	resp := db.Apply(&DBCommand{Command: "COPY", Path: "/app/v1", Target: "/backup/v1"})
+	if resp.Error != "" {
+		t.Fatalf("COPY failed: %s", resp.Error)
+	}
+	if n, _ := getNode(db.Root, "/backup/v1"); string(n.Value) != "config2" || n.Stats.Version != 2 {
+		t.Errorf("COPY made %#v", n)
+	}
+	if kids, _ := getChildren(db.Root, "/backup/v1"); len(kids) != 0 {
+		t.Errorf("COPY without WITH_SUBTREE copied children %v", kids)
+	}
+	// The whole subtree, starting the versions over
+	db.Apply(&DBCommand{Command: "COPY", Path: "/app/v1", Target: "/app/v2", Flags: WITH_SUBTREE | RESET_VERSIONS})
+	if n, _ := getNode(db.Root, "/app/v2/db"); n == nil || string(n.Value) != "db" {
+		t.Errorf("COPY with WITH_SUBTREE didn't copy /app/v1/db")
+	}
+	if n, _ := getNode(db.Root, "/app/v2"); n.Stats.Version != 1 {
+		t.Errorf("RESET_VERSIONS left version %d", n.Stats.Version)
+	}
+	// Copies are independent of the original
+	db.Apply(&DBCommand{Command: "SET", Path: "/app/v2/db", Value: "changed"})
+	if n, _ := getNode(db.Root, "/app/v1/db"); string(n.Value) != "db" {
+		t.Errorf("Changing a copy changed the original")
+	}
+	if resp := db.Apply(&DBCommand{Command: "COPY", Path: "/app/v1", Target: "/app/v2"}); resp.Error == "" {
+		t.Errorf("COPY onto an existing node should fail")
+	}
+	// Moves need WITH_SUBTREE for nodes with children, and can't go under themselves
+	if resp := db.Apply(&DBCommand{Command: "MOVE", Path: "/app/v1", Target: "/old/v1"}); resp.Error != ErrNotEmpty.Error() {
+		t.Errorf("MOVE of a node with children returned %q", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "MOVE", Path: "/app", Target: "/app/v1/app", Flags: WITH_SUBTREE}); resp.Error != ErrMoveIntoSelf.Error() {
+		t.Errorf("MOVE under itself returned %q", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "MOVE", Path: "/app/v1", Target: "/old/v1", Flags: WITH_SUBTREE}); resp.Error != "" {
+		t.Errorf("MOVE failed: %s", resp.Error)
+	}
+	if exists, _ := existsNode(db.Root, "/app/v1"); exists {
+		t.Errorf("MOVE left the original behind")
+	}
+	if n, _ := getNode(db.Root, "/old/v1/db"); n == nil || n.Stats.Version != 1 || string(n.Value) != "db" {
+		t.Errorf("MOVE didn't bring the subtree along")
+	}
+	if hashNode(db.Root) != hashNode(copyTreeUncached(db.Root)) {
+		t.Errorf("COPY or MOVE left a stale digest")
+	}
+}
@@ -1,9 +1,52 @@
 package phatdb
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+)
+
+// limits on what clients can put in the tree, so bad input can't bog down every replica
+// (0 means no limit). Every replica needs the same limits
+var (
+	MaxPathDepth  = 64      // components in a path
+	MaxNameLength = 255     // bytes in a single path component
+	MaxValueSize  = 1 << 20 // bytes in a node's value
+)
+
+// how many old values of each node to keep for GET_VERSION (0 keeps none).
+// Every replica needs the same setting
+var HistoryLength = 0
+
+// flags for CREATE
+const (
+	// node is deleted once its owner's session ends
+	EPHEMERAL = 1 << iota
+	// node is deleted once its last child is (e.g. the directory of a lock or queue recipe)
+	CONTAINER
+)
+
+var (
+	ErrEphemeralParent = errors.New("ephemeral nodes can't have children")
+	ErrNoSession       = errors.New("ephemeral nodes need an owning session")
+	ErrBadVersion      = errors.New("node version doesn't match the expected version")
+	ErrNotEmpty        = errors.New("node has children")
+	ErrDeleteRoot      = errors.New("the root node can't be deleted")
+	ErrRootNode        = errors.New("the root node has no data")
+	ErrTooLarge        = errors.New("node value would be too large")
+	ErrPathTooDeep     = errors.New("path has too many components")
+	ErrNameTooLong     = errors.New("path component is too long")
+	ErrReadOnly        = errors.New("database is read-only")
+	ErrNotNumber       = errors.New("node value isn't a number")
+	ErrNoSuchVersion   = errors.New("that version of the node isn't available")
+	ErrNotModified     = errors.New("node hasn't changed")
 )
 
 func SplitOnSlash(r rune) bool {
@@ -11,9 +54,18 @@ func SplitOnSlash(r rune) bool {
 }
 
 type StatNode struct {
-	Version     uint64 // File version
-	CVersion    uint64 // Children version
-	NumChildren uint64 // Number of children
+	Version        uint64        // File version
+	CVersion       uint64        // Children version
+	NumChildren    uint64        // Number of children
+	EphemeralOwner string        // Session that owns this node ("" if it isn't ephemeral)
+	DataLength     uint64        // Length of the node's value in bytes
+	Ctime          time.Time     // When the node was created
+	Mtime          time.Time     // Last time the node was created or set
+	CreateOp       uint64        // VR op number of the command that created the node
+	LockHolder     string        // Session holding the node's advisory lock ("" if it's free)
+	LockToken      uint64        // Fencing token: a new one, bigger than any before, every time the lock changes hands
+	Container      bool          // Node is deleted once its last child is
+	TTL            time.Duration // Node is deleted if not set for this long (0 means never)
 }
 
 func (s *StatNode) GoString() string {
@@ -21,53 +73,279 @@ func (s *StatNode) GoString() string {
 }
 
 type DataNode struct {
-	Value string
-	Stats *StatNode
+	Value      []byte
+	Compressed bool // Value is compressed (see Plain)
+	Stats      *StatNode
+	ACL        []ACL // who can do what to this node (empty means anyone can do anything)
 }
 
 func (d *DataNode) GoString() string {
-	return fmt.Sprintf("<DN V=%#v Stats=%#v>", d.Value, d.Stats)
+	return fmt.Sprintf("<DN V=%q Stats=%#v>", d.Value, d.Stats)
 }
 
 type FileNode struct {
 	//Parent   *FileNode
 	Children map[string]*FileNode
 	Data     *DataNode
+	Sequence uint64 // counter for sequentially created children
+	Quota    *Quota // limits on this node's subtree, if any
+	// only used on the root: every write (other than turning this off) is rejected.
+	// it lives in the tree so snapshots and checkpoints keep it
+	ReadOnly bool
+	hash     []byte     // cached Merkle digest of the subtree (see digest)
+	History  []Revision // the node's previous values, oldest first (see HistoryLength)
+	// only used on the root: recently deleted paths (see Tombstone)
+	Tombstones map[string]Tombstone
+	// only used on the root: the subtrees whose writes are recorded, and the record
+	Audited  map[string]bool
+	AuditLog []AuditEntry
+	// only used on the root: the sessions opened with OPEN_SESSION
+	Sessions map[string]SessionLease
+	// only used on the root: who each session has authenticated as with AUTH, and the
+	// token its commands have to carry for that to count
+	Identities map[string][]Identity
+	AuthTokens map[string]string
+	// only used on the root: the OpNumber of the last write applied, so the ones VR
+	// replays to a restarted replica aren't applied on top of what it persisted
+	AppliedOp uint64
+	// only used on the root: the last fencing token handed out (see LockToken). It's
+	// shared by every node, so a node that's deleted and created again doesn't hand
+	// out its old holders' tokens all over again
+	LockTokens uint64
+	// only used on the root: the containers the command being applied emptied and so
+	// deleted (see deleteNodeRecursive), which aren't in its own paths
+	reaped []string
+}
+
+// Revision is an old value of a node
+type Revision struct {
+	Version    uint64
+	Value      []byte
+	Compressed bool
+	Mtime      time.Time
 }
 
 func (f *FileNode) GoString() string {
 	return fmt.Sprintf("<FN Children=%#v Data=%#v>", f.Children, f.Data)
 }
 
+// copyTree returns a deep copy of the tree rooted at f
+func copyTree(f *FileNode) *FileNode {
+	n := shallowCopy(f)
+	for name, child := range f.Children {
+		n.Children[name] = copyTree(child)
+	}
+	return n
+}
+
+// shallowCopy copies f itself, sharing its children with it
+func shallowCopy(f *FileNode) *FileNode {
+	n := &FileNode{Children: make(map[string]*FileNode, len(f.Children)), Sequence: f.Sequence, Quota: f.Quota, ReadOnly: f.ReadOnly, AppliedOp: f.AppliedOp, LockTokens: f.LockTokens, hash: f.hash}
+	if f.Data != nil {
+		data := *f.Data
+		stats := *f.Data.Stats
+		data.Stats = &stats
+		data.Value = append([]byte(nil), f.Data.Value...)
+		data.ACL = append([]ACL(nil), f.Data.ACL...)
+		n.Data = &data
+	}
+	n.History = append([]Revision(nil), f.History...)
+	if f.Tombstones != nil {
+		n.Tombstones = make(map[string]Tombstone, len(f.Tombstones))
+		for path, stone := range f.Tombstones {
+			n.Tombstones[path] = stone
+		}
+	}
+	if f.Audited != nil {
+		n.Audited = make(map[string]bool, len(f.Audited))
+		for path := range f.Audited {
+			n.Audited[path] = true
+		}
+	}
+	if f.Sessions != nil {
+		n.Sessions = make(map[string]SessionLease, len(f.Sessions))
+		for session, lease := range f.Sessions {
+			n.Sessions[session] = lease
+		}
+	}
+	if f.Identities != nil {
+		n.Identities = make(map[string][]Identity, len(f.Identities))
+		for session, ids := range f.Identities {
+			n.Identities[session] = append([]Identity(nil), ids...)
+		}
+	}
+	if f.AuthTokens != nil {
+		n.AuthTokens = make(map[string]string, len(f.AuthTokens))
+		for session, token := range f.AuthTokens {
+			n.AuthTokens[session] = token
+		}
+	}
+	// entries are never changed once they're in the log, so sharing them is fine
+	n.AuditLog = f.AuditLog[:len(f.AuditLog):len(f.AuditLog)]
+	for name, child := range f.Children {
+		n.Children[name] = child
+	}
+	return n
+}
+
+// copyPath makes sure the nodes on the way to path are root's own, copying the ones that
+// aren't in copied yet (and adding them), so they can be changed without changing the
+// tree root was copied from
+func copyPath(root *FileNode, path string, copied map[*FileNode]bool) {
+	n := root
+	for _, part := range GetNodePath(path) {
+		child, ok := n.Children[part]
+		if !ok {
+			return
+		}
+		if !copied[child] {
+			child = shallowCopy(child)
+			n.Children[part] = child
+			copied[child] = true
+		}
+		n = child
+	}
+}
+
+// copySubtree is copyPath, copying everything under path as well
+func copySubtree(root *FileNode, path string, copied map[*FileNode]bool) {
+	parts := GetNodePath(path)
+	if len(parts) == 0 {
+		return
+	}
+	copyPath(root, path, copied)
+	parent, err := traverseToNode(root, parts[:len(parts)-1], false)
+	if err != nil {
+		return
+	}
+	name := parts[len(parts)-1]
+	if n, ok := parent.Children[name]; ok {
+		parent.Children[name] = copyTree(n)
+	}
+}
+
+// fixupTree restores what gob leaves out when a tree is decoded: empty maps and
+// all-zero structs (e.g. the data of intermediate nodes) come back as nil
+func fixupTree(f *FileNode, isRoot bool) {
+	if f.Children == nil {
+		f.Children = make(map[string]*FileNode)
+	}
+	if !isRoot {
+		if f.Data == nil {
+			f.Data = &DataNode{}
+		}
+		if f.Data.Stats == nil {
+			f.Data.Stats = &StatNode{}
+		}
+	}
+	for _, child := range f.Children {
+		fixupTree(child, false)
+	}
+}
+
+// SerializeTree encodes the whole tree, e.g. for a VR snapshot
+func SerializeTree(root *FileNode) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// RestoreTree decodes a tree encoded by SerializeTree
+func RestoreTree(data []byte) (*FileNode, error) {
+	root := new(FileNode)
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(root); err != nil {
+		return nil, err
+	}
+	fixupTree(root, true)
+	return root, nil
+}
+
 func GetNodePath(path string) []string {
 	parts := strings.FieldsFunc(path, SplitOnSlash)
 	return parts
 }
 
+// checkValueSize fails with ErrTooLarge if a value of size bytes is over MaxValueSize
+func checkValueSize(size int) error {
+	if MaxValueSize > 0 && size > MaxValueSize {
+		return ErrTooLarge
+	}
+	return nil
+}
+
 func traverseToNode(root *FileNode, parts []string, createMissing bool) (*FileNode, error) {
+	if createMissing && MaxPathDepth > 0 && len(parts) > MaxPathDepth {
+		return nil, ErrPathTooDeep
+	}
 	temp := root
-	// Walk along the path to find our node
-	for _, part := range parts {
-		if _, exists := temp.Children[part]; !exists {
-			if !createMissing {
-				return nil, os.ErrNotExist
-			}
-			// Create any missing nodes along the way
-			temp.Children[part] = &FileNode{}
-			//temp.Children[part].Parent = temp
-			temp = temp.Children[part]
-			temp.Children = make(map[string]*FileNode)
-			temp.Data = &DataNode{}
-			temp.Data.Stats = &StatNode{}
-		} else {
-			temp = temp.Children[part]
+	// Walk along the path as far as it exists
+	i := 0
+	for ; i < len(parts); i++ {
+		child, exists := temp.Children[parts[i]]
+		if !exists {
+			break
+		}
+		temp = child
+	}
+	if i == len(parts) {
+		return temp, nil
+	}
+	if !createMissing {
+		return nil, os.ErrNotExist
+	}
+	// check the rest of the path before creating any of it, so a failed create
+	// doesn't leave half of it behind
+	if temp.Data != nil && temp.Data.Stats.EphemeralOwner != "" {
+		return nil, ErrEphemeralParent
+	}
+	for _, part := range parts[i:] {
+		if MaxNameLength > 0 && len(part) > MaxNameLength {
+			return nil, ErrNameTooLong
+		}
+	}
+	// Create any missing nodes along the way
+	for _, part := range parts[i:] {
+		temp.Children[part] = &FileNode{}
+		// the root doesn't have any stats
+		if temp.Data != nil {
+			temp.Data.Stats.CVersion += 1
+			temp.Data.Stats.NumChildren = uint64(len(temp.Children))
 		}
+		//temp.Children[part].Parent = temp
+		temp = temp.Children[part]
+		temp.Children = make(map[string]*FileNode)
+		temp.Data = &DataNode{}
+		temp.Data.Stats = &StatNode{}
 	}
 	return temp, nil
 }
 
+// traverseToData returns the node at path, which has to have data of its own: the root
+// doesn't, so commands on a node's value or stats fail with ErrRootNode there
+func traverseToData(root *FileNode, path string) (*FileNode, error) {
+	n, err := traverseToNode(root, GetNodePath(path), false)
+	if err != nil {
+		return nil, err
+	}
+	if n.Data == nil {
+		return nil, ErrRootNode
+	}
+	return n, nil
+}
+
 func createNode(root *FileNode, path string, val string) (*DataNode, error) {
-	n, _ := traverseToNode(root, GetNodePath(path), true)
+	if err := checkValueSize(len(val)); err != nil {
+		return nil, err
+	}
+	n, err := traverseToNode(root, GetNodePath(path), true)
+	if err != nil {
+		return nil, err
+	}
+	if n.Data == nil {
+		return nil, ErrRootNode
+	}
 	if n.Data.Stats.Version != 0 {
 		return nil, os.ErrExist
 	}
@@ -75,8 +353,37 @@ func createNode(root *FileNode, path string, val string) (*DataNode, error) {
 	return n.Data, nil
 }
 
+// createEphemeralNode creates a node that is owned by the given session
+func createEphemeralNode(root *FileNode, path string, val string, owner string) (*DataNode, error) {
+	if owner == "" {
+		return nil, ErrNoSession
+	}
+	n, err := createNode(root, path, val)
+	if err != nil {
+		return nil, err
+	}
+	n.Stats.EphemeralOwner = owner
+	return n, nil
+}
+
+// deleteNode deletes a node that doesn't have any children
 func deleteNode(root *FileNode, path string) (*StatNode, error) {
+	n, err := traverseToNode(root, GetNodePath(path), false)
+	if err != nil {
+		return nil, err
+	}
+	if len(n.Children) > 0 {
+		return nil, ErrNotEmpty
+	}
+	return deleteNodeRecursive(root, path)
+}
+
+// deleteNodeRecursive deletes a node along with everything under it
+func deleteNodeRecursive(root *FileNode, path string) (*StatNode, error) {
 	parts := GetNodePath(path)
+	if len(parts) == 0 {
+		return nil, ErrDeleteRoot
+	}
 	n, err := traverseToNode(root, parts, false)
 	if err != nil {
 		return nil, err
@@ -87,9 +394,121 @@ func deleteNode(root *FileNode, path string) (*StatNode, error) {
 		return nil, err
 	}
 	delete(p.Children, parts[len(parts)-1])
+	// the root doesn't have any stats
+	if p.Data != nil {
+		p.Data.Stats.CVersion += 1
+		p.Data.Stats.NumChildren = uint64(len(p.Children))
+		// take empty containers with us
+		if p.Data.Stats.Container && len(p.Children) == 0 {
+			container := "/" + strings.Join(parts[:len(parts)-1], "/")
+			root.reaped = append(root.reaped, container)
+			deleteNodeRecursive(root, container)
+		}
+	}
 	return n.Data.Stats, nil
 }
 
+// createSequentialNode creates a node whose name has the parent's (zero-padded) sequence
+// counter appended, e.g. /queue/item-0000000003. A path ending in / just uses the counter
+// as the name. Returns the generated path
+func createSequentialNode(root *FileNode, path string, val string, owner string) (string, *DataNode, error) {
+	if err := checkValueSize(len(val)); err != nil {
+		return "", nil, err
+	}
+	parts := GetNodePath(path)
+	name := ""
+	if !strings.HasSuffix(path, "/") && len(parts) > 0 {
+		name = parts[len(parts)-1]
+		parts = parts[:len(parts)-1]
+	}
+	// a parent that doesn't exist yet starts counting at 0. It's created along with the
+	// node, so a failed create doesn't leave it behind
+	var sequence uint64
+	if parent, err := traverseToNode(root, parts, false); err == nil {
+		sequence = parent.Sequence
+	}
+	newPath := fmt.Sprintf("/%s", strings.Join(append(parts, fmt.Sprintf("%s%010d", name, sequence)), "/"))
+	var n *DataNode
+	var err error
+	if owner != "" {
+		n, err = createEphemeralNode(root, newPath, val, owner)
+	} else {
+		n, err = createNode(root, newPath, val)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	parent, _ := traverseToNode(root, parts, false)
+	parent.Sequence++
+	return newPath, n, nil
+}
+
+// deleteSessionNodes deletes all the ephemeral nodes owned by session,
+// returning the deleted paths
+func deleteSessionNodes(root *FileNode, session string) []string {
+	var owned []string
+	// every non-ephemeral node has an empty owner
+	if session == "" {
+		return owned
+	}
+	var walk func(n *FileNode, path string)
+	walk = func(n *FileNode, path string) {
+		for name, child := range n.Children {
+			childPath := path + "/" + name
+			if child.Data.Stats.EphemeralOwner == session {
+				owned = append(owned, childPath)
+			}
+			walk(child, childPath)
+		}
+	}
+	walk(root, "")
+	// in the same order on every replica, since the audit log records them in this order
+	sort.Strings(owned)
+	for _, path := range owned {
+		deleteNode(root, path)
+	}
+	return owned
+}
+
+// deleteNodeVersion deletes the node only if it's still at the expected version
+func deleteNodeVersion(root *FileNode, path string, version uint64) (*StatNode, error) {
+	if err := checkVersion(root, path, version); err != nil {
+		return nil, err
+	}
+	return deleteNode(root, path)
+}
+
+// expiredNodes returns the paths of TTL nodes that haven't been set since now-TTL
+func expiredNodes(root *FileNode, now time.Time) []string {
+	var expired []string
+	var walk func(n *FileNode, path string)
+	walk = func(n *FileNode, path string) {
+		for name, child := range n.Children {
+			childPath := path + "/" + name
+			stats := child.Data.Stats
+			if stats.TTL > 0 && !stats.Mtime.Add(stats.TTL).After(now) {
+				expired = append(expired, childPath)
+				// the whole subtree is going anyway
+				continue
+			}
+			walk(child, childPath)
+		}
+	}
+	walk(root, "")
+	// the same order on every replica (see deleteSessionNodes)
+	sort.Strings(expired)
+	return expired
+}
+
+// expireNodes deletes every TTL node that has expired as of now
+func expireNodes(root *FileNode, now time.Time) []string {
+	expired := expiredNodes(root, now)
+	for _, path := range expired {
+		deleteNodeRecursive(root, path)
+	}
+	return expired
+}
+
 func existsNode(root *FileNode, path string) (bool, error) {
 	n, err := traverseToNode(root, GetNodePath(path), false)
 	// If the error is that the file does/doesn't exist, that's no issue
@@ -100,20 +519,34 @@ func existsNode(root *FileNode, path string) (bool, error) {
 	return n != nil, err
 }
 
+// getChildren returns the names of all of a node's children, sorted
 func getChildren(root *FileNode, path string) ([]string, error) {
+	return getChildrenPage(root, path, "", "", 0)
+}
+
+// getChildrenPage returns, in sorted order, up to limit (0 means no limit) names of a node's
+// children that start with prefix and sort after after. Passing the last name of one page
+// as after fetches the next one
+func getChildrenPage(root *FileNode, path string, prefix string, after string, limit int) ([]string, error) {
 	n, err := traverseToNode(root, GetNodePath(path), false)
 	if err != nil {
 		return nil, err
 	}
 	var keys []string
 	for k := range n.Children {
-		keys = append(keys, k)
+		if strings.HasPrefix(k, prefix) && (after == "" || k > after) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
 	}
 	return keys, nil
 }
 
 func getNode(root *FileNode, path string) (*DataNode, error) {
-	n, err := traverseToNode(root, GetNodePath(path), false)
+	n, err := traverseToData(root, path)
 	if err != nil {
 		return nil, err
 	}
@@ -121,7 +554,10 @@ func getNode(root *FileNode, path string) (*DataNode, error) {
 }
 
 func setNode(root *FileNode, path string, val string) (*DataNode, error) {
-	n, err := traverseToNode(root, GetNodePath(path), false)
+	if err := checkValueSize(len(val)); err != nil {
+		return nil, err
+	}
+	n, err := traverseToData(root, path)
 	if err != nil {
 		return nil, err
 	}
@@ -129,11 +565,115 @@ func setNode(root *FileNode, path string, val string) (*DataNode, error) {
 	return n.Data, nil
 }
 
+// setNodeVersion sets the node's value only if it's still at the expected version
+func setNodeVersion(root *FileNode, path string, val string, version uint64) (*DataNode, error) {
+	if err := checkVersion(root, path, version); err != nil {
+		return nil, err
+	}
+	return setNode(root, path, val)
+}
+
+// getSetNode sets the node's value, returning its data (value and stats) from before
+// the set along with its current data
+func getSetNode(root *FileNode, path string, val string) (old *DataNode, cur *DataNode, err error) {
+	if err := checkValueSize(len(val)); err != nil {
+		return nil, nil, err
+	}
+	n, err := traverseToData(root, path)
+	if err != nil {
+		return nil, nil, err
+	}
+	prev := *n.Data
+	stats := *n.Data.Stats
+	prev.Stats = &stats
+	// _setNode replaces the value slice rather than writing into it, so prev.Value is safe
+	_setNode(n, val)
+	return &prev, n.Data, nil
+}
+
+// appendNode adds val to the end of the node's value, as long as that keeps it
+// within MaxValueSize
+func appendNode(root *FileNode, path string, val string) (*DataNode, error) {
+	n, err := traverseToData(root, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkValueSize(int(n.Data.Stats.DataLength) + len(val)); err != nil {
+		return nil, err
+	}
+	// build a new value: the old one may be shared (e.g. by a GETSET reply)
+	_setNode(n, string(plainValue(n.Data))+val)
+	return n.Data, nil
+}
+
+// incrNode adds delta to the node's value, which is stored as a decimal number (an empty
+// value counts as 0). Returns the new value
+func incrNode(root *FileNode, path string, delta int64) (int64, *DataNode, error) {
+	n, err := traverseToData(root, path)
+	if err != nil {
+		return 0, nil, err
+	}
+	var val int64
+	if len(n.Data.Value) > 0 {
+		val, err = strconv.ParseInt(string(plainValue(n.Data)), 10, 64)
+		if err != nil {
+			return 0, nil, ErrNotNumber
+		}
+	}
+	val += delta
+	_setNode(n, strconv.FormatInt(val, 10))
+	return val, n.Data, nil
+}
+
+// getNodeVersion returns the node's data as of the given version, which has to be
+// the current one or still in its history
+func getNodeVersion(root *FileNode, path string, version uint64) (*DataNode, error) {
+	n, err := traverseToData(root, path)
+	if err != nil {
+		return nil, err
+	}
+	if n.Data.Stats.Version == version {
+		return n.Data, nil
+	}
+	for _, rev := range n.History {
+		if rev.Version == version {
+			stats := *n.Data.Stats
+			stats.Version = rev.Version
+			stats.Mtime = rev.Mtime
+			stats.DataLength = uint64(len(plainValue(&DataNode{Value: rev.Value, Compressed: rev.Compressed})))
+			return &DataNode{Value: rev.Value, Compressed: rev.Compressed, Stats: &stats, ACL: n.Data.ACL}, nil
+		}
+	}
+	return nil, ErrNoSuchVersion
+}
+
 func _setNode(n *FileNode, val string) {
-	n.Data.Value = val
+	if HistoryLength > 0 && n.Data.Stats.Version > 0 {
+		d := n.Data
+		n.History = append(n.History, Revision{d.Stats.Version, d.Value, d.Compressed, d.Stats.Mtime})
+		if len(n.History) > HistoryLength {
+			// copy rather than reslice, so the dropped values can be freed
+			n.History = append([]Revision(nil), n.History[len(n.History)-HistoryLength:]...)
+		}
+	}
+	n.Data.Value, n.Data.Compressed = storedValue(val)
+	n.Data.Stats.DataLength = uint64(len(val))
 	n.Data.Stats.Version += 1
 }
 
+// checkVersion fails with ErrBadVersion if the node's version isn't version
+func checkVersion(root *FileNode, path string, version uint64) error {
+	n, err := traverseToData(root, path)
+	if err != nil {
+		return err
+	}
+	if n.Data.Stats.Version != version {
+		return ErrBadVersion
+	}
+	return nil
+}
+
+// hashNode returns the hex Merkle digest of the whole tree
 func hashNode(root *FileNode) string {
-	return fmt.Sprintf("%#v", root)
+	return hex.EncodeToString(root.digest())
 }
@@ -1,14 +1,76 @@
 package phatdb
 
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
 type DBCommand struct {
 	Command string
 	Path    string
-	Value   string
+	Value   string        // strings are just bytes to gob, so this is fine for binary values too
+	Flags   int           // e.g. EPHEMERAL or CONTAINER, for CREATE, LIST_PREFIX, for LIST, or WITH_SUBTREE, for COPY
+	Session string        // session of the client issuing the command
+	Auth    []Identity    // who the issuing client has authenticated as
+	ACL     []ACL         // for CREATE and SETACL
+	Version uint64        // expected version, for CHECK_VERSION, SET_VERSION and DELETE_VERSION (or the one to get, for GET_VERSION, or the one the sender has, for GET_IF_MODIFIED)
+	Ops     []*DBCommand  // sub-operations of a MULTI
+	TTL     time.Duration // for CREATE: delete the node if it isn't SET for this long, or for OPEN_SESSION, expire the session if it isn't renewed for this long
+	Quota   *Quota        // for SET_QUOTA (nil removes the quota)
+	Prefix  string        // for CHILDREN: only return names starting with this
+	After   string        // for CHILDREN: only return names after this one (the last name of the previous page)
+	Limit   int           // for CHILDREN: return at most this many names (0 means all of them), or for AUDIT_LOG, entries
+	Delta   int64         // for INCR
+	Paths   []string      // for MGET
+	Target  string        // destination path, for COPY and MOVE
+	Scheme  string        // for AUTH: how the credentials in Value are checked (see Authenticate)
+	// the token AUTH replied with. Only commands that carry it get the identities their
+	// session has proven, so another client can't use them just by sending the same Session
+	AuthToken string
+	// if set, every path in the command (and its reply) is relative to this node, so
+	// clients can be confined to their own part of the tree
+	Root string
+	// if set, the subtree at Root can't grow past this, on top of any quotas in the tree.
+	// Servers set it for tenants (see phatRPC's Config.Tenants)
+	TenantQuota *Quota
+	// Root, once chrootCommand has made the paths absolute, for TenantQuota
+	quotaRoot string
+	// when the master received the command. All time-based state uses this rather
+	// than the local clock, so every replica makes the same decisions
+	Time time.Time
+	// for reads: the sender can live with slightly out of date data, so any replica may
+	// answer (see phatRPC's RPCDB)
+	Stale bool
+	// the sender's count of the writes it has sent (counting from 1), so together with
+	// Session it identifies a request across retries. 0 if the sender doesn't count
+	SeqNumber uint64
+	// VR op number of the command, filled in as it's committed (0 if it didn't go through VR)
+	OpNumber uint64
+	// for GET_IF_MODIFIED: the CreateOp of the sender's copy, so a node that was deleted
+	// and created again isn't mistaken for it
+	CreateOp uint64
+	// the sender's id for the request, which every layer it passes through puts in its
+	// log lines about it (and the audit log), so it can be followed from end to end
+	TraceID string
+}
+
+// tracePrefix is what log lines about the command start with
+func (req *DBCommand) tracePrefix() string {
+	if req.TraceID == "" {
+		return ""
+	}
+	return "[" + req.TraceID + "] "
 }
 
 type DBResponse struct {
 	Reply interface{}
 	Error string
+	Code  ErrorCode // what kind of error Error is (see CodeOf)
+	// containers the command deleted by emptying them (see FileNode.reaped)
+	reaped []string
 }
 
 type DBCommandWithChannel struct {
@@ -16,62 +78,638 @@ type DBCommandWithChannel struct {
 	Done chan *DBResponse
 }
 
-func DatabaseServer(input chan DBCommandWithChannel) {
+// Database holds the state that DatabaseServer's command loop works on
+type Database struct {
+	Root  *FileNode
+	Store Storage
+	// commands journaled since the last checkpoint
+	sinceCheckpoint int
+	// lets Serve run reads in parallel with each other, but not with anything else
+	lock       sync.RWMutex
+	triggers   triggers
+	validators *validators
+}
+
+func NewDatabase() *Database {
 	// Set up the root of the pseudo file system
 	root := &FileNode{}
 	root.Children = make(map[string]*FileNode)
+	return &Database{Root: root, Store: MemoryStorage{}, validators: newValidators()}
+}
+
+// OpenDatabase rebuilds the database from what store has persisted. The tree knows the
+// last op it has (see FileNode.AppliedOp), so VR can replay its log on top of it
+func OpenDatabase(store Storage) (*Database, error) {
+	db := NewDatabase()
+	root, cmds, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if root != nil {
+		db.Root = root
+	}
+	// replay the journal, without journaling it all over again
+	for _, cmd := range cmds {
+		db.apply(cmd)
+		db.noteApplied(cmd)
+	}
+	db.Store = store
+	return db, nil
+}
+
+// DatabaseServer runs an in-memory database on input until input is closed
+func DatabaseServer(input chan DBCommandWithChannel) {
+	NewDatabase().Serve(input)
+}
+
+// Serve runs the command loop on input. Writes (and anything else that isn't a plain
+// read) run one at a time in the order they arrive. Reads (and batches of them) run in
+// parallel with each other, but still see every write that arrived before them.
+// Closing input shuts the database down: the commands already queued are still run,
+// then the database is closed
+func (db *Database) Serve(input chan DBCommandWithChannel) {
+	updateSizeMetrics(db.Root)
+	ticker := time.NewTicker(METRICS_INTERVAL)
+	defer ticker.Stop()
+	var reads sync.WaitGroup
 	// Enter the command loop
 	for {
-		request := <-input
-		req := request.Cmd
-		resp := &DBResponse{}
-		switch req.Command {
-		case "CHILDREN":
-			kids, err := getChildren(root, req.Path)
-			if err == nil {
-				resp.Reply = kids
-			} else {
-				resp.Error = err.Error()
-			}
-		case "CREATE":
-			n, err := createNode(root, req.Path, req.Value)
-			if err == nil {
-				resp.Reply = n
-			} else {
-				resp.Error = err.Error()
-			}
-		case "DELETE":
-			n, err := deleteNode(root, req.Path)
-			if err == nil {
-				resp.Reply = n
-			} else {
-				resp.Error = err.Error()
+		select {
+		case request, ok := <-input:
+			if !ok {
+				reads.Wait()
+				if err := db.Close(); err != nil {
+					log.Printf("Couldn't close the database: %v", err)
+				}
+				return
 			}
-		case "EXISTS":
-			n, err := existsNode(root, req.Path)
-			if err == nil {
-				resp.Reply = n
+			if Kind(request.Cmd.Command) == ReadCommand || request.Cmd.Command == "READ_BATCH" {
+				reads.Add(1)
+				go func(request DBCommandWithChannel) {
+					defer reads.Done()
+					db.serveOne(request, true)
+				}(request)
 			} else {
-				resp.Error = err.Error()
+				db.serveOne(request, false)
 			}
-		case "GET":
-			n, err := getNode(root, req.Path)
-			if err == nil {
-				resp.Reply = n
-			} else {
-				resp.Error = err.Error()
+		case <-ticker.C:
+			// only this goroutine writes, so it can look at the tree without locking
+			updateSizeMetrics(db.Root)
+		}
+	}
+}
+
+func (db *Database) serveOne(request DBCommandWithChannel, read bool) {
+	start := time.Now()
+	var resp *DBResponse
+	if read {
+		db.lock.RLock()
+		resp = db.apply(request.Cmd)
+		db.lock.RUnlock()
+	} else {
+		db.lock.Lock()
+		resp = db.Apply(request.Cmd)
+		db.lock.Unlock()
+	}
+	recordCommand(request.Cmd.Command, resp, time.Since(start))
+	request.Done <- resp
+}
+
+// Compact checkpoints the tree now, so the journal can be thrown away. It can be called
+// while Serve is running
+func (db *Database) Compact() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.sinceCheckpoint = 0
+	return db.Store.Checkpoint(db.Root)
+}
+
+// SessionCount returns how many sessions are open (see OPEN_SESSION). It can be called
+// while Serve is running
+func (db *Database) SessionCount() int {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return len(db.Root.Sessions)
+}
+
+// Close checkpoints the tree, so the next OpenDatabase doesn't need to replay the
+// journal, and closes the storage
+func (db *Database) Close() error {
+	if err := db.Store.Checkpoint(db.Root); err != nil {
+		db.Store.Close()
+		return err
+	}
+	return db.Store.Close()
+}
+
+// Apply runs a single command against the database, persisting it if it changed the tree.
+// It isn't safe to use while Serve is running
+func (db *Database) Apply(req *DBCommand) *DBResponse {
+	if db.applied(req) {
+		// it's already in the tree, and whoever sent it got their reply before we
+		// restarted
+		return &DBResponse{}
+	}
+	abs := chrootCommand(req)
+	resp := db.apply(abs)
+	db.noteApplied(req)
+	if resp.Error != "" || !IsWrite(req.Command) {
+		unchrootReply(req.Root, abs, resp)
+		return resp
+	}
+	// triggers see the real paths
+	db.triggers.fire(abs, resp)
+	unchrootReply(req.Root, abs, resp)
+	// the command has been applied either way, so all we can do here is complain
+	if err := db.Store.Append(req); err != nil {
+		log.Printf("%sCouldn't persist %s %s: %v", req.tracePrefix(), req.Command, req.Path, err)
+		return resp
+	}
+	db.sinceCheckpoint++
+	if db.sinceCheckpoint >= CHECKPOINT_FREQ {
+		db.sinceCheckpoint = 0
+		if err := db.Store.Checkpoint(db.Root); err != nil {
+			log.Printf("Couldn't checkpoint the tree: %v", err)
+		}
+	}
+	return resp
+}
+
+// applied says whether req is a write VR has already committed to the tree, which it
+// does again when a restarted replica catches up from the start of its log
+func (db *Database) applied(req *DBCommand) bool {
+	return req.OpNumber != 0 && req.OpNumber <= db.Root.AppliedOp && IsWrite(req.Command)
+}
+
+// noteApplied records that the tree has req in it, if it's a write that went through
+// VR. Writes that fail are noted too: they'd only fail again
+func (db *Database) noteApplied(req *DBCommand) {
+	if req.OpNumber > db.Root.AppliedOp && IsWrite(req.Command) {
+		db.Root.AppliedOp = req.OpNumber
+	}
+}
+
+func (db *Database) apply(req *DBCommand) *DBResponse {
+	resp := db.applyCommand(req)
+	resp.Code = CodeOf(resp.Error)
+	return resp
+}
+
+func (db *Database) applyCommand(req *DBCommand) *DBResponse {
+	if req.Root != "" {
+		abs := chrootCommand(req)
+		resp := db.apply(abs)
+		unchrootReply(req.Root, abs, resp)
+		return resp
+	}
+	root := db.Root
+	if IsWrite(req.Command) {
+		// reads run alongside each other, so only writes can touch it
+		root.reaped = nil
+	}
+	resp := &DBResponse{}
+	req = withIdentities(root, req)
+	if req.Flags&COMPRESSED != 0 {
+		val, err := decompressValue([]byte(req.Value))
+		if err != nil {
+			resp.Error = err.Error()
+			return resp
+		}
+		// the command itself is in the log, so work on a copy
+		plain := *req
+		plain.Value = string(val)
+		plain.Flags &^= COMPRESSED
+		req = &plain
+	}
+	if err := checkAccess(root, req); err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if root.ReadOnly && IsWrite(req.Command) && req.Command != "SET_READONLY" {
+		resp.Error = ErrReadOnly.Error()
+		return resp
+	}
+	if err := checkCommandQuota(root, req); err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	var before map[string]uint64
+	if IsWrite(req.Command) && req.Command != "MULTI" {
+		before = auditVersions(root, req)
+	}
+	switch req.Command {
+	case "CHILDREN":
+		kids, err := getChildrenPage(root, req.Path, req.Prefix, req.After, req.Limit)
+		if err == nil {
+			resp.Reply = kids
+		} else {
+			resp.Error = err.Error()
+		}
+	case "LIST":
+		entries, err := listNodes(root, req.Path, req.Flags, req.Auth)
+		if err == nil {
+			resp.Reply = entries
+		} else {
+			resp.Error = err.Error()
+		}
+	case "CREATE":
+		var n *DataNode
+		var err error
+		if req.Flags&EPHEMERAL != 0 {
+			n, err = createEphemeralNode(root, req.Path, req.Value, req.Session)
+		} else {
+			n, err = createNode(root, req.Path, req.Value)
+		}
+		if err == nil {
+			n.ACL = req.ACL
+			n.Stats.TTL = req.TTL
+			n.Stats.Container = req.Flags&CONTAINER != 0
+			n.Stats.Ctime = req.Time
+			n.Stats.Mtime = req.Time
+			n.Stats.CreateOp = req.OpNumber
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "CREATE_SEQ":
+		owner := ""
+		if req.Flags&EPHEMERAL != 0 {
+			owner = req.Session
+			if owner == "" {
+				resp.Error = ErrNoSession.Error()
+				break
 			}
-		case "SET":
-			_, err := setNode(root, req.Path, req.Value)
-			// SET doesn't return any results on success
-			if err != nil {
-				resp.Error = err.Error()
+		}
+		// replies with the generated path
+		path, n, err := createSequentialNode(root, req.Path, req.Value, owner)
+		if err == nil {
+			n.ACL = req.ACL
+			n.Stats.TTL = req.TTL
+			n.Stats.Container = req.Flags&CONTAINER != 0
+			n.Stats.Ctime = req.Time
+			n.Stats.Mtime = req.Time
+			n.Stats.CreateOp = req.OpNumber
+			resp.Reply = path
+		} else {
+			resp.Error = err.Error()
+		}
+	case "SESSION":
+		// replies with what the tree holds for the sender's session
+		resp.Reply = sessionInfo(root, req.Session)
+	case "CLOSE_SESSION":
+		// the session is gone, so take its ephemeral nodes with it and break its locks
+		resp.Reply = closeSession(root, req.Session)
+	case "OPEN_SESSION":
+		// the session expires if it isn't renewed for req.TTL
+		if err := openSession(root, req.Session, req.TTL, req.Time); err != nil {
+			resp.Error = err.Error()
+		}
+	case "KEEPALIVE":
+		if err := renewSession(root, req.Session, req.Time); err != nil {
+			resp.Error = err.Error()
+		}
+	case "RENEW_SESSIONS":
+		renewSessions(root, req.Time)
+	case "EXPIRED_SESSIONS":
+		// sessions that are due to expire as of req.Time
+		resp.Reply = expiredSessions(root, req.Time)
+	case "EXPIRE_SESSION":
+		// closes the session if it's still expired as of req.Time, replying with the
+		// nodes deleted
+		deleted, err := expireSession(root, req.Session, req.Time)
+		if err == nil {
+			resp.Reply = deleted
+		} else {
+			resp.Error = err.Error()
+		}
+	case "AUTH":
+		// the server that took the command has already checked the credentials
+		// (see Authenticate), and swapped them for who they say the client is and a
+		// token it issued. Replies with the session's token
+		token, err := authenticate(root, req)
+		if err == nil {
+			resp.Reply = token
+		} else {
+			resp.Error = err.Error()
+		}
+	case "LOCK":
+		// replies with the fencing token
+		token, err := lockNode(root, req.Path, req.Session)
+		if err == nil {
+			resp.Reply = token
+		} else {
+			resp.Error = err.Error()
+		}
+	case "UNLOCK":
+		if err := unlockNode(root, req.Path, req.Session); err != nil {
+			resp.Error = err.Error()
+		}
+	case "DELETE":
+		n, err := deleteNode(root, req.Path)
+		if err == nil {
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "DELETE_VERSION":
+		n, err := deleteNodeVersion(root, req.Path, req.Version)
+		if err == nil {
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "DELETE_RECURSIVE":
+		n, err := deleteNodeRecursive(root, req.Path)
+		if err == nil {
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "STAT":
+		n, err := getNode(root, req.Path)
+		if err == nil {
+			resp.Reply = *n.Stats
+		} else {
+			resp.Error = err.Error()
+		}
+	case "EXISTS":
+		n, err := existsNode(root, req.Path)
+		if err == nil {
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "GET":
+		n, err := getNode(root, req.Path)
+		if err == nil {
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "GET_IF_MODIFIED":
+		// like GET, but replies ErrNotModified instead if the sender's copy is current
+		n, err := getNode(root, req.Path)
+		if err != nil {
+			resp.Error = err.Error()
+		} else if n.Stats.Version == req.Version && n.Stats.CreateOp == req.CreateOp {
+			resp.Error = ErrNotModified.Error()
+		} else {
+			resp.Reply = n
+		}
+	case "GET_VERSION":
+		n, err := getNodeVersion(root, req.Path, req.Version)
+		if err == nil {
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "MGET":
+		// replies with the result of a GET of each path
+		results := make([]DBResponse, len(req.Paths))
+		for i, path := range req.Paths {
+			get := DBCommand{Command: "GET", Path: path, Session: req.Session, Auth: req.Auth}
+			results[i] = *db.apply(&get)
+		}
+		resp.Reply = results
+	case "READ_BATCH":
+		// replies with the result of each of Ops, which have to be reads. Servers send
+		// these to have several clients' reads answered at once
+		results := make([]DBResponse, len(req.Ops))
+		for i, op := range req.Ops {
+			if Kind(op.Command) != ReadCommand {
+				results[i].Fail(ErrUnknownCommand)
+				continue
 			}
-		case "SHA256":
-			resp.Reply = hashNode(root)
-		default:
-			resp.Error = "Unknown command"
+			results[i] = *db.apply(op)
+		}
+		resp.Reply = results
+	case "SET":
+		n, err := setNode(root, req.Path, req.Value)
+		// SET doesn't return any results on success
+		if err == nil {
+			n.Stats.Mtime = req.Time
+		} else {
+			resp.Error = err.Error()
+		}
+	case "GETSET":
+		// replies with the node's data from before the set
+		old, n, err := getSetNode(root, req.Path, req.Value)
+		if err == nil {
+			n.Stats.Mtime = req.Time
+			resp.Reply = old
+		} else {
+			resp.Error = err.Error()
+		}
+	case "APPEND":
+		n, err := appendNode(root, req.Path, req.Value)
+		if err == nil {
+			n.Stats.Mtime = req.Time
+			resp.Reply = n.Stats
+		} else {
+			resp.Error = err.Error()
+		}
+	case "INCR":
+		// replies with the new value
+		val, n, err := incrNode(root, req.Path, req.Delta)
+		if err == nil {
+			n.Stats.Mtime = req.Time
+			resp.Reply = val
+		} else {
+			resp.Error = err.Error()
+		}
+	case "COPY", "MOVE":
+		// the source's access was checked already, but the target needs checking too
+		if err := checkAccess(root, &DBCommand{Command: "CREATE", Path: req.Target, Auth: req.Auth}); err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		var n *DataNode
+		var err error
+		if req.Command == "COPY" {
+			n, err = copyNode(root, req.Path, req.Target, req.Flags)
+		} else {
+			n, err = moveNode(root, req.Path, req.Target, req.Flags)
+		}
+		if err == nil {
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "SETACL":
+		n, err := setACL(root, req.Path, req.ACL)
+		if err == nil {
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "GETACL":
+		acl, err := getACL(root, req.Path)
+		if err == nil {
+			resp.Reply = acl
+		} else {
+			resp.Error = err.Error()
+		}
+	case "SET_VERSION":
+		// compare-and-swap: replies with the updated node so the client knows the new version
+		n, err := setNodeVersion(root, req.Path, req.Value, req.Version)
+		if err == nil {
+			n.Stats.Mtime = req.Time
+			resp.Reply = n
+		} else {
+			resp.Error = err.Error()
+		}
+	case "EXPIRED":
+		// TTL nodes that are due to be deleted as of req.Time (none while we can't delete them)
+		if !root.ReadOnly {
+			resp.Reply = expiredNodes(root, req.Time)
+		}
+	case "EXPIRE":
+		resp.Reply = expireNodes(root, req.Time)
+	case "TOMBSTONES":
+		resp.Reply = getTombstones(root, req.Path)
+	case "PURGE_TOMBSTONES":
+		// purges the ones from before req.Time
+		resp.Reply = purgeTombstones(root, req.Time)
+	case "START_AUDIT":
+		startAudit(root, req.Path)
+	case "STOP_AUDIT":
+		stopAudit(root, req.Path)
+	case "AUDIT_LOG":
+		resp.Reply = auditLog(root, req.Path, req.Limit)
+	case "MULTI":
+		results, err := db.multi(req)
+		resp.Reply = results
+		if err != nil {
+			resp.Error = err.Error()
+		}
+	case "CHECK_VERSION":
+		if err := checkVersion(root, req.Path, req.Version); err != nil {
+			resp.Error = err.Error()
+		}
+	case "SET_READONLY":
+		// Value is "true" or "false"
+		readOnly, err := strconv.ParseBool(req.Value)
+		if err == nil {
+			root.ReadOnly = readOnly
+		} else {
+			resp.Error = err.Error()
+		}
+	case "SET_QUOTA":
+		if err := setQuota(root, req.Path, req.Quota); err != nil {
+			resp.Error = err.Error()
+		}
+	case "GET_QUOTA":
+		q, err := getQuota(root, req.Path)
+		if err != nil {
+			resp.Error = err.Error()
+		} else if q != nil {
+			resp.Reply = *q
+		}
+	case "SNAPSHOT":
+		data, err := SerializeTree(root)
+		if err == nil {
+			resp.Reply = data
+		} else {
+			resp.Error = err.Error()
+		}
+	case "LOAD_SNAPSHOT":
+		// Value holds the serialized tree, which replaces ours completely
+		newRoot, err := RestoreTree([]byte(req.Value))
+		if err != nil {
+			resp.Error = err.Error()
+			break
+		}
+		db.Root = newRoot
+		if err = db.Store.Checkpoint(newRoot); err != nil {
+			log.Printf("Couldn't checkpoint the loaded snapshot: %v", err)
+		}
+	case "SYNC":
+		// nothing to do: getting here through the log means everything committed before
+		// it has been applied. Replies with the op number it was committed at
+		resp.Reply = req.OpNumber
+	case "SHA256":
+		resp.Reply = hashNode(root)
+	case "DIGEST":
+		// lets replicas compare subtrees to narrow down where they differ
+		digest, err := subtreeDigest(root, req.Path)
+		if err == nil {
+			resp.Reply = digest
+		} else {
+			resp.Error = err.Error()
+		}
+	default:
+		resp.Error = ErrUnknownCommand.Error()
+	}
+	if IsWrite(req.Command) {
+		resp.reaped, db.Root.reaped = db.Root.reaped, nil
+		paths := touchedPaths(req, resp)
+		// MULTI's operations already did this themselves
+		if resp.Error == "" && req.Command != "MULTI" {
+			recordTombstones(db.Root, req, paths)
+			recordAudit(db.Root, req, before, paths)
+		}
+		for _, path := range paths {
+			touchPath(db.Root, path)
+		}
+	}
+	return resp
+}
+
+// commands that can be part of a MULTI
+var multiCommands = map[string]bool{
+	"CREATE":           true,
+	"CREATE_SEQ":       true,
+	"SET":              true,
+	"SET_VERSION":      true,
+	"GETSET":           true,
+	"APPEND":           true,
+	"INCR":             true,
+	"COPY":             true,
+	"MOVE":             true,
+	"DELETE":           true,
+	"DELETE_VERSION":   true,
+	"DELETE_RECURSIVE": true,
+	"CHECK_VERSION":    true,
+	"GET":              true,
+	"EXISTS":           true,
+}
+
+// multi applies all of req's sub-operations atomically: they're run against a copy
+// of the tree, which only replaces the real one if every operation succeeds.
+// Returns the result of each operation that was run
+func (db *Database) multi(req *DBCommand) ([]DBResponse, error) {
+	// the operations run on a copy, so a failed one leaves the tree as it was. Only the
+	// nodes they can change are copied, as they go, and the rest is shared with the tree
+	tmp := &Database{Root: shallowCopy(db.Root), Store: db.Store, validators: db.validators}
+	copied := map[*FileNode]bool{tmp.Root: true}
+	results := make([]DBResponse, 0, len(req.Ops))
+	for i, op := range req.Ops {
+		if !multiCommands[op.Command] {
+			return results, fmt.Errorf("MULTI op %d: %s can't be part of a MULTI", i, op.Command)
+		}
+		// sub-operations always run as whoever sent the MULTI
+		sub := *op
+		sub.Session = req.Session
+		sub.Auth = req.Auth
+		sub.Time = req.Time
+		sub.OpNumber = req.OpNumber
+		sub.TenantQuota = req.TenantQuota
+		sub.quotaRoot = req.quotaRoot
+		abs := chrootCommand(&sub)
+		copyPath(tmp.Root, abs.Path, copied)
+		if abs.Target != "" {
+			copyPath(tmp.Root, abs.Target, copied)
+		}
+		if abs.Command == "MOVE" {
+			// the moved subtree is changed all the way down with RESET_VERSIONS
+			copySubtree(tmp.Root, abs.Path, copied)
+		}
+		result := tmp.apply(&sub)
+		results = append(results, *result)
+		if result.Error != "" {
+			return results, fmt.Errorf("MULTI op %d (%s %s) failed: %s", i, op.Command, op.Path, result.Error)
 		}
-		request.Done <- resp
 	}
+	db.Root = tmp.Root
+	return results, nil
 }
@@ -1,48 +1,82 @@
 package phatdb
 
 import (
+	"reflect"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestDatabaseHash(t *testing.T) {
 	input := make(chan DBCommandWithChannel)
 	go DatabaseServer(input)
 	//
-	hashCmd := DBCommandWithChannel{&DBCommand{"SHA256", "", ""}, make(chan *DBResponse)}
+	hashCmd := DBCommandWithChannel{&DBCommand{Command: "SHA256"}, make(chan *DBResponse)}
 	input <- hashCmd
-	expected := "<FN Children=map[string]*phatdb.FileNode{} Data=<nil>>"
+	expected := hashNode(setup())
 	if resp := <-hashCmd.Done; resp.Reply != expected || resp.Error != "" {
 		t.Errorf("Hash returned %v instead of %v", resp.Reply, expected)
 	}
 	//
-	createCmd := DBCommandWithChannel{&DBCommand{"CREATE", "/dev/null", "empty"}, make(chan *DBResponse)}
+	createCmd := DBCommandWithChannel{&DBCommand{Command: "CREATE", Path: "/dev/null", Value: "empty"}, make(chan *DBResponse)}
 	input <- createCmd
-	if resp := <-createCmd.Done; (resp.Reply.(*DataNode)).Value != "empty" || resp.Error != "" {
+	if resp := <-createCmd.Done; string((resp.Reply.(*DataNode)).Value) != "empty" || resp.Error != "" {
 		t.Errorf("CREATE that should work has failed")
 	}
 	//
 	input <- hashCmd
-	expected = "<FN Children=map[string]*phatdb.FileNode{\"dev\":<FN Children=map[string]*phatdb.FileNode{\"null\":<FN Children=map[string]*phatdb.FileNode{} Data=<DN V=\"empty\" Stats=<SN V=1 CV=0 NC=0>>>} Data=<DN V=\"\" Stats=<SN V=0 CV=0 NC=0>>>} Data=<nil>>"
+	other := setup()
+	createNode(other, "/dev/null", "empty")
+	expected = hashNode(other)
 	if resp := <-hashCmd.Done; resp.Reply != expected || resp.Error != "" {
 		t.Errorf("Hash returned %v instead of %v", resp.Reply, expected)
 	}
 }
 
+func TestDatabaseDigests(t *testing.T) {
+	db := NewDatabase()
+	other := NewDatabase()
+	for _, d := range []*Database{db, other} {
+		d.Apply(&DBCommand{Command: "CREATE", Path: "/a/x", Value: "1"})
+		d.Apply(&DBCommand{Command: "CREATE", Path: "/b/y", Value: "2"})
+	}
+	// a divergent write shows up in the digests of its subtree only
+	db.Apply(&DBCommand{Command: "SET", Path: "/b/y", Value: "3"})
+	digest := func(d *Database, path string) string {
+		return d.Apply(&DBCommand{Command: "DIGEST", Path: path}).Reply.(string)
+	}
+	if digest(db, "/") == digest(other, "/") || digest(db, "/b") == digest(other, "/b") {
+		t.Errorf("Divergent trees have the same digest")
+	}
+	if digest(db, "/a") != digest(other, "/a") {
+		t.Errorf("Equal subtrees have different digests")
+	}
+	// every kind of write keeps the cached digests right
+	db.Apply(&DBCommand{Command: "CREATE_SEQ", Path: "/a/item-", Value: "q"})
+	db.Apply(&DBCommand{Command: "MULTI", Ops: []*DBCommand{{Command: "APPEND", Path: "/a/x", Value: "2"}}})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/b/z", TTL: time.Second})
+	db.Apply(&DBCommand{Command: "EXPIRE", Time: time.Now().Add(time.Minute)})
+	db.Apply(&DBCommand{Command: "DELETE_RECURSIVE", Path: "/b"})
+	if hashNode(db.Root) != hashNode(copyTreeUncached(db.Root)) {
+		t.Errorf("Cached digest %v doesn't match a fresh one %v", hashNode(db.Root), hashNode(copyTreeUncached(db.Root)))
+	}
+}
+
 func TestDatabaseServer(t *testing.T) {
 	input := make(chan DBCommandWithChannel)
 	go DatabaseServer(input)
 	//
 	// A bad command should fail
-	badCmd := DBCommandWithChannel{&DBCommand{"HAMMERTIME", "", ""}, make(chan *DBResponse)}
+	badCmd := DBCommandWithChannel{&DBCommand{Command: "HAMMERTIME"}, make(chan *DBResponse)}
 	input <- badCmd
 	// TODO: Ensure it's the expected error
 	if resp := <-badCmd.Done; resp.Reply != nil || resp.Error == "" {
 		t.Errorf("A bad command returned non-error response")
 	}
 	// Create should succeed
-	createCmd := DBCommandWithChannel{&DBCommand{"CREATE", "/dev/null", "empty"}, make(chan *DBResponse)}
+	createCmd := DBCommandWithChannel{&DBCommand{Command: "CREATE", Path: "/dev/null", Value: "empty"}, make(chan *DBResponse)}
 	input <- createCmd
-	if resp := <-createCmd.Done; (resp.Reply.(*DataNode)).Value != "empty" || resp.Error != "" {
+	if resp := <-createCmd.Done; string((resp.Reply.(*DataNode)).Value) != "empty" || resp.Error != "" {
 		t.Errorf("CREATE that should work has failed")
 	}
 	// Try to create a file that already exists
@@ -51,20 +85,20 @@ func TestDatabaseServer(t *testing.T) {
 		t.Errorf("CREATE has succeeded even though file already exists")
 	}
 	//
-	getCmd := DBCommandWithChannel{&DBCommand{"GET", "/dev/null", ""}, make(chan *DBResponse)}
+	getCmd := DBCommandWithChannel{&DBCommand{Command: "GET", Path: "/dev/null"}, make(chan *DBResponse)}
 	input <- getCmd
-	if resp := <-getCmd.Done; resp.Reply.(*DataNode).Value != "empty" || resp.Reply.(*DataNode).Stats.Version != 1 || resp.Error != "" {
+	if resp := <-getCmd.Done; string(resp.Reply.(*DataNode).Value) != "empty" || resp.Reply.(*DataNode).Stats.Version != 1 || resp.Error != "" {
 		t.Errorf("GET fails")
 	}
 	//
-	setCmd := DBCommandWithChannel{&DBCommand{"SET", "/dev/null", "nullify"}, make(chan *DBResponse)}
+	setCmd := DBCommandWithChannel{&DBCommand{Command: "SET", Path: "/dev/null", Value: "nullify"}, make(chan *DBResponse)}
 	input <- setCmd
 	if resp := <-setCmd.Done; resp.Error != "" {
 		t.Errorf("SET fails")
 	}
 	//
 	for _, path := range []string{"/dev/nulled", "/dev/random", "/dev/urandom"} {
-		setCmd = DBCommandWithChannel{&DBCommand{"CREATE", path, "nullify"}, make(chan *DBResponse)}
+		setCmd = DBCommandWithChannel{&DBCommand{Command: "CREATE", Path: path, Value: "nullify"}, make(chan *DBResponse)}
 		input <- setCmd
 		if resp := <-setCmd.Done; resp.Error != "" {
 			t.Errorf("SET fails with %s", resp.Error)
@@ -72,7 +106,7 @@ func TestDatabaseServer(t *testing.T) {
 	}
 	// Check get children
 	for _, path := range []string{"/dev", "/dev/"} {
-		childrenCmd := DBCommandWithChannel{&DBCommand{"CHILDREN", path, ""}, make(chan *DBResponse)}
+		childrenCmd := DBCommandWithChannel{&DBCommand{Command: "CHILDREN", Path: path}, make(chan *DBResponse)}
 		input <- childrenCmd
 		expected := []string{"null", "nulled", "random", "urandom"}
 		if resp := <-childrenCmd.Done; !areEqual(expected, resp.Reply.([]string)) || resp.Error != "" {
@@ -80,3 +114,379 @@ func TestDatabaseServer(t *testing.T) {
 		}
 	}
 }
+
+func TestDatabaseACL(t *testing.T) {
+	input := make(chan DBCommandWithChannel)
+	go DatabaseServer(input)
+	run := func(cmd *DBCommand) *DBResponse {
+		withChannel := DBCommandWithChannel{cmd, make(chan *DBResponse)}
+		input <- withChannel
+		return <-withChannel.Done
+	}
+	alice := []Identity{{"digest", "alice"}}
+	bob := []Identity{{"digest", "bob"}}
+	acl := []ACL{{"digest", "alice", PERM_ALL}, {Anyone.Scheme, Anyone.Id, PERM_READ}}
+	//
+	if resp := run(&DBCommand{Command: "CREATE", Path: "/config", Value: "v1", Auth: alice, ACL: acl}); resp.Error != "" {
+		t.Errorf("CREATE with an ACL failed: %s", resp.Error)
+	}
+	// Anyone can read, but only alice can write
+	if resp := run(&DBCommand{Command: "GET", Path: "/config", Auth: bob}); resp.Error != "" {
+		t.Errorf("GET by bob should be allowed: %s", resp.Error)
+	}
+	if resp := run(&DBCommand{Command: "SET", Path: "/config", Value: "v2", Auth: bob}); resp.Error != ErrNotAuthorized.Error() {
+		t.Errorf("SET by bob should be denied, got %q", resp.Error)
+	}
+	if resp := run(&DBCommand{Command: "SET", Path: "/config", Value: "v2", Auth: alice}); resp.Error != "" {
+		t.Errorf("SET by alice should be allowed: %s", resp.Error)
+	}
+	// Creating children needs CREATE on the parent
+	if resp := run(&DBCommand{Command: "CREATE", Path: "/config/db", Value: "x", Auth: bob}); resp.Error != ErrNotAuthorized.Error() {
+		t.Errorf("CREATE under /config by bob should be denied, got %q", resp.Error)
+	}
+	// Open the node up and bob can write
+	run(&DBCommand{Command: "SETACL", Path: "/config", Auth: alice, ACL: []ACL{{Anyone.Scheme, Anyone.Id, PERM_ALL}}})
+	if resp := run(&DBCommand{Command: "SET", Path: "/config", Value: "v3", Auth: bob}); resp.Error != "" {
+		t.Errorf("SET by bob should be allowed after SETACL: %s", resp.Error)
+	}
+	if resp := run(&DBCommand{Command: "GETACL", Path: "/config"}); len(resp.Reply.([]ACL)) != 1 {
+		t.Errorf("GETACL returned %v", resp.Reply)
+	}
+}
+
+func TestDatabaseCheckAccess(t *testing.T) {
+	db := NewDatabase()
+	alice := []Identity{{"digest", "alice"}}
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/jail/config", Value: "v1", Auth: alice, ACL: []ACL{{"digest", "alice", PERM_ALL}}})
+	if err := db.CheckAccess(&DBCommand{Command: "SET", Path: "/jail/config", Auth: alice}); err != nil {
+		t.Errorf("SET by alice should be allowed: %s", err)
+	}
+	if err := db.CheckAccess(&DBCommand{Command: "SET", Path: "/config", Root: "/jail"}); err != ErrNotAuthorized {
+		t.Errorf("SET by anyone else should be denied, even chrooted, got %v", err)
+	}
+	db.Apply(&DBCommand{Command: "AUTH", Session: "s1", Auth: alice, Value: "t1"})
+	if err := db.CheckAccess(&DBCommand{Command: "SET", Path: "/jail/config", Session: "s1", AuthToken: "t1"}); err != nil {
+		t.Errorf("SET by a session authenticated as alice should be allowed: %s", err)
+	}
+}
+
+func TestDatabaseMulti(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/a", Value: "1"})
+	//
+	multi := &DBCommand{Command: "MULTI", Ops: []*DBCommand{
+		{Command: "CHECK_VERSION", Path: "/a", Version: 1},
+		{Command: "SET", Path: "/a", Value: "2"},
+		{Command: "CREATE", Path: "/b", Value: "b"},
+	}}
+	if resp := db.Apply(multi); resp.Error != "" || len(resp.Reply.([]DBResponse)) != 3 {
+		t.Errorf("MULTI that should work failed: %v %s", resp.Reply, resp.Error)
+	}
+	if n, _ := getNode(db.Root, "/a"); string(n.Value) != "2" {
+		t.Errorf("MULTI didn't apply its SET")
+	}
+	// A failing op means none of them are applied
+	multi = &DBCommand{Command: "MULTI", Ops: []*DBCommand{
+		{Command: "SET", Path: "/a", Value: "3"},
+		{Command: "DELETE", Path: "/b"},
+		{Command: "CHECK_VERSION", Path: "/a", Version: 1},
+	}}
+	if resp := db.Apply(multi); resp.Error == "" || len(resp.Reply.([]DBResponse)) != 3 {
+		t.Errorf("MULTI with a bad version should fail: %v", resp.Reply)
+	}
+	if n, _ := getNode(db.Root, "/a"); string(n.Value) != "2" {
+		t.Errorf("Failed MULTI still applied its SET")
+	}
+	if exists, _ := existsNode(db.Root, "/b"); !exists {
+		t.Errorf("Failed MULTI still applied its DELETE")
+	}
+	// Only some commands can be part of a MULTI
+	multi = &DBCommand{Command: "MULTI", Ops: []*DBCommand{{Command: "SHA256"}}}
+	if resp := db.Apply(multi); resp.Error == "" {
+		t.Errorf("MULTI allowed a SHA256 op")
+	}
+}
+
+func TestDatabaseMultiCopies(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/a/b/c", Value: "1"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/a/b/d", Value: "1"})
+	db.Apply(&DBCommand{Command: "SET", Path: "/a/b/d", Value: "2"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/big/x", Value: "1"})
+	before := hashNode(db.Root)
+	// a failed MULTI doesn't leave any of its changes behind, however deep
+	multi := &DBCommand{Command: "MULTI", Ops: []*DBCommand{
+		{Command: "SET", Path: "/a/b/c", Value: "2"},
+		{Command: "MOVE", Path: "/a/b", Target: "/moved", Flags: WITH_SUBTREE | RESET_VERSIONS},
+		{Command: "CREATE", Path: "/moved/e"},
+		{Command: "DELETE_RECURSIVE", Path: "/moved"},
+		{Command: "CHECK_VERSION", Path: "/big/x", Version: 5},
+	}}
+	if resp := db.Apply(multi); resp.Error == "" {
+		t.Fatalf("MULTI with a bad version should fail: %v", resp.Reply)
+	}
+	if hashNode(db.Root) != before || hashNode(copyTreeUncached(db.Root)) != before {
+		t.Errorf("Failed MULTI changed the tree")
+	}
+	// and one that works leaves what it didn't touch where it was, rather than copying it
+	big := db.Root.Children["big"]
+	multi = &DBCommand{Command: "MULTI", Ops: []*DBCommand{{Command: "SET", Path: "/a/b/c", Value: "3"}}}
+	if resp := db.Apply(multi); resp.Error != "" {
+		t.Fatalf("MULTI failed: %s", resp.Error)
+	}
+	if db.Root.Children["big"] != big {
+		t.Errorf("MULTI copied a subtree it didn't touch")
+	}
+	if n, _ := getNode(db.Root, "/a/b/c"); string(n.Value) != "3" {
+		t.Errorf("MULTI didn't apply its SET")
+	}
+}
+
+func TestDatabaseTTL(t *testing.T) {
+	db := NewDatabase()
+	start := time.Now()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/tmp/a", Value: "a", TTL: time.Minute, Time: start})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/tmp/b", Value: "b", TTL: 2 * time.Minute, Time: start})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/tmp/c", Value: "c", Time: start})
+	//
+	if resp := db.Apply(&DBCommand{Command: "EXPIRED", Time: start.Add(30 * time.Second)}); resp.Reply != nil && len(resp.Reply.([]string)) != 0 {
+		t.Errorf("Nothing should have expired yet, got %v", resp.Reply)
+	}
+	// Refreshing /tmp/a keeps it alive past its original deadline
+	db.Apply(&DBCommand{Command: "SET", Path: "/tmp/a", Value: "a2", Time: start.Add(50 * time.Second)})
+	if resp := db.Apply(&DBCommand{Command: "EXPIRE", Time: start.Add(100 * time.Second)}); resp.Reply != nil && len(resp.Reply.([]string)) != 0 {
+		t.Errorf("Nothing should have expired yet, got %v", resp.Reply)
+	}
+	resp := db.Apply(&DBCommand{Command: "EXPIRE", Time: start.Add(3 * time.Minute)})
+	if expired := resp.Reply.([]string); len(expired) != 2 {
+		t.Errorf("Expected /tmp/a and /tmp/b to expire, got %v", expired)
+	}
+	if kids, _ := getChildren(db.Root, "/tmp"); !areEqual(kids, []string{"c"}) {
+		t.Errorf("Only /tmp/c should be left, got %v", kids)
+	}
+}
+
+func TestDatabaseStat(t *testing.T) {
+	db := NewDatabase()
+	start := time.Now()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/lock", Value: "me", Flags: EPHEMERAL, Session: "s1", Time: start, OpNumber: 7})
+	db.Apply(&DBCommand{Command: "SET", Path: "/lock", Value: "still me", Time: start.Add(time.Second), OpNumber: 8})
+	//
+	resp := db.Apply(&DBCommand{Command: "STAT", Path: "/lock"})
+	if resp.Error != "" {
+		t.Fatalf("STAT failed: %s", resp.Error)
+	}
+	stats := resp.Reply.(StatNode)
+	if !stats.Ctime.Equal(start) || !stats.Mtime.Equal(start.Add(time.Second)) {
+		t.Errorf("STAT has the wrong times: ctime %v, mtime %v", stats.Ctime, stats.Mtime)
+	}
+	if stats.CreateOp != 7 || stats.EphemeralOwner != "s1" || stats.DataLength != 8 || stats.Version != 2 {
+		t.Errorf("STAT returned %+v", stats)
+	}
+	if resp := db.Apply(&DBCommand{Command: "STAT", Path: "/missing"}); resp.Error == "" {
+		t.Errorf("STAT of a missing node should fail")
+	}
+}
+
+func TestDatabaseReadOnly(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/config", Value: "v1"})
+	if resp := db.Apply(&DBCommand{Command: "SET_READONLY", Path: "/", Value: "true", Auth: []Identity{Admin}}); resp.Error != "" {
+		t.Fatalf("SET_READONLY failed: %s", resp.Error)
+	}
+	//
+	if resp := db.Apply(&DBCommand{Command: "SET", Path: "/config", Value: "v2"}); resp.Error != ErrReadOnly.Error() {
+		t.Errorf("SET while read-only returned %q", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "GET", Path: "/config"}); resp.Error != "" || string(resp.Reply.(*DataNode).Value) != "v1" {
+		t.Errorf("GET while read-only returned %#v", resp)
+	}
+	// The mode survives a snapshot
+	data := db.Apply(&DBCommand{Command: "SNAPSHOT"}).Reply.([]byte)
+	restored := NewDatabase()
+	restored.Apply(&DBCommand{Command: "LOAD_SNAPSHOT", Value: string(data)})
+	if resp := restored.Apply(&DBCommand{Command: "CREATE", Path: "/new"}); resp.Error != ErrReadOnly.Error() {
+		t.Errorf("CREATE after restoring a read-only snapshot returned %q", resp.Error)
+	}
+	db.Apply(&DBCommand{Command: "SET_READONLY", Path: "/", Value: "false", Auth: []Identity{Admin}})
+	if resp := db.Apply(&DBCommand{Command: "SET", Path: "/config", Value: "v2"}); resp.Error != "" {
+		t.Errorf("SET after leaving read-only mode failed: %s", resp.Error)
+	}
+}
+
+func TestDatabaseRootAdmin(t *testing.T) {
+	db := NewDatabase()
+	alice := []Identity{{"digest", "alice"}}
+	for _, cmd := range []string{"SET_READONLY", "SET_QUOTA", "START_AUDIT", "STOP_AUDIT", "AUDIT_LOG", "PURGE_TOMBSTONES"} {
+		if resp := db.Apply(&DBCommand{Command: cmd, Path: "/", Value: "true", Session: "s1"}); resp.Error != ErrNotAuthorized.Error() {
+			t.Errorf("Expected %s on / from an unauthenticated client to fail, got %#v", cmd, resp)
+		}
+		if err := db.CheckAccess(&DBCommand{Command: cmd, Path: "/", Auth: alice}); err != ErrNotAuthorized {
+			t.Errorf("Expected %s on / from a client that isn't an admin to be turned away, got %v", cmd, err)
+		}
+	}
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/config", Value: "v1", Session: "s1"}); resp.Error != "" {
+		t.Errorf("Expected anyone to be able to create under /, got %s", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "SET_READONLY", Path: "/", Value: "true", Auth: []Identity{Admin}}); resp.Error != "" {
+		t.Errorf("Expected an admin to be able to turn on read-only mode, got %s", resp.Error)
+	}
+}
+
+func TestDatabaseSync(t *testing.T) {
+	db := NewDatabase()
+	before := hashNode(db.Root)
+	resp := db.Apply(&DBCommand{Command: "SYNC", OpNumber: 12})
+	if resp.Error != "" || resp.Reply.(uint64) != 12 {
+		t.Errorf("SYNC returned %#v", resp)
+	}
+	if hashNode(db.Root) != before {
+		t.Errorf("SYNC changed the tree")
+	}
+}
+
+func TestDatabaseContainers(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/locks", Flags: CONTAINER})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/locks/db", Flags: CONTAINER})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/locks/db/a", Flags: EPHEMERAL, Session: "s1"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/locks/db/b", Flags: EPHEMERAL, Session: "s2"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/empty", Flags: CONTAINER})
+	//
+	db.Apply(&DBCommand{Command: "CLOSE_SESSION", Session: "s1"})
+	if exists, _ := existsNode(db.Root, "/locks/db"); !exists {
+		t.Errorf("Container was deleted while it still had children")
+	}
+	// Deleting the last child takes every emptied container up the path with it
+	var changed []string
+	db.OnChange("/", func(c Change) { changed = append(changed, c.Path) })
+	db.Apply(&DBCommand{Command: "DELETE", Path: "/locks/db/b"})
+	if exists, _ := existsNode(db.Root, "/locks"); exists {
+		t.Errorf("Empty containers weren't deleted")
+	}
+	// and says so, so caches drop what they have of them and their parents
+	if !reflect.DeepEqual(changed, []string{"/locks/db/b", "/locks/db", "/locks"}) {
+		t.Errorf("Expected the containers to be reported changed too, got %v", changed)
+	}
+	// Containers that never had children are left alone
+	if exists, _ := existsNode(db.Root, "/empty"); !exists {
+		t.Errorf("A new container was deleted")
+	}
+	if hashNode(db.Root) != hashNode(copyTreeUncached(db.Root)) {
+		t.Errorf("Deleting containers left a stale digest")
+	}
+}
+
+func TestDatabaseMGet(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/config/a", Value: "1"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/config/b", Value: "2", ACL: []ACL{{"digest", "alice", PERM_ALL}}})
+	//
+	resp := db.Apply(&DBCommand{Command: "MGET", Paths: []string{"/config/a", "/missing", "/config/b"}})
+	results := resp.Reply.([]DBResponse)
+	if resp.Error != "" || len(results) != 3 {
+		t.Fatalf("MGET returned %#v", resp)
+	}
+	if string(results[0].Reply.(*DataNode).Value) != "1" {
+		t.Errorf("MGET returned the wrong data for /config/a: %#v", results[0])
+	}
+	if results[1].Error == "" {
+		t.Errorf("MGET of a missing node should fail")
+	}
+	// each path gets its own access check
+	if results[2].Error != ErrNotAuthorized.Error() {
+		t.Errorf("MGET of an unreadable node returned %#v", results[2])
+	}
+}
+
+func TestDatabaseGetIfModified(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/config", Value: "v1", OpNumber: 3})
+	get := &DBCommand{Command: "GET_IF_MODIFIED", Path: "/config", Version: 1, CreateOp: 3}
+	if resp := db.Apply(get); resp.Error != ErrNotModified.Error() {
+		t.Errorf("GET_IF_MODIFIED of a current copy returned %#v", resp)
+	}
+	db.Apply(&DBCommand{Command: "SET", Path: "/config", Value: "v2"})
+	if resp := db.Apply(get); resp.Error != "" || string(resp.Reply.(*DataNode).Value) != "v2" {
+		t.Errorf("GET_IF_MODIFIED of a changed node returned %#v", resp)
+	}
+	// same version, but not the same node
+	db.Apply(&DBCommand{Command: "DELETE", Path: "/config"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/config", Value: "v3", OpNumber: 9})
+	if resp := db.Apply(get); resp.Error != "" || string(resp.Reply.(*DataNode).Value) != "v3" {
+		t.Errorf("GET_IF_MODIFIED of a recreated node returned %#v", resp)
+	}
+}
+
+func TestDatabaseParallelReads(t *testing.T) {
+	input := make(chan DBCommandWithChannel, 100)
+	go DatabaseServer(input)
+	defer close(input)
+	send := func(cmd *DBCommand) chan *DBResponse {
+		req := DBCommandWithChannel{cmd, make(chan *DBResponse, 1)}
+		input <- req
+		return req.Done
+	}
+	send(&DBCommand{Command: "CREATE", Path: "/counter", Value: "0"})
+	// Reads queued behind a write always see it, however they're interleaved
+	var gets []chan *DBResponse
+	for i := 1; i <= 20; i++ {
+		send(&DBCommand{Command: "SET", Path: "/counter", Value: strconv.Itoa(i)})
+		gets = append(gets, send(&DBCommand{Command: "GET", Path: "/counter"}))
+	}
+	for i, done := range gets {
+		resp := <-done
+		if val, _ := strconv.Atoi(string(resp.Reply.(*DataNode).Value)); val < i+1 {
+			t.Errorf("GET after SET %d returned %d", i+1, val)
+		}
+	}
+}
+
+func TestDatabaseReadBatch(t *testing.T) {
+	input := make(chan DBCommandWithChannel)
+	go DatabaseServer(input)
+	defer close(input)
+	create := DBCommandWithChannel{&DBCommand{Command: "CREATE", Path: "/a", Value: "1"}, make(chan *DBResponse)}
+	input <- create
+	<-create.Done
+	batch := DBCommandWithChannel{&DBCommand{Command: "READ_BATCH", Ops: []*DBCommand{
+		{Command: "GET", Path: "/a"},
+		{Command: "EXISTS", Path: "/b"},
+		{Command: "SET", Path: "/a", Value: "2"},
+	}}, make(chan *DBResponse)}
+	input <- batch
+	resp := <-batch.Done
+	results, ok := resp.Reply.([]DBResponse)
+	if resp.Error != "" || !ok || len(results) != 3 {
+		t.Fatalf("READ_BATCH returned %#v", resp)
+	}
+	if string(results[0].Reply.(*DataNode).Value) != "1" || results[1].Reply != false {
+		t.Errorf("READ_BATCH returned the wrong results: %#v", results)
+	}
+	// only reads can be batched
+	if results[2].Error != ErrUnknownCommand.Error() {
+		t.Errorf("Expected a SET in a READ_BATCH to be turned down, got %#v", results[2])
+	}
+}
+
+func TestDatabaseSnapshot(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/dev/null", Value: "empty"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/dev/random", Value: "4"})
+	//
+	resp := db.Apply(&DBCommand{Command: "SNAPSHOT"})
+	if resp.Error != "" {
+		t.Fatalf("SNAPSHOT failed: %s", resp.Error)
+	}
+	other := NewDatabase()
+	other.Apply(&DBCommand{Command: "CREATE", Path: "/stale", Value: "gone soon"})
+	if resp := other.Apply(&DBCommand{Command: "LOAD_SNAPSHOT", Value: string(resp.Reply.([]byte))}); resp.Error != "" {
+		t.Fatalf("LOAD_SNAPSHOT failed: %s", resp.Error)
+	}
+	if hashNode(other.Root) != hashNode(db.Root) {
+		t.Errorf("Restored tree %v doesn't match %v", hashNode(other.Root), hashNode(db.Root))
+	}
+	if resp := other.Apply(&DBCommand{Command: "LOAD_SNAPSHOT", Value: "garbage"}); resp.Error == "" {
+		t.Errorf("LOAD_SNAPSHOT of garbage should fail")
+	}
+}
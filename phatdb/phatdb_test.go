@@ -2,6 +2,7 @@ package phatdb
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -63,12 +64,12 @@ func TestAddGetDelNode(t *testing.T) {
 	val2 := "nothingness"
 	// Create the node
 	n, err := createNode(root, path, val1)
-	if err != nil || n.Value != val1 || n.Stats.Version != 1 {
+	if err != nil || string(n.Value) != val1 || n.Stats.Version != 1 {
 		t.Errorf("Set node failed")
 	}
 	// Update the contents of the node
 	setNode(root, path, val2)
-	if n, err := getNode(root, path); err != nil || n.Value != val2 || n.Stats.Version != 2 {
+	if n, err := getNode(root, path); err != nil || string(n.Value) != val2 || n.Stats.Version != 2 {
 		t.Errorf("Get and/or set node failed")
 	}
 	// Ensure the node exists
@@ -82,7 +83,7 @@ func TestAddGetDelNode(t *testing.T) {
 	}
 	// Create the node again -- currently we expect the version to be 1 again
 	// TODO: Should this have different behaviour? Is this what you'd expect?
-	if n, err = createNode(root, path, val1); n.Value != val1 || n.Stats.Version != 1 {
+	if n, err = createNode(root, path, val1); string(n.Value) != val1 || n.Stats.Version != 1 {
 		t.Errorf("Set node failed")
 	}
 }
@@ -110,17 +111,344 @@ func TestGetChildren(t *testing.T) {
 
 func TestHashDB(t *testing.T) {
 	root := setup()
-	expected := "<FN Children=map[string]*phatdb.FileNode{} Data=<nil>>"
-	if hashNode(root) != expected {
-		t.Errorf("Database does not hash to expected value: %v instead of %v", hashNode(root), expected)
+	empty := hashNode(root)
+	if empty != hashNode(setup()) {
+		t.Errorf("Empty databases hash differently")
 	}
 	//
 	_, err := createNode(root, "/dev/null", "empty")
 	if err != nil {
 		t.Errorf("Create node failed")
 	}
-	expected = "<FN Children=map[string]*phatdb.FileNode{\"dev\":<FN Children=map[string]*phatdb.FileNode{\"null\":<FN Children=map[string]*phatdb.FileNode{} Data=<DN V=\"empty\" Stats=<SN V=1 CV=0 NC=0>>>} Data=<DN V=\"\" Stats=<SN V=0 CV=0 NC=0>>>} Data=<nil>>"
-	if hashNode(root) != expected {
-		t.Errorf("Database does not hash to expected value: %v instead of %v", hashNode(root), expected)
+	// the helpers leave keeping the digests up to date to the caller
+	touchPath(root, "/dev/null")
+	if hashNode(root) == empty {
+		t.Errorf("Database hash didn't change after a CREATE")
+	}
+	other := setup()
+	createNode(other, "/dev/null", "empty")
+	if hashNode(root) != hashNode(other) {
+		t.Errorf("Equal databases hash differently: %v and %v", hashNode(root), hashNode(other))
+	}
+	// cached digests only get recomputed along the touched path
+	createNode(root, "/etc/hosts", "localhost")
+	touchPath(root, "/etc/hosts")
+	before, _ := subtreeDigest(root, "/dev")
+	setNode(root, "/etc/hosts", "127.0.0.1")
+	touchPath(root, "/etc/hosts")
+	if after, _ := subtreeDigest(root, "/dev"); after != before {
+		t.Errorf("Digest of an untouched subtree changed")
+	}
+	if hashNode(root) != hashNode(copyTreeUncached(root)) {
+		t.Errorf("Cached digest %v doesn't match a fresh one %v", hashNode(root), hashNode(copyTreeUncached(root)))
+	}
+}
+
+// copyTreeUncached copies a tree without its cached digests
+func copyTreeUncached(f *FileNode) *FileNode {
+	n := copyTree(f)
+	var clear func(n *FileNode)
+	clear = func(n *FileNode) {
+		n.hash = nil
+		for _, child := range n.Children {
+			clear(child)
+		}
+	}
+	clear(n)
+	return n
+}
+
+func TestEphemeralNodes(t *testing.T) {
+	root := setup()
+	//
+	if _, err := createEphemeralNode(root, "/locks/a", "1", "s1"); err != nil {
+		t.Errorf("Creating an ephemeral node failed: %v", err)
+	}
+	createEphemeralNode(root, "/locks/b", "2", "s2")
+	createNode(root, "/locks/c", "3")
+	if _, err := createEphemeralNode(root, "/locks/d", "4", ""); err != ErrNoSession {
+		t.Errorf("Ephemeral node without a session should fail, got %v", err)
+	}
+	// Ephemeral nodes can't have children
+	if _, err := createNode(root, "/locks/a/child", "x"); err != ErrEphemeralParent {
+		t.Errorf("Creating a child of an ephemeral node should fail, got %v", err)
+	}
+	if _, err := createNode(root, "/locks/a/child/grandchild", "x"); err != ErrEphemeralParent {
+		t.Errorf("Creating a grandchild of an ephemeral node should fail, got %v", err)
+	}
+	if exists, _ := existsNode(root, "/locks/a/child"); exists {
+		t.Errorf("Failed CREATE still created /locks/a/child")
+	}
+	// Ending s1 only takes s1's nodes with it
+	if deleted := deleteSessionNodes(root, "s1"); !areEqual(deleted, []string{"/locks/a"}) {
+		t.Errorf("deleteSessionNodes deleted %v, expected [/locks/a]", deleted)
+	}
+	for path, expected := range map[string]bool{"/locks/a": false, "/locks/b": true, "/locks/c": true} {
+		if exists, _ := existsNode(root, path); exists != expected {
+			t.Errorf("existsNode(%s) = %v, expected %v", path, exists, expected)
+		}
+	}
+}
+
+func TestSequentialNodes(t *testing.T) {
+	root := setup()
+	//
+	expected := []string{"/queue/item-0000000000", "/queue/item-0000000001", "/queue/item-0000000002"}
+	for _, want := range expected {
+		if path, n, err := createSequentialNode(root, "/queue/item-", "x", ""); err != nil || path != want || string(n.Value) != "x" {
+			t.Errorf("createSequentialNode returned %v (err %v), expected %v", path, err, want)
+		}
+	}
+	// Counters are per parent, and a trailing slash just uses the counter
+	if path, _, _ := createSequentialNode(root, "/other/", "x", ""); path != "/other/0000000000" {
+		t.Errorf("createSequentialNode returned %v, expected /other/0000000000", path)
+	}
+	// Deleting children doesn't reuse numbers
+	deleteNode(root, "/queue/item-0000000002")
+	if path, _, _ := createSequentialNode(root, "/queue/item-", "x", "s1"); path != "/queue/item-0000000003" {
+		t.Errorf("createSequentialNode returned %v, expected /queue/item-0000000003", path)
+	}
+}
+
+func TestSetNodeVersion(t *testing.T) {
+	root := setup()
+	//
+	createNode(root, "/counter", "0")
+	n, err := setNodeVersion(root, "/counter", "1", 1)
+	if err != nil || string(n.Value) != "1" || n.Stats.Version != 2 {
+		t.Errorf("SET_VERSION at the current version failed: %v", err)
+	}
+	// A stale version loses
+	if _, err := setNodeVersion(root, "/counter", "stale", 1); err != ErrBadVersion {
+		t.Errorf("SET_VERSION at a stale version returned %v, expected ErrBadVersion", err)
+	}
+	if n, _ := getNode(root, "/counter"); string(n.Value) != "1" {
+		t.Errorf("Failed SET_VERSION changed the value to %v", string(n.Value))
+	}
+	if _, err := setNodeVersion(root, "/missing", "x", 0); err == nil {
+		t.Errorf("SET_VERSION on a missing node should fail")
+	}
+}
+
+func TestGetSetNode(t *testing.T) {
+	root := setup()
+	//
+	createNode(root, "/seq", "1")
+	old, cur, err := getSetNode(root, "/seq", "2")
+	if err != nil || string(old.Value) != "1" || old.Stats.Version != 1 {
+		t.Errorf("GETSET returned the wrong old data: %#v (err: %v)", old, err)
+	}
+	if string(cur.Value) != "2" || cur.Stats.Version != 2 {
+		t.Errorf("GETSET didn't set the node: %#v", cur)
+	}
+	if _, _, err := getSetNode(root, "/missing", "x"); err == nil {
+		t.Errorf("GETSET on a missing node should fail")
+	}
+}
+
+func TestAppendNode(t *testing.T) {
+	root := setup()
+	//
+	createNode(root, "/journal", "a")
+	old, _, _ := getSetNode(root, "/journal", "ab")
+	if n, err := appendNode(root, "/journal", "c"); err != nil || string(n.Value) != "abc" || n.Stats.DataLength != 3 {
+		t.Errorf("APPEND failed: %#v (err: %v)", n, err)
+	}
+	if string(old.Value) != "a" {
+		t.Errorf("APPEND changed an earlier GETSET result to %q", old.Value)
+	}
+	if _, err := appendNode(root, "/journal", strings.Repeat("x", MaxValueSize)); err != ErrTooLarge {
+		t.Errorf("APPEND past MaxValueSize returned %v, expected ErrTooLarge", err)
+	}
+	if n, _ := getNode(root, "/journal"); string(n.Value) != "abc" {
+		t.Errorf("Failed APPEND still changed the node to %q", n.Value)
+	}
+}
+
+func TestIncrNode(t *testing.T) {
+	root := setup()
+	//
+	createNode(root, "/counter", "")
+	if val, _, err := incrNode(root, "/counter", 5); err != nil || val != 5 {
+		t.Errorf("INCR of an empty node returned %d (err: %v)", val, err)
+	}
+	if val, n, err := incrNode(root, "/counter", -7); err != nil || val != -2 || string(n.Value) != "-2" || n.Stats.Version != 3 {
+		t.Errorf("INCR returned %d, %#v (err: %v)", val, n, err)
+	}
+	createNode(root, "/name", "bob")
+	if _, _, err := incrNode(root, "/name", 1); err != ErrNotNumber {
+		t.Errorf("INCR of a non-number returned %v, expected ErrNotNumber", err)
+	}
+}
+
+func TestNamespaceLimits(t *testing.T) {
+	root := setup()
+	//
+	if _, err := createNode(root, strings.Repeat("/a", MaxPathDepth+1), ""); err != ErrPathTooDeep {
+		t.Errorf("CREATE of a deep path returned %v, expected ErrPathTooDeep", err)
+	}
+	if _, err := createNode(root, "/dir/"+strings.Repeat("a", MaxNameLength+1), ""); err != ErrNameTooLong {
+		t.Errorf("CREATE with a long name returned %v, expected ErrNameTooLong", err)
+	}
+	// nothing on the way to a bad name is created either
+	if _, err := createNode(root, "/new/parent/"+strings.Repeat("a", MaxNameLength+1), ""); err != ErrNameTooLong {
+		t.Errorf("CREATE with a long name returned %v, expected ErrNameTooLong", err)
+	}
+	if _, _, err := createSequentialNode(root, "/seq/parent/"+strings.Repeat("a", MaxNameLength), "", ""); err != ErrNameTooLong {
+		t.Errorf("CREATE_SEQ with a long name returned %v, expected ErrNameTooLong", err)
+	}
+	for _, p := range []string{"/new", "/seq"} {
+		if exists, _ := existsNode(root, p); exists {
+			t.Errorf("Failed CREATE still created %s", p)
+		}
+	}
+	if _, err := createNode(root, "/big", strings.Repeat("x", MaxValueSize+1)); err != ErrTooLarge {
+		t.Errorf("CREATE with a large value returned %v, expected ErrTooLarge", err)
+	}
+	if exists, _ := existsNode(root, "/big"); exists {
+		t.Errorf("Failed CREATE still created the node")
+	}
+	createNode(root, "/small", "")
+	if _, err := setNode(root, "/small", strings.Repeat("x", MaxValueSize+1)); err != ErrTooLarge {
+		t.Errorf("SET with a large value returned %v, expected ErrTooLarge", err)
+	}
+	// limits can be changed (or turned off)
+	defer func(depth int) { MaxPathDepth = depth }(MaxPathDepth)
+	MaxPathDepth = 0
+	if _, err := createNode(root, strings.Repeat("/a", 100), ""); err != nil {
+		t.Errorf("CREATE of a deep path without a limit failed: %v", err)
+	}
+}
+
+func TestNodeHistory(t *testing.T) {
+	defer func(length int) { HistoryLength = length }(HistoryLength)
+	HistoryLength = 2
+	root := setup()
+	//
+	createNode(root, "/config", "v1")
+	setNode(root, "/config", "v2")
+	setNode(root, "/config", "v3")
+	setNode(root, "/config", "v4")
+	for version, expected := range map[uint64]string{2: "v2", 3: "v3", 4: "v4"} {
+		if n, err := getNodeVersion(root, "/config", version); err != nil || string(n.Value) != expected || n.Stats.Version != version {
+			t.Errorf("GET_VERSION %d returned %#v (err: %v)", version, n, err)
+		}
+	}
+	// only the last HistoryLength old values are kept
+	if _, err := getNodeVersion(root, "/config", 1); err != ErrNoSuchVersion {
+		t.Errorf("GET_VERSION of a dropped version returned %v, expected ErrNoSuchVersion", err)
+	}
+	if n, _ := getNode(root, "/config"); string(n.Value) != "v4" {
+		t.Errorf("GET_VERSION changed the node to %q", n.Value)
+	}
+}
+
+func TestDeleteNodeVersion(t *testing.T) {
+	root := setup()
+	//
+	createNode(root, "/config", "a")
+	setNode(root, "/config", "b")
+	if _, err := deleteNodeVersion(root, "/config", 1); err != ErrBadVersion {
+		t.Errorf("DELETE_VERSION at a stale version returned %v, expected ErrBadVersion", err)
+	}
+	if exists, _ := existsNode(root, "/config"); !exists {
+		t.Errorf("Failed DELETE_VERSION still deleted the node")
+	}
+	if _, err := deleteNodeVersion(root, "/config", 2); err != nil {
+		t.Errorf("DELETE_VERSION at the current version failed: %v", err)
+	}
+	if exists, _ := existsNode(root, "/config"); exists {
+		t.Errorf("DELETE_VERSION didn't delete the node")
+	}
+}
+
+func TestGetChildrenPage(t *testing.T) {
+	root := setup()
+	//
+	for _, child := range []string{"item-3", "item-1", "lock", "item-2", "item-4"} {
+		createNode(root, "/queue/"+child, "")
+	}
+	// Page through the items two at a time
+	var pages [][]string
+	after := ""
+	for {
+		names, err := getChildrenPage(root, "/queue", "item-", after, 2)
+		if err != nil {
+			t.Fatalf("getChildrenPage failed: %v", err)
+		}
+		pages = append(pages, names)
+		if len(names) < 2 {
+			break
+		}
+		after = names[len(names)-1]
+	}
+	expected := [][]string{{"item-1", "item-2"}, {"item-3", "item-4"}, nil}
+	if len(pages) != len(expected) {
+		t.Fatalf("getChildrenPage: wanted %v, received %v", expected, pages)
+	}
+	for i := range pages {
+		if !areEqual(pages[i], expected[i]) {
+			t.Errorf("getChildrenPage: wanted %v, received %v", expected, pages)
+		}
+	}
+}
+
+func TestChildStats(t *testing.T) {
+	root := setup()
+	createNode(root, "/app", "")
+	createNode(root, "/app/a", "1")
+	if n, _ := getNode(root, "/app"); n.Stats.CVersion != 1 || n.Stats.NumChildren != 1 {
+		t.Errorf("CREATE didn't update the parent's stats: %#v", n.Stats)
+	}
+	createSequentialNode(root, "/app/item-", "", "")
+	deleteNode(root, "/app/a")
+	if n, _ := getNode(root, "/app"); n.Stats.CVersion != 3 || n.Stats.NumChildren != 1 {
+		t.Errorf("CREATE_SEQ and DELETE didn't update the parent's stats: %#v", n.Stats)
+	}
+	// intermediate nodes count as children too
+	createNode(root, "/app/b/c", "")
+	if n, _ := getNode(root, "/app/b"); n.Stats.NumChildren != 1 {
+		t.Errorf("Expected /app/b to have a child: %#v", n.Stats)
+	}
+	if n, _ := getNode(root, "/app"); n.Stats.NumChildren != 2 {
+		t.Errorf("Expected /app to have 2 children: %#v", n.Stats)
+	}
+}
+
+func TestDeleteNodeRecursive(t *testing.T) {
+	root := setup()
+	//
+	createNode(root, "/app", "")
+	createNode(root, "/app/config/a", "1")
+	createNode(root, "/app/config/b", "2")
+	if _, err := deleteNode(root, "/app/config"); err != ErrNotEmpty {
+		t.Errorf("DELETE of a node with children returned %v, expected ErrNotEmpty", err)
+	}
+	if _, err := deleteNodeRecursive(root, "/app/config"); err != nil {
+		t.Errorf("DELETE_RECURSIVE failed: %v", err)
+	}
+	if exists, _ := existsNode(root, "/app/config/a"); exists {
+		t.Errorf("DELETE_RECURSIVE left a child behind")
+	}
+	// created once and deleted once
+	if n, _ := getNode(root, "/app"); n.Stats.CVersion != 2 || n.Stats.NumChildren != 0 {
+		t.Errorf("DELETE_RECURSIVE didn't update the parent's stats: %#v", n.Stats)
+	}
+	if _, err := deleteNodeRecursive(root, "/"); err != ErrDeleteRoot {
+		t.Errorf("DELETE_RECURSIVE of the root returned %v, expected ErrDeleteRoot", err)
+	}
+}
+
+func TestBinaryValues(t *testing.T) {
+	root := setup()
+	//
+	val := string([]byte{0, 1, 2, 255, 0})
+	n, err := createNode(root, "/bin", val)
+	if err != nil || string(n.Value) != val || n.Stats.DataLength != 5 {
+		t.Errorf("Binary value didn't round trip: %v (length %d)", n.Value, n.Stats.DataLength)
+	}
+	setNode(root, "/bin", "")
+	if n, _ := getNode(root, "/bin"); len(n.Value) != 0 || n.Stats.DataLength != 0 {
+		t.Errorf("Emptying the value left %v (length %d)", n.Value, n.Stats.DataLength)
 	}
 }
@@ -0,0 +1,145 @@
+package phatdb
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits the size of the subtree under a node. 0 means no limit
+type Quota struct {
+	MaxBytes    uint64 // total length of all the values in the subtree (including the node itself)
+	MaxChildren uint64 // number of direct children of the node
+	MaxNodes    uint64 // number of nodes in the subtree (not counting the node itself)
+}
+
+func subtreeBytes(n *FileNode) uint64 {
+	var total uint64
+	if n.Data != nil {
+		total = n.Data.Stats.DataLength
+	}
+	for _, child := range n.Children {
+		total += subtreeBytes(child)
+	}
+	return total
+}
+
+func subtreeNodes(n *FileNode) uint64 {
+	var total uint64
+	for _, child := range n.Children {
+		total += 1 + subtreeNodes(child)
+	}
+	return total
+}
+
+// quotasAt returns the quotas that apply to n, the node depth levels down the path req
+// writes to: its own, and req's TenantQuota if n is req's root
+func quotasAt(req *DBCommand, n *FileNode, depth int) []*Quota {
+	var quotas []*Quota
+	if n.Quota != nil {
+		quotas = append(quotas, n.Quota)
+	}
+	if req.TenantQuota != nil && depth == len(GetNodePath(req.quotaRoot)) {
+		quotas = append(quotas, req.TenantQuota)
+	}
+	return quotas
+}
+
+// checkQuota makes sure writing a value of valLen bytes to the node at parts (creating it,
+// and any missing parents, if create is set, along with extraNodes more under it) doesn't
+// push any node with a quota along the way over its limits
+func checkQuota(root *FileNode, req *DBCommand, parts []string, valLen uint64, extraNodes uint64, create bool) error {
+	nodes := []*FileNode{root}
+	n := root
+	exists := true
+	for _, part := range parts {
+		child, ok := n.Children[part]
+		if !ok {
+			exists = false
+			break
+		}
+		n = child
+		nodes = append(nodes, n)
+	}
+	var oldLen uint64
+	if exists && n.Data != nil {
+		oldLen = n.Data.Stats.DataLength
+	}
+	var added uint64
+	if create {
+		added = uint64(len(parts)-(len(nodes)-1)) + extraNodes
+	}
+	for i, node := range nodes {
+		for _, q := range quotasAt(req, node, i) {
+			if q.MaxBytes > 0 && subtreeBytes(node)-oldLen+valLen > q.MaxBytes {
+				return ErrQuotaExceeded
+			}
+			// creating a missing node adds a child to the deepest node that does exist
+			if create && !exists && i == len(nodes)-1 && q.MaxChildren > 0 &&
+				uint64(len(node.Children))+1 > q.MaxChildren {
+				return ErrQuotaExceeded
+			}
+			if q.MaxNodes > 0 && subtreeNodes(node)+added > q.MaxNodes {
+				return ErrQuotaExceeded
+			}
+		}
+	}
+	return nil
+}
+
+// checkCommandQuota checks the quotas for the commands that add data to the tree
+func checkCommandQuota(root *FileNode, req *DBCommand) error {
+	parts := GetNodePath(req.Path)
+	switch req.Command {
+	case "CREATE":
+		return checkQuota(root, req, parts, uint64(len(req.Value)), 0, true)
+	case "CREATE_SEQ":
+		// the sequential name never exists yet (and node names are never empty)
+		if !strings.HasSuffix(req.Path, "/") && len(parts) > 0 {
+			parts = parts[:len(parts)-1]
+		}
+		return checkQuota(root, req, append(parts, ""), uint64(len(req.Value)), 0, true)
+	case "SET", "SET_VERSION", "GETSET":
+		return checkQuota(root, req, parts, uint64(len(req.Value)), 0, false)
+	case "COPY", "MOVE":
+		// the whole subtree might be coming along
+		n, err := traverseToData(root, req.Path)
+		if err != nil {
+			// the command itself reports the missing node (or the root)
+			return nil
+		}
+		size := n.Data.Stats.DataLength
+		var below uint64
+		if req.Flags&WITH_SUBTREE != 0 {
+			size = subtreeBytes(n)
+			below = subtreeNodes(n)
+		}
+		return checkQuota(root, req, GetNodePath(req.Target), size, below, true)
+	case "APPEND":
+		n, err := traverseToData(root, req.Path)
+		if err != nil {
+			// the command itself reports the missing node (or the root)
+			return nil
+		}
+		return checkQuota(root, req, parts, n.Data.Stats.DataLength+uint64(len(req.Value)), 0, false)
+	}
+	return nil
+}
+
+func setQuota(root *FileNode, path string, quota *Quota) error {
+	n, err := traverseToNode(root, GetNodePath(path), false)
+	if err != nil {
+		return err
+	}
+	n.Quota = quota
+	return nil
+}
+
+func getQuota(root *FileNode, path string) (*Quota, error) {
+	n, err := traverseToNode(root, GetNodePath(path), false)
+	if err != nil {
+		return nil, err
+	}
+	return n.Quota, nil
+}
@@ -0,0 +1,87 @@
+package phatdb
+
+import (
+	"testing"
+)
+
+func TestQuota(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/app", Value: "1234"})
+	if resp := db.Apply(&DBCommand{Command: "SET_QUOTA", Path: "/app", Quota: &Quota{MaxBytes: 10, MaxChildren: 2}}); resp.Error != "" {
+		t.Fatalf("SET_QUOTA failed: %s", resp.Error)
+	}
+	// Stay within both limits
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/app/a", Value: "123"}); resp.Error != "" {
+		t.Errorf("CREATE within the quota failed: %s", resp.Error)
+	}
+	// 4 + 3 + 4 bytes is over the limit
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/app/b", Value: "1234"}); resp.Error != ErrQuotaExceeded.Error() {
+		t.Errorf("CREATE over the byte quota returned %q", resp.Error)
+	}
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/app/b", Value: "1"})
+	// Too many children, even through a sequential node or a deeper path
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/app/c"}); resp.Error != ErrQuotaExceeded.Error() {
+		t.Errorf("CREATE over the children quota returned %q", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "CREATE_SEQ", Path: "/app/c-"}); resp.Error != ErrQuotaExceeded.Error() {
+		t.Errorf("CREATE_SEQ over the children quota returned %q", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/app/c/d"}); resp.Error != ErrQuotaExceeded.Error() {
+		t.Errorf("CREATE of a deep path over the children quota returned %q", resp.Error)
+	}
+	// SETs count the difference from the old value
+	if resp := db.Apply(&DBCommand{Command: "SET", Path: "/app/a", Value: "12345"}); resp.Error != "" {
+		t.Errorf("SET within the quota failed: %s", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "SET", Path: "/app/a", Value: "123456"}); resp.Error != ErrQuotaExceeded.Error() {
+		t.Errorf("SET over the byte quota returned %q", resp.Error)
+	}
+	// Removing the quota lifts the limits
+	db.Apply(&DBCommand{Command: "SET_QUOTA", Path: "/app"})
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/app/c", Value: "123456789"}); resp.Error != "" {
+		t.Errorf("CREATE without a quota failed: %s", resp.Error)
+	}
+}
+
+func TestQuotaNodes(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/app"})
+	db.Apply(&DBCommand{Command: "SET_QUOTA", Path: "/app", Quota: &Quota{MaxNodes: 3}})
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/app/a/b"}); resp.Error != "" {
+		t.Errorf("CREATE within the node quota failed: %s", resp.Error)
+	}
+	// the missing parents count too
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/app/c/d"}); resp.Error != ErrQuotaExceeded.Error() {
+		t.Errorf("CREATE over the node quota returned %q", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/app/a/c"}); resp.Error != "" {
+		t.Errorf("CREATE up to the node quota failed: %s", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "COPY", Path: "/app/a", Target: "/app/z", Flags: WITH_SUBTREE}); resp.Error != ErrQuotaExceeded.Error() {
+		t.Errorf("COPY over the node quota returned %q", resp.Error)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/teams/a"})
+	quota := &Quota{MaxNodes: 2, MaxBytes: 5}
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Root: "/teams/a", Path: "/x", Value: "123", TenantQuota: quota}); resp.Error != "" {
+		t.Errorf("CREATE within the tenant's quota failed: %s", resp.Error)
+	}
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Root: "/teams/a", Path: "/y", Value: "123", TenantQuota: quota}); resp.Error != ErrQuotaExceeded.Error() {
+		t.Errorf("CREATE over the tenant's byte quota returned %q", resp.Error)
+	}
+	// MULTI's operations are held to it too
+	multi := &DBCommand{Command: "MULTI", Root: "/teams/a", TenantQuota: quota, Ops: []*DBCommand{
+		{Command: "CREATE", Path: "/y"},
+		{Command: "CREATE", Path: "/z"},
+	}}
+	if resp := db.Apply(multi); resp.Error == "" {
+		t.Errorf("Expected a MULTI over the tenant's node quota to fail")
+	}
+	// the quota's only on the command, not the tree
+	if resp := db.Apply(&DBCommand{Command: "CREATE", Path: "/teams/a/y", Value: "123"}); resp.Error != "" {
+		t.Errorf("CREATE without the tenant's quota failed: %s", resp.Error)
+	}
+}
@@ -0,0 +1,141 @@
+package phatdb
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrSessionExpired    = errors.New("session has expired")
+	ErrSessionNotExpired = errors.New("session hasn't expired")
+)
+
+// SessionLease is an open session's timeout, kept on the root (see OPEN_SESSION): if the
+// session isn't renewed for Timeout, it's expired like a CLOSE_SESSION
+type SessionLease struct {
+	Timeout time.Duration
+	Renewed time.Time
+}
+
+func (l SessionLease) expired(now time.Time) bool {
+	return !l.Renewed.Add(l.Timeout).After(now)
+}
+
+// SessionInfo is what the tree holds on a session's behalf, as SESSION replies
+type SessionInfo struct {
+	Session   string
+	Ephemeral []string      // the ephemeral nodes it owns
+	Locks     []string      // the nodes whose locks it holds
+	Timeout   time.Duration // 0 if it was never opened with OPEN_SESSION
+}
+
+// openSession starts (or renews) a session that expires after timeout without a renewal
+func openSession(root *FileNode, session string, timeout time.Duration, now time.Time) error {
+	if session == "" {
+		return ErrNoSession
+	}
+	if root.Sessions == nil {
+		root.Sessions = make(map[string]SessionLease)
+	}
+	root.Sessions[session] = SessionLease{Timeout: timeout, Renewed: now}
+	sessionsChanged(root)
+	return nil
+}
+
+// sessionsChanged clears the root's digest, which covers the session table. No node
+// has changed, so nothing else needs to hear of it
+func sessionsChanged(root *FileNode) {
+	root.hash = nil
+}
+
+// renewSession puts off the session's expiry, as of now
+func renewSession(root *FileNode, session string, now time.Time) error {
+	lease, ok := root.Sessions[session]
+	if !ok {
+		return ErrSessionExpired
+	}
+	lease.Renewed = now
+	root.Sessions[session] = lease
+	sessionsChanged(root)
+	return nil
+}
+
+// renewSessions renews every session as of now, for a new master: clients can't renew
+// while there isn't one, so that time mustn't count against them
+func renewSessions(root *FileNode, now time.Time) {
+	for session, lease := range root.Sessions {
+		lease.Renewed = now
+		root.Sessions[session] = lease
+	}
+	sessionsChanged(root)
+}
+
+// expiredSessions returns the sessions that are due to expire as of now
+func expiredSessions(root *FileNode, now time.Time) []string {
+	expired := []string{}
+	for session, lease := range root.Sessions {
+		if lease.expired(now) {
+			expired = append(expired, session)
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
+
+// closeSession ends a session, deleting its ephemeral nodes and releasing its locks. It
+// returns the nodes it deleted
+func closeSession(root *FileNode, session string) []string {
+	if _, ok := root.Sessions[session]; ok {
+		delete(root.Sessions, session)
+		sessionsChanged(root)
+	}
+	if _, ok := root.Identities[session]; ok {
+		delete(root.Identities, session)
+		delete(root.AuthTokens, session)
+		sessionsChanged(root)
+	}
+	deleted := deleteSessionNodes(root, session)
+	for _, path := range releaseSessionLocks(root, session) {
+		touchPath(root, path)
+	}
+	return deleted
+}
+
+// expireSession is closeSession for a session that's expired as of now
+func expireSession(root *FileNode, session string, now time.Time) ([]string, error) {
+	lease, ok := root.Sessions[session]
+	if !ok {
+		return nil, ErrSessionExpired
+	}
+	if !lease.expired(now) {
+		return nil, ErrSessionNotExpired
+	}
+	return closeSession(root, session), nil
+}
+
+// sessionInfo finds what the tree holds for session
+func sessionInfo(root *FileNode, session string) SessionInfo {
+	info := SessionInfo{Session: session, Ephemeral: []string{}, Locks: []string{}}
+	if session == "" {
+		return info
+	}
+	info.Timeout = root.Sessions[session].Timeout
+	var walk func(n *FileNode, path string)
+	walk = func(n *FileNode, path string) {
+		for name, child := range n.Children {
+			childPath := path + "/" + name
+			if child.Data.Stats.EphemeralOwner == session {
+				info.Ephemeral = append(info.Ephemeral, childPath)
+			}
+			if child.Data.Stats.LockHolder == session {
+				info.Locks = append(info.Locks, childPath)
+			}
+			walk(child, childPath)
+		}
+	}
+	walk(root, "")
+	sort.Strings(info.Ephemeral)
+	sort.Strings(info.Locks)
+	return info
+}
@@ -0,0 +1,64 @@
+package phatdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionInfo(t *testing.T) {
+	db := NewDatabase()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/app/members/b", Flags: EPHEMERAL, Session: "s1"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/app/members/a", Flags: EPHEMERAL, Session: "s1"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/other", Flags: EPHEMERAL, Session: "s2"})
+	db.Apply(&DBCommand{Command: "LOCK", Path: "/app", Session: "s1"})
+	//
+	resp := db.Apply(&DBCommand{Command: "SESSION", Session: "s1"})
+	info := resp.Reply.(SessionInfo)
+	if resp.Error != "" || len(info.Ephemeral) != 2 || info.Ephemeral[0] != "/app/members/a" || len(info.Locks) != 1 || info.Locks[0] != "/app" {
+		t.Errorf("SESSION returned %#v", resp)
+	}
+	// seen from inside a root
+	resp = db.Apply(&DBCommand{Command: "SESSION", Session: "s1", Root: "/app/members"})
+	info = resp.Reply.(SessionInfo)
+	if len(info.Ephemeral) != 2 || info.Ephemeral[1] != "/b" || len(info.Locks) != 0 {
+		t.Errorf("SESSION under a root returned %#v", info)
+	}
+	db.Apply(&DBCommand{Command: "CLOSE_SESSION", Session: "s1"})
+	if info := db.Apply(&DBCommand{Command: "SESSION", Session: "s1"}).Reply.(SessionInfo); len(info.Ephemeral) != 0 || len(info.Locks) != 0 {
+		t.Errorf("SESSION after CLOSE_SESSION returned %#v", info)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	db := NewDatabase()
+	start := time.Now()
+	at := func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	if resp := db.Apply(&DBCommand{Command: "OPEN_SESSION", Session: "s1", TTL: 10 * time.Second, Time: at(0)}); resp.Error != "" {
+		t.Fatalf("OPEN_SESSION failed: %s", resp.Error)
+	}
+	db.Apply(&DBCommand{Command: "OPEN_SESSION", Session: "s2", TTL: 10 * time.Second, Time: at(0)})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/members/a", Flags: EPHEMERAL, Session: "s1"})
+	db.Apply(&DBCommand{Command: "KEEPALIVE", Session: "s1", Time: at(5)})
+	if info := db.Apply(&DBCommand{Command: "SESSION", Session: "s1"}).Reply.(SessionInfo); info.Timeout != 10*time.Second {
+		t.Errorf("Expected SESSION to report the timeout, got %#v", info)
+	}
+	expired := db.Apply(&DBCommand{Command: "EXPIRED_SESSIONS", Time: at(12)}).Reply.([]string)
+	if len(expired) != 1 || expired[0] != "s2" {
+		t.Errorf("Expected only s2 to have expired, got %v", expired)
+	}
+	if resp := db.Apply(&DBCommand{Command: "EXPIRE_SESSION", Session: "s1", Time: at(12)}); resp.Error != ErrSessionNotExpired.Error() {
+		t.Errorf("Expected s1 not to be expired yet, got %#v", resp)
+	}
+	// a new master gives everyone a fresh start
+	db.Apply(&DBCommand{Command: "RENEW_SESSIONS", Time: at(20)})
+	if expired := db.Apply(&DBCommand{Command: "EXPIRED_SESSIONS", Time: at(25)}).Reply.([]string); len(expired) != 0 {
+		t.Errorf("Expected the sessions to have been renewed, got %v", expired)
+	}
+	resp := db.Apply(&DBCommand{Command: "EXPIRE_SESSION", Session: "s1", Time: at(30)})
+	if deleted, _ := resp.Reply.([]string); resp.Error != "" || len(deleted) != 1 || deleted[0] != "/members/a" {
+		t.Errorf("Expected expiring s1 to delete /members/a, got %#v", resp)
+	}
+	if resp := db.Apply(&DBCommand{Command: "KEEPALIVE", Session: "s1", Time: at(31)}); resp.Error != ErrSessionExpired.Error() {
+		t.Errorf("Expected renewing an expired session to fail, got %#v", resp)
+	}
+}
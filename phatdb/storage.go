@@ -0,0 +1,142 @@
+package phatdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// how many journaled commands before the tree gets checkpointed
+const CHECKPOINT_FREQ = 1000
+
+// Storage persists the tree, so a restarted replica can rebuild it locally
+type Storage interface {
+	// Load returns the last checkpointed tree (nil if there isn't one) and the
+	// commands applied since, which need to be replayed on top of it
+	Load() (*FileNode, []*DBCommand, error)
+	// Append records a command that has been applied to the tree
+	Append(cmd *DBCommand) error
+	// Checkpoint persists the whole tree, after which the journaled commands aren't needed
+	Checkpoint(root *FileNode) error
+	Close() error
+}
+
+// MemoryStorage doesn't persist anything: the tree only lives in memory
+type MemoryStorage struct{}
+
+func (MemoryStorage) Load() (*FileNode, []*DBCommand, error) { return nil, nil, nil }
+func (MemoryStorage) Append(cmd *DBCommand) error            { return nil }
+func (MemoryStorage) Checkpoint(root *FileNode) error        { return nil }
+func (MemoryStorage) Close() error                           { return nil }
+
+// DiskStorage keeps a checkpoint of the tree plus an append-only journal of the
+// commands applied since, both in Dir
+type DiskStorage struct {
+	Dir     string
+	journal *os.File
+}
+
+func NewDiskStorage(dir string) (*DiskStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &DiskStorage{Dir: dir}
+	var err error
+	d.journal, err = os.OpenFile(d.journalFile(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DiskStorage) checkpointFile() string {
+	return filepath.Join(d.Dir, "tree.snap")
+}
+
+func (d *DiskStorage) journalFile() string {
+	return filepath.Join(d.Dir, "journal.bin")
+}
+
+func (d *DiskStorage) Load() (*FileNode, []*DBCommand, error) {
+	var root *FileNode
+	data, err := ioutil.ReadFile(d.checkpointFile())
+	if err == nil {
+		if root, err = RestoreTree(data); err != nil {
+			return nil, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	data, err = ioutil.ReadFile(d.journalFile())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	var cmds []*DBCommand
+	// each entry is a 4 byte length followed by the gob encoded command
+	for len(data) >= 4 {
+		length := int(binary.LittleEndian.Uint32(data[:4]))
+		data = data[4:]
+		if length > len(data) {
+			// torn write at the end of the journal, the command never finished
+			break
+		}
+		cmd := new(DBCommand)
+		if err := gob.NewDecoder(bytes.NewBuffer(data[:length])).Decode(cmd); err != nil {
+			return nil, nil, err
+		}
+		cmds = append(cmds, cmd)
+		data = data[length:]
+	}
+	return root, cmds, nil
+}
+
+func (d *DiskStorage) Append(cmd *DBCommand) error {
+	var entry bytes.Buffer
+	if err := gob.NewEncoder(&entry).Encode(cmd); err != nil {
+		return err
+	}
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(entry.Len()))
+	if _, err := d.journal.Write(append(length, entry.Bytes()...)); err != nil {
+		return err
+	}
+	return d.journal.Sync()
+}
+
+func (d *DiskStorage) Checkpoint(root *FileNode) error {
+	// write to a temp file and move it into place, so the checkpoint is replaced atomically
+	tmpfile := d.checkpointFile() + ".tmp"
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, err := SerializeTree(root)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpfile, d.checkpointFile()); err != nil {
+		return err
+	}
+	// everything in the journal is in the checkpoint now
+	if err = d.journal.Truncate(0); err != nil {
+		return err
+	}
+	_, err = d.journal.Seek(0, io.SeekStart)
+	return err
+}
+
+func (d *DiskStorage) Close() error {
+	return d.journal.Close()
+}
@@ -0,0 +1,144 @@
+package phatdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phatdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//
+	store, err := NewDiskStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDatabase(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/dev/null", Value: "empty"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/dev/random", Value: "4"})
+	// Checkpoint, then keep going so we need both the checkpoint and the journal
+	store.Checkpoint(db.Root)
+	db.Apply(&DBCommand{Command: "SET", Path: "/dev/null", Value: "nothing"})
+	db.Apply(&DBCommand{Command: "DELETE", Path: "/dev/random"})
+	// Failed commands and reads aren't journaled
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/dev/null", Value: "again"})
+	db.Apply(&DBCommand{Command: "GET", Path: "/dev/null"})
+	expected := hashNode(db.Root)
+	store.Close()
+	//
+	store, err = NewDiskStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, cmds, _ := store.Load(); len(cmds) != 2 {
+		t.Errorf("Expected 2 journaled commands, got %d", len(cmds))
+	}
+	restarted, err := OpenDatabase(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashNode(restarted.Root) != expected {
+		t.Errorf("Reopened database is %v, expected %v", hashNode(restarted.Root), expected)
+	}
+	// The checkpointed tree should be usable as normal
+	if resp := restarted.Apply(&DBCommand{Command: "CREATE", Path: "/dev/null/child", Value: "x"}); resp.Error != "" {
+		t.Errorf("CREATE on the reopened database failed: %s", resp.Error)
+	}
+	if resp := restarted.Apply(&DBCommand{Command: "SET", Path: "/dev", Value: "x"}); resp.Error != "" {
+		t.Errorf("SET on the reopened database failed: %s", resp.Error)
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phatdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//
+	store, err := NewDiskStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDatabase(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := make(chan DBCommandWithChannel, 2)
+	stopped := make(chan bool)
+	go func() {
+		db.Serve(input)
+		stopped <- true
+	}()
+	// Commands queued before the close still get run
+	create := DBCommandWithChannel{&DBCommand{Command: "CREATE", Path: "/dev/null", Value: "empty"}, make(chan *DBResponse, 1)}
+	input <- create
+	close(input)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Serve didn't return after its input was closed")
+	}
+	if resp := <-create.Done; resp.Error != "" {
+		t.Errorf("Queued CREATE failed: %s", resp.Error)
+	}
+	// Shutting down checkpointed the tree, so there's nothing left to replay
+	store, err = NewDiskStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	root, cmds, err := store.Load()
+	if err != nil || len(cmds) != 0 || hashNode(root) != hashNode(db.Root) {
+		t.Errorf("Shutdown didn't checkpoint: %d commands to replay (err: %v)", len(cmds), err)
+	}
+}
+
+func TestReplayedOps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "phatdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//
+	store, err := NewDiskStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDatabase(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/counter", Value: "0", OpNumber: 1})
+	db.Apply(&DBCommand{Command: "INCR", Path: "/counter", Delta: 1, OpNumber: 2})
+	store.Checkpoint(db.Root)
+	db.Apply(&DBCommand{Command: "INCR", Path: "/counter", Delta: 1, OpNumber: 3})
+	store.Close()
+	//
+	store, err = NewDiskStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	restarted, err := OpenDatabase(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// VR replays its whole log, but only what's newer than the checkpoint and journal
+	// counts
+	for op := uint64(2); op <= 4; op++ {
+		restarted.Apply(&DBCommand{Command: "INCR", Path: "/counter", Delta: 1, OpNumber: op})
+	}
+	if resp := restarted.Apply(&DBCommand{Command: "GET", Path: "/counter"}); resp.Error != "" || string(resp.Reply.(*DataNode).Value) != "3" {
+		t.Errorf("Expected the counter to be 3, got %v", resp)
+	}
+}
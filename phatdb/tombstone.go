@@ -0,0 +1,63 @@
+package phatdb
+
+import (
+	"sort"
+	"time"
+)
+
+// how long the master keeps tombstones around before replicating a PURGE_TOMBSTONES
+var TombstoneRetention = time.Hour
+
+// Tombstone records that a node was deleted, so watches and session cleanup can still
+// find out about it after the node itself is gone. A recursive delete leaves a single
+// tombstone, for the top of the subtree
+type Tombstone struct {
+	Path     string
+	Command  string    // the command that deleted it
+	Deleted  time.Time // the command's Time
+	DeleteOp uint64    // the command's OpNumber
+}
+
+// recordTombstones notes which of the paths a write touched are now gone (and forgets the
+// tombstones of the ones that are back)
+func recordTombstones(root *FileNode, req *DBCommand, paths []string) {
+	for _, path := range paths {
+		path = cleanPath(path)
+		if exists, _ := existsNode(root, path); exists {
+			delete(root.Tombstones, path)
+			continue
+		}
+		if root.Tombstones == nil {
+			root.Tombstones = make(map[string]Tombstone)
+		}
+		root.Tombstones[path] = Tombstone{Path: path, Command: req.Command, Deleted: req.Time, DeleteOp: req.OpNumber}
+	}
+}
+
+// getTombstones returns the tombstones at or under path, sorted by path
+func getTombstones(root *FileNode, path string) []Tombstone {
+	path = cleanPath(path)
+	stones := []Tombstone{}
+	for p, stone := range root.Tombstones {
+		if under(p, path) {
+			stones = append(stones, stone)
+		}
+	}
+	sort.Slice(stones, func(i, j int) bool { return stones[i].Path < stones[j].Path })
+	return stones
+}
+
+// purgeTombstones removes the tombstones of nodes deleted before cutoff, returning their
+// paths. The master picks the cutoff (see TombstoneRetention), so every replica purges
+// the same ones
+func purgeTombstones(root *FileNode, cutoff time.Time) []string {
+	purged := []string{}
+	for path, stone := range root.Tombstones {
+		if stone.Deleted.Before(cutoff) {
+			delete(root.Tombstones, path)
+			purged = append(purged, path)
+		}
+	}
+	sort.Strings(purged)
+	return purged
+}
@@ -0,0 +1,48 @@
+package phatdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTombstones(t *testing.T) {
+	db := NewDatabase()
+	start := time.Now()
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/a", Value: ""})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/a/b", Value: ""})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/c", Value: "", Flags: EPHEMERAL, Session: "s1"})
+	db.Apply(&DBCommand{Command: "DELETE", Path: "/a/b", Time: start, OpNumber: 4})
+	db.Apply(&DBCommand{Command: "CLOSE_SESSION", Session: "s1", Time: start.Add(time.Minute)})
+	stones := db.Apply(&DBCommand{Command: "TOMBSTONES", Path: "/"}).Reply.([]Tombstone)
+	if len(stones) != 2 || stones[0].Path != "/a/b" || stones[1].Path != "/c" {
+		t.Fatalf("Expected tombstones for /a/b and /c, got %v", stones)
+	}
+	if stones[0].Command != "DELETE" || !stones[0].Deleted.Equal(start) || stones[0].DeleteOp != 4 {
+		t.Errorf("Tombstone for /a/b is %#v", stones[0])
+	}
+	if stones := getTombstones(db.Root, "/a"); len(stones) != 1 {
+		t.Errorf("Expected 1 tombstone under /a, got %v", stones)
+	}
+	// Recreating a node removes its tombstone
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/a/b", Value: ""})
+	if stones := getTombstones(db.Root, "/a"); len(stones) != 0 {
+		t.Errorf("Recreated node still has tombstone %v", stones)
+	}
+	// MULTI deletes leave them too, and rolled back ones don't
+	db.Apply(&DBCommand{Command: "MULTI", Ops: []*DBCommand{{Command: "DELETE", Path: "/a/b"}, {Command: "DELETE", Path: "/missing"}}})
+	if stones := getTombstones(db.Root, "/a"); len(stones) != 0 {
+		t.Errorf("Failed MULTI left tombstones %v", stones)
+	}
+	db.Apply(&DBCommand{Command: "MULTI", Ops: []*DBCommand{{Command: "DELETE", Path: "/a/b"}}})
+	if stones := getTombstones(db.Root, "/a"); len(stones) != 1 || stones[0].Command != "DELETE" {
+		t.Errorf("MULTI left tombstones %v", stones)
+	}
+	// Purging only removes the old ones
+	resp := db.Apply(&DBCommand{Command: "PURGE_TOMBSTONES", Time: start.Add(time.Second), Auth: []Identity{Admin}})
+	if purged := resp.Reply.([]string); len(purged) != 1 || purged[0] != "/a/b" {
+		t.Errorf("PURGE_TOMBSTONES purged %v", purged)
+	}
+	if stones := getTombstones(db.Root, "/"); len(stones) != 1 || stones[0].Path != "/c" {
+		t.Errorf("Expected only /c's tombstone left, got %v", stones)
+	}
+}
@@ -0,0 +1,76 @@
+package phatdb
+
+import (
+	"strings"
+	"sync"
+)
+
+// Change describes a write to a node, for triggers
+type Change struct {
+	Command string
+	Path    string
+}
+
+type trigger struct {
+	prefix string
+	f      func(Change)
+}
+
+// triggers are the callbacks registered with OnChange
+type triggers struct {
+	lock   sync.Mutex
+	nextId int
+	byId   map[int]trigger
+}
+
+// OnChange registers f to be called for every successful write to prefix or anything
+// under it, until the returned cancel function is called. f runs on the database's own
+// goroutine right after the write, so it mustn't block or send commands to the database
+// (hand the change off to another goroutine for that)
+func (db *Database) OnChange(prefix string, f func(Change)) (cancel func()) {
+	t := &db.triggers
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.byId == nil {
+		t.byId = make(map[int]trigger)
+	}
+	id := t.nextId
+	t.nextId++
+	t.byId[id] = trigger{prefix: cleanPath(prefix), f: f}
+	return func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		delete(t.byId, id)
+	}
+}
+
+// cleanPath returns path with a single leading slash and no trailing one
+func cleanPath(path string) string {
+	return "/" + strings.Join(GetNodePath(path), "/")
+}
+
+// under returns whether path is prefix or in its subtree
+func under(path string, prefix string) bool {
+	return prefix == "/" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// fire calls the triggers for the paths a write changed
+func (t *triggers) fire(req *DBCommand, resp *DBResponse) {
+	t.lock.Lock()
+	var matching []func(Change)
+	var changes []Change
+	for _, path := range touchedPaths(req, resp) {
+		path = cleanPath(path)
+		for _, trig := range t.byId {
+			if under(path, trig.prefix) {
+				matching = append(matching, trig.f)
+				changes = append(changes, Change{Command: req.Command, Path: path})
+			}
+		}
+	}
+	t.lock.Unlock()
+	// don't hold the lock, so triggers can cancel themselves
+	for i, f := range matching {
+		f(changes[i])
+	}
+}
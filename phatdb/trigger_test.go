@@ -0,0 +1,37 @@
+package phatdb
+
+import (
+	"testing"
+)
+
+func TestTriggers(t *testing.T) {
+	db := NewDatabase()
+	var changes []Change
+	cancel := db.OnChange("/config/", func(c Change) {
+		changes = append(changes, c)
+	})
+	//
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/config/db", Value: "1"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/configuration", Value: "x"})
+	db.Apply(&DBCommand{Command: "GET", Path: "/config/db"})
+	db.Apply(&DBCommand{Command: "SET", Path: "/config/missing", Value: "x"})
+	db.Apply(&DBCommand{Command: "MULTI", Ops: []*DBCommand{
+		{Command: "CREATE_SEQ", Path: "/config/item-"},
+		{Command: "CREATE", Path: "/other", Value: "y"},
+	}})
+	// Only successful writes under /config fire, with the paths they actually changed
+	expected := []Change{{"CREATE", "/config/db"}, {"MULTI", "/config/item-0000000000"}}
+	if len(changes) != len(expected) {
+		t.Fatalf("Triggers fired for %v, expected %v", changes, expected)
+	}
+	for i := range changes {
+		if changes[i] != expected[i] {
+			t.Errorf("Trigger %d fired for %v, expected %v", i, changes[i], expected[i])
+		}
+	}
+	cancel()
+	db.Apply(&DBCommand{Command: "SET", Path: "/config/db", Value: "2"})
+	if len(changes) != len(expected) {
+		t.Errorf("Cancelled trigger still fired for %v", changes[len(changes)-1])
+	}
+}
@@ -0,0 +1,148 @@
+package phatdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// Validator checks a value about to be written to path, returning why it's invalid
+type Validator func(path string, value []byte) error
+
+type validator struct {
+	prefix string
+	v      Validator
+}
+
+type validators struct {
+	lock   sync.Mutex
+	nextId int
+	byId   map[int]validator
+}
+
+// AddValidator makes every write of a value to prefix or anything under it go through v
+// first (until the returned cancel function is called). Writes v rejects fail without
+// changing anything. Validators are only checked by Validate, which servers call before
+// replicating a write, so it's the validators on the server that takes it that count
+func (db *Database) AddValidator(prefix string, v Validator) (cancel func()) {
+	vs := db.validators
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	id := vs.nextId
+	vs.nextId++
+	vs.byId[id] = validator{prefix: cleanPath(prefix), v: v}
+	return func() {
+		vs.lock.Lock()
+		defer vs.lock.Unlock()
+		delete(vs.byId, id)
+	}
+}
+
+func newValidators() *validators {
+	return &validators{byId: make(map[int]validator)}
+}
+
+// Validate returns why a value req would write is invalid (see AddValidator), as the
+// tree stands. It's not run when commands are applied, since every replica would have to
+// have the same validators: servers call it before replicating them instead. It can be
+// called while Serve is running
+func (db *Database) Validate(req *DBCommand) error {
+	req = chrootCommand(req)
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.validators.check(db.Root, req)
+}
+
+// check runs the validators for the values req would write
+func (vs *validators) check(root *FileNode, req *DBCommand) error {
+	value := []byte(req.Value)
+	if req.Flags&COMPRESSED != 0 {
+		val, err := decompressValue(value)
+		if err != nil {
+			// the command itself reports the bad value
+			return nil
+		}
+		value = val
+	}
+	switch req.Command {
+	case "CREATE", "CREATE_SEQ", "SET", "SET_VERSION", "GETSET":
+		return vs.checkValue(req.Path, value)
+	case "APPEND":
+		n, err := traverseToData(root, req.Path)
+		if err != nil {
+			// the command itself reports the missing node
+			return nil
+		}
+		return vs.checkValue(req.Path, append(append([]byte(nil), plainValue(n.Data)...), value...))
+	case "COPY", "MOVE":
+		// the values don't change, but they end up somewhere else
+		n, err := traverseToNode(root, GetNodePath(req.Path), false)
+		if err != nil {
+			return nil
+		}
+		return vs.checkTree(n, cleanPath(req.Target), req.Flags&WITH_SUBTREE != 0)
+	case "MULTI":
+		for _, op := range req.Ops {
+			if err := vs.check(root, op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkTree runs the validators for n's value as if it were at path, and with subtree,
+// for its descendants' too
+func (vs *validators) checkTree(n *FileNode, path string, subtree bool) error {
+	if n.Data != nil {
+		if err := vs.checkValue(path, plainValue(n.Data)); err != nil {
+			return err
+		}
+	}
+	if !subtree {
+		return nil
+	}
+	for name, child := range n.Children {
+		if err := vs.checkTree(child, path+"/"+name, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkValue runs the validators for value being written to path
+func (vs *validators) checkValue(path string, value []byte) error {
+	path = cleanPath(path)
+	vs.lock.Lock()
+	var matching []Validator
+	for _, v := range vs.byId {
+		if under(path, v.prefix) {
+			matching = append(matching, v.v)
+		}
+	}
+	vs.lock.Unlock()
+	for _, v := range matching {
+		if err := v(path, value); err != nil {
+			return fmt.Errorf("invalid value for %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// ValidJSON is a Validator for values that must be JSON
+func ValidJSON(path string, value []byte) error {
+	if !json.Valid(value) {
+		return errors.New("not valid JSON")
+	}
+	return nil
+}
+
+// ValidInteger is a Validator for values that must be (decimal) integers
+func ValidInteger(path string, value []byte) error {
+	if _, err := strconv.ParseInt(string(value), 10, 64); err != nil {
+		return errors.New("not an integer")
+	}
+	return nil
+}
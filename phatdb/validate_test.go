@@ -0,0 +1,60 @@
+package phatdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidators(t *testing.T) {
+	db := NewDatabase()
+	db.AddValidator("/config/json", ValidJSON)
+	cancel := db.AddValidator("/limits", ValidInteger)
+	//
+	if err := db.Validate(&DBCommand{Command: "CREATE", Path: "/config/json/app", Value: `{"port": 80}`}); err != nil {
+		t.Errorf("CREATE of valid JSON was turned away: %s", err)
+	}
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/config/json/app", Value: `{"port": 80}`})
+	err := db.Validate(&DBCommand{Command: "SET", Path: "/config/json/app", Value: `{"port": `})
+	if err == nil || !strings.Contains(err.Error(), "not valid JSON") {
+		t.Errorf("SET of invalid JSON returned %v", err)
+	}
+	// ... even under a root
+	if err := db.Validate(&DBCommand{Command: "SET", Root: "/config", Path: "/json/app", Value: "{"}); err == nil {
+		t.Errorf("Chrooted SET of invalid JSON should be turned away")
+	}
+	// Other subtrees aren't affected
+	if err := db.Validate(&DBCommand{Command: "CREATE", Path: "/config/jsonish", Value: "{"}); err != nil {
+		t.Errorf("CREATE outside the validated subtree was turned away: %s", err)
+	}
+	// APPENDs are checked on the value they'd leave behind
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/limits/max", Value: "10"})
+	if err := db.Validate(&DBCommand{Command: "APPEND", Path: "/limits/max", Value: "0"}); err != nil {
+		t.Errorf("APPEND leaving an integer was turned away: %s", err)
+	}
+	if err := db.Validate(&DBCommand{Command: "APPEND", Path: "/limits/max", Value: "x"}); err == nil {
+		t.Errorf("APPEND leaving a non-integer should be turned away")
+	}
+	// ... including inside a MULTI
+	multi := &DBCommand{Command: "MULTI", Ops: []*DBCommand{{Command: "SET", Path: "/limits/max", Value: "lots"}}}
+	if err := db.Validate(multi); err == nil {
+		t.Errorf("MULTI with an invalid SET should be turned away")
+	}
+	// COPY and MOVE are checked on where the values end up, subtree and all
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/drafts/max", Value: "lots"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/drafts/max/min", Value: "1"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/drafts/min", Value: "1"})
+	db.Apply(&DBCommand{Command: "CREATE", Path: "/drafts/min/max", Value: "lots"})
+	if err := db.Validate(&DBCommand{Command: "COPY", Path: "/drafts/max", Target: "/limits/other"}); err == nil {
+		t.Errorf("COPY of a non-integer into /limits should be turned away")
+	}
+	if err := db.Validate(&DBCommand{Command: "COPY", Path: "/drafts/min", Target: "/limits/min"}); err != nil {
+		t.Errorf("COPY of an integer into /limits was turned away: %s", err)
+	}
+	if err := db.Validate(&DBCommand{Command: "MOVE", Path: "/drafts/min", Target: "/limits/min", Flags: WITH_SUBTREE}); err == nil {
+		t.Errorf("MOVE of a subtree with a non-integer into /limits should be turned away")
+	}
+	cancel()
+	if err := db.Validate(&DBCommand{Command: "SET", Path: "/limits/max", Value: "lots"}); err != nil {
+		t.Errorf("SET after removing the validator was turned away: %s", err)
+	}
+}
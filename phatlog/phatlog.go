@@ -5,9 +5,20 @@ import (
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"reflect"
+	"sort"
+	"sync"
 )
 
+// when set, adding a conflicting command panics instead of returning an error
+// (useful while debugging, since a conflict means the replicas have diverged)
+var PanicOnConflict = false
+
+var ErrConflict = errors.New("conflicting command already in log")
+
 //dummy struct for testing, replace once we get an idea
 //of what this will look like
 type Command struct {
@@ -16,9 +27,19 @@ type Command struct {
 
 //is map the best choice here?
 type Log struct {
-	Commits  map[uint]interface{}
-	MaxIndex uint // highest seen index
-    MinIndex uint // lower bound of the log. Log contains entries i, MinIndex < i <= MaxIndex
+	Commits   map[uint]interface{}
+	Checksums map[uint]string // sha256 of each entry, taken when it was added
+	MaxIndex  uint            // highest seen index
+	MinIndex  uint            // lower bound of the log. Log contains entries i, MinIndex < i <= MaxIndex
+	// guards Commits and Checksums, which a repair changes while commits go on
+	lock sync.Mutex
+}
+
+// a single log entry along with its checksum, e.g. for sending to another replica
+type Entry struct {
+	Index    uint
+	Command  interface{}
+	Checksum string
 }
 
 //no builtin int max function??
@@ -32,25 +53,146 @@ func Max(a, b uint) uint {
 func EmptyLog() *Log {
 	l := new(Log)
 	l.Commits = make(map[uint]interface{})
+	l.Checksums = make(map[uint]string)
 	return l
 }
 
-func (l *Log) Add(index uint, command interface{}) {
-	//should we check if this has already been commited to log?
-	//in practice this would not matter, but might be useful
-	//for debugging
+// Checksum hashes the gob encoding of a command
+func Checksum(command interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(command); err != nil {
+		return "", err
+	}
+	md := sha256.Sum256(buf.Bytes())
+	return hex.EncodeToString(md[:]), nil
+}
+
+// Add puts command at the given index. Re-adding an identical command is a no-op,
+// but a different command at an already filled index is a protocol bug, so it
+// is reported (or panics if PanicOnConflict is set) rather than overwritten
+func (l *Log) Add(index uint, command interface{}) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if old, exists := l.Commits[index]; exists {
+		if reflect.DeepEqual(old, command) {
+			return nil
+		}
+		err := fmt.Errorf("%w at index %d: have %+v, got %+v", ErrConflict, index, old, command)
+		if PanicOnConflict {
+			panic(err)
+		}
+		return err
+	}
 	l.Commits[index] = command
+	l.setChecksum(index)
 	l.MaxIndex = Max(l.MaxIndex, index)
+	return nil
+}
+
+func (l *Log) setChecksum(index uint) {
+	if l.Checksums == nil {
+		l.Checksums = make(map[uint]string)
+	}
+	// commands that can't be encoded just don't get checked
+	sum, err := Checksum(l.Commits[index])
+	if err != nil {
+		delete(l.Checksums, index)
+		return
+	}
+	l.Checksums[index] = sum
+}
+
+// VerifyEntry returns false if the entry at index no longer matches its checksum
+func (l *Log) VerifyEntry(index uint) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.verifyEntry(index)
+}
+
+func (l *Log) verifyEntry(index uint) bool {
+	expected, ok := l.Checksums[index]
+	if !ok {
+		return true
+	}
+	sum, err := Checksum(l.Commits[index])
+	return err == nil && sum == expected
+}
+
+// Verify returns the (sorted) indices of all corrupted entries
+func (l *Log) Verify() []uint {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var corrupt []uint
+	for index := range l.Commits {
+		if !l.verifyEntry(index) {
+			corrupt = append(corrupt, index)
+		}
+	}
+	sort.Sort(byIndex(corrupt))
+	return corrupt
+}
 
+func (l *Log) Entry(index uint) Entry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return Entry{index, l.Commits[index], l.Checksums[index]}
 }
 
+// Replace overwrites an entry (e.g. a corrupted one) with a copy from another replica.
+// The copy has to match its own checksum, otherwise we'd just swap one bad entry for another
+func (l *Log) Replace(e Entry) error {
+	sum, err := Checksum(e.Command)
+	if err != nil {
+		return err
+	}
+	if sum != e.Checksum {
+		return fmt.Errorf("entry %d doesn't match its checksum", e.Index)
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.Commits[e.Index] = e.Command
+	l.Checksums[e.Index] = sum
+	l.MaxIndex = Max(l.MaxIndex, e.Index)
+	return nil
+}
+
+// Repair replaces corrupted entries with ones fetched from a healthy peer.
+// fetch is given the corrupted indices and returns whatever entries it could get. It's
+// called without the log locked, so the log can be used while it waits on the peers.
+// Returns the indices that are still corrupted
+func (l *Log) Repair(fetch func(indices []uint) []Entry) []uint {
+	corrupt := l.Verify()
+	if len(corrupt) == 0 {
+		return nil
+	}
+	for _, e := range fetch(corrupt) {
+		if err := l.Replace(e); err != nil {
+			log.Printf("Couldn't repair log entry %d: %v", e.Index, err)
+		}
+	}
+	return l.Verify()
+}
+
+type byIndex []uint
+
+func (a byIndex) Len() int           { return len(a) }
+func (a byIndex) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byIndex) Less(i, j int) bool { return a[i] < a[j] }
+
 func (l *Log) Suffix(newBegin uint) *Log {
-    newLog := EmptyLog()
-    newLog.MinIndex = newBegin
-    for i := newBegin+1; i < l.MaxIndex; i++ {
-        newLog.Add(i, l.GetCommand(i))
-    }
-    return newLog
+	newLog := EmptyLog()
+	newLog.MinIndex = newBegin
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	// copy the checksums over rather than recomputing them, so corruption isn't hidden
+	for i := newBegin + 1; i < l.MaxIndex; i++ {
+		newLog.Commits[i] = l.Commits[i]
+		if sum, ok := l.Checksums[i]; ok {
+			newLog.Checksums[i] = sum
+		}
+		newLog.MaxIndex = Max(newLog.MaxIndex, i)
+	}
+	return newLog
 }
 
 func (l *Log) HasEntry(index uint) bool {
@@ -58,6 +200,8 @@ func (l *Log) HasEntry(index uint) bool {
 }
 
 func (l *Log) GetCommand(index uint) interface{} {
+	l.lock.Lock()
+	defer l.lock.Unlock()
 	return l.Commits[index]
 }
 
@@ -65,7 +209,9 @@ func (l *Log) HashLog() string {
 	var logState bytes.Buffer
 	// Encode the log state
 	enc := gob.NewEncoder(&logState)
+	l.lock.Lock()
 	err := enc.Encode(l)
+	l.lock.Unlock()
 	if err != nil {
 		log.Fatal("Cannot hash the database state")
 	}
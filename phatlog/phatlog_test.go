@@ -5,18 +5,16 @@ import (
 )
 
 func setup() *Log {
-	commitLog := &Log{}
-	commitLog.Commits = make(map[int]*Command)
-	return commitLog
+	return EmptyLog()
 }
 
 func addCommits(commitLog *Log) {
 	a := &Command{"create"}
 	b := &Command{"delete"}
 	c := &Command{"close"}
-	commitLog.commit(0, a)
-	commitLog.commit(1, b)
-	commitLog.commit(3, c)
+	commitLog.Add(0, a)
+	commitLog.Add(1, b)
+	commitLog.Add(3, c)
 
 }
 
@@ -38,8 +36,102 @@ func TestGet(t *testing.T) {
 	commitLog := setup()
 	addCommits(commitLog)
 
-	for i := 0; i < commitLog.MaxIndex+1; i++ {
-		command := commitLog.getCommit(i)
+	for i := uint(0); i < commitLog.MaxIndex+1; i++ {
+		command := commitLog.GetCommand(i)
 		t.Log("Key:", i, "Value:", command)
 	}
 }
+
+func TestAddConflict(t *testing.T) {
+	commitLog := setup()
+	addCommits(commitLog)
+
+	// re-adding the same command is fine
+	if err := commitLog.Add(1, &Command{"delete"}); err != nil {
+		t.Errorf("Re-adding an identical command failed: %v", err)
+	}
+	// but a different one at the same index isn't
+	if err := commitLog.Add(1, &Command{"create"}); err == nil {
+		t.Errorf("Conflicting Add at the same index didn't return an error")
+	}
+	if commitLog.GetCommand(1).(*Command).name != "delete" {
+		t.Errorf("Conflicting Add overwrote the existing entry")
+	}
+
+	PanicOnConflict = true
+	defer func() {
+		PanicOnConflict = false
+		if recover() == nil {
+			t.Errorf("Conflicting Add didn't panic with PanicOnConflict set")
+		}
+	}()
+	commitLog.Add(3, &Command{"create"})
+}
+
+type checkedCommand struct {
+	Name string
+}
+
+func TestVerifyAndRepair(t *testing.T) {
+	commitLog := EmptyLog()
+	healthy := EmptyLog()
+	for i, name := range []string{"create", "delete", "close"} {
+		commitLog.Add(uint(i+1), &checkedCommand{name})
+		healthy.Add(uint(i+1), &checkedCommand{name})
+	}
+	if corrupt := commitLog.Verify(); len(corrupt) != 0 {
+		t.Errorf("Fresh log reported corrupted entries %v", corrupt)
+	}
+
+	// corrupt an entry behind the log's back
+	commitLog.Commits[2].(*checkedCommand).Name = "garbage"
+	if commitLog.VerifyEntry(2) {
+		t.Errorf("VerifyEntry didn't notice the corrupted entry")
+	}
+	if corrupt := commitLog.Verify(); len(corrupt) != 1 || corrupt[0] != 2 {
+		t.Errorf("Verify returned %v, expected [2]", corrupt)
+	}
+
+	// a bad copy shouldn't be accepted
+	bad := Entry{2, &checkedCommand{"garbage"}, healthy.Checksums[2]}
+	if err := commitLog.Replace(bad); err == nil {
+		t.Errorf("Replace accepted an entry that doesn't match its checksum")
+	}
+
+	stillCorrupt := commitLog.Repair(func(indices []uint) []Entry {
+		var entries []Entry
+		for _, i := range indices {
+			entries = append(entries, healthy.Entry(i))
+		}
+		return entries
+	})
+	if len(stillCorrupt) != 0 || commitLog.GetCommand(2).(*checkedCommand).Name != "delete" {
+		t.Errorf("Repair didn't restore the corrupted entry")
+	}
+}
+
+func TestRepairConcurrently(t *testing.T) {
+	commitLog := EmptyLog()
+	healthy := EmptyLog()
+	commitLog.Add(1, &checkedCommand{"create"})
+	healthy.Add(1, &checkedCommand{"create"})
+	commitLog.Commits[1].(*checkedCommand).Name = "garbage"
+
+	// commits go on while the repair waits on the peers
+	done := make(chan []uint)
+	go func() {
+		done <- commitLog.Repair(func(indices []uint) []Entry {
+			for i := uint(2); i <= 100; i++ {
+				commitLog.Add(i, &checkedCommand{"set"})
+			}
+			return []Entry{healthy.Entry(1)}
+		})
+	}()
+	for i := uint(2); i <= 100; i++ {
+		commitLog.VerifyEntry(i)
+		commitLog.GetCommand(i)
+	}
+	if stillCorrupt := <-done; len(stillCorrupt) != 0 || commitLog.MaxIndex != 100 {
+		t.Errorf("Expected the repair and the adds to both go through, got %v (up to %d)", stillCorrupt, commitLog.MaxIndex)
+	}
+}
@@ -3,10 +3,23 @@ package phatqueue
 import "strconv"
 import "bytes"
 import "encoding/gob"
+import "sort"
+import "time"
+
+// how long a popped message stays in progress before it's redelivered, by default
+const DEFAULT_VISIBILITY_TIMEOUT = 30 * time.Second
 
 type QMessage struct {
 	MessageID string
 	Value     interface{}
+	// while it's in progress, when it'll be redelivered if it isn't done by then
+	Deadline time.Time
+	// how many times it's been redelivered after not being done in time
+	Redeliveries int
+	// when it's dropped if it hasn't been popped by then (never if zero)
+	Expires time.Time
+	// the queue it's moved to when it expires, if any
+	DeadLetterQueue string
 }
 
 type LogEntry struct {
@@ -33,8 +46,7 @@ func (mq *MessageQueue) Copy() (newmq *MessageQueue) {
     newmq = new(MessageQueue)
     newmq.Init()
 
-    // newmq.queue is initially empty so this effectively copies mq.queue to it
-    copy(newmq.Queue, mq.Queue)
+    newmq.Queue = append([]QMessage(nil), mq.Queue...)
     for k, v := range mq.InProgress {
         newmq.InProgress[k] = v
     }
@@ -42,22 +54,147 @@ func (mq *MessageQueue) Copy() (newmq *MessageQueue) {
     return
 }
 
-func (mq *MessageQueue) Push(v interface{}) {
-	qm := QMessage{strconv.Itoa(mq.NextID()), v}
+// Push adds v to the queue, returning the id of its message
+func (mq *MessageQueue) Push(v interface{}) string {
+	return mq.PushMessage(QMessage{Value: v})
+}
+
+// PushMessage adds qm to the queue with a new id, which it returns
+func (mq *MessageQueue) PushMessage(qm QMessage) string {
+	qm.MessageID = strconv.Itoa(mq.NextID())
 	mq.Queue = append(mq.Queue, qm)
+	return qm.MessageID
+}
+
+// Expire takes the messages that have expired by time now off the queue, returning them
+// in the order they were queued. Messages in progress don't expire until they're back
+// on the queue
+func (mq *MessageQueue) Expire(now time.Time) []QMessage {
+	var expired []QMessage
+	kept := mq.Queue[:0]
+	for _, qm := range mq.Queue {
+		if !qm.Expires.IsZero() && !now.Before(qm.Expires) {
+			expired = append(expired, qm)
+		} else {
+			kept = append(kept, qm)
+		}
+	}
+	mq.Queue = kept
+	return expired
 }
 
 func (mq *MessageQueue) Pop() *QMessage {
+	return mq.PopAt(time.Now(), DEFAULT_VISIBILITY_TIMEOUT)
+}
+
+// PopAt pops a message at time now (see PopArgs). It's in progress until it's done or
+// timeout passes, whichever comes first. Messages whose timeouts have passed by now are
+// put back on the queue first
+func (mq *MessageQueue) PopAt(now time.Time, timeout time.Duration) *QMessage {
+	mq.Redeliver(now)
 	if mq.Len() == 0 {
 		return nil
 	}
     var qm QMessage
     qm, mq.Queue = mq.Queue[len(mq.Queue)-1], mq.Queue[:len(mq.Queue)-1]
+	qm.Deadline = now.Add(timeout)
+	mq.InProgress[qm.MessageID] = qm
 	return &qm
 }
 
-func (mq *MessageQueue) Done(mId string) {
+// Redeliver puts the messages that are still in progress at time now back on the queue,
+// returning how many there were
+func (mq *MessageQueue) Redeliver(now time.Time) int {
+	overdue := mq.overdue(now)
+	for _, qm := range overdue {
+		delete(mq.InProgress, qm.MessageID)
+		mq.Queue = append(mq.Queue, qm)
+	}
+	return len(overdue)
+}
+
+// overdue returns the messages Redeliver would put back on the queue at time now, as
+// they'd be put back
+func (mq *MessageQueue) overdue(now time.Time) []QMessage {
+	var expired []QMessage
+	for _, qm := range mq.InProgress {
+		if now.After(qm.Deadline) {
+			expired = append(expired, qm)
+		}
+	}
+	// in the same order on every replica
+	sort.Slice(expired, func(i, j int) bool {
+		if !expired[i].Deadline.Equal(expired[j].Deadline) {
+			return expired[i].Deadline.Before(expired[j].Deadline)
+		}
+		return idLess(expired[i].MessageID, expired[j].MessageID)
+	})
+	for i := range expired {
+		expired[i].Deadline = time.Time{}
+		expired[i].Redeliveries++
+	}
+	return expired
+}
+
+// idLess orders message ids by when they were pushed
+func idLess(a, b string) bool {
+	i, _ := strconv.Atoi(a)
+	j, _ := strconv.Atoi(b)
+	return i < j
+}
+
+// Peek returns the message a pop at time now would get, without popping it, or nil if
+// there isn't one
+func (mq *MessageQueue) Peek(now time.Time) *QMessage {
+	queued := append(append([]QMessage(nil), mq.Queue...), mq.overdue(now)...)
+	for i := len(queued) - 1; i >= 0; i-- {
+		qm := queued[i]
+		if qm.Expires.IsZero() || now.Before(qm.Expires) {
+			return &qm
+		}
+	}
+	return nil
+}
+
+// BrowseReply is a page of a queue's messages (see Browse)
+type BrowseReply struct {
+	// the queued messages in the order they were queued, then the ones in progress
+	// (which have a Deadline) in the order they were pushed
+	Messages []QMessage
+	// how many messages there are altogether
+	Total int
+}
+
+// Browse returns up to limit of the queue's messages (all of them if limit is negative),
+// queued and in progress, starting from the offset'th
+func (mq *MessageQueue) Browse(offset, limit int) BrowseReply {
+	var inProgress []QMessage
+	for _, qm := range mq.InProgress {
+		inProgress = append(inProgress, qm)
+	}
+	sort.Slice(inProgress, func(i, j int) bool {
+		return idLess(inProgress[i].MessageID, inProgress[j].MessageID)
+	})
+	all := append(append([]QMessage(nil), mq.Queue...), inProgress...)
+	reply := BrowseReply{Messages: []QMessage{}, Total: len(all)}
+	if offset < 0 || offset >= len(all) {
+		return reply
+	}
+	end := len(all)
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+	reply.Messages = all[offset:end]
+	return reply
+}
+
+// Done forgets about a popped message, returning whether it was in progress
+func (mq *MessageQueue) Done(mId string) bool {
+	if _, ok := mq.InProgress[mId]; !ok {
+		return false
+	}
 	delete(mq.InProgress, mId)
+	return true
 }
 
 func (mq *MessageQueue) Len() int {
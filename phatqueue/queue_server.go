@@ -1,16 +1,34 @@
 package phatqueue
 
 import (
-//	"fmt"
+	//	"fmt"
+	"bytes"
+	"encoding/gob"
+	"sort"
+	"time"
 )
 
 const (
 	USE_COPY_ON_WRITE = true
 )
 
+// errors the queue replies with
+const (
+	ErrNothingToPop  = "Nothing to pop"
+	ErrNotInProgress = "Message not in progress"
+	ErrNoSuchQueue   = "No such queue"
+	ErrQueueExists   = "Queue already exists"
+	ErrDefaultQueue  = "The default queue can't be created or deleted"
+)
+
+// the queue commands without a queue name go to. It's always there
+const DEFAULT_QUEUE = ""
+
 type QCommand struct {
 	Command string
 	Value   interface{}
+	// the queue the command is for (DEFAULT_QUEUE if empty)
+	Queue string
 }
 
 type QResponse struct {
@@ -23,15 +41,45 @@ type QCommandWithChannel struct {
 	Done chan *QResponse
 }
 
+// PopArgs is the value of a POP command. The master fills it in, so every replica
+// redelivers the same messages
+type PopArgs struct {
+	// when the master got the POP
+	Time time.Time
+	// how long the message is in progress for (DEFAULT_VISIBILITY_TIMEOUT if 0)
+	VisibilityTimeout time.Duration
+}
+
+// PushArgs is the value of a PUSH command for a message that expires. The master fills
+// in Time, so every replica expires it at the same point
+type PushArgs struct {
+	Value interface{}
+	// when the master got the PUSH
+	Time time.Time
+	// how long the message can wait to be popped before it's dropped (forever if 0)
+	TTL time.Duration
+	// if set, the queue the message is moved to when it expires, rather than dropped
+	DeadLetterQueue string
+}
+
+// BrowseArgs is the value of a BROWSE command
+type BrowseArgs struct {
+	Offset int
+	// the most messages to return (DEFAULT_BROWSE_LIMIT if 0)
+	Limit int
+}
+
+// how many messages BROWSE returns, if it isn't told
+const DEFAULT_BROWSE_LIMIT = 100
+
 type QSnapshot struct {
 	Data          []byte
 	SnapshotIndex uint
 }
 
 func QueueServer(input chan QCommandWithChannel) {
-	// Set up the queue
-	mq := new(MessageQueue)
-	mq.Init()
+	// Set up the queues
+	queues := newQueues()
 	copyOnWrite := false
 	// Enter the command loop
 	for {
@@ -41,44 +89,123 @@ func QueueServer(input chan QCommandWithChannel) {
 
 		if copyOnWrite {
 			switch req.Command {
-			case "PUSH", "POP", "DONE":
+			case "PUSH", "POP", "DONE", "CREATE_QUEUE", "DELETE_QUEUE":
 				// we're writing, so we need to do a copy
 				//fmt.Printf("copying the queue because copy on write")
-				mq = mq.Copy()
+				queues = copyQueues(queues)
 				copyOnWrite = false
 			}
 		}
 
+		mq := queues[req.Queue]
+		switch req.Command {
+		case "PUSH", "POP", "DONE", "LEN", "LEN_IN_PROGRESS", "PEEK", "BROWSE":
+			if mq == nil {
+				resp.Error = ErrNoSuchQueue
+				request.Done <- resp
+				continue
+			}
+		}
+
 		switch req.Command {
 		case "PUSH":
-			mq.Push(req.Value.(string))
+			args, ok := req.Value.(PushArgs)
+			if !ok {
+				resp.Reply = mq.Push(req.Value)
+				break
+			}
+			if args.Time.IsZero() {
+				args.Time = time.Now()
+			}
+			expire(queues, mq, args.Time)
+			qm := QMessage{Value: args.Value, DeadLetterQueue: args.DeadLetterQueue}
+			if args.TTL > 0 {
+				qm.Expires = args.Time.Add(args.TTL)
+			}
+			resp.Reply = mq.PushMessage(qm)
 		case "POP":
-			v := mq.Pop()
+			args, ok := req.Value.(PopArgs)
+			if !ok {
+				args.Time = time.Now()
+			}
+			if args.VisibilityTimeout == 0 {
+				args.VisibilityTimeout = DEFAULT_VISIBILITY_TIMEOUT
+			}
+			mq.Redeliver(args.Time)
+			expire(queues, mq, args.Time)
+			v := mq.PopAt(args.Time, args.VisibilityTimeout)
 			if v != nil {
 				resp.Reply = v
 			} else {
-				resp.Error = "Nothing to pop"
+				resp.Error = ErrNothingToPop
 			}
 		case "DONE":
-			mq.Done(req.Value.(string))
+			id, _ := req.Value.(string)
+			if !mq.Done(id) {
+				resp.Error = ErrNotInProgress
+			}
+		case "PEEK":
+			// like POP, without changing anything
+			now, ok := req.Value.(time.Time)
+			if !ok {
+				now = time.Now()
+			}
+			if v := mq.Peek(now); v != nil {
+				resp.Reply = v
+			} else {
+				resp.Error = ErrNothingToPop
+			}
+		case "BROWSE":
+			args, _ := req.Value.(BrowseArgs)
+			if args.Limit == 0 {
+				args.Limit = DEFAULT_BROWSE_LIMIT
+			}
+			resp.Reply = mq.Browse(args.Offset, args.Limit)
 		case "LEN":
 			resp.Reply = mq.Len()
 		case "LEN_IN_PROGRESS":
 			resp.Reply = mq.LenInProgress()
+		case "CREATE_QUEUE":
+			if req.Queue == DEFAULT_QUEUE {
+				resp.Error = ErrDefaultQueue
+			} else if mq != nil {
+				resp.Error = ErrQueueExists
+			} else {
+				mq = new(MessageQueue)
+				mq.Init()
+				queues[req.Queue] = mq
+			}
+		case "DELETE_QUEUE":
+			if req.Queue == DEFAULT_QUEUE {
+				resp.Error = ErrDefaultQueue
+			} else if mq == nil {
+				resp.Error = ErrNoSuchQueue
+			} else {
+				delete(queues, req.Queue)
+			}
+		case "LIST_QUEUES":
+			names := []string{}
+			for name := range queues {
+				if name != DEFAULT_QUEUE {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			resp.Reply = names
 		case "SNAPSHOT":
 			// need to ask for the index here, to guarantee it's the current one
 			index := req.Value.(func() uint)()
 
+			// the next write copies the queues rather than changing these
+			queues_snap := queues
 			encodeFunc := func() {
-				mq_snap := mq
-				bytes, err := mq_snap.Bytes()
+				bytes, err := queuesBytes(queues_snap)
 				if err != nil {
 					resp.Error = err.Error()
 				} else {
 					resp.Reply = QSnapshot{bytes, index}
 				}
 				request.Done <- resp
-				copyOnWrite = false
 			}
 
 			if USE_COPY_ON_WRITE {
@@ -88,11 +215,13 @@ func QueueServer(input chan QCommandWithChannel) {
 				encodeFunc()
 			}
 			continue
-        case "LOAD_SNAPSHOT":
-            err := mq.RecoverSnapshot(req.Value.([]byte))
-            if err != nil {
-                resp.Error = err.Error()
-            }
+		case "LOAD_SNAPSHOT":
+			loaded, err := recoverQueues(req.Value.([]byte))
+			if err != nil {
+				resp.Error = err.Error()
+			} else {
+				queues = loaded
+			}
 		default:
 			resp.Error = "Unknown command"
 		}
@@ -100,3 +229,62 @@ func QueueServer(input chan QCommandWithChannel) {
 		request.Done <- resp
 	}
 }
+
+// expire drops mq's messages that have expired by time now, moving those that have a
+// dead-letter queue to it (if it's still there)
+func expire(queues map[string]*MessageQueue, mq *MessageQueue, now time.Time) {
+	for _, qm := range mq.Expire(now) {
+		dead := queues[qm.DeadLetterQueue]
+		if qm.DeadLetterQueue == DEFAULT_QUEUE || dead == nil || dead == mq {
+			continue
+		}
+		dead.PushMessage(QMessage{Value: qm.Value})
+	}
+}
+
+// newQueues returns a set of queues with just the default one
+func newQueues() map[string]*MessageQueue {
+	mq := new(MessageQueue)
+	mq.Init()
+	return map[string]*MessageQueue{DEFAULT_QUEUE: mq}
+}
+
+// copyQueues copies every queue, so a snapshot being encoded doesn't see later writes
+func copyQueues(queues map[string]*MessageQueue) map[string]*MessageQueue {
+	copied := make(map[string]*MessageQueue, len(queues))
+	for name, mq := range queues {
+		copied[name] = mq.Copy()
+	}
+	return copied
+}
+
+// queuesBytes encodes every queue for a snapshot
+func queuesBytes(queues map[string]*MessageQueue) ([]byte, error) {
+	var state bytes.Buffer
+	if err := gob.NewEncoder(&state).Encode(queues); err != nil {
+		return nil, err
+	}
+	return state.Bytes(), nil
+}
+
+// recoverQueues decodes the queues in a snapshot made by queuesBytes
+func recoverQueues(snapshotBytes []byte) (map[string]*MessageQueue, error) {
+	var queues map[string]*MessageQueue
+	if err := gob.NewDecoder(bytes.NewBuffer(snapshotBytes)).Decode(&queues); err != nil {
+		return nil, err
+	}
+	if queues == nil {
+		queues = make(map[string]*MessageQueue)
+	}
+	for _, mq := range queues {
+		if mq.InProgress == nil {
+			mq.InProgress = make(map[string]QMessage)
+		}
+	}
+	if queues[DEFAULT_QUEUE] == nil {
+		mq := new(MessageQueue)
+		mq.Init()
+		queues[DEFAULT_QUEUE] = mq
+	}
+	return queues, nil
+}
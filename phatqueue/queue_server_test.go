@@ -1,17 +1,19 @@
 package phatqueue
 
 import (
+	"fmt"
 	"testing"
+	"time"
 )
 
 func TestQServer(t *testing.T) {
 	input := make(chan QCommandWithChannel)
 	go QueueServer(input)
 	//
-	popCmd := QCommandWithChannel{&QCommand{"POP", ""}, make(chan *QResponse)}
-	lenCmd := QCommandWithChannel{&QCommand{"LEN", ""}, make(chan *QResponse)}
+	popCmd := QCommandWithChannel{&QCommand{Command: "POP", Value: ""}, make(chan *QResponse)}
+	lenCmd := QCommandWithChannel{&QCommand{Command: "LEN", Value: ""}, make(chan *QResponse)}
 	// A bad command should fail
-	badCmd := QCommandWithChannel{&QCommand{"HAMMERTIME", ""}, make(chan *QResponse)}
+	badCmd := QCommandWithChannel{&QCommand{Command: "HAMMERTIME", Value: ""}, make(chan *QResponse)}
 	input <- badCmd
 	// TODO: Ensure it's the expected error
 	if resp := <-badCmd.Done; resp.Reply != nil || resp.Error == "" {
@@ -26,7 +28,7 @@ func TestQServer(t *testing.T) {
 	elems := []string{"/dev/nulled", "/dev/random", "/dev/urandom"}
 	for _, val := range elems {
 		// Place an object on the queue
-		pushCmd := QCommandWithChannel{&QCommand{"PUSH", val}, make(chan *QResponse)}
+		pushCmd := QCommandWithChannel{&QCommand{Command: "PUSH", Value: val}, make(chan *QResponse)}
 		input <- pushCmd
 		<-pushCmd.Done
 	}
@@ -44,7 +46,7 @@ func TestQServer(t *testing.T) {
 			t.Errorf("POP fails with %v", resp.Reply)
 		}
 		//
-		//doneCmd := QCommandWithChannel{&QCommand{"DONE", resp.Reply.(QMessage).MessageID}, make(chan *QResponse)}
+		//doneCmd := QCommandWithChannel{&QCommand{Command: "DONE", Value: resp.Reply.(QMessage).MessageID}, make(chan *QResponse)}
 		//<-doneCmd.Done
 		//
 		input <- lenCmd
@@ -54,3 +56,98 @@ func TestQServer(t *testing.T) {
 		}
 	}
 }
+
+func TestNamedQueues(t *testing.T) {
+	input := make(chan QCommandWithChannel)
+	go QueueServer(input)
+	run := func(cmd *QCommand) *QResponse {
+		req := QCommandWithChannel{cmd, make(chan *QResponse)}
+		input <- req
+		return <-req.Done
+	}
+
+	if resp := run(&QCommand{Command: "PUSH", Value: "x", Queue: "jobs"}); resp.Error != ErrNoSuchQueue {
+		t.Errorf("Expected pushing to a missing queue to fail, got %v", resp)
+	}
+	for _, name := range []string{"jobs", "emails"} {
+		if resp := run(&QCommand{Command: "CREATE_QUEUE", Queue: name}); resp.Error != "" {
+			t.Fatalf("Couldn't create %s: %s", name, resp.Error)
+		}
+	}
+	if resp := run(&QCommand{Command: "CREATE_QUEUE", Queue: "jobs"}); resp.Error != ErrQueueExists {
+		t.Errorf("Expected creating jobs again to fail, got %v", resp)
+	}
+	if resp := run(&QCommand{Command: "LIST_QUEUES"}); fmt.Sprint(resp.Reply) != "[emails jobs]" {
+		t.Errorf("Unexpected queues %v", resp.Reply)
+	}
+
+	// the queues are independent of each other and of the default queue
+	run(&QCommand{Command: "PUSH", Value: "build", Queue: "jobs"})
+	if resp := run(&QCommand{Command: "POP", Queue: "emails"}); resp.Error != ErrNothingToPop {
+		t.Errorf("Expected emails to be empty, got %v", resp)
+	}
+	if resp := run(&QCommand{Command: "LEN"}); resp.Reply != 0 {
+		t.Errorf("Expected the default queue to be empty, got %v", resp.Reply)
+	}
+	resp := run(&QCommand{Command: "POP", Queue: "jobs"})
+	if resp.Error != "" || resp.Reply.(*QMessage).Value != "build" {
+		t.Fatalf("Expected to pop build from jobs, got %v", resp)
+	}
+	if resp := run(&QCommand{Command: "DONE", Value: resp.Reply.(*QMessage).MessageID, Queue: "emails"}); resp.Error != ErrNotInProgress {
+		t.Errorf("Expected a message to only be done in its own queue, got %v", resp)
+	}
+
+	// snapshots keep every queue
+	snap := run(&QCommand{Command: "SNAPSHOT", Value: func() uint { return 1 }})
+	if snap.Error != "" {
+		t.Fatalf("Couldn't snapshot: %s", snap.Error)
+	}
+	run(&QCommand{Command: "DELETE_QUEUE", Queue: "jobs"})
+	if resp := run(&QCommand{Command: "LEN_IN_PROGRESS", Queue: "jobs"}); resp.Error != ErrNoSuchQueue {
+		t.Errorf("Expected jobs to be deleted, got %v", resp)
+	}
+	if resp := run(&QCommand{Command: "DELETE_QUEUE"}); resp.Error != ErrDefaultQueue {
+		t.Errorf("Expected deleting the default queue to fail, got %v", resp)
+	}
+	run(&QCommand{Command: "LOAD_SNAPSHOT", Value: snap.Reply.(QSnapshot).Data})
+	if resp := run(&QCommand{Command: "LEN_IN_PROGRESS", Queue: "jobs"}); resp.Reply != 1 {
+		t.Errorf("Expected jobs to be back with its message in progress, got %v", resp)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	input := make(chan QCommandWithChannel)
+	go QueueServer(input)
+	run := func(cmd *QCommand) *QResponse {
+		req := QCommandWithChannel{cmd, make(chan *QResponse)}
+		input <- req
+		return <-req.Done
+	}
+
+	now := time.Now()
+	run(&QCommand{Command: "CREATE_QUEUE", Queue: "dead"})
+	run(&QCommand{Command: "PUSH", Value: PushArgs{Value: "stale", Time: now, TTL: time.Second, DeadLetterQueue: "dead"}})
+	run(&QCommand{Command: "PUSH", Value: PushArgs{Value: "gone", Time: now, TTL: time.Second}})
+	run(&QCommand{Command: "PUSH", Value: PushArgs{Value: "fresh", Time: now, TTL: time.Minute}})
+	run(&QCommand{Command: "PUSH", Value: "forever"})
+
+	later := now.Add(2 * time.Second)
+	var popped []interface{}
+	for {
+		resp := run(&QCommand{Command: "POP", Value: PopArgs{Time: later}})
+		if resp.Error != "" {
+			break
+		}
+		popped = append(popped, resp.Reply.(*QMessage).Value)
+	}
+	if len(popped) != 2 {
+		t.Errorf("Expected only the unexpired messages to be popped, got %v", popped)
+	}
+	resp := run(&QCommand{Command: "POP", Queue: "dead", Value: PopArgs{Time: later}})
+	if resp.Error != "" || resp.Reply.(*QMessage).Value != "stale" {
+		t.Errorf("Expected the expired message to be in the dead-letter queue, got %v", resp)
+	}
+	if resp := run(&QCommand{Command: "LEN", Queue: "dead"}); resp.Reply != 0 {
+		t.Errorf("Expected only one message to be dead-lettered, got %v", resp.Reply)
+	}
+}
@@ -2,6 +2,7 @@ package phatqueue
 
 import (
 	"testing"
+	"time"
 )
 
 func TestExistsNode(t *testing.T) {
@@ -46,3 +47,92 @@ func TestExistsNode(t *testing.T) {
 	mq.Done(qmesg.MessageID)
 	//
 }
+
+func TestInProgress(t *testing.T) {
+	mq := MessageQueue{}
+	mq.Init()
+	id := mq.Push("work")
+	qmesg := mq.Pop()
+	if qmesg == nil || qmesg.MessageID != id || mq.LenInProgress() != 1 {
+		t.Fatalf("Expected the popped message to be in progress")
+	}
+	// snapshots' copies keep what's queued and what's in progress
+	mq.Push("more")
+	copied := mq.Copy()
+	if copied.Len() != 1 || copied.LenInProgress() != 1 {
+		t.Errorf("Expected the copy to have 1 message queued and 1 in progress, got %d and %d", copied.Len(), copied.LenInProgress())
+	}
+	if !mq.Done(id) || mq.LenInProgress() != 0 {
+		t.Errorf("Expected Done to finish the message")
+	}
+	if mq.Done(id) {
+		t.Errorf("Expected a message to only be done once")
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	mq := MessageQueue{}
+	mq.Init()
+	now := time.Now()
+	first := mq.Push("first")
+	second := mq.Push("second")
+	mq.PopAt(now, time.Second)
+	mq.PopAt(now.Add(time.Second), time.Second)
+	if mq.Len() != 0 || mq.LenInProgress() != 2 {
+		t.Fatalf("Expected both messages to be in progress")
+	}
+	// nothing's timed out yet
+	if qmesg := mq.PopAt(now.Add(time.Second), time.Second); qmesg != nil {
+		t.Errorf("Expected nothing to pop, got %v", qmesg)
+	}
+	mq.Done(first)
+	// the undone one comes back, counting the redelivery
+	qmesg := mq.PopAt(now.Add(3*time.Second), time.Second)
+	if qmesg == nil || qmesg.MessageID != second || qmesg.Redeliveries != 1 || !qmesg.Deadline.Equal(now.Add(4*time.Second)) {
+		t.Fatalf("Expected %s to be redelivered, got %v", second, qmesg)
+	}
+	if !mq.Done(second) || mq.LenInProgress() != 0 {
+		t.Errorf("Expected the redelivered message to be done")
+	}
+}
+
+func TestPeekAndBrowse(t *testing.T) {
+	mq := MessageQueue{}
+	mq.Init()
+	now := time.Now()
+	if mq.Peek(now) != nil {
+		t.Errorf("Expected nothing to peek at in an empty queue")
+	}
+	mq.PushMessage(QMessage{Value: "stale", Expires: now})
+	mq.Push("a")
+	mq.Push("b")
+	popped := mq.PopAt(now.Add(-time.Minute), time.Second)
+
+	// overdue messages are next
+	if qmesg := mq.Peek(now); qmesg == nil || qmesg.MessageID != popped.MessageID || qmesg.Redeliveries != 1 {
+		t.Errorf("Expected to peek at the overdue message, got %v", qmesg)
+	}
+	mq.Done(popped.MessageID)
+	if qmesg := mq.Peek(now); qmesg == nil || qmesg.Value != "a" {
+		t.Errorf("Expected to peek at a, got %v", qmesg)
+	}
+	if mq.Len() != 2 || mq.LenInProgress() != 0 {
+		t.Errorf("Expected peeking to leave the queue alone")
+	}
+
+	mq.PopAt(now, time.Minute)
+	// expired ones are skipped
+	if qmesg := mq.Peek(now); qmesg != nil {
+		t.Errorf("Expected nothing to peek at, got %v", qmesg)
+	}
+	page := mq.Browse(0, 10)
+	if page.Total != 2 || len(page.Messages) != 2 || page.Messages[0].Value != "stale" || page.Messages[1].Deadline.IsZero() {
+		t.Errorf("Expected a queued message then one in progress, got %+v", page)
+	}
+	if page := mq.Browse(1, 10); len(page.Messages) != 1 || page.Messages[0].Value != "a" {
+		t.Errorf("Expected the second page to have the message in progress, got %+v", page)
+	}
+	if page := mq.Browse(2, 10); len(page.Messages) != 0 || page.Total != 2 {
+		t.Errorf("Expected nothing past the end, got %+v", page)
+	}
+}
@@ -1,10 +1,12 @@
 package queueRPC
 
 import (
+	"crypto/tls"
 	"encoding/gob"
 	"errors"
 	"fmt"
 //	"log"
+	"github.com/mgentili/goPhat/client"
 	"github.com/mgentili/goPhat/level_log"
 	queue "github.com/mgentili/goPhat/phatqueue"
 	"github.com/mgentili/goPhat/queuedisk"
@@ -12,17 +14,34 @@ import (
 	"net"
 	"net/rpc"
 	"os"
+	"sync"
+	"time"
 )
 
 const DEBUG = 0
 
 var server_log *level_log.Logger
 
+// how long popped messages have to be done before they're redelivered
+// (phatqueue.DEFAULT_VISIBILITY_TIMEOUT if 0)
+var VisibilityTimeout time.Duration
+
+const (
+	// how long a BlockingPop waits for a message, if it doesn't say
+	DEFAULT_POP_WAIT = 30 * time.Second
+	// how often a BlockingPop tries again while it waits, to pick up messages being
+	// redelivered (which happens as POPs are applied, not as PUSHes are)
+	POP_RETRY_INTERVAL = time.Second
+)
+
 type Server struct {
 	ReplicaServer *vr.Replica
 	InputChan     chan queue.QCommandWithChannel
 	ClientTable   map[string]ClientTableEntry
 	UseVR bool
+	// closed and replaced whenever a PUSH is applied, to wake up BlockingPops
+	pushed     chan struct{}
+	pushedLock sync.Mutex
 }
 
 type ClientTableEntry struct {
@@ -60,7 +79,7 @@ func (c CommandFunctor) CommitFunc(context interface{}) {
 
 func SnapshotFunc(context interface{}, SnapshotHandle func() uint) ([]byte, uint, error) {
 	s := context.(*Server)
-	command := &queue.QCommand{"SNAPSHOT", SnapshotHandle}
+	command := &queue.QCommand{Command: "SNAPSHOT", Value: SnapshotHandle}
 
 	argsWithChannel := queue.QCommandWithChannel{command, make(chan *queue.QResponse)}
 	s.InputChan <- argsWithChannel
@@ -75,7 +94,7 @@ func SnapshotFunc(context interface{}, SnapshotHandle func() uint) ([]byte, uint
 
 func LoadSnapshotFunc(context interface{}, data []byte) error {
     s := context.(*Server)
-    command := &queue.QCommand{"LOAD_SNAPSHOT", data}
+    command := &queue.QCommand{Command: "LOAD_SNAPSHOT", Value: data}
 
     argsWithChannel := queue.QCommandWithChannel{command, make(chan *queue.QResponse)}
     s.InputChan <- argsWithChannel
@@ -115,10 +134,19 @@ func SetupLog() {
 // startServer starts a TCP server that accepts client requests at the given port
 // and has information about the replica server
 func StartServer(address string, replica *vr.Replica, useVR bool) (*rpc.Server, error) {
+	return StartServerTLS(address, replica, useVR, nil)
+}
+
+// StartServerTLS is StartServer, with clients connecting over TLS with the given
+// configuration if it isn't nil
+func StartServerTLS(address string, replica *vr.Replica, useVR bool, tlsConfig *tls.Config) (*rpc.Server, error) {
 	SetupLog()
 
 	var err error
-	
+	if tlsConfig != nil && len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil {
+		return nil, errors.New("TLS config has no certificate")
+	}
+
 	/*defer func() {
 		log.Printf("StartServer errored with %v", err)
 	}()*/
@@ -127,10 +155,14 @@ func StartServer(address string, replica *vr.Replica, useVR bool) (*rpc.Server,
 	if err != nil {
 		return nil, err
 	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 	serve := new(Server)
 	serve.ReplicaServer = replica
 	serve.ClientTable = make(map[string]ClientTableEntry)
 	serve.UseVR = useVR
+	replica.SetClientAddresses(nil, address)
 	serve.startQueue()
 
 	replica.Context = serve
@@ -149,6 +181,10 @@ func StartServer(address string, replica *vr.Replica, useVR bool) (*rpc.Server,
 	gob.Register(queue.QCommandWithChannel{})
 	// Need to register all types that are returned within the QResponse
 	gob.Register(queue.QMessage{})
+	gob.Register(queue.PopArgs{})
+	gob.Register(queue.PushArgs{})
+	gob.Register(queue.BrowseArgs{})
+	gob.Register(queue.BrowseReply{})
 
 	serve.debug(DEBUG, "Server at %s trying to accept new client connections\n", address)
 	go newServer.Accept(listener)
@@ -168,20 +204,22 @@ func (s *Server) checkState() error {
 	// Temporary workaround to allow responses to SHA256 on non-master nodes
 	if Id != MasterId {
 		s.debug(DEBUG, "I'm not the master!")
-		return errors.New("Not master node")
+		r := s.ReplicaServer
+		return client.NotMasterAt(client.MasterInfo{Id: MasterId, View: r.Rstate.View, Address: r.MasterAddress()})
 	}
 
 	return nil
 }
 
-// returns the master id, as long as replica is in a normal state
-func (s *Server) GetMaster(args *Null, reply *uint) error {
+// returns the master's id and address, as long as replica is in a normal state
+func (s *Server) GetMaster(args *Null, reply *client.MasterInfo) error {
 	//if in recovery state, error
 	if s.ReplicaServer.Rstate.Status != vr.Normal {
 		return errors.New("Master Failover")
 	}
 
-	*reply = s.ReplicaServer.GetMasterId()
+	r := s.ReplicaServer
+	*reply = client.MasterInfo{Id: r.GetMasterId(), View: r.Rstate.View, Address: r.MasterAddress()}
 	return nil
 }
 
@@ -222,21 +260,231 @@ func (s *Server) Send(args *ClientCommand, reply *queue.QResponse) error {
 	s.ClientTable[args.Uid] = ClientTableEntry{args.SeqNumber, nil}
 	*/
 
-	argsWithChannel := queue.QCommandWithChannel{args.Command, make(chan *queue.QResponse, 1)}
+	cmd := args.Command
+	if cmd.Command == "POP" {
+		cmd = s.popCommand(cmd.Queue)
+	}
+	if push, ok := cmd.Value.(queue.PushArgs); ok && cmd.Command == "PUSH" {
+		// timed by the master, as for POP
+		push.Time = time.Now()
+		cmd = &queue.QCommand{Command: "PUSH", Value: push, Queue: cmd.Queue}
+	}
+	if cmd.Command == "PEEK" || cmd.Command == "BROWSE" {
+		*reply = *s.read(cmd)
+	} else {
+		*reply = *s.run(cmd)
+	}
+
 	
+	// place the response entry into the client table
+	// s.ClientTable[args.Uid] = ClientTableEntry{s.ClientTable[args.Uid].SeqNumber, reply}
+
+	return nil
+}
+
+// run replicates cmd through VR (or, without VR, hands it straight to the disk-backed
+// queue) and returns the queue's reply once it's been applied
+func (s *Server) run(cmd *queue.QCommand) *queue.QResponse {
+	argsWithChannel := queue.QCommandWithChannel{cmd, make(chan *queue.QResponse, 1)}
+
 	if s.UseVR {
-		s.ReplicaServer.RunVR(CommandFunctor{argsWithChannel})
-	} else { // in this case, we're using disk 
+		if err := s.ReplicaServer.RunVR(CommandFunctor{argsWithChannel}); err != nil {
+			return &queue.QResponse{Error: err.Error()}
+		}
+	} else { // in this case, we're using disk
 		s.InputChan <- argsWithChannel
 	}
 
 	result := <-argsWithChannel.Done
-	*reply = *result
+	if cmd.Command == "PUSH" && result.Error == "" {
+		s.notifyPushed()
+	}
+	return result
+}
 
-	
-	// place the response entry into the client table
-	// s.ClientTable[args.Uid] = ClientTableEntry{s.ClientTable[args.Uid].SeqNumber, reply}
+// read runs a command that doesn't change the queue (PEEK or BROWSE) here, without
+// replicating it, and returns the queue's reply
+func (s *Server) read(cmd *queue.QCommand) *queue.QResponse {
+	argsWithChannel := queue.QCommandWithChannel{cmd, make(chan *queue.QResponse, 1)}
+	s.InputChan <- argsWithChannel
+	return <-argsWithChannel.Done
+}
+
+// pushedChan returns a channel that's closed the next time a PUSH is applied
+func (s *Server) pushedChan() chan struct{} {
+	s.pushedLock.Lock()
+	defer s.pushedLock.Unlock()
+	if s.pushed == nil {
+		s.pushed = make(chan struct{})
+	}
+	return s.pushed
+}
+
+// notifyPushed wakes up the BlockingPops waiting for a message
+func (s *Server) notifyPushed() {
+	s.pushedLock.Lock()
+	defer s.pushedLock.Unlock()
+	if s.pushed != nil {
+		close(s.pushed)
+		s.pushed = nil
+	}
+}
+
+// call runs cmd on the master, turning the queue's error, if any, into the call's
+func (s *Server) call(cmd *queue.QCommand) (interface{}, error) {
+	if err := s.checkState(); err != nil {
+		return nil, err
+	}
+	result := s.run(cmd)
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+	return result.Reply, nil
+}
+
+// popCommand returns a POP from the named queue to replicate, timed by the master so
+// every replica redelivers the same messages
+func (s *Server) popCommand(name string) *queue.QCommand {
+	return &queue.QCommand{Command: "POP", Value: queue.PopArgs{Time: time.Now(), VisibilityTimeout: VisibilityTimeout}, Queue: name}
+}
+
+// QueueArgs names the queue a call is for (phatqueue.DEFAULT_QUEUE if empty)
+type QueueArgs struct {
+	Queue string
+}
+
+type PushArgs struct {
+	Queue string
+	Value string
+	// if set, how long the message can wait to be popped before it expires
+	TTL time.Duration
+	// if set, the queue the message is moved to when it expires, rather than dropped
+	DeadLetterQueue string
+}
+
+type DoneArgs struct {
+	Queue     string
+	MessageID string
+}
 
+// Push adds a value to a queue, replying with its message's id. Messages with a TTL
+// that haven't been popped by the time it's up are dropped, or moved to their
+// dead-letter queue
+func (s *Server) Push(args *PushArgs, id *string) error {
+	value := queue.PushArgs{Value: args.Value, Time: time.Now(), TTL: args.TTL, DeadLetterQueue: args.DeadLetterQueue}
+	res, err := s.call(&queue.QCommand{Command: "PUSH", Value: value, Queue: args.Queue})
+	if err != nil {
+		return err
+	}
+	*id, _ = res.(string)
+	return nil
+}
+
+// Pop takes the next message off a queue. It's in progress until Done is called with
+// its id, or it's redelivered once its visibility timeout has passed
+func (s *Server) Pop(args *QueueArgs, msg *queue.QMessage) error {
+	res, err := s.call(s.popCommand(args.Queue))
+	if err != nil {
+		return err
+	}
+	*msg = *res.(*queue.QMessage)
+	return nil
+}
+
+type BlockingPopArgs struct {
+	Queue string
+	// how long to wait for a message (DEFAULT_POP_WAIT if 0)
+	Timeout time.Duration
+}
+
+// BlockingPop is Pop, but if the queue's empty it waits for a message, up to
+// args.Timeout, rather than failing straight away
+func (s *Server) BlockingPop(args *BlockingPopArgs, msg *queue.QMessage) error {
+	timeout := args.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_POP_WAIT
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		// before trying, so a PUSH applied just after the POP fails isn't missed
+		pushed := s.pushedChan()
+		err := s.Pop(&QueueArgs{args.Queue}, msg)
+		if err == nil || err.Error() != queue.ErrNothingToPop {
+			return err
+		}
+		wait := deadline.Sub(time.Now())
+		if wait <= 0 {
+			return err
+		}
+		if wait > POP_RETRY_INTERVAL {
+			wait = POP_RETRY_INTERVAL
+		}
+		select {
+		case <-pushed:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Done says the popped message with the given id has been dealt with
+func (s *Server) Done(args *DoneArgs, reply *Null) error {
+	_, err := s.call(&queue.QCommand{Command: "DONE", Value: args.MessageID, Queue: args.Queue})
+	return err
+}
+
+// Peek replies with the message a Pop would get from a queue, without taking it off
+func (s *Server) Peek(args *QueueArgs, msg *queue.QMessage) error {
+	if err := s.checkState(); err != nil {
+		return err
+	}
+	result := s.read(&queue.QCommand{Command: "PEEK", Value: time.Now(), Queue: args.Queue})
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+	*msg = *result.Reply.(*queue.QMessage)
+	return nil
+}
+
+type BrowseArgs struct {
+	Queue  string
+	Offset int
+	// the most messages to reply with (phatqueue.DEFAULT_BROWSE_LIMIT if 0)
+	Limit int
+}
+
+// Browse replies with a page of a queue's messages, queued and in progress, for seeing
+// what's going on. It doesn't change what's delivered when
+func (s *Server) Browse(args *BrowseArgs, reply *queue.BrowseReply) error {
+	if err := s.checkState(); err != nil {
+		return err
+	}
+	value := queue.BrowseArgs{Offset: args.Offset, Limit: args.Limit}
+	result := s.read(&queue.QCommand{Command: "BROWSE", Value: value, Queue: args.Queue})
+	if result.Error != "" {
+		return errors.New(result.Error)
+	}
+	*reply = result.Reply.(queue.BrowseReply)
+	return nil
+}
+
+// CreateQueue adds a new, empty queue with the given name
+func (s *Server) CreateQueue(args *QueueArgs, reply *Null) error {
+	_, err := s.call(&queue.QCommand{Command: "CREATE_QUEUE", Queue: args.Queue})
+	return err
+}
+
+// DeleteQueue removes a queue, along with its messages
+func (s *Server) DeleteQueue(args *QueueArgs, reply *Null) error {
+	_, err := s.call(&queue.QCommand{Command: "DELETE_QUEUE", Queue: args.Queue})
+	return err
+}
+
+// ListQueues replies with the names of the queues other than the default one, in order
+func (s *Server) ListQueues(args *Null, names *[]string) error {
+	res, err := s.call(&queue.QCommand{Command: "LIST_QUEUES"})
+	if err != nil {
+		return err
+	}
+	*names = res.([]string)
 	return nil
 }
-	
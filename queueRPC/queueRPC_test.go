@@ -0,0 +1,74 @@
+package queueRPC
+
+import (
+	queue "github.com/mgentili/goPhat/phatqueue"
+	"github.com/mgentili/goPhat/vr"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server that's master of a cluster of one, straight on top
+// of a queue
+func newTestServer() *Server {
+	if vr.NREPLICAS == 0 {
+		vr.NREPLICAS = 1
+	}
+	SetupLog()
+	s := &Server{ReplicaServer: &vr.Replica{}}
+	s.InputChan = make(chan queue.QCommandWithChannel)
+	go queue.QueueServer(s.InputChan)
+	return s
+}
+
+func TestBlockingPop(t *testing.T) {
+	s := newTestServer()
+	msg := &queue.QMessage{}
+
+	start := time.Now()
+	err := s.BlockingPop(&BlockingPopArgs{Timeout: 50 * time.Millisecond}, msg)
+	if err == nil || err.Error() != queue.ErrNothingToPop {
+		t.Errorf("Expected an empty queue to time out, got %v", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("Expected to wait for a message, only waited %s", waited)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		var id string
+		s.Push(&PushArgs{Value: "work"}, &id)
+	}()
+	start = time.Now()
+	if err := s.BlockingPop(&BlockingPopArgs{Timeout: 5 * time.Second}, msg); err != nil || msg.Value != "work" {
+		t.Fatalf("Expected to pop the pushed message, got %v %v", msg, err)
+	}
+	if waited := time.Since(start); waited > POP_RETRY_INTERVAL {
+		t.Errorf("Expected the push to wake the pop up, waited %s", waited)
+	}
+
+	if err := s.BlockingPop(&BlockingPopArgs{Queue: "missing"}, msg); err == nil || err.Error() != queue.ErrNoSuchQueue {
+		t.Errorf("Expected popping a missing queue to fail straight away, got %v", err)
+	}
+}
+
+func TestPeekAndBrowse(t *testing.T) {
+	s := newTestServer()
+	var id string
+	s.Push(&PushArgs{Value: "work"}, &id)
+
+	msg := &queue.QMessage{}
+	if err := s.Peek(&QueueArgs{}, msg); err != nil || msg.MessageID != id {
+		t.Errorf("Expected to peek at %s, got %v %v", id, msg, err)
+	}
+	var page queue.BrowseReply
+	if err := s.Browse(&BrowseArgs{}, &page); err != nil || page.Total != 1 || page.Messages[0].MessageID != id {
+		t.Errorf("Expected to browse %s, got %+v %v", id, page, err)
+	}
+	// neither took it
+	if err := s.Pop(&QueueArgs{}, msg); err != nil || msg.MessageID != id {
+		t.Errorf("Expected to pop %s, got %v %v", id, msg, err)
+	}
+	if err := s.Peek(&QueueArgs{}, msg); err == nil || err.Error() != queue.ErrNothingToPop {
+		t.Errorf("Expected nothing left to peek at, got %v", err)
+	}
+}
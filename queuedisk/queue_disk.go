@@ -55,7 +55,7 @@ func (mq *MessageQueue) NextID() int {
 }
 
 func (mq *MessageQueue) Push(v interface{}) {
-	qm := queue.QMessage{strconv.Itoa(mq.NextID()), v}
+	qm := queue.QMessage{MessageID: strconv.Itoa(mq.NextID()), Value: v}
 	mq.Queue = append(mq.Queue, qm)
     mq.BackupLog(queue.LogEntry{Message:qm, Command:"PUSH"})
     mq.OpCounter++
@@ -77,7 +77,7 @@ func (mq *MessageQueue) Pop() *queue.QMessage {
 //ReplayPush/Pop modify the queue in the same way, but do not add to
 //logging file (since they are already there!)
 func (mq *MessageQueue) ReplayPush(v interface{}) {
-	qm := queue.QMessage{strconv.Itoa(mq.NextID()), v}
+	qm := queue.QMessage{MessageID: strconv.Itoa(mq.NextID()), Value: v}
 	mq.Queue = append(mq.Queue, qm)
 }
 
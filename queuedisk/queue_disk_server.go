@@ -16,9 +16,20 @@ func QueueServer(input chan queue.QCommandWithChannel) {
 		request := <-input
 		req := request.Cmd
 		resp := &queue.QResponse{}
+		// the disk-backed queue only has the default queue
+		if req.Queue != queue.DEFAULT_QUEUE {
+			resp.Error = queue.ErrNoSuchQueue
+			request.Done <- resp
+			continue
+		}
 		switch req.Command {
 		case "PUSH":
-			mq.Push(req.Value)
+			// messages here don't expire
+			if args, ok := req.Value.(queue.PushArgs); ok {
+				mq.Push(args.Value)
+			} else {
+				mq.Push(req.Value)
+			}
 		case "POP":
 			v := mq.Pop()
 			if v != nil {
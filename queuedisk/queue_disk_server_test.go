@@ -14,21 +14,21 @@ func TestQServer(t *testing.T) {
     for i := 0; i < 100; i++ {
 	for _, val := range elems {
 		// Place an object on the queue
-		pushCmd := queue.QCommandWithChannel{&queue.QCommand{"PUSH", val}, make(chan *queue.QResponse)}
+		pushCmd := queue.QCommandWithChannel{&queue.QCommand{Command: "PUSH", Value: val}, make(chan *queue.QResponse)}
 		input <- pushCmd
 		<-pushCmd.Done
 }
-    popCmd := queue.QCommandWithChannel{&queue.QCommand{"POP", ""}, make(chan *queue.QResponse)}
+    popCmd := queue.QCommandWithChannel{&queue.QCommand{Command: "POP", Value: ""}, make(chan *queue.QResponse)}
     input <- popCmd
     <-popCmd.Done
 
     }
-    popCmd := queue.QCommandWithChannel{&queue.QCommand{"POP", ""}, make(chan *queue.QResponse)}
+    popCmd := queue.QCommandWithChannel{&queue.QCommand{Command: "POP", Value: ""}, make(chan *queue.QResponse)}
     input <- popCmd
     <-popCmd.Done
 
 
-    popCmd = queue.QCommandWithChannel{&queue.QCommand{"POP", ""}, make(chan *queue.QResponse)}
+    popCmd = queue.QCommandWithChannel{&queue.QCommand{Command: "POP", Value: ""}, make(chan *queue.QResponse)}
     input <- popCmd
     <-popCmd.Done
 
@@ -0,0 +1,70 @@
+package vr
+
+import (
+	"errors"
+	"net/rpc"
+	"time"
+)
+
+// ForwardArgs carries a request from a replica to the master (see Forward)
+type ForwardArgs struct {
+	Request interface{}
+}
+
+// ForwardReply carries the master's reply to a forwarded request
+type ForwardReply struct {
+	Reply interface{}
+}
+
+// Forward is called by other replicas to have the master handle a request for them
+func (t *RPCReplica) Forward(args *ForwardArgs, reply *ForwardReply) error {
+	r := t.R
+	if !r.IsMaster() {
+		return errors.New("not master")
+	}
+	if r.ForwardFunc == nil {
+		return errors.New("master doesn't take forwarded requests")
+	}
+	result, err := r.ForwardFunc(r.Context, args.Request)
+	reply.Reply = result
+	return err
+}
+
+// Forward sends request to the master over the replica network, for its ForwardFunc to
+// handle, and returns what that returns. The request and reply travel as interface
+// values, so their types have to be gob.Registered
+func (r *Replica) Forward(request interface{}, timeout time.Duration) (interface{}, error) {
+	master := r.GetMasterId()
+	if master == r.Rstate.ReplicaNumber {
+		return nil, errors.New("we're the master")
+	}
+	r.ConnLock.Lock()
+	conn := r.Conns[master]
+	r.ConnLock.Unlock()
+	if conn == nil {
+		var err error
+		if conn, err = r.ClientConnect(master); err != nil {
+			return nil, err
+		}
+	}
+	reply := &ForwardReply{}
+	call := conn.Go("RPCReplica.Forward", &ForwardArgs{request}, reply, nil)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+	case <-timer.C:
+		return nil, errors.New("forwarding to the master timed out")
+	}
+	if call.Error == rpc.ErrShutdown {
+		// connection is shutdown so force reconnect
+		r.ConnLock.Lock()
+		if r.Conns[master] == conn {
+			conn.Close()
+			r.Conns[master] = nil
+		}
+		r.ConnLock.Unlock()
+	}
+	r.Debug(DEBUG, "Forwarded request to master %d: %v", master, call.Error)
+	return reply.Reply, call.Error
+}
@@ -17,6 +17,11 @@ type GobServerCodec struct {
 	encBuf *bufio.Writer
 }
 
+func NewGobServerCodec(conn io.ReadWriteCloser) *GobServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &GobServerCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf}
+}
+
 func (c *GobServerCodec) ReadRequestHeader(r *rpc.Request) error {
 	err := c.dec.Decode(r)
 	return err
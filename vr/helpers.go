@@ -52,16 +52,46 @@ func (r *Replica) replicaStateInfo() string {
 
 func (r *Replica) IsMaster() bool {
 	// only consider ourself master if we're in Normal state!
-	return r.Rstate.View%NREPLICAS == r.Rstate.ReplicaNumber && r.Rstate.Status == Normal
+	return r.GetMasterId() == r.Rstate.ReplicaNumber && r.Rstate.Status == Normal
 }
 
+// GetMasterId returns the number of the replica that is master in the current view.
+// Everything that needs to know which replica is master should ask this
 func (r *Replica) GetMasterId() uint {
 	return r.Rstate.View % NREPLICAS
 }
 
+// MasterAddress returns where clients reach the current master (see ClientAddresses),
+// or "" if that isn't known
+func (r *Replica) MasterAddress() string {
+	master := r.GetMasterId()
+	if master >= uint(len(r.ClientAddresses)) {
+		return ""
+	}
+	return r.ClientAddresses[master]
+}
+
+// SetClientAddresses sets ClientAddresses to addresses, filling in this replica's own
+// client address (the one its server listens on) if addresses doesn't have it
+func (r *Replica) SetClientAddresses(addresses []string, own string) {
+	addresses = append([]string(nil), addresses...)
+	me := r.Rstate.ReplicaNumber
+	for uint(len(addresses)) <= me {
+		addresses = append(addresses, "")
+	}
+	if addresses[me] == "" {
+		addresses[me] = own
+	}
+	r.ClientAddresses = addresses
+}
+
 func (mstate *MasterState) Reset() {
 	mstate.HighestOp = map[uint]uint{}
 	mstate.Heartbeats = map[uint]time.Time{}
+	// a new master has no lease until a majority have heard from it
+	mstate.leaseLock.Lock()
+	mstate.leaseExpiry = time.Time{}
+	mstate.leaseLock.Unlock()
 }
 
 // just closes the connections (doesn't stop timers, etc.)
@@ -25,6 +25,22 @@ func (r *Replica) Heartbeat(replica uint, newTime time.Time) {
 	leaseExpiry := sortedTimes[oldestMajority].Add(-MAX_CLOCK_DRIFT)
 	r.Mstate.ExtendNeedsRenewal(leaseExpiry)
 	r.Rstate.ExtendLease(leaseExpiry)
+	r.Mstate.leaseLock.Lock()
+	r.Mstate.leaseExpiry = leaseExpiry
+	r.Mstate.leaseLock.Unlock()
+}
+
+// HasLease returns whether we're master and hold the master lease: a majority of the
+// replicas have promised not to elect anyone else for a while yet, so nobody else can
+// have committed anything we don't know about. Reads served without going through VR
+// are only up to date if this holds
+func (r *Replica) HasLease() bool {
+	if !r.IsMaster() {
+		return false
+	}
+	r.Mstate.leaseLock.Lock()
+	defer r.Mstate.leaseLock.Unlock()
+	return time.Now().Before(r.Mstate.leaseExpiry)
 }
 
 func (mstate *MasterState) ExtendNeedsRenewal(newTime time.Time) {
@@ -38,7 +54,7 @@ func (rstate *ReplicaState) ExtendLease(newTime time.Time) {
 func (r *Replica) ReplicaTimeout() {
 	if r.IsMaster() {
 		r.Debug(STATUS, "we couldn't stay master :(,ViewNum:%d\n", r.Rstate.View)
-		// TODO: can't handle read requests anymore
+		// our lease has run out too, so HasLease stops reads
 	}
 	r.Debug(STATUS, "Timed out, trying view change")
 	r.PrepareViewChange()
@@ -1,13 +1,13 @@
 package vr
 
 import (
-	"bufio"
 	"encoding/gob"
 	"errors"
 	"fmt"
 	"github.com/mgentili/goPhat/phatlog"
 	"net"
 	"net/rpc"
+	"path/filepath"
 	"sync"
 	"time"
 )
@@ -15,6 +15,15 @@ import (
 var NREPLICAS uint
 var F uint
 
+// what RunVR returns when the master's copy of a command's log entry is corrupted and
+// couldn't be repaired. The master steps down, so the command may still be committed by
+// the next one
+var ErrCorruptLog = errors.New("log entry corrupted")
+
+// the directory replicas started with RunAsReplica keep their snapshots in (the working
+// directory if empty)
+var SnapshotDir string
+
 const (
 	LEASE = 2000 * time.Millisecond
 	// how soon master renews lease before actual expiry date. e.g. if lease expires in 100 seconds
@@ -27,6 +36,9 @@ const (
 	MAX_TRIES = 2
 	// doubles after every failure
 	BACKOFF_TIME = 10 * time.Millisecond
+	// how long to wait for the other replicas to send good copies of corrupted log
+	// entries, before getting the whole state from the master instead
+	REPAIR_TIMEOUT = LEASE
 
 	// start off with very frequent snapshots (set to high number to disable snapshots)
 	SNAP_FREQ     = 100
@@ -56,17 +68,28 @@ type Replica struct {
 	Context interface{}
 	// ensure each commit only happens once!
 	CommitLock sync.Mutex
-	Listener   net.Listener
-	Codecs     []*GobServerCodec
+	// guards repairing and repairTarget: while a repair of the log is running, the
+	// highest commit number asked for, which is committed up to once it's done
+	repairLock   sync.Mutex
+	repairing    bool
+	repairTarget uint
+	Listener     net.Listener
+	Codecs       []*GobServerCodec
 
 	SnapshotFunc     func(interface{}, func() uint) ([]byte, uint, error)
 	LoadSnapshotFunc func(interface{}, []byte) error
+	// handles requests other replicas forward to the master (see Forward), if set
+	ForwardFunc func(interface{}, interface{}) (interface{}, error)
 	// ensure only one snapshot at a time
 	SnapshotLock sync.Mutex
 	// index of last snapshot
 	SnapshotIndex uint
 	SnapshotFile  string
 
+	// where clients reach each replica's server, by replica number, as far as it's
+	// known (see SetClientAddresses)
+	ClientAddresses []string
+
 	IsShutdown     bool // completely shutdown
 	IsDisconnected bool // just disconnected from other replicas
 }
@@ -77,11 +100,36 @@ type Command interface {
 	CommitFunc(interface{})
 }
 
+// Traced is implemented by commands that carry an id to follow them through the logs by
+type Traced interface {
+	TraceID() string
+}
+
+// traceOf returns what log lines about command end with: its trace id, if it has one
+func traceOf(command Command) string {
+	if t, ok := command.(Traced); ok && t.TraceID() != "" {
+		return " [" + t.TraceID() + "]"
+	}
+	return ""
+}
+
 // actual command struct which we pass around through VR
-// just adds a channel so we can signal RunVR that a command is committed
+// just adds a channel so we can signal RunVR that a command is committed (or failed)
 type VRCommand struct {
 	C    Command
-	Done chan int
+	Done chan error
+}
+
+// finish tells RunVR (if it's ours to tell) that the command is done with. It's only
+// told once: a command failed by a master stepping down may still be committed later
+func (c VRCommand) finish(err error) {
+	if c.Done == nil {
+		return
+	}
+	select {
+	case c.Done <- err:
+	default:
+	}
 }
 
 /* special object just for RPC calls, so that other methods
@@ -109,6 +157,9 @@ type MasterState struct {
 	Timer      *time.Timer
 	Heartbeats map[uint]time.Time
 	RunVRLock  sync.Mutex
+	// until when a majority have promised not to elect anyone else (see HasLease)
+	leaseExpiry time.Time
+	leaseLock   sync.Mutex
 }
 
 type PrepareArgs struct {
@@ -163,7 +214,11 @@ func (t *RPCReplica) Prepare(args *PrepareArgs, reply *PrepareReply) error {
 	}
 
 	if args.OpNumber > r.Rstate.OpNumber {
-		r.addLog(args.Command)
+		if err := r.addLog(args.Command); err != nil {
+			// we don't have the master's command at this op, so we mustn't count
+			// towards committing it
+			return err
+		}
 		r.Rstate.OpNumber++
 	}
 
@@ -198,19 +253,25 @@ func (t *RPCReplica) Commit(args *CommitArgs, reply *HeartbeatReply) error {
 	return nil
 }
 
-func (r *Replica) RunVR(command Command) {
+// RunVR replicates command, returning once it's been committed, or an error if it
+// couldn't be put in the log (in which case it's never committed) or couldn't be
+// committed here (ErrCorruptLog)
+func (r *Replica) RunVR(command Command) error {
 	if r.IsShutdown {
-		return
+		return nil
 	}
 	assert(r.IsMaster())
 	r.Mstate.RunVRLock.Lock()
 
-	vrCommand := VRCommand{command, make(chan int)}
+	vrCommand := VRCommand{command, make(chan error, 1)}
 
-	r.addLog(vrCommand)
+	if err := r.addLog(vrCommand); err != nil {
+		r.Mstate.RunVRLock.Unlock()
+		return err
+	}
 	r.Rstate.OpNumber++
 
-	r.Debug(STATUS, "I'm master, RunVR'ing %d", r.Rstate.OpNumber)
+	r.Debug(STATUS, "I'm master, RunVR'ing %d%s", r.Rstate.OpNumber, traceOf(command))
 
 	args := PrepareArgs{r.Rstate.View, vrCommand, r.Rstate.OpNumber, r.Rstate.CommitNumber}
 	replyConstructor := func() interface{} { return new(PrepareReply) }
@@ -219,8 +280,11 @@ func (r *Replica) RunVR(command Command) {
 	})
 	r.Mstate.RunVRLock.Unlock()
 
-	<-vrCommand.Done
+	if err := <-vrCommand.Done; err != nil {
+		return err
+	}
 	r.Debug(DEBUG, "Finished RunVR")
+	return nil
 }
 
 func (r *Replica) calcHighestMajorityOp() uint {
@@ -282,7 +346,7 @@ func RunAsReplica(i uint, config []string) *Replica {
 	F = (NREPLICAS - 1) / 2
 	r := new(Replica)
 	r.Rstate.ReplicaNumber = i
-	r.SnapshotFile = fmt.Sprintf(SNAPSHOT_FILE, i)
+	r.SnapshotFile = filepath.Join(SnapshotDir, fmt.Sprintf(SNAPSHOT_FILE, i))
 	r.Config = config
 	r.Conns = make([]*rpc.Client, NREPLICAS)
 
@@ -305,7 +369,8 @@ func (r *Replica) BecomeMaster() {
 	// TODO: anything else we need to do to become the master?
 	r.Mstate.Reset()
 	// resets master's timer
-	// TODO: we can't just assume we have the lease like this
+	// TODO: we can't just assume we have the lease like this (HasLease doesn't: reads
+	// wait for a majority to answer us)
 	r.Mstate.ExtendNeedsRenewal(time.Now().Add(LEASE - MAX_CLOCK_DRIFT))
 	r.Rstate.ExtendLease(time.Now().Add(LEASE - MAX_CLOCK_DRIFT))
 }
@@ -353,16 +418,20 @@ func (r *Replica) ReplicaRun() {
 			time.Sleep(500 * time.Millisecond)
 			continue
 		}
-		buf := bufio.NewWriter(conn)
-		srv := &GobServerCodec{conn, gob.NewDecoder(conn), gob.NewEncoder(buf), buf}
+		srv := NewGobServerCodec(conn)
 		r.Codecs = append(r.Codecs, srv)
 		go newServer.ServeCodec(srv)
 	}
 }
 
-func (r *Replica) addLog(command interface{}) {
-	r.Phatlog.Add(r.Rstate.OpNumber+1, command)
+func (r *Replica) addLog(command interface{}) error {
+	if err := r.Phatlog.Add(r.Rstate.OpNumber+1, command); err != nil {
+		// two different commands at the same op number means we've diverged
+		VR_log.Printf(ERROR, "r%d: %v", r.Rstate.ReplicaNumber, err)
+		return err
+	}
 	r.Debug(DEBUG, "adding command to log")
+	return nil
 }
 
 func (r *Replica) doCommit(cn uint) {
@@ -398,17 +467,61 @@ func (r *Replica) doCommit(cn uint) {
 		return
 	}
 	assert(cn == r.Rstate.CommitNumber+1)
-	r.Debug(STATUS, "commiting %d", r.Rstate.CommitNumber+1)
+	// never hand a corrupted command to the state machine
+	if !r.Phatlog.VerifyEntry(cn) {
+		// the repair waits on the other replicas, so it's done in the background,
+		// without holding up the prepares and heartbeats that got us here
+		r.startRepair(cn)
+		return
+	}
 	vrCommand := r.Phatlog.GetCommand(r.Rstate.CommitNumber + 1).(VRCommand)
+	r.Debug(STATUS, "commiting %d%s", r.Rstate.CommitNumber+1, traceOf(vrCommand.C))
 	vrCommand.C.CommitFunc(r.Context)
 	r.Rstate.CommitNumber++
 	r.Debug(DEBUG, "committed: %d", r.Rstate.CommitNumber)
 	if (r.Rstate.CommitNumber % SNAP_FREQ) == SNAP_FREQ-1 {
 		go r.TakeSnapshot()
 	}
-	if vrCommand.Done != nil {
-		vrCommand.Done <- 0
+	vrCommand.finish(nil)
+}
+
+// startRepair repairs the log in the background (unless a repair is already running),
+// then commits up to the highest commit number asked for meanwhile, cn at least
+func (r *Replica) startRepair(cn uint) {
+	r.repairLock.Lock()
+	defer r.repairLock.Unlock()
+	r.repairTarget = Max(r.repairTarget, cn)
+	if r.repairing {
+		return
 	}
+	r.repairing = true
+	go func() {
+		err := r.RepairLog()
+		r.repairLock.Lock()
+		target := r.repairTarget
+		r.repairing = false
+		r.repairTarget = 0
+		r.repairLock.Unlock()
+		if err == nil {
+			r.doCommit(target)
+			return
+		}
+		r.Debug(ERROR, "Not committing %d, its log entry is corrupted: %v", target, err)
+		if !r.IsMaster() {
+			r.StartStateTransfer()
+			return
+		}
+		// the state comes from the master, so there's nobody to transfer it from: fail
+		// the commands waiting on the entry, and let a replica with a good log take over
+		r.Mstate.RunVRLock.Lock()
+		for i := r.Rstate.CommitNumber + 1; i <= r.Rstate.OpNumber; i++ {
+			if vrCommand, ok := r.Phatlog.GetCommand(i).(VRCommand); ok {
+				vrCommand.finish(ErrCorruptLog)
+			}
+		}
+		r.Mstate.RunVRLock.Unlock()
+		r.PrepareViewChange()
+	}()
 }
 
 func (r *Replica) ClientConnect(repNum uint) (*rpc.Client, error) {
@@ -129,7 +129,7 @@ func (r *Replica) handleRecoveryResponse(reply *RecoveryResponse) (done bool) {
 	}
 
 	// this could be outdated, but it WON'T be outdated once we have F+1 responses
-	var masterId uint = r.Rstate.View % NREPLICAS
+	var masterId uint = r.GetMasterId()
 
 	//We have recived enough Recovery messages and have recieved from master
 	if r.Rcvstate.RecoveryResponses >= F+1 && ((1<<masterId)&r.Rcvstate.RecoveryResponseReplies) != 0 {
@@ -1,7 +1,10 @@
 package vr
 
 import (
+	"fmt"
 	"github.com/mgentili/goPhat/phatlog"
+	"sync"
+	"time"
 )
 
 type GetStateArgs struct {
@@ -29,7 +32,7 @@ func (r *Replica) StartStateTransfer() {
 	args := GetStateArgs{r.Rstate.View, r.Rstate.OpNumber}
 
 	//send State Transfer RPC to master
-	r.sendAndRecvTo([]uint{r.Rstate.View % NREPLICAS}, "RPCReplica.GetState", args,
+	r.sendAndRecvTo([]uint{r.GetMasterId()}, "RPCReplica.GetState", args,
 		func() interface{} { return new(GetStateResponse) },
 		func(reply interface{}) bool { return r.handleGetStateResponse(reply.(*GetStateResponse)) })
 }
@@ -63,3 +66,81 @@ func (r *Replica) handleGetStateResponse(reply *GetStateResponse) bool {
 
 	return true
 }
+
+type GetLogEntriesArgs struct {
+	Indices []uint
+}
+
+type GetLogEntriesReply struct {
+	ReplicaNumber uint
+	Entries       []phatlog.Entry
+}
+
+// GetLogEntries sends over the requested log entries (that we have) so a replica with
+// corrupted entries can repair them
+func (t *RPCReplica) GetLogEntries(args *GetLogEntriesArgs, reply *GetLogEntriesReply) error {
+	r := t.R
+
+	reply.ReplicaNumber = r.Rstate.ReplicaNumber
+	for _, index := range args.Indices {
+		if !r.Phatlog.HasEntry(index) || index > r.Rstate.OpNumber || !r.Phatlog.VerifyEntry(index) {
+			continue
+		}
+		reply.Entries = append(reply.Entries, r.Phatlog.Entry(index))
+	}
+	return nil
+}
+
+// RepairLog checks our log for corrupted entries and replaces them with copies from the
+// other replicas, waiting at most REPAIR_TIMEOUT for them. Returns an error if some
+// entries are still corrupted
+func (r *Replica) RepairLog() error {
+	stillCorrupt := r.Phatlog.Repair(func(indices []uint) []phatlog.Entry {
+		r.Debug(ERROR, "Log entries %v are corrupted, fetching them from peers", indices)
+		// the replies can keep coming after we've given up on them
+		var lock sync.Mutex
+		var entries []phatlog.Entry
+		have := make(map[uint]bool)
+		args := GetLogEntriesArgs{indices}
+		fetched := make(chan struct{})
+		go func() {
+			r.sendAndRecv(NREPLICAS-1, "RPCReplica.GetLogEntries", args,
+				func() interface{} { return new(GetLogEntriesReply) },
+				func(reply interface{}) bool {
+					lock.Lock()
+					defer lock.Unlock()
+					for _, e := range reply.(*GetLogEntriesReply).Entries {
+						if !have[e.Index] {
+							entries = append(entries, e)
+							have[e.Index] = true
+						}
+					}
+					return len(have) == len(indices)
+				})
+			close(fetched)
+		}()
+		select {
+		case <-fetched:
+		case <-time.After(REPAIR_TIMEOUT):
+			r.Debug(ERROR, "Timed out fetching log entries %v", indices)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		repaired := make([]phatlog.Entry, len(entries))
+		for i, e := range entries {
+			// channels aren't sent over RPC, so keep our own, or RunVR never hears back
+			if fetched, ok := e.Command.(VRCommand); ok {
+				if old, ok := r.Phatlog.GetCommand(e.Index).(VRCommand); ok {
+					fetched.Done = old.Done
+					e.Command = fetched
+				}
+			}
+			repaired[i] = e
+		}
+		return repaired
+	})
+	if len(stillCorrupt) > 0 {
+		return fmt.Errorf("couldn't repair log entries %v", stillCorrupt)
+	}
+	return nil
+}
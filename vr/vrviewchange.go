@@ -104,9 +104,9 @@ func (t *RPCReplica) StartViewChange(args *StartViewChangeArgs, reply *int) erro
 	//if we have recieved enough StartViewChange messages send DoViewChange to new master
 	if r.Vcstate.StartViews == F {
 		r.Debug(STATUS, "Sending DoViewChange")
-		r.Debug(STATUS, "Sending to: %d\n", r.Rstate.View%NREPLICAS)
+		r.Debug(STATUS, "Sending to: %d\n", r.GetMasterId())
 
-		if r.Rstate.View%NREPLICAS == r.Rstate.ReplicaNumber {
+		if r.GetMasterId() == r.Rstate.ReplicaNumber {
 			r.Debug(STATUS, "Implicitly sending DoViewChange to myself")
 			r.Vcstate.DoViews++
 			r.Vcstate.DoViewChangeMsgs[r.Rstate.ReplicaNumber] = DoViewChangeArgs{r.Rstate.View, r.Rstate.ReplicaNumber,
@@ -119,7 +119,7 @@ func (t *RPCReplica) StartViewChange(args *StartViewChangeArgs, reply *int) erro
 			r.Phatlog, r.Vcstate.NormalView, r.Rstate.OpNumber, r.Rstate.CommitNumber}
 
 		//send to new master
-		r.SendOne(r.Rstate.View%NREPLICAS, "RPCReplica.DoViewChange", DVCargs, nil)
+		r.SendOne(r.GetMasterId(), "RPCReplica.DoViewChange", DVCargs, nil)
 	}
 
 	return nil
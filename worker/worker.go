@@ -7,6 +7,7 @@ import (
 	queue "github.com/mgentili/goPhat/phatqueue"
 	"github.com/mgentili/goPhat/queueRPC"
 	"log"
+	"time"
 )
 
 const (
@@ -18,6 +19,8 @@ const (
 type Worker struct {
 	Cli       *client.Client
 	SeqNumber uint
+	// the queue the worker pushes to and pops from (the default queue if empty)
+	Queue string
 }
 
 func (w *Worker) debug(level int, format string, args ...interface{}) {
@@ -42,6 +45,7 @@ func NewWorker(servers []string, id uint, uid string) (*Worker, error) {
 }
 
 func (w *Worker) processCall(cmd *queue.QCommand) (*queue.QResponse, error) {
+	cmd.Queue = w.Queue
 	args := &queueRPC.ClientCommand{w.Cli.Uid, w.SeqNumber, cmd}
 	response := &queue.QResponse{}
 	w.SeqNumber++
@@ -62,13 +66,13 @@ func (w *Worker) processCall(cmd *queue.QCommand) (*queue.QResponse, error) {
 }
 
 func (w *Worker) Push(work string) error {
-	cmd := &queue.QCommand{"PUSH", work}
+	cmd := &queue.QCommand{Command: "PUSH", Value: work}
 	_, err := w.processCall(cmd)
 	return err
 }
 
 func (w *Worker) Pop() (*queue.QResponse, error) {
-	cmd := &queue.QCommand{"POP", ""}
+	cmd := &queue.QCommand{Command: "POP", Value: ""}
 	res, err := w.processCall(cmd)
 	if err != nil {
 		log.Printf("Errored in pop %v", err)
@@ -77,8 +81,20 @@ func (w *Worker) Pop() (*queue.QResponse, error) {
 	return res, err
 }
 
-func (w *Worker) Done() error {
-	cmd := &queue.QCommand{"DONE", ""}
+// BlockingPop pops a message from the worker's queue, waiting up to timeout for one if
+// the queue's empty
+func (w *Worker) BlockingPop(timeout time.Duration) (*queue.QMessage, error) {
+	args := &queueRPC.BlockingPopArgs{Queue: w.Queue, Timeout: timeout}
+	msg := &queue.QMessage{}
+	if err := w.Cli.RpcClient.Call("Server.BlockingPop", args, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Done says the popped message with the given id has been dealt with
+func (w *Worker) Done(id string) error {
+	cmd := &queue.QCommand{Command: "DONE", Value: id}
 	_, err := w.processCall(cmd)
 	return err
 }